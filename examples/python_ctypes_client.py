@@ -19,6 +19,11 @@ ERROR_DISK_FULL = -1
 ERROR_INVALID_ARG = -2
 ERROR_NOT_FOUND = -3
 ERROR_NOT_INIT = -4
+ERROR_TOO_LARGE = -5
+ERROR_BUFFER_SIZE = -6
+
+# C API version this client was written for (ApiVersion() in library.go)
+SUPPORTED_API_VERSION = 1
 
 
 class SqliteCacheLibrary:
@@ -83,6 +88,14 @@ class SqliteCacheLibrary:
             else:
                 raise RuntimeError(f"Cannot load library {self.library_path}: {e}") from e
         
+        # ApiVersion() -> int. 古いライブラリにはないので、なければ互換性を確かめない
+        if hasattr(self.lib, "ApiVersion"):
+            self.lib.ApiVersion.argtypes = []
+            self.lib.ApiVersion.restype = ctypes.c_int
+            api_version = self.lib.ApiVersion()
+            if api_version != SUPPORTED_API_VERSION:
+                raise RuntimeError(f"Unsupported C API version {api_version} (expected {SUPPORTED_API_VERSION})")
+        
         # Configure function signatures for new API
         # Init(char* baseDir, int maxSize, double cap) -> int
         self.lib.Init.argtypes = [ctypes.c_char_p, ctypes.c_int, ctypes.c_double]
@@ -100,6 +113,36 @@ class SqliteCacheLibrary:
         self.lib.Set.argtypes = [ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_int]
         self.lib.Set.restype = ctypes.c_int
         
+        # SetWithTTL(char* table, char* tenantId, char* freshness, char* bind, char* content, int contentLen, long long ttlSeconds) -> int
+        self.lib.SetWithTTL.argtypes = [ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_int, ctypes.c_longlong]
+        self.lib.SetWithTTL.restype = ctypes.c_int
+        
+        # Exists(char* table, char* tenantId, char* freshness, char* bind) -> int
+        self.lib.Exists.argtypes = [ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p]
+        self.lib.Exists.restype = ctypes.c_int
+        
+        # DeleteEntry(char* table, char* tenantId, char* freshness, char* bind) -> int
+        self.lib.DeleteEntry.argtypes = [ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p]
+        self.lib.DeleteEntry.restype = ctypes.c_int
+        
+        # Stats(int* resultLen) -> char* (JSON)
+        self.lib.Stats.argtypes = [ctypes.POINTER(ctypes.c_int)]
+        self.lib.Stats.restype = ctypes.c_void_p
+        
+        # MGet(char* table, char* tenantId, char* freshness, char** binds, int count, long long* offsets, char** blob) -> int
+        self.lib.MGet.argtypes = [ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.POINTER(ctypes.c_char_p), ctypes.c_int,
+                                  ctypes.POINTER(ctypes.c_longlong), ctypes.POINTER(ctypes.c_void_p)]
+        self.lib.MGet.restype = ctypes.c_int
+        
+        # MSet(char* table, char* tenantId, char* freshness, char** binds, int count, long long* offsets, char* blob) -> int
+        self.lib.MSet.argtypes = [ctypes.c_char_p, ctypes.c_char_p, ctypes.c_char_p, ctypes.POINTER(ctypes.c_char_p), ctypes.c_int,
+                                  ctypes.POINTER(ctypes.c_longlong), ctypes.c_char_p]
+        self.lib.MSet.restype = ctypes.c_int
+        
+        # GetLastError() -> const char* (ライブラリが管理するのでFreeMemしない)
+        self.lib.GetLastError.argtypes = []
+        self.lib.GetLastError.restype = ctypes.c_char_p
+        
         # Delete(char* table) -> int
         self.lib.Delete.argtypes = [ctypes.c_char_p]
         self.lib.Delete.restype = ctypes.c_int
@@ -196,6 +239,8 @@ class SqliteCacheLibrary:
         
         if result == ERROR_DISK_FULL:
             raise RuntimeError("Disk full - cannot set cache")
+        elif result == ERROR_TOO_LARGE:
+            raise ValueError("Content exceeds the maximum entry size")
         elif result == ERROR_INVALID_ARG:
             raise ValueError("Invalid argument provided to set")
         elif result == ERROR_NOT_INIT:
@@ -205,6 +250,137 @@ class SqliteCacheLibrary:
         
         return True
     
+    def _last_error(self) -> str:
+        """Return the message of the last failed call on this thread."""
+        message = self.lib.GetLastError()
+        return message.decode('utf-8', 'replace') if message else ""
+    
+    def set_with_ttl(self, table: str, tenant_id: str, freshness: str, bind: str, content: bytes, ttl_seconds: int) -> bool:
+        """Set data in cache that expires after ttl_seconds (0 or less means no expiry)."""
+        if self.lib is None:
+            raise RuntimeError("Library not loaded")
+        
+        result = self.lib.SetWithTTL(table.encode('utf-8'), tenant_id.encode('utf-8'), freshness.encode('utf-8'),
+                                     bind.encode('utf-8'), ctypes.c_char_p(content), len(content), ttl_seconds)
+        
+        if result == ERROR_DISK_FULL:
+            raise RuntimeError("Disk full - cannot set cache")
+        elif result == ERROR_TOO_LARGE:
+            raise ValueError("Content exceeds the maximum entry size")
+        elif result == ERROR_INVALID_ARG:
+            raise ValueError("Invalid argument provided to set_with_ttl")
+        elif result == ERROR_NOT_INIT:
+            raise RuntimeError("Cache not initialized")
+        elif result != SUCCESS:
+            raise RuntimeError(f"Failed to set cache (error code: {result}): {self._last_error()}")
+        
+        return True
+    
+    def exists(self, table: str, tenant_id: str, freshness: str, bind: str) -> bool:
+        """Check whether an entry exists without reading its content."""
+        if self.lib is None:
+            raise RuntimeError("Library not loaded")
+        
+        result = self.lib.Exists(table.encode('utf-8'), tenant_id.encode('utf-8'), freshness.encode('utf-8'), bind.encode('utf-8'))
+        
+        if result == SUCCESS:
+            return True
+        elif result == ERROR_NOT_FOUND:
+            return False
+        elif result == ERROR_INVALID_ARG:
+            raise ValueError("Invalid argument provided to exists")
+        elif result == ERROR_NOT_INIT:
+            raise RuntimeError("Cache not initialized")
+        raise RuntimeError(f"Cache exists failed (error code: {result}): {self._last_error()}")
+    
+    def delete_entry(self, table: str, tenant_id: str, freshness: str, bind: str) -> bool:
+        """Delete a single cache entry."""
+        if self.lib is None:
+            raise RuntimeError("Library not loaded")
+        
+        result = self.lib.DeleteEntry(table.encode('utf-8'), tenant_id.encode('utf-8'), freshness.encode('utf-8'), bind.encode('utf-8'))
+        
+        if result == ERROR_INVALID_ARG:
+            raise ValueError("Invalid argument provided to delete_entry")
+        elif result == ERROR_NOT_INIT:
+            raise RuntimeError("Cache not initialized")
+        elif result != SUCCESS:
+            raise RuntimeError(f"Failed to delete entry (error code: {result}): {self._last_error()}")
+        
+        return True
+    
+    def stats(self) -> list:
+        """Return the statistics of every cache DB file."""
+        if self.lib is None:
+            raise RuntimeError("Library not loaded")
+        
+        result_len = ctypes.c_int(0)
+        result_ptr = self.lib.Stats(ctypes.byref(result_len))
+        
+        if result_len.value == ERROR_NOT_INIT:
+            raise RuntimeError("Cache not initialized")
+        elif result_len.value < 0 or not result_ptr:
+            raise RuntimeError(f"Cache stats failed (error code: {result_len.value}): {self._last_error()}")
+        
+        try:
+            return json.loads(ctypes.string_at(result_ptr, result_len.value))
+        finally:
+            self.lib.FreeMem(result_ptr)
+    
+    def mget(self, table: str, tenant_id: str, freshness: str, binds: list) -> Dict[str, bytes]:
+        """Get many entries with one library call. Binds that miss are absent from the result."""
+        if self.lib is None:
+            raise RuntimeError("Library not loaded")
+        
+        count = len(binds)
+        binds_c = (ctypes.c_char_p * count)(*[b.encode('utf-8') for b in binds])
+        offsets = (ctypes.c_longlong * (count + 1))()
+        blob = ctypes.c_void_p()
+        result = self.lib.MGet(table.encode('utf-8'), tenant_id.encode('utf-8'), freshness.encode('utf-8'),
+                               binds_c, count, offsets, ctypes.byref(blob))
+        
+        if result == ERROR_INVALID_ARG:
+            raise ValueError("Invalid argument provided to mget")
+        elif result == ERROR_NOT_INIT:
+            raise RuntimeError("Cache not initialized")
+        elif result != SUCCESS:
+            raise RuntimeError(f"Cache mget failed (error code: {result}): {self._last_error()}")
+        
+        if not blob.value:
+            return {}
+        try:
+            data = ctypes.string_at(blob, offsets[count])
+        finally:
+            self.lib.FreeMem(blob)
+        # 空の範囲はキャッシュミス
+        return {bind: data[offsets[i]:offsets[i + 1]] for i, bind in enumerate(binds) if offsets[i] < offsets[i + 1]}
+    
+    def mset(self, table: str, tenant_id: str, freshness: str, entries: Dict[str, bytes]) -> bool:
+        """Set many entries in one transaction with one library call."""
+        if self.lib is None:
+            raise RuntimeError("Library not loaded")
+        
+        count = len(entries)
+        binds_c = (ctypes.c_char_p * count)(*[b.encode('utf-8') for b in entries])
+        offsets = (ctypes.c_longlong * (count + 1))()
+        for i, content in enumerate(entries.values()):
+            offsets[i + 1] = offsets[i] + len(content)
+        result = self.lib.MSet(table.encode('utf-8'), tenant_id.encode('utf-8'), freshness.encode('utf-8'),
+                               binds_c, count, offsets, b"".join(entries.values()))
+        
+        if result == ERROR_DISK_FULL:
+            raise RuntimeError("Disk full - cannot set cache")
+        elif result == ERROR_TOO_LARGE:
+            raise ValueError("Content exceeds the maximum entry size")
+        elif result == ERROR_INVALID_ARG:
+            raise ValueError("Invalid argument provided to mset")
+        elif result == ERROR_NOT_INIT:
+            raise RuntimeError("Cache not initialized")
+        elif result != SUCCESS:
+            raise RuntimeError(f"Failed to mset cache (error code: {result}): {self._last_error()}")
+        
+        return True
+    
     def delete(self, table: str) -> bool:
         """Delete all cache data for a table."""
         if self.lib is None:
@@ -300,6 +476,21 @@ def main():
         if missing_data is None:
             print("Cache miss as expected")
         
+        # TTL付きの登録と存在確認
+        print("Setting an entry that expires in 60 seconds...")
+        cache.set_with_ttl(table, tenant_id, freshness, "session_abc", b"token", 60)
+        print(f"Exists: {cache.exists(table, tenant_id, freshness, 'session_abc')}")
+        cache.delete_entry(table, tenant_id, freshness, "session_abc")
+        print(f"Exists after delete_entry: {cache.exists(table, tenant_id, freshness, 'session_abc')}")
+        
+        # 多数のキーを1回の呼び出しでまとめて登録・取得する
+        cache.mset(table, tenant_id, freshness, {f"item_{i}": f"value {i}".encode() for i in range(100)})
+        items = cache.mget(table, tenant_id, freshness, [f"item_{i}" for i in range(0, 200, 50)])
+        print(f"MGet: {items}")
+        
+        for db in cache.stats():
+            print(f"Stats: {db}")
+        
         # Clean up
         print(f"Deleting cache for table {table}...")
         cache.delete(table)
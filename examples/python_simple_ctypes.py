@@ -18,6 +18,7 @@ ERROR_DISK_FULL = -1
 ERROR_INVALID_ARG = -2
 ERROR_NOT_FOUND = -3
 ERROR_NOT_INIT = -4
+ERROR_TOO_LARGE = -5
 
 
 # Global library handle
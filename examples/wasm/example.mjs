@@ -0,0 +1,24 @@
+// node examples/wasm/example.mjs build/sqcache.wasm ./cache
+import { mkdirSync } from 'node:fs';
+import { SqCache } from './sqcache.mjs';
+
+const [wasmPath = 'build/sqcache.wasm', dir = './cache'] = process.argv.slice(2);
+mkdirSync(dir, { recursive: true });
+
+const cache = await SqCache.load(wasmPath, { dir });
+cache.init('/cache', 100, 0.8);
+
+cache.set('users', 'tenant1', '2024-01', 'user:1', JSON.stringify({ name: 'Alice' }));
+cache.set('users', 'tenant1', '2024-01', 'session', 'token', 60);
+console.log('get:', cache.get('users', 'tenant1', '2024-01', 'user:1')?.toString());
+console.log('exists:', cache.exists('users', 'tenant1', '2024-01', 'session'));
+
+cache.delete('users', 'tenant1', '2024-01', 'user:1');
+console.log('after delete:', cache.get('users', 'tenant1', '2024-01', 'user:1'));
+
+try {
+  cache.get('users', '../escape', '2024-01', 'user:1');
+} catch (err) {
+  console.log('error:', err.code, err.message);
+}
+cache.close();
@@ -0,0 +1,159 @@
+// sqcache.wasm (make build-wasm) をNode.js・Electronから使うためのラッパー。
+// ネイティブの共有ライブラリを使わず、node:wasiでモジュールを読み込む。
+//
+//   import { SqCache } from './sqcache.mjs';
+//   const cache = await SqCache.load('build/sqcache.wasm', { dir: './cache' });
+//   cache.init('/cache', 100, 0.8);
+//   cache.set('users', 'tenant1', '2024-01', 'user:1', 'hello', 60);
+//   cache.get('users', 'tenant1', '2024-01', 'user:1'); // Buffer、ミスならnull
+//   cache.close();
+
+import { readFile } from 'node:fs/promises';
+import { WASI } from 'node:wasi';
+
+export const SUCCESS = 1;
+export const ERROR_GENERAL = 0;
+export const ERROR_DISK_FULL = -1;
+export const ERROR_INVALID_ARG = -2;
+export const ERROR_NOT_FOUND = -3;
+export const ERROR_NOT_INIT = -4;
+export const ERROR_TOO_LARGE = -5;
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+export class SqCacheError extends Error {
+  constructor(code, message) {
+    super(message || `sqcache error ${code}`);
+    this.code = code;
+  }
+}
+
+export class SqCache {
+  // wasmPathのモジュールを読み込む。dirはモジュールから見える/cacheに割り当てるホストのディレクトリ
+  static async load(wasmPath, { dir, mountPoint = '/cache' } = {}) {
+    const wasi = new WASI({
+      version: 'preview1',
+      preopens: dir ? { [mountPoint]: dir } : {},
+    });
+    const imports = wasi.getImportObject();
+    // Node.js 20ではwasmからWASIの関数を直接呼ぶとSetの後にプロセスが落ちるので、JSの関数を挟む
+    const preview1 = imports.wasi_snapshot_preview1;
+    for (const [name, fn] of Object.entries(preview1)) {
+      preview1[name] = (...args) => fn(...args);
+    }
+    const module = await WebAssembly.compile(await readFile(wasmPath));
+    const instance = await WebAssembly.instantiate(module, imports);
+    // -buildmode=c-sharedのreactorなので、startではなくinitializeでランタイムを起動する
+    wasi.initialize(instance);
+    return new SqCache(instance.exports);
+  }
+
+  constructor(exports) {
+    this.x = exports;
+    this.lenPtr = this.x.Alloc(4) >>> 0; // resultLenを受け取る領域
+  }
+
+  // 呼び出しのたびにメモリが伸びてArrayBufferが替わることがあるので、毎回取り直す
+  view() {
+    return new DataView(this.x.memory.buffer);
+  }
+
+  bytes(ptr, len) {
+    return new Uint8Array(this.x.memory.buffer, ptr, len);
+  }
+
+  // valueを確保したメモリにコピーし、[ptr, len]を返す。使い終わったらfreeする
+  put(value) {
+    const data = typeof value === 'string' ? encoder.encode(value) : value;
+    if (data.length === 0) {
+      return [0, 0];
+    }
+    const ptr = this.x.Alloc(data.length) >>> 0;
+    this.bytes(ptr, data.length).set(data);
+    return [ptr, data.length];
+  }
+
+  free(...ptrs) {
+    for (const [ptr] of ptrs) {
+      if (ptr) this.x.FreeMem(ptr);
+    }
+  }
+
+  lastError() {
+    const ptr = this.x.GetLastError(this.lenPtr) >>> 0;
+    const len = this.view().getInt32(this.lenPtr, true);
+    return ptr ? decoder.decode(this.bytes(ptr, len)) : '';
+  }
+
+  check(code) {
+    if (code !== SUCCESS) {
+      throw new SqCacheError(code, this.lastError());
+    }
+  }
+
+  // table・tenantId・freshness・bindを確保して fn(...引数) を呼ぶ
+  withKeys(keys, fn) {
+    const args = keys.map((k) => this.put(k));
+    try {
+      return fn(...args.flat());
+    } finally {
+      this.free(...args);
+    }
+  }
+
+  init(baseDir, maxSizeMB = 100, cap = 0.8) {
+    this.withKeys([baseDir], (p, n) => this.check(this.x.Init(p, n, maxSizeMB, cap)));
+  }
+
+  // contentをBufferで返す。ミスならnull
+  get(table, tenantId, freshness, bind) {
+    return this.withKeys([table, tenantId, freshness, bind], (...args) => {
+      const ptr = this.x.Get(...args, this.lenPtr) >>> 0;
+      const len = this.view().getInt32(this.lenPtr, true);
+      if (len === ERROR_NOT_FOUND) {
+        return null;
+      }
+      if (len <= 0) {
+        throw new SqCacheError(len, this.lastError());
+      }
+      const content = Buffer.from(this.bytes(ptr, len));
+      if (ptr) this.x.FreeMem(ptr);
+      return content;
+    });
+  }
+
+  // contentは文字列かUint8Array。ttlSecondsが0なら期限なし
+  set(table, tenantId, freshness, bind, content, ttlSeconds = 0) {
+    const data = this.put(content);
+    try {
+      this.withKeys([table, tenantId, freshness, bind], (...args) =>
+        this.check(this.x.SetWithTTL(...args, ...data, BigInt(ttlSeconds))));
+    } finally {
+      this.free(data);
+    }
+  }
+
+  exists(table, tenantId, freshness, bind) {
+    const code = this.withKeys([table, tenantId, freshness, bind], (...args) => this.x.Exists(...args));
+    if (code === ERROR_NOT_FOUND) {
+      return false;
+    }
+    this.check(code);
+    return true;
+  }
+
+  // 1件だけ削除する
+  delete(table, tenantId, freshness, bind) {
+    this.withKeys([table, tenantId, freshness, bind], (...args) => this.check(this.x.DeleteEntry(...args)));
+  }
+
+  // テーブルのすべてのテナントのキャッシュを削除する
+  deleteTable(table) {
+    this.withKeys([table], (p, n) => this.check(this.x.Delete(p, n)));
+  }
+
+  close() {
+    this.check(this.x.Close());
+  }
+}
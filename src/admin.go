@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"strings"
+	"text/tabwriter"
+)
+
+// 管理用のサブコマンドは既存のキャッシュツリーを読み取り専用で調べるので、
+// 動いているプロセスがあっても実行できる (結果はその瞬間のもの)。
+
+// runStats prints one line per DB file: sqcache stats [--json] <basedir>
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: sqcache stats [--json] <basedir>")
+	}
+
+	infos, err := cache.InspectTree(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(infos)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tTENANT\tFRESHNESS\tENTRIES\tEXPIRED\tCONTENT\tFILE\tFREE\tMODIFIED")
+	var entries, content, file int64
+	for _, info := range infos {
+		if info.Error != "" {
+			fmt.Fprintf(w, "%s\t%s\t%s\terror: %s\n", info.Table, info.TenantID, info.Freshness, info.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\t%s\n", info.Table, info.TenantID, info.Freshness,
+			info.Entries, info.Expired, formatBytes(info.ContentBytes), formatBytes(info.FileBytes),
+			formatBytes(info.FreeBytes), info.ModTime.Format("2006-01-02 15:04:05"))
+		entries += info.Entries
+		content += info.ContentBytes
+		file += info.FileBytes
+	}
+	w.Flush()
+	fmt.Printf("%d files, %d entries, %s content, %s on disk\n", len(infos), entries, formatBytes(content), formatBytes(file))
+	return nil
+}
+
+// runLs lists tables, the tenants of a table, or the freshness generations of a tenant:
+// sqcache ls <basedir> [table [tenant]]
+func runLs(args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return fmt.Errorf("usage: sqcache ls <basedir> [table [tenant]]")
+	}
+	infos, err := cache.InspectTree(args[0])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	switch len(args) {
+	case 1:
+		fmt.Fprintln(w, "TABLE\tTENANTS\tFILES\tENTRIES\tSIZE")
+		for _, group := range groupInfos(infos, func(info cache.DBFileInfo) string { return info.Table }) {
+			tenants := len(groupInfos(group, func(info cache.DBFileInfo) string { return info.TenantID }))
+			entries, size := sumInfos(group)
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", group[0].Table, tenants, len(group), entries, formatBytes(size))
+		}
+	case 2:
+		// フレッシュネスは新しいものから並べ、現在のものに*を付ける
+		fmt.Fprintln(w, "TENANT\tENTRIES\tSIZE\tFRESHNESS")
+		for _, group := range groupInfos(filterInfos(infos, args[1], ""), func(info cache.DBFileInfo) string { return info.TenantID }) {
+			generations := make([]string, len(group))
+			for i, info := range group {
+				generations[i] = info.Freshness
+			}
+			generations[0] += "*"
+			entries, size := sumInfos(group)
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", group[0].TenantID, entries, formatBytes(size), strings.Join(generations, " "))
+		}
+	case 3:
+		fmt.Fprintln(w, "FRESHNESS\tENTRIES\tEXPIRED\tSIZE\tMODIFIED")
+		for i, info := range filterInfos(infos, args[1], args[2]) {
+			name := info.Freshness
+			if i == 0 {
+				name += "*"
+			}
+			if info.Error != "" {
+				fmt.Fprintf(w, "%s\terror: %s\n", name, info.Error)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", name, info.Entries, info.Expired, formatBytes(info.FileBytes), info.ModTime.Format("2006-01-02 15:04:05"))
+		}
+	}
+	return nil
+}
+
+// runDu prints the disk usage of each tenant and table directory, including files other than DBs
+// such as journals and leftovers: sqcache du <basedir>
+func runDu(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: sqcache du <basedir>")
+	}
+	baseDir := args[0]
+
+	usage := make(map[string]int64) // "table"または"table/tenant" → バイト数
+	var total int64
+	err := filepath.WalkDir(baseDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if len(parts) >= 2 {
+			usage[parts[0]] += info.Size()
+		}
+		if len(parts) >= 3 {
+			usage[parts[0]+"/"+parts[1]] += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// duと同じく、テナントの後にテーブルの合計を出す
+	keys := make([]string, 0, len(usage))
+	for key := range usage {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i]+"/", keys[j]+"/"
+		if strings.HasPrefix(a, b) || strings.HasPrefix(b, a) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	for _, key := range keys {
+		fmt.Printf("%s\t%s\n", formatBytes(usage[key]), key)
+	}
+	fmt.Printf("%s\ttotal\n", formatBytes(total))
+	return nil
+}
+
+// runDoctor prints the problems found in a cache directory and, with --fix, repairs them:
+// sqcache doctor [--fix] [--retain 0] [--json] <basedir>
+func runDoctor(args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fix := fs.Bool("fix", false, "repair what can be repaired (stop the processes using the directory first)")
+	retain := fs.Int("retain", 0, "old freshness files to keep per tenant, as --retain-freshness of the cache")
+	asJSON := fs.Bool("json", false, "print the findings as JSON")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: sqcache doctor [--fix] [--retain 0] [--json] <basedir>")
+	}
+
+	findings, err := cache.Diagnose(fs.Arg(0), cache.DiagnoseOptions{Fix: *fix, RetainFreshness: *retain})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(findings); err != nil {
+			return err
+		}
+	}
+
+	// 修正されずに残ったerror・warningがあれば、スクリプトから分かるよう失敗で終える
+	remaining := 0
+	for _, finding := range findings {
+		if finding.Severity != cache.SeverityInfo && !finding.Fixed {
+			remaining++
+		}
+		if *asJSON {
+			continue
+		}
+		fmt.Printf("%-7s %-15s %s: %s\n", strings.ToUpper(finding.Severity), finding.Check, finding.Path, finding.Message)
+		switch {
+		case finding.Fixed:
+			fmt.Printf("        fixed: %s\n", finding.Fix)
+		case finding.FixError != "":
+			fmt.Printf("        fix failed: %s: %s\n", finding.Fix, finding.FixError)
+		case finding.Fix != "":
+			fmt.Printf("        fix (--fix): %s\n", finding.Fix)
+		}
+	}
+	if !*asJSON {
+		fmt.Printf("%d findings, %d unresolved\n", len(findings), remaining)
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d unresolved problems", remaining)
+	}
+	return nil
+}
+
+// runCompact runs VACUUM and PRAGMA optimize on the tenants of a cache directory and prints the bytes
+// reclaimed from each: sqcache compact <basedir> [table [tenant]]
+func runCompact(args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return fmt.Errorf("usage: sqcache compact <basedir> [table [tenant]]")
+	}
+	// 存在しないディレクトリをInitで作らない
+	if _, err := os.Stat(args[0]); err != nil {
+		return err
+	}
+	// 他のプロセスが使っていても、テナントごとのロックとSQLiteのロックで書き込みと競合しない
+	if err := api.Init(args[0], 100, 0.8); err != nil {
+		return err
+	}
+	defer api.Close()
+
+	tables := args[1:min(2, len(args))]
+	if len(tables) == 0 {
+		var err error
+		if tables, err = api.ListTables(); err != nil {
+			return err
+		}
+	}
+	var total int64
+	for _, table := range tables {
+		tenants := args[min(2, len(args)):]
+		if len(tenants) == 0 {
+			var err error
+			if tenants, err = api.ListTenants(table); err != nil {
+				return err
+			}
+		}
+		for _, tenantID := range tenants {
+			reclaimed, err := api.Compact(table, tenantID)
+			total += reclaimed
+			if err != nil {
+				return fmt.Errorf("%s/%s: %w", table, tenantID, err)
+			}
+			fmt.Printf("%s\t%s/%s\n", formatBytes(reclaimed), table, tenantID)
+		}
+	}
+	fmt.Printf("%s\treclaimed\n", formatBytes(total))
+	return nil
+}
+
+// groupInfos splits infos, which are ordered by table and tenant, into runs with the same key
+func groupInfos(infos []cache.DBFileInfo, key func(cache.DBFileInfo) string) [][]cache.DBFileInfo {
+	var groups [][]cache.DBFileInfo
+	for i, info := range infos {
+		if i == 0 || key(info) != key(infos[i-1]) {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], info)
+	}
+	return groups
+}
+
+// filterInfos returns the infos of the table, and of the tenant unless it is empty
+func filterInfos(infos []cache.DBFileInfo, table, tenantID string) []cache.DBFileInfo {
+	var filtered []cache.DBFileInfo
+	for _, info := range infos {
+		if info.Table == table && (tenantID == "" || info.TenantID == tenantID) {
+			filtered = append(filtered, info)
+		}
+	}
+	return filtered
+}
+
+func sumInfos(infos []cache.DBFileInfo) (int64, int64) {
+	var entries, size int64
+	for _, info := range infos {
+		entries += info.Entries
+		size += info.FileBytes
+	}
+	return entries, size
+}
+
+// formatBytes formats n with a binary unit, e.g. "1.5M"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	value, suffix := float64(n)/unit, "K"
+	for _, next := range []string{"M", "G", "T"} {
+		if value < unit {
+			break
+		}
+		value, suffix = value/unit, next
+	}
+	return fmt.Sprintf("%.1f%s", value, suffix)
+}
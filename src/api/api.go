@@ -1,8 +1,11 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"sqlite-cache/src/cache"
+	"time"
 )
 
 var globalCacheManager *cache.CacheManager
@@ -20,6 +23,14 @@ func Close() error {
 	return nil
 }
 
+// Shutdown closes the cache like Close, but succeeds when it was never initialized
+func Shutdown() error {
+	if globalCacheManager == nil {
+		return nil
+	}
+	return Close()
+}
+
 // Init initializes the cache system
 func Init(baseDir string, maxSize int, cap float64) error {
 	globalCacheManager = cache.NewCacheManager(cache.CacheConfig{})
@@ -31,6 +42,357 @@ func Init(baseDir string, maxSize int, cap float64) error {
 	return nil
 }
 
+// InitWithConfig initializes the cache system with the full set of options
+func InitWithConfig(config cache.CacheConfig) error {
+	globalCacheManager = cache.NewCacheManager(config)
+
+	if err := globalCacheManager.Init(config.BaseDir, config.MaxSize, config.Cap); err != nil {
+		return fmt.Errorf("failed to initialize cache manager: %w", err)
+	}
+
+	return nil
+}
+
+// TenantMetrics returns per-(table, tenant) counters collected when metrics are enabled
+func TenantMetrics() ([]cache.TenantStats, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.TenantMetrics(), nil
+}
+
+// Stats returns entry counts, sizes and hit/miss counters of every cache DB file
+func Stats() ([]cache.DBStats, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	stats, err := globalCacheManager.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect stats: %w", err)
+	}
+
+	return stats, nil
+}
+
+// StatsFor returns the stats of one cache DB file
+func StatsFor(table, tenantId, freshness string) (cache.DBStats, error) {
+	if globalCacheManager == nil {
+		return cache.DBStats{}, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.StatsFor(table, tenantId, freshness)
+}
+
+// TopKeys returns the n most and least read entries of the tenant with their sizes
+func TopKeys(table, tenantId string, n int) (*cache.TopKeysResult, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.TopKeys(table, tenantId, n)
+}
+
+// PreviewEviction returns the entries of each freshness DB of the tenant that eviction would remove at its current size
+func PreviewEviction(table, tenantId string) ([]cache.EvictionPreview, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.PreviewEviction(table, tenantId)
+}
+
+// SweepExpired removes expired entries from every cache file and returns how many were removed
+func SweepExpired() (int64, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	removed, err := globalCacheManager.SweepExpired()
+	if err != nil {
+		return removed, fmt.Errorf("failed to sweep expired entries: %w", err)
+	}
+	return removed, nil
+}
+
+// Backup writes a consistent copy of the cache file to destPath
+func Backup(table, tenantId string, freshness string, destPath string) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.Backup(table, tenantId, freshness, destPath)
+}
+
+// BackupAll backs up every cache file into destDir and returns the number of files written
+func BackupAll(destDir string) (int, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.BackupAll(destDir)
+}
+
+// Restore installs the snapshot cache files under srcDir and returns the number of files installed
+func Restore(srcDir string) (int, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.Restore(srcDir)
+}
+
+// Export writes the entries of the tenant to an archive and returns the number of entries written
+func Export(table, tenantId string, path string) (int, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.Export(table, tenantId, path)
+}
+
+// Import stores the entries of an archive written by Export and returns the number of entries stored
+func Import(path string) (int, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.Import(path)
+}
+
+// Preload bulk-loads newline-delimited JSON or an Export archive into one cache file and returns the number of entries stored
+func Preload(table, tenantId string, freshness string, manifest io.Reader, progress func(cache.PreloadProgress)) (int, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.Preload(table, tenantId, freshness, manifest, progress)
+}
+
+// SyncSnapshots uploads the snapshots of the changed cache files and returns the number uploaded
+func SyncSnapshots(ctx context.Context) (int, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.SyncSnapshots(ctx)
+}
+
+// Subscribe returns a channel receiving the cache mutations until ctx is done.
+// The channel is also closed when the subscriber falls behind and mutations are lost.
+func Subscribe(ctx context.Context) (<-chan cache.Mutation, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.Subscribe(ctx)
+}
+
+// Replicate calls send with the changes to stream to replicas until ctx is done,
+// preceded by every live entry when snapshot is set
+func Replicate(ctx context.Context, snapshot bool, send func(cache.ReplicationRecord) error) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.Replicate(ctx, snapshot, send)
+}
+
+// ApplyReplication applies a change received from the primary
+func ApplyReplication(record cache.ReplicationRecord) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.ApplyReplication(record)
+}
+
+// ListTables returns the names of the tables in the cache tree
+func ListTables() ([]string, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.ListTables()
+}
+
+// ListTenants returns the tenant IDs of the table
+func ListTenants(table string) ([]string, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.ListTenants(table)
+}
+
+// Scan returns a page of the entries of the cache file and the cursor of the next page
+func Scan(table, tenantId string, freshness string, cursor string, limit int) ([]cache.BindInfo, string, error) {
+	if globalCacheManager == nil {
+		return nil, "", fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.Scan(table, tenantId, freshness, cursor, limit)
+}
+
+// ScanPrefix returns a page of the entries whose bind starts with prefix and the cursor of the next page
+func ScanPrefix(table, tenantId string, freshness string, prefix string, cursor string, limit int) ([]cache.BindInfo, string, error) {
+	if globalCacheManager == nil {
+		return nil, "", fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.ScanPrefix(table, tenantId, freshness, prefix, cursor, limit)
+}
+
+// DeletePrefix removes the entries whose bind starts with prefix
+func DeletePrefix(table, tenantId string, freshness string, prefix string) (int64, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.DeletePrefix(table, tenantId, freshness, prefix)
+}
+
+// SetMulti stores content under a bind made of several key parts
+func SetMulti(table, tenantId string, freshness string, keyParts []string, content []byte, ttl time.Duration) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.SetMulti(table, tenantId, freshness, keyParts, content, ttl)
+}
+
+// GetMulti returns the content stored by SetMulti
+func GetMulti(table, tenantId string, freshness string, keyParts []string) ([]byte, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.GetMulti(table, tenantId, freshness, keyParts)
+}
+
+// DeleteWhere removes the entries stored by SetMulti whose key starts with leadingParts
+func DeleteWhere(table, tenantId string, freshness string, leadingParts []string) (int64, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.DeleteWhere(table, tenantId, freshness, leadingParts)
+}
+
+// SetWithMetadata stores content together with a small metadata string
+func SetWithMetadata(table, tenantId string, freshness string, bind string, content []byte, ttl time.Duration, metadata string) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.SetWithMetadata(table, tenantId, freshness, bind, content, ttl, metadata)
+}
+
+// FindByMetadata returns the entries of the tenant whose JSON metadata has value at jsonPath
+func FindByMetadata(table, tenantId string, jsonPath string, value interface{}) ([]cache.BindInfo, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.FindByMetadata(table, tenantId, jsonPath, value)
+}
+
+// SetWithTags stores content and attaches tags to the entry
+func SetWithTags(table, tenantId string, freshness string, bind string, content []byte, ttl time.Duration, tags []string) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.SetWithTags(table, tenantId, freshness, bind, content, ttl, tags)
+}
+
+// SetWithPriority stores content with its eviction priority; pinned entries are never evicted
+func SetWithPriority(table, tenantId string, freshness string, bind string, content []byte, ttl time.Duration, priority cache.Priority) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.SetWithPriority(table, tenantId, freshness, bind, content, ttl, priority)
+}
+
+// InvalidateTag deletes all entries of the tenant carrying tag
+func InvalidateTag(table, tenantId string, tag string) (int64, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.InvalidateTag(table, tenantId, tag)
+}
+
+// Tags returns the tags of the entry
+func Tags(table, tenantId string, freshness string, bind string) ([]string, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.Tags(table, tenantId, freshness, bind)
+}
+
+// SetEvents replaces the receiver of eviction, expiry, disk full and corruption notifications
+func SetEvents(events cache.Events) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	globalCacheManager.SetEvents(events)
+	return nil
+}
+
+// Use adds interceptors around Get, Set and DeleteEntry
+func Use(interceptors ...cache.Interceptor) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	globalCacheManager.Use(interceptors...)
+	return nil
+}
+
+// ReconcileReport returns the summary of the startup scan enabled by ReconcileOnInit
+func ReconcileReport() (cache.ReconcileReport, error) {
+	if globalCacheManager == nil {
+		return cache.ReconcileReport{}, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.ReconcileReport(), nil
+}
+
+// StatementStats returns how often prepared statements were reused
+// Ping reports whether the cache is initialized, without touching the disk
+func Ping() error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+	return nil
+}
+
+// CheckHealth verifies that the base directory is writable and that a probe DB can be created there
+func CheckHealth() error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.CheckHealth(); err != nil {
+		return fmt.Errorf("health check failed: %w", err)
+	}
+
+	return nil
+}
+
+func StatementStats() (cache.StatementStats, error) {
+	if globalCacheManager == nil {
+		return cache.StatementStats{}, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.StatementStats(), nil
+}
+
 func Get(table, tenantId string, freshness string, bind string) ([]byte, error) {
 	if globalCacheManager == nil {
 		return nil, fmt.Errorf("cache manager not initialized")
@@ -44,6 +406,126 @@ func Get(table, tenantId string, freshness string, bind string) ([]byte, error)
 	return content, nil
 }
 
+// GetContext is Get that gives up when ctx is done
+func GetContext(ctx context.Context, table, tenantId string, freshness string, bind string) ([]byte, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	content, err := globalCacheManager.GetContext(ctx, table, tenantId, freshness, bind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get from cache: %w", err)
+	}
+
+	return content, nil
+}
+
+// GetWithInfo retrieves the entry with its version token for SetCAS
+func GetWithInfo(table, tenantId string, freshness string, bind string) (*cache.CacheEntry, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	entry, err := globalCacheManager.GetWithInfo(table, tenantId, freshness, bind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get from cache: %w", err)
+	}
+
+	return entry, nil
+}
+
+// GetIfChanged retrieves the entry unless its version equals knownVersion, returning cache.ErrNotModified then
+func GetIfChanged(table, tenantId string, freshness string, bind string, knownVersion int64) (*cache.CacheEntry, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	return globalCacheManager.GetIfChanged(table, tenantId, freshness, bind, knownVersion)
+}
+
+// GetWithOptions retrieves the entry like GetWithInfo. With AllowStale a miss falls back to the
+// previous freshness kept by Rotate.
+func GetWithOptions(table, tenantId string, freshness string, bind string, opts cache.GetOptions) (*cache.CacheEntry, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	entry, err := globalCacheManager.GetWithOptions(table, tenantId, freshness, bind, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get from cache: %w", err)
+	}
+
+	return entry, nil
+}
+
+// Rotate switches the tenant to newFreshness, keeping the previous freshness for stale reads
+func Rotate(table, tenantId string, newFreshness string) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.Rotate(table, tenantId, newFreshness); err != nil {
+		return fmt.Errorf("failed to rotate freshness: %w", err)
+	}
+	return nil
+}
+
+// GetReader retrieves the item as a stream, without loading the whole value into memory.
+// The caller must close the reader.
+func GetReader(table, tenantId string, freshness string, bind string) (io.ReadCloser, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	r, err := globalCacheManager.GetReader(table, tenantId, freshness, bind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get from cache: %w", err)
+	}
+
+	return r, nil
+}
+
+// GetOrLoad returns cached content, calling loader and storing its result on miss
+func GetOrLoad(table, tenantId string, freshness string, bind string, loader func() ([]byte, error)) ([]byte, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	content, err := globalCacheManager.GetOrLoad(table, tenantId, freshness, bind, loader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get or load cache: %w", err)
+	}
+
+	return content, nil
+}
+
+// MGet fetches multiple binds at once. Missing binds are not included in the result.
+func MGet(table, tenantId string, freshness string, binds []string) (map[string][]byte, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	result, err := globalCacheManager.MGet(table, tenantId, freshness, binds)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get from cache: %w", err)
+	}
+
+	return result, nil
+}
+
+// Iterate calls fn for every live entry of the cache file without updating access times
+func Iterate(table, tenantId string, freshness string, fn func(bind string, content []byte) error) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.Iterate(table, tenantId, freshness, fn); err != nil {
+		return fmt.Errorf("failed to iterate cache: %w", err)
+	}
+
+	return nil
+}
+
 func Set(table, tenantId string, freshness string, bind string, content []byte) error {
 	if globalCacheManager == nil {
 		return fmt.Errorf("cache manager not initialized")
@@ -56,6 +538,114 @@ func Set(table, tenantId string, freshness string, bind string, content []byte)
 	return nil
 }
 
+// SetWithTTL stores content that is treated as a miss once ttl has elapsed
+func SetWithTTL(table, tenantId string, freshness string, bind string, content []byte, ttl time.Duration) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.SetWithTTL(table, tenantId, freshness, bind, content, ttl); err != nil {
+		return fmt.Errorf("failed to set cache: %w", err)
+	}
+
+	return nil
+}
+
+// SetContext is SetWithTTL that gives up when ctx is done
+func SetContext(ctx context.Context, table, tenantId string, freshness string, bind string, content []byte, ttl time.Duration) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.SetContext(ctx, table, tenantId, freshness, bind, content, ttl); err != nil {
+		return fmt.Errorf("failed to set cache: %w", err)
+	}
+
+	return nil
+}
+
+// SetNX stores the item only if it is not cached yet and reports whether it was stored
+func SetNX(table, tenantId string, freshness string, bind string, content []byte, ttl time.Duration) (bool, error) {
+	if globalCacheManager == nil {
+		return false, fmt.Errorf("cache manager not initialized")
+	}
+
+	stored, err := globalCacheManager.SetNX(table, tenantId, freshness, bind, content, ttl)
+	if err != nil {
+		return false, fmt.Errorf("failed to set cache: %w", err)
+	}
+
+	return stored, nil
+}
+
+// SetCAS replaces the item only if its version is unchanged and returns the new version.
+// The error wraps cache.ErrConflict if the item was modified in the meantime.
+func SetCAS(table, tenantId string, freshness string, bind string, content []byte, ttl time.Duration, version int64) (int64, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	newVersion, err := globalCacheManager.SetCAS(table, tenantId, freshness, bind, content, ttl, version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to set cache: %w", err)
+	}
+
+	return newVersion, nil
+}
+
+// SetFromReader stores the item read from r and returns the number of bytes read
+func SetFromReader(table, tenantId string, freshness string, bind string, r io.Reader, ttl time.Duration) (int64, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	n, err := globalCacheManager.SetFromReader(table, tenantId, freshness, bind, r, ttl)
+	if err != nil {
+		return n, fmt.Errorf("failed to set cache: %w", err)
+	}
+
+	return n, nil
+}
+
+// Append adds data to the end of the item, creating it if it is not cached yet
+func Append(table, tenantId string, freshness string, bind string, data []byte) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.Append(table, tenantId, freshness, bind, data); err != nil {
+		return fmt.Errorf("failed to append to cache: %w", err)
+	}
+
+	return nil
+}
+
+// MSet stores multiple entries in a single transaction
+func MSet(table, tenantId string, freshness string, entries []cache.CacheEntry) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.MSet(table, tenantId, freshness, entries); err != nil {
+		return fmt.Errorf("failed to set cache: %w", err)
+	}
+
+	return nil
+}
+
+// ApplyBatch applies the sets and deletes of ops to one cache file atomically, in order
+func ApplyBatch(table, tenantId string, freshness string, ops []cache.BatchOp) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.ApplyBatch(table, tenantId, freshness, ops); err != nil {
+		return fmt.Errorf("failed to apply batch: %w", err)
+	}
+
+	return nil
+}
+
 func Delete(table string) error {
 	if globalCacheManager == nil {
 		return fmt.Errorf("cache manager not initialized")
@@ -67,3 +657,98 @@ func Delete(table string) error {
 
 	return nil
 }
+
+// Peek returns cached content without updating its access time
+func Peek(table, tenantId string, freshness string, bind string) ([]byte, error) {
+	if globalCacheManager == nil {
+		return nil, fmt.Errorf("cache manager not initialized")
+	}
+
+	content, err := globalCacheManager.Peek(table, tenantId, freshness, bind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to peek cache: %w", err)
+	}
+
+	return content, nil
+}
+
+// Touch marks the item as recently used and, if ttl is positive, makes it expire ttl from now
+func Touch(table, tenantId string, freshness string, bind string, ttl time.Duration) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.Touch(table, tenantId, freshness, bind, ttl); err != nil {
+		return fmt.Errorf("failed to touch cache: %w", err)
+	}
+
+	return nil
+}
+
+// Exists reports whether the item is cached without reading it or updating its access time
+func Exists(table, tenantId string, freshness string, bind string) (bool, error) {
+	if globalCacheManager == nil {
+		return false, fmt.Errorf("cache manager not initialized")
+	}
+
+	exists, err := globalCacheManager.Exists(table, tenantId, freshness, bind)
+	if err != nil {
+		return false, fmt.Errorf("failed to check cache: %w", err)
+	}
+
+	return exists, nil
+}
+
+// DeleteEntry removes a single cached item
+func DeleteEntry(table, tenantId string, freshness string, bind string) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.DeleteEntry(table, tenantId, freshness, bind); err != nil {
+		return fmt.Errorf("failed to delete entry: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteEntryContext is DeleteEntry that gives up when ctx is done
+func DeleteEntryContext(ctx context.Context, table, tenantId string, freshness string, bind string) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.DeleteEntryContext(ctx, table, tenantId, freshness, bind); err != nil {
+		return fmt.Errorf("failed to delete entry: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteTenant removes all cached data of one tenant in the table
+func DeleteTenant(table, tenantId string) error {
+	if globalCacheManager == nil {
+		return fmt.Errorf("cache manager not initialized")
+	}
+
+	if err := globalCacheManager.DeleteTenant(table, tenantId); err != nil {
+		return fmt.Errorf("failed to delete tenant: %w", err)
+	}
+
+	return nil
+}
+
+// Compact runs a full VACUUM on the tenant's DB files, or on every tenant of the table if tenantId
+// is empty, and returns the reclaimed bytes
+func Compact(table, tenantId string) (int64, error) {
+	if globalCacheManager == nil {
+		return 0, fmt.Errorf("cache manager not initialized")
+	}
+
+	reclaimed, err := globalCacheManager.Compact(table, tenantId)
+	if err != nil {
+		return reclaimed, fmt.Errorf("failed to compact: %w", err)
+	}
+
+	return reclaimed, nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"flag"
+	"fmt"
+	mathrand "math/rand"
+	"os"
+	"sort"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"sync"
+	"time"
+)
+
+// benchTable is the table written by sqcache bench
+const benchTable = "bench"
+
+// benchResult is the result of one operation type, printed by sqcache bench
+type benchResult struct {
+	Op        string  `json:"op"`
+	Count     int     `json:"count"`
+	Errors    int     `json:"errors"`
+	Misses    int     `json:"misses,omitempty"`
+	OpsPerSec float64 `json:"ops_per_sec"`
+	P50       string  `json:"p50"`
+	P90       string  `json:"p90"`
+	P99       string  `json:"p99"`
+	P999      string  `json:"p99_9"`
+	Max       string  `json:"max"`
+}
+
+// benchWorker holds the latencies measured by one worker, merged after the run
+type benchWorker struct {
+	gets, sets           []time.Duration
+	getErrors, setErrors int
+	misses               int
+}
+
+// runBench drives a read/write mix against a temporary cache and prints throughput and latency
+// percentiles: sqcache bench [--workers 4] [--value-size 1024] [--keys 10000] [--duration 10s] ...
+func runBench(args []string) error {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	workers := fs.Int("workers", 4, "concurrent workers")
+	valueSize := fs.Int("value-size", 1024, "bytes per value")
+	keys := fs.Int("keys", 10000, "distinct keys, written once before the run")
+	duration := fs.Duration("duration", 10*time.Second, "length of the run")
+	readRatio := fs.Float64("read-ratio", 0.9, "fraction of operations that are gets (the rest are sets)")
+	tenants := fs.Int("tenants", 1, "tenants the keys are spread over (writes to one tenant are serialized)")
+	baseDir := fs.String("base-dir", "", "cache directory to benchmark on, e.g. on the disk to be used (default: a temporary directory, removed afterwards)")
+	maxSize := fs.Int("max-size", 100, "max size per DB in MB")
+	cap := fs.Float64("cap", 0.8, "ratio of entries kept by LRU cleanup")
+	journalMode := fs.String("journal-mode", "", "PRAGMA journal_mode (default OFF)")
+	synchronous := fs.String("synchronous", "", "PRAGMA synchronous (default NORMAL)")
+	compression := fs.String("compression", "", "value compression: gzip or zstd")
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	fs.Parse(args)
+	if *workers <= 0 || *keys <= 0 || *tenants <= 0 || *valueSize < 0 || *duration <= 0 || *readRatio < 0 || *readRatio > 1 {
+		return fmt.Errorf("--workers, --keys, --tenants and --duration must be positive and --read-ratio between 0 and 1")
+	}
+
+	dir := *baseDir
+	if dir == "" {
+		tmp, err := os.MkdirTemp("", "sqcache-bench-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		dir = tmp
+	}
+	config := cache.CacheConfig{
+		BaseDir: dir, MaxSize: *maxSize, Cap: *cap,
+		JournalMode: *journalMode, Synchronous: *synchronous, Compression: *compression,
+	}
+	if err := api.InitWithConfig(config); err != nil {
+		return err
+	}
+	defer api.Close()
+
+	// 値はすべて同じで良いが、圧縮が効きすぎないようランダムにする
+	value := make([]byte, *valueSize)
+	rand.Read(value)
+	tenantOf := func(key int) string { return fmt.Sprintf("t%d", key%*tenants) }
+	bindOf := func(key int) string { return fmt.Sprintf("key%d", key) }
+
+	// 読み込みがミスにならないよう、先にすべてのキーを登録しておく
+	start := time.Now()
+	for key := 0; key < *keys; key++ {
+		if err := api.Set(benchTable, tenantOf(key), "1", bindOf(key), value); err != nil {
+			return fmt.Errorf("failed to prefill: %w", err)
+		}
+	}
+	prefill := time.Since(start)
+
+	results := make([]benchWorker, *workers)
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(*duration)
+	start = time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(w *benchWorker, seed int64) {
+			defer wg.Done()
+			rng := mathrand.New(mathrand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				key := rng.Intn(*keys)
+				if rng.Float64() < *readRatio {
+					begin := time.Now()
+					_, err := api.Get(benchTable, tenantOf(key), "1", bindOf(key))
+					w.gets = append(w.gets, time.Since(begin))
+					if cache.IsNotFound(err) {
+						w.misses++
+					} else if err != nil {
+						w.getErrors++
+					}
+				} else {
+					begin := time.Now()
+					err := api.Set(benchTable, tenantOf(key), "1", bindOf(key), value)
+					w.sets = append(w.sets, time.Since(begin))
+					if err != nil {
+						w.setErrors++
+					}
+				}
+			}
+		}(&results[i], int64(i)+time.Now().UnixNano())
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var gets, sets []time.Duration
+	var getErrors, setErrors, misses int
+	for _, w := range results {
+		gets = append(gets, w.gets...)
+		sets = append(sets, w.sets...)
+		getErrors += w.getErrors
+		setErrors += w.setErrors
+		misses += w.misses
+	}
+	all := append(append([]time.Duration(nil), gets...), sets...)
+	report := []benchResult{
+		summarizeBench("get", gets, getErrors, misses, elapsed),
+		summarizeBench("set", sets, setErrors, 0, elapsed),
+		summarizeBench("total", all, getErrors+setErrors, misses, elapsed),
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	}
+	fmt.Printf("%d workers, %d keys over %d tenants, %d byte values, %.0f%% gets, %s (prefill %s)\n",
+		*workers, *keys, *tenants, *valueSize, *readRatio*100, elapsed.Round(time.Millisecond), prefill.Round(time.Millisecond))
+	fmt.Printf("%-6s %10s %8s %8s %12s %10s %10s %10s %10s %10s\n", "OP", "COUNT", "ERRORS", "MISSES", "OPS/SEC", "P50", "P90", "P99", "P99.9", "MAX")
+	for _, r := range report {
+		fmt.Printf("%-6s %10d %8d %8d %12.0f %10s %10s %10s %10s %10s\n", r.Op, r.Count, r.Errors, r.Misses, r.OpsPerSec, r.P50, r.P90, r.P99, r.P999, r.Max)
+	}
+	return nil
+}
+
+// summarizeBench computes the throughput and latency percentiles of the measured operations
+func summarizeBench(op string, latencies []time.Duration, errors, misses int, elapsed time.Duration) benchResult {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	percentile := func(p float64) string {
+		if len(latencies) == 0 {
+			return "-"
+		}
+		return latencies[min(int(p*float64(len(latencies))), len(latencies)-1)].Round(time.Microsecond).String()
+	}
+	return benchResult{
+		Op:        op,
+		Count:     len(latencies),
+		Errors:    errors,
+		Misses:    misses,
+		OpsPerSec: float64(len(latencies)) / elapsed.Seconds(),
+		P50:       percentile(0.50),
+		P90:       percentile(0.90),
+		P99:       percentile(0.99),
+		P999:      percentile(0.999),
+		Max:       percentile(1),
+	}
+}
@@ -0,0 +1,294 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// アクセスログは監査のための追記専用の記録で、誰が (WithAccessorでctxに付けた名前)・いつ・どのbindを
+// 読み書き・削除したかを残す。contentは含めない。操作はチャネルに渡すだけで、書き込みは1つのゴルーチンが
+// まとめて行う。書き込みが追いつかないときは記録を捨てずに操作を待たせる。
+// ファイルはキャッシュのDBとは別なので、LRU削除やフレッシュネスの切り替えでは消えない。
+
+const (
+	AccessLogNDJSON = "ndjson"
+	AccessLogSQLite = "sqlite"
+
+	// accessLogBuffer bounds the records waiting to be written before operations wait
+	accessLogBuffer = 4096
+	// accessLogBatch bounds the records written at once (one transaction for AccessLogSQLite)
+	accessLogBatch = 512
+)
+
+// AccessRecord is one entry of the access log
+type AccessRecord struct {
+	Time      time.Time `json:"time"`
+	Who       string    `json:"who,omitempty"`
+	Op        string    `json:"op"` // get, peek, set, append, touch, scan, export, delete, delete_prefix, delete_tenant, delete_table, invalidate_tag
+	Table     string    `json:"table"`
+	TenantID  string    `json:"tenant_id"`
+	Freshness string    `json:"freshness,omitempty"`
+	Bind      string    `json:"bind,omitempty"` // delete_prefixではプレフィックス、invalidate_tagではタグ
+	Result    string    `json:"result"`         // hit, miss, ok, not_stored, error
+	Size      int64     `json:"size,omitempty"` // 読み書きしたcontentのバイト数
+}
+
+type accessorKey struct{}
+
+// WithAccessor returns a ctx whose operations are recorded in the access log as done by who,
+// e.g. a user or service name. Operations without a ctx are recorded with an empty who.
+func WithAccessor(ctx context.Context, who string) context.Context {
+	return context.WithValue(ctx, accessorKey{}, who)
+}
+
+// accessorFrom returns the name given to WithAccessor, or "" if none
+func accessorFrom(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	who, _ := ctx.Value(accessorKey{}).(string)
+	return who
+}
+
+func validateAccessLogConfig(config CacheConfig) error {
+	switch config.AccessLogFormat {
+	case "", AccessLogNDJSON, AccessLogSQLite:
+	default:
+		return fmt.Errorf("invalid access log format %q: must be %s or %s", config.AccessLogFormat, AccessLogNDJSON, AccessLogSQLite)
+	}
+	if config.AccessLogSampleRate < 0 || config.AccessLogSampleRate > 1 {
+		return fmt.Errorf("access log sample rate must be between 0 and 1, got %f", config.AccessLogSampleRate)
+	}
+	return nil
+}
+
+// accessSink stores batches of records
+type accessSink interface {
+	write(records []AccessRecord) error
+	close() error
+}
+
+// accessLog writes records to its sink in the background. A nil *accessLog is disabled.
+type accessLog struct {
+	sampleRate float64
+	sink       accessSink
+	logger     *slog.Logger
+
+	mu      sync.RWMutex // closedの確認とrecordsへの送信・クローズを排他する
+	closed  bool
+	records chan AccessRecord
+	done    chan struct{}
+}
+
+// openAccessLog opens the access log of the config, or returns nil if AccessLogPath is empty
+func (cm *CacheManager) openAccessLog() (*accessLog, error) {
+	path := cm.config.AccessLogPath
+	if path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create access log directory: %w", err)
+	}
+	var sink accessSink
+	var err error
+	if cm.config.AccessLogFormat == AccessLogSQLite {
+		sink, err = cm.openSQLiteAccessSink(path)
+	} else {
+		sink, err = openNDJSONAccessSink(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l := &accessLog{
+		sampleRate: cm.config.AccessLogSampleRate,
+		sink:       sink,
+		logger:     cm.logger(),
+		records:    make(chan AccessRecord, accessLogBuffer),
+		done:       make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+// record queues r, unless it is left out by sampling or the log is closed
+func (l *accessLog) record(r AccessRecord) {
+	if l == nil {
+		return
+	}
+	if l.sampleRate > 0 && l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
+		return
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	l.records <- r
+}
+
+func (l *accessLog) run() {
+	defer close(l.done)
+	batch := make([]AccessRecord, 0, accessLogBatch)
+	for r := range l.records {
+		batch = append(batch[:0], r)
+		// 溜まっている記録をまとめて書く
+	drain:
+		for len(batch) < accessLogBatch {
+			select {
+			case r, ok := <-l.records:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, r)
+			default:
+				break drain
+			}
+		}
+		if err := l.sink.write(batch); err != nil {
+			l.logger.Warn("sqlite-cache: failed to write access log", "records", len(batch), "error", err)
+		}
+	}
+}
+
+// close writes the queued records and closes the sink
+func (l *accessLog) close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.records)
+	l.mu.Unlock()
+	<-l.done
+	return l.sink.close()
+}
+
+// logAccess records an operation on bind with the result of accessResult
+func (cm *CacheManager) logAccess(ctx context.Context, op, table, tenantID, freshness, bind string, size int64, result string) {
+	if cm.access == nil {
+		return
+	}
+	cm.access.record(AccessRecord{Time: cm.now(), Who: accessorFrom(ctx), Op: op, Table: table, TenantID: tenantID, Freshness: freshness, Bind: bind, Result: result, Size: size})
+}
+
+// accessResult returns the result recorded for err: hit for a successful read, ok for a successful
+// write, miss for a miss and error for any other error
+func accessResult(read bool, err error) string {
+	switch {
+	case IsNotFound(err):
+		return "miss"
+	case err != nil:
+		return "error"
+	case read:
+		return "hit"
+	}
+	return "ok"
+}
+
+// entrySize returns the content bytes of entry, or 0 if it is nil
+func entrySize(entry *CacheEntry) int64 {
+	if entry == nil {
+		return 0
+	}
+	return int64(len(entry.Content))
+}
+
+// ndjsonAccessSink appends one JSON object per line
+type ndjsonAccessSink struct {
+	file *os.File
+	buf  bytes.Buffer
+}
+
+func openNDJSONAccessSink(path string) (*ndjsonAccessSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open access log: %w", err)
+	}
+	return &ndjsonAccessSink{file: file}, nil
+}
+
+func (s *ndjsonAccessSink) write(records []AccessRecord) error {
+	s.buf.Reset()
+	enc := json.NewEncoder(&s.buf)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return err
+		}
+	}
+	// O_APPENDなので、他のプロセスと同じファイルに書いても行が混ざらない
+	_, err := s.file.Write(s.buf.Bytes())
+	return err
+}
+
+func (s *ndjsonAccessSink) close() error {
+	return s.file.Close()
+}
+
+// sqliteAccessSink inserts records into the access_log table of its own DB file
+type sqliteAccessSink struct {
+	db *sql.DB
+}
+
+func (cm *CacheManager) openSQLiteAccessSink(path string) (*sqliteAccessSink, error) {
+	pragmas := []string{"PRAGMA journal_mode = WAL", "PRAGMA synchronous = NORMAL"}
+	if cm.config.BusyTimeout > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d", cm.config.BusyTimeout.Milliseconds()))
+	}
+	db := cm.openSQLite(path, pragmas)
+	_, err := db.Exec(`
+	CREATE TABLE IF NOT EXISTS access_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time INTEGER NOT NULL, -- UNIXエポックからのミリ秒
+		who TEXT NOT NULL,
+		op TEXT NOT NULL,
+		table_name TEXT NOT NULL,
+		tenant_id TEXT NOT NULL,
+		freshness TEXT NOT NULL,
+		bind TEXT NOT NULL,
+		result TEXT NOT NULL,
+		size INTEGER NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS idx_access_log_tenant_time ON access_log(table_name, tenant_id, time);
+	`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open access log: %w", err)
+	}
+	return &sqliteAccessSink{db: db}, nil
+}
+
+func (s *sqliteAccessSink) write(records []AccessRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare("INSERT INTO access_log (time, who, op, table_name, tenant_id, freshness, bind, result, size) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, r := range records {
+		if _, err := stmt.Exec(r.Time.UnixMilli(), r.Who, r.Op, r.Table, r.TenantID, r.Freshness, r.Bind, r.Result, r.Size); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteAccessSink) close() error {
+	return s.db.Close()
+}
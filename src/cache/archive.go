@@ -0,0 +1,221 @@
+package cache
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// アーカイブはzstdで圧縮したtarで、SQLiteのファイル形式やflagsのビットに依存しない。
+// 先頭にarchiveManifestのJSONを置き、続けてエントリごとに元のcontentを1つのファイルとして入れる。
+// bind、メタデータ、有効期限はPAXレコードに入れるので、bindにどんな文字が含まれていてもよい。
+
+const (
+	archiveVersion      = 1
+	archiveManifestName = "sqcache.json"
+
+	paxBind      = "SQCACHE.bind"
+	paxMetadata  = "SQCACHE.metadata"
+	paxExpiresAt = "SQCACHE.expires_at"
+)
+
+// archiveManifest is the first file of an archive
+type archiveManifest struct {
+	Version  int    `json:"version"`
+	Table    string `json:"table"`
+	TenantID string `json:"tenant_id"`
+}
+
+// Export writes the live entries of every freshness DB of the tenant to an archive at path and
+// returns the number of entries written. Content is written as originally set, so the archive can
+// be imported by a manager with other compression or encryption settings.
+func (cm *CacheManager) Export(table, tenantID string, path string) (int, error) {
+	written, err := cm.export(table, tenantID, path)
+	cm.logAccess(context.Background(), "export", table, tenantID, "", "", 0, accessResult(false, err))
+	return written, err
+}
+
+func (cm *CacheManager) export(table, tenantID string, path string) (int, error) {
+	if err := cm.checkNames(table, tenantID); err != nil {
+		return 0, err
+	}
+	freshnesses, err := cm.otherFreshness(table, tenantID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create archive: %w", err)
+	}
+	written, err := cm.writeArchive(file, table, tenantID, freshnesses)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to write archive: %w", closeErr)
+	}
+	if err != nil {
+		// 途中まで書いたアーカイブは残さない
+		os.Remove(path)
+		return 0, err
+	}
+	return written, nil
+}
+
+func (cm *CacheManager) writeArchive(w io.Writer, table, tenantID string, freshnesses []string) (int, error) {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return 0, fmt.Errorf("failed to initialize zstd: %w", err)
+	}
+	tw := tar.NewWriter(zw)
+
+	manifest, err := json.Marshal(archiveManifest{Version: archiveVersion, Table: table, TenantID: tenantID})
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Truncate(time.Second)
+	if err := writeArchiveFile(tw, &tar.Header{Name: archiveManifestName, ModTime: now}, manifest); err != nil {
+		return 0, err
+	}
+
+	// Importでは新しいフレッシュネスの登録で古いファイルが削除されるので、古いものから書く
+	written := 0
+	for i := len(freshnesses) - 1; i >= 0; i-- {
+		freshness := freshnesses[i]
+		var lastID int64
+		for {
+			page, err := cm.iteratePage(table, tenantID, freshness, lastID)
+			if err != nil {
+				return written, err
+			}
+			for _, row := range page {
+				header := &tar.Header{
+					Name:    fmt.Sprintf("%s/%d", freshness, written),
+					ModTime: now,
+					PAXRecords: map[string]string{
+						paxBind:      row.bind,
+						paxMetadata:  row.metadata,
+						paxExpiresAt: strconv.FormatInt(row.expiresAt, 10),
+					},
+				}
+				if err := writeArchiveFile(tw, header, row.content); err != nil {
+					return written, err
+				}
+				written++
+			}
+			if len(page) < iteratePageSize {
+				break
+			}
+			lastID = page[len(page)-1].id
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return written, fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return written, fmt.Errorf("failed to write archive: %w", err)
+	}
+	return written, nil
+}
+
+func writeArchiveFile(tw *tar.Writer, header *tar.Header, data []byte) error {
+	header.Typeflag = tar.TypeReg
+	header.Mode = 0644
+	header.Size = int64(len(data))
+	header.Format = tar.FormatPAX
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// Import stores the entries of an archive written by Export into the table and tenant it was
+// exported from and returns the number of entries stored. Entries that have expired since the
+// export are skipped, and existing entries with the same bind are replaced.
+func (cm *CacheManager) Import(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	zr, err := zstd.NewReader(file)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != archiveManifestName {
+		return 0, fmt.Errorf("invalid archive: manifest not found")
+	}
+	var manifest archiveManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return 0, fmt.Errorf("invalid archive: %w", err)
+	}
+	if manifest.Version != archiveVersion {
+		return 0, fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+	if !isPathElement(manifest.Table) || !isPathElement(manifest.TenantID) {
+		return 0, fmt.Errorf("invalid archive: bad table or tenant %q/%q", manifest.Table, manifest.TenantID)
+	}
+
+	imported := 0
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return imported, nil
+		}
+		if err != nil {
+			return imported, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		bind, ok := header.PAXRecords[paxBind]
+		if !ok {
+			return imported, fmt.Errorf("invalid archive: %s has no bind", header.Name)
+		}
+		freshness, _, _ := strings.Cut(header.Name, "/")
+		if !isPathElement(freshness) || freshness+"/" == header.Name {
+			return imported, fmt.Errorf("invalid archive: bad entry name %q", header.Name)
+		}
+		var ttl time.Duration
+		if expiresAt, _ := strconv.ParseInt(header.PAXRecords[paxExpiresAt], 10, 64); expiresAt > 0 {
+			if ttl = time.Unix(expiresAt, 0).Sub(cm.now()); ttl <= 0 {
+				continue
+			}
+		}
+		if err := cm.checkEntrySize(header.Size); err != nil {
+			return imported, fmt.Errorf("%s: %w", bind, err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return imported, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if err := cm.SetWithMetadata(manifest.Table, manifest.TenantID, freshness, bind, content, ttl, header.PAXRecords[paxMetadata]); err != nil {
+			return imported, fmt.Errorf("%s: %w", bind, err)
+		}
+		imported++
+	}
+}
+
+// isPathElement reports whether name can be used as one directory or file name under BaseDir,
+// so that names read from an archive cannot point outside it
+func isPathElement(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`) && !strings.ContainsRune(name, 0)
+}
@@ -0,0 +1,193 @@
+package cache
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ReadOnlyCacheは他のプロセスが使っているBaseDirを、書き込まずに読むためのもの。DBファイルはmode=roと
+// query_onlyで開き、スキーマの移行・PRAGMAの設定・古いファイルの削除・アクセス時刻の更新は行わない。
+// 相手のプロセスがフレッシュネスの切り替えやRestoreでファイルを消したり置き換えたりするので、
+// 読むたびにファイルを確かめ、開いたものと違えば開き直す。
+
+// ReadOnlyCache reads the entries and stats of a cache tree without writing to it
+type ReadOnlyCache struct {
+	cm *CacheManager // 名前の検査とcontentの復元に使う。Initはしない
+
+	mu  sync.Mutex
+	dbs map[string]*attachedDB
+}
+
+type attachedDB struct {
+	db   *sql.DB
+	file os.FileInfo // 開いたときのファイル。置き換えられたかどうかの比較に使う
+}
+
+// OpenReadOnly attaches to the cache tree under baseDir, which another process may be using
+func OpenReadOnly(baseDir string) (*ReadOnlyCache, error) {
+	return OpenReadOnlyWithConfig(CacheConfig{BaseDir: baseDir})
+}
+
+// OpenReadOnlyWithConfig is OpenReadOnly with the settings the entries were written with, such as the
+// encryption key, HashBindsOver and HashUnsafeNames. Limits, PRAGMAs and background work are not used.
+func OpenReadOnlyWithConfig(config CacheConfig) (*ReadOnlyCache, error) {
+	if config.BaseDir == "" {
+		return nil, fmt.Errorf("base directory is required")
+	}
+	stat, err := os.Stat(config.BaseDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache tree: %w", err)
+	}
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("failed to open cache tree: %s is not a directory", config.BaseDir)
+	}
+	if err := validateHashBindsConfig(config); err != nil {
+		return nil, err
+	}
+
+	cm := NewCacheManager(config)
+	key, err := loadEncryptionKey(config)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if cm.aead, err = newAEAD(key); err != nil {
+			return nil, err
+		}
+	}
+	return &ReadOnlyCache{cm: cm, dbs: make(map[string]*attachedDB)}, nil
+}
+
+// open returns the read-only handle of the DB file, reopening it when the file was replaced.
+// It returns ErrCacheNotFound when the file does not exist.
+func (rc *ReadOnlyCache) open(table, tenantID string, freshness string) (*sql.DB, error) {
+	if err := rc.cm.checkNames(table, tenantID, freshness); err != nil {
+		return nil, err
+	}
+	key := rc.cm.getDBKey(table, tenantID, freshness)
+	dbPath := rc.cm.getDBPath(table, tenantID, freshness)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.dbs == nil {
+		return nil, fmt.Errorf("read-only cache is closed")
+	}
+
+	file, err := os.Stat(dbPath)
+	if a, exists := rc.dbs[key]; exists {
+		if err == nil && os.SameFile(a.file, file) {
+			return a.db, nil
+		}
+		// 消されたか置き換えられたファイルを読み続けない
+		a.db.Close()
+		delete(rc.dbs, key)
+	}
+	if os.IsNotExist(err) {
+		return nil, ErrCacheNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	pragmas := []string{"PRAGMA query_only = ON"}
+	if rc.cm.config.BusyTimeout > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d", rc.cm.config.BusyTimeout.Milliseconds()))
+	}
+	db := rc.cm.openSQLite(readOnlyDSN(dbPath), pragmas)
+	rc.dbs[key] = &attachedDB{db: db, file: file}
+	return db, nil
+}
+
+// Get returns the content of a live entry. Access times and hit counters are not updated.
+func (rc *ReadOnlyCache) Get(table, tenantID string, freshness string, bind string) ([]byte, error) {
+	entry, err := rc.GetWithInfo(table, tenantID, freshness, bind)
+	if err != nil {
+		return nil, err
+	}
+	return entry.Content, nil
+}
+
+// GetWithInfo returns a live entry with its timestamps, version and metadata
+func (rc *ReadOnlyCache) GetWithInfo(table, tenantID string, freshness string, bind string) (*CacheEntry, error) {
+	db, err := rc.open(table, tenantID, freshness)
+	if err != nil {
+		return nil, err
+	}
+	entry, _, err := rc.cm.readLiveEntry(db, table, tenantID, bind)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Exists reports whether a live entry exists without reading its content
+func (rc *ReadOnlyCache) Exists(table, tenantID string, freshness string, bind string) (bool, error) {
+	db, err := rc.open(table, tenantID, freshness)
+	if errors.Is(err, ErrCacheNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM cache WHERE bind = ? AND (expires_at IS NULL OR expires_at > ?))",
+		rc.cm.storedBind(bind), rc.cm.now().Unix()).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to query cache: %w", err)
+	}
+	return exists, nil
+}
+
+// ScanPrefix lists live entries whose bind starts with prefix, like CacheManager.ScanPrefix
+func (rc *ReadOnlyCache) ScanPrefix(table, tenantID string, freshness string, prefix string, cursor string, limit int) ([]BindInfo, string, error) {
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	limit = min(limit, maxScanLimit)
+	after, err := decodeScanCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	db, err := rc.open(table, tenantID, freshness)
+	if err != nil {
+		return nil, "", err
+	}
+	return rc.cm.scanDB(db, prefix, cursor, after, limit)
+}
+
+// Scan lists the live entries of the DB in bind order, like CacheManager.Scan
+func (rc *ReadOnlyCache) Scan(table, tenantID string, freshness string, cursor string, limit int) ([]BindInfo, string, error) {
+	return rc.ScanPrefix(table, tenantID, freshness, "", cursor, limit)
+}
+
+// ListTables returns the table names in sorted order
+func (rc *ReadOnlyCache) ListTables() ([]string, error) {
+	return rc.cm.ListTables()
+}
+
+// ListTenants returns the tenant IDs of the table in sorted order
+func (rc *ReadOnlyCache) ListTenants(table string) ([]string, error) {
+	return rc.cm.ListTenants(table)
+}
+
+// Stats describes every DB file of the tree, as InspectTree does
+func (rc *ReadOnlyCache) Stats() ([]DBFileInfo, error) {
+	return InspectTree(rc.cm.config.BaseDir)
+}
+
+// Close closes the DB files. The cache tree is left as it is.
+func (rc *ReadOnlyCache) Close() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	var firstErr error
+	for _, a := range rc.dbs {
+		if err := a.db.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	rc.dbs = nil
+	return firstErr
+}
@@ -0,0 +1,246 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// defaultSoftWatermark is the fraction of MaxSize above which background eviction starts
+const defaultSoftWatermark = 0.9
+
+// defaultEvictionBatchRatio is the fraction of MaxSize evicted per background batch
+const defaultEvictionBatchRatio = 0.01
+
+// evictionQueueSize bounds the number of DBs waiting for background eviction
+const evictionQueueSize = 1024
+
+type evictionJob struct {
+	table     string
+	tenantID  string
+	freshness string
+}
+
+// evictionWorker runs size enforcement outside the Set path
+type evictionWorker struct {
+	jobs chan evictionJob
+	stop chan struct{}
+	done chan struct{}
+
+	mu       sync.Mutex
+	idle     *sync.Cond
+	queued   map[evictionJob]bool // 同じDBを重複して積まない
+	inflight int
+	stopped  bool
+}
+
+func newEvictionWorker() *evictionWorker {
+	w := &evictionWorker{
+		jobs:   make(chan evictionJob, evictionQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		queued: make(map[evictionJob]bool),
+	}
+	w.idle = sync.NewCond(&w.mu)
+	return w
+}
+
+// enqueue schedules eviction for the DB. It never blocks; if the queue is full the
+// request is dropped and the hard watermark still protects the size limit.
+func (w *evictionWorker) enqueue(job evictionJob) {
+	w.mu.Lock()
+	if w.stopped || w.queued[job] {
+		w.mu.Unlock()
+		return
+	}
+	w.queued[job] = true
+	w.inflight++
+	w.mu.Unlock()
+
+	select {
+	case w.jobs <- job:
+	default:
+		w.finish(job)
+	}
+}
+
+func (w *evictionWorker) finish(job evictionJob) {
+	w.mu.Lock()
+	delete(w.queued, job)
+	w.inflight--
+	if w.inflight == 0 {
+		w.idle.Broadcast()
+	}
+	w.mu.Unlock()
+}
+
+func (w *evictionWorker) run(cm *CacheManager) {
+	defer close(w.done)
+	for {
+		select {
+		case <-w.stop:
+			return
+		case job := <-w.jobs:
+			// 実行中に同じDBへの新しい要求を受け付けられるよう、先にキューから外す
+			w.mu.Lock()
+			delete(w.queued, job)
+			w.mu.Unlock()
+
+			cm.runBackgroundEviction(job, w.stop)
+
+			w.mu.Lock()
+			w.inflight--
+			if w.inflight == 0 {
+				w.idle.Broadcast()
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// wait blocks until no eviction is queued or running
+func (w *evictionWorker) wait() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for w.inflight > 0 {
+		w.idle.Wait()
+	}
+}
+
+// shutdown stops the worker and discards queued jobs
+func (w *evictionWorker) shutdown() {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return
+	}
+	w.stopped = true
+	w.mu.Unlock()
+
+	close(w.stop)
+	<-w.done
+
+	w.mu.Lock()
+	w.inflight = 0
+	w.queued = make(map[evictionJob]bool)
+	w.idle.Broadcast()
+	w.mu.Unlock()
+}
+
+// runBackgroundEviction evicts the DB of the job batch by batch down to Cap of its limit.
+// The tenant lock is released between batches so that Gets and Sets of the tenant are not held up.
+func (cm *CacheManager) runBackgroundEviction(job evictionJob, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if !cm.evictBatch(job) {
+			return
+		}
+	}
+}
+
+// evictBatch evicts up to one batch from the DB of the job and reports whether it is still above the target
+func (cm *CacheManager) evictBatch(job evictionJob) bool {
+	unlock := cm.lockTenant(job.table, job.tenantID)
+	defer unlock()
+
+	// 待っている間にフレッシュネスが切り替わって削除されていれば何もしない
+	if _, err := os.Stat(cm.getDBPath(job.table, job.tenantID, job.freshness)); err != nil {
+		return false
+	}
+
+	db, err := cm.openDB(job.table, job.tenantID, job.freshness)
+	if err != nil {
+		return false
+	}
+
+	size, err := dbSizeBytes(db)
+	if err != nil {
+		return false
+	}
+	maxBytes := cm.maxBytes(job.table, job.tenantID)
+	target := cm.backgroundTargetBytes(maxBytes)
+	if size <= target {
+		return false
+	}
+
+	if err := cm.evict(job.table, job.tenantID, job.freshness, db, min(size-target, cm.evictionBatchBytes(maxBytes))); err != nil {
+		return false
+	}
+	// 削除できるエントリがなくなってもページが減らないことがあるので、減らなければやめる
+	after, err := dbSizeBytes(db)
+	return err == nil && after < size && after > target
+}
+
+// softWatermarkBytes returns the size above which background eviction starts for a DB limited to maxBytes
+func (cm *CacheManager) softWatermarkBytes(maxBytes int64) int64 {
+	soft := cm.config.SoftWatermark
+	if soft == 0 {
+		soft = defaultSoftWatermark
+	}
+	return int64(soft * float64(maxBytes))
+}
+
+// hardWatermarkBytes returns the size above which Set evicts synchronously for a DB limited to maxBytes
+func (cm *CacheManager) hardWatermarkBytes(maxBytes int64) int64 {
+	hard := cm.config.HardWatermark
+	if hard == 0 {
+		return maxBytes
+	}
+	return int64(hard * float64(maxBytes))
+}
+
+// backgroundTargetBytes returns the size background eviction shrinks a DB limited to maxBytes to
+func (cm *CacheManager) backgroundTargetBytes(maxBytes int64) int64 {
+	return min(int64(float64(maxBytes)*cm.config.Cap), cm.softWatermarkBytes(maxBytes))
+}
+
+// evictionBatchBytes returns the bytes evicted per background batch for a DB limited to maxBytes
+func (cm *CacheManager) evictionBatchBytes(maxBytes int64) int64 {
+	if cm.config.EvictionBatchSize > 0 {
+		return cm.config.EvictionBatchSize
+	}
+	return max(int64(float64(maxBytes)*defaultEvictionBatchRatio), 1)
+}
+
+func validateWatermarkConfig(config CacheConfig) error {
+	if config.SoftWatermark < 0 || config.SoftWatermark > 1 {
+		return fmt.Errorf("soft watermark must be between 0 and 1, got %f", config.SoftWatermark)
+	}
+	if config.HardWatermark < 0 || config.HardWatermark > 1 {
+		return fmt.Errorf("hard watermark must be between 0 and 1, got %f", config.HardWatermark)
+	}
+	soft, hard := config.SoftWatermark, config.HardWatermark
+	if soft == 0 {
+		soft = defaultSoftWatermark
+	}
+	if hard == 0 {
+		hard = 1
+	}
+	if config.BackgroundEviction && soft > hard {
+		return fmt.Errorf("soft watermark %f must not exceed hard watermark %f", soft, hard)
+	}
+	if config.EvictionBatchSize < 0 {
+		return fmt.Errorf("eviction batch size must not be negative, got %d", config.EvictionBatchSize)
+	}
+	return nil
+}
+
+// WaitForEviction blocks until all scheduled background evictions have finished.
+// It returns immediately when background eviction is disabled.
+func (cm *CacheManager) WaitForEviction() {
+	if w := cm.evictor; w != nil {
+		w.wait()
+	}
+}
+
+// stopEvictionWorker stops the worker. Call it before taking cm.mutex exclusively, since
+// a running job holds a tenant lock; the field itself is cleared under cm.mutex by the caller.
+func (cm *CacheManager) stopEvictionWorker() {
+	if cm.evictor != nil {
+		cm.evictor.shutdown()
+	}
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// バックアップはVACUUM INTOで取る。読み取りトランザクションの中で新しいファイルに書き出すので、
+// 書き込み中のページを含まない一貫したスナップショットになり、コピー先も詰めた状態になる。
+// テナントの共有ロックしか持たないので、その間も読み込みは止まらない。
+
+// Backup writes a consistent copy of the DB (table, tenantID, freshness) to destPath, which must not exist.
+// Content is copied as stored, so a compressed or encrypted entry stays so in the backup.
+func (cm *CacheManager) Backup(table, tenantID string, freshness string, destPath string) error {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return err
+	}
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+	defer cm.metrics.observe(table, tenantID, "backup", time.Now())
+	defer cm.logSlow(table, tenantID, "backup", time.Now())
+
+	if _, err := os.Stat(cm.getDBPath(table, tenantID, freshness)); os.IsNotExist(err) {
+		return ErrCacheNotFound
+	}
+	// VACUUM INTOは空でないファイルに書き込めないので、先にわかりやすいエラーにする
+	if _, err := os.Stat(destPath); err == nil {
+		return fmt.Errorf("backup destination already exists: %s", destPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return fmt.Errorf("failed to create backup directory: %w", err)
+	}
+
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error: %w", err)
+		}
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	if _, err := db.Exec("VACUUM INTO ?", destPath); err != nil {
+		// 途中まで書いたファイルは残さない
+		os.Remove(destPath)
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error during backup: %w", err)
+		}
+		return fmt.Errorf("failed to back up database: %w", err)
+	}
+	return nil
+}
+
+// BackupAll backs up every cache DB file under BaseDir into destDir with the same layout, so destDir
+// can be used as the BaseDir of another manager. It returns the number of files written.
+// Each file is a consistent snapshot on its own; files are not taken at the same instant.
+func (cm *CacheManager) BackupAll(destDir string) (int, error) {
+	if within, err := isWithin(destDir, cm.config.BaseDir); err != nil {
+		return 0, err
+	} else if within {
+		return 0, fmt.Errorf("backup directory must be outside the base directory: %s", destDir)
+	}
+
+	paths, err := cm.globData(filepath.Join("*", "*", "*.db"))
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, dbPath := range paths {
+		table, tenantID, freshness := splitDBPath(dbPath)
+		destPath := filepath.Join(destDir, table, tenantID, freshness+".db")
+		if err := cm.Backup(table, tenantID, freshness, destPath); err != nil {
+			// フレッシュネスが切り替わって消えたファイルは飛ばす
+			if err == ErrCacheNotFound {
+				continue
+			}
+			return written, fmt.Errorf("%s/%s/%s: %w", table, tenantID, freshness, err)
+		}
+		written++
+	}
+	return written, nil
+}
+
+// isWithin reports whether path is dir or inside it
+func isWithin(path, dir string) (bool, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	if err != nil {
+		return false, nil
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))), nil
+}
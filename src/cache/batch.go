@@ -0,0 +1,167 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// 登録と削除を1つのトランザクションで順に適用するので、他の読み込みには途中の状態が見えない。
+// 失敗したら何も適用しない。MSetと同じく有効期限は付けず、サイズチェックとLRU削除はバッチごとに1回行う。
+
+// BatchOp is one write of ApplyBatch: a set of Content to Bind, or a delete of Bind when Delete is true
+type BatchOp struct {
+	Bind    string
+	Content []byte
+	Delete  bool
+}
+
+// ApplyBatch applies ops in order in a single transaction, so that readers see either none or all of them
+func (cm *CacheManager) ApplyBatch(table, tenantID string, freshness string, ops []BatchOp) error {
+	err := cm.writeBatch(table, tenantID, freshness, ops)
+	if cm.access != nil {
+		result := accessResult(false, err)
+		for _, op := range ops {
+			if op.Delete {
+				cm.logAccess(context.Background(), "delete", table, tenantID, freshness, op.Bind, 0, result)
+			} else {
+				cm.logAccess(context.Background(), "set", table, tenantID, freshness, op.Bind, int64(len(op.Content)), result)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	// DeleteEntryと同じく、テナントのロックを離してから他のノードに流す
+	for _, op := range ops {
+		if op.Delete {
+			cm.broadcastInvalidation(context.Background(), Invalidation{Op: InvalidateEntry, Table: table, TenantID: tenantID, Freshness: freshness, Bind: op.Bind})
+		}
+	}
+	return nil
+}
+
+func (cm *CacheManager) writeBatch(table, tenantID string, freshness string, ops []BatchOp) error {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return err
+	}
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+	defer cm.metrics.observe(table, tenantID, "batch", time.Now())
+	defer cm.logSlow(table, tenantID, "batch", time.Now())
+
+	if len(ops) == 0 {
+		return nil
+	}
+	for _, op := range ops {
+		if !op.Delete {
+			if err := cm.checkEntrySize(int64(len(op.Content))); err != nil {
+				return fmt.Errorf("%s: %w", op.Bind, err)
+			}
+		}
+	}
+	if err := cm.checkWritable(); err != nil {
+		return err
+	}
+
+	if !cm.dbFileExists(table, tenantID, freshness) {
+		if cleanErr := cm.cleanupOldCacheFiles(table, tenantID, freshness, cm.config.RetainFreshness); cleanErr != nil {
+			return fmt.Errorf("failed to cleanup old cache files: %w", cleanErr)
+		}
+	}
+
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error: %w", err)
+		}
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	stored := make([][]byte, len(ops))
+	flags := make([]int, len(ops))
+	var incoming int64
+	sets := 0
+	for i, op := range ops {
+		if op.Delete {
+			continue
+		}
+		if stored[i], flags[i], err = cm.encodeContent(table, tenantID, op.Bind, op.Content); err != nil {
+			return err
+		}
+		incoming += int64(len(stored[i]))
+		sets++
+	}
+	if err := cm.enforceSize(table, tenantID, freshness, db, incoming); err != nil {
+		return fmt.Errorf("failed to enforce size limits before insert: %w", err)
+	}
+
+	// 同じbindの登録と削除が混ざることがあるので、ホットキャッシュには入れ直さない
+	for _, op := range ops {
+		cm.hot.remove(flightKey(table, tenantID, freshness, op.Bind))
+		cm.negative.remove(flightKey(table, tenantID, freshness, op.Bind))
+	}
+	err = cm.writeWithRetry(table, tenantID, freshness, db, incoming, func() error {
+		return cm.retryBusy(context.Background(), func() error {
+			return cm.applyBatch(db, ops, stored, flags)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		if op.Delete {
+			cm.publishMutation(MutationDelete, table, tenantID, freshness, op.Bind)
+		} else {
+			cm.publishMutation(MutationSet, table, tenantID, freshness, op.Bind)
+		}
+	}
+	cm.metrics.recordSets(table, tenantID, sets)
+	cm.recordDBSize(table, tenantID, db)
+	if cm.config.StampedeWait > 0 {
+		for _, op := range ops {
+			if !op.Delete {
+				cm.misses.release(flightKey(table, tenantID, freshness, op.Bind))
+			}
+		}
+	}
+	return nil
+}
+
+// applyBatch runs the sets and deletes of ops in one transaction
+func (cm *CacheManager) applyBatch(db *sql.DB, ops []BatchOp, stored [][]byte, flags []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(batchInsertSQL)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert statement: %w", err)
+	}
+	defer insert.Close()
+
+	now := cm.now().Unix()
+	for i, op := range ops {
+		if op.Delete {
+			if _, err := tx.Exec("DELETE FROM cache WHERE bind = ?", cm.storedBind(op.Bind)); err != nil {
+				return fmt.Errorf("failed to delete cache entry: %w", err)
+			}
+			continue
+		}
+		if err := cm.insertEncoded(tx, insert, op.Bind, stored[i], flags[i], now); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error during commit: %w", err)
+		}
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+//go:build cgo && !purego && !wasip1
+
+package cache
+
+/*
+#include <stdlib.h>
+
+// mattn/go-sqlite3に組み込まれたSQLiteのincremental blob I/Oを直接呼ぶ
+typedef struct sqlite3 sqlite3;
+typedef struct sqlite3_blob sqlite3_blob;
+int sqlite3_blob_open(sqlite3*, const char*, const char*, const char*, long long, int, sqlite3_blob**);
+int sqlite3_blob_read(sqlite3_blob*, void*, int, int);
+int sqlite3_blob_write(sqlite3_blob*, const void*, int, int);
+int sqlite3_blob_close(sqlite3_blob*);
+const char *sqlite3_errmsg(sqlite3*);
+*/
+import "C"
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"unsafe"
+)
+
+// errNoBlobIO is returned when the driver connection does not expose its sqlite3 handle.
+// Callers then fall back to reading and writing with SQL in chunks.
+var errNoBlobIO = errors.New("incremental blob I/O is not available")
+
+var (
+	blobMain    = C.CString("main")
+	blobTable   = C.CString("cache")
+	blobContent = C.CString("content")
+)
+
+// sqliteHandle returns the sqlite3 handle of a mattn/go-sqlite3 connection, which the driver keeps
+// in the unexported field db. It returns nil for other drivers.
+func sqliteHandle(driverConn any) *C.sqlite3 {
+	v := reflect.ValueOf(driverConn)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	field := v.Elem().FieldByName("db")
+	if !field.IsValid() || field.Kind() != reflect.Pointer || field.IsNil() {
+		return nil
+	}
+	return (*C.sqlite3)(field.UnsafePointer())
+}
+
+// hasBlobIO reports whether the driver connection of conn exposes incremental blob I/O
+func hasBlobIO(conn *sql.Conn) bool {
+	return conn.Raw(func(driverConn any) error {
+		if sqliteHandle(driverConn) == nil {
+			return errNoBlobIO
+		}
+		return nil
+	}) == nil
+}
+
+// withBlob opens the content of the row id for blob I/O on conn and calls fn with it
+func withBlob(conn *sql.Conn, id int64, write bool, fn func(blob *C.sqlite3_blob) error) error {
+	return conn.Raw(func(driverConn any) error {
+		handle := sqliteHandle(driverConn)
+		if handle == nil {
+			return errNoBlobIO
+		}
+
+		flags := C.int(0)
+		if write {
+			flags = 1
+		}
+		var blob *C.sqlite3_blob
+		if rc := C.sqlite3_blob_open(handle, blobMain, blobTable, blobContent, C.longlong(id), flags, &blob); rc != 0 {
+			return fmt.Errorf("failed to open blob: %s", C.GoString(C.sqlite3_errmsg(handle)))
+		}
+		defer C.sqlite3_blob_close(blob)
+		return fn(blob)
+	})
+}
+
+// readBlob reads len(p) bytes of the content of row id starting at offset
+func readBlob(conn *sql.Conn, id int64, offset int64, p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	return withBlob(conn, id, false, func(blob *C.sqlite3_blob) error {
+		if rc := C.sqlite3_blob_read(blob, unsafe.Pointer(&p[0]), C.int(len(p)), C.int(offset)); rc != 0 {
+			return fmt.Errorf("failed to read blob (error code %d)", int(rc))
+		}
+		return nil
+	})
+}
+
+// writeBlob fills the content of row id, created with zeroblob, from r
+func writeBlob(conn *sql.Conn, id int64, r io.Reader) error {
+	return withBlob(conn, id, true, func(blob *C.sqlite3_blob) error {
+		pooled := getStreamBuffer()
+		defer putStreamBuffer(pooled)
+		buf := *pooled
+		var offset int64
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				if rc := C.sqlite3_blob_write(blob, unsafe.Pointer(&buf[0]), C.int(n), C.int(offset)); rc != 0 {
+					return fmt.Errorf("failed to write blob (error code %d)", int(rc))
+				}
+				offset += int64(n)
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+}
@@ -0,0 +1,26 @@
+//go:build !cgo || purego || wasip1
+
+package cache
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+)
+
+// errNoBlobIO is returned when the driver connection does not expose its sqlite3 handle.
+// Callers then fall back to reading and writing with SQL in chunks.
+var errNoBlobIO = errors.New("incremental blob I/O is not available")
+
+// hasBlobIO reports false, as blob I/O needs the sqlite3 handle of the mattn/go-sqlite3 driver
+func hasBlobIO(conn *sql.Conn) bool {
+	return false
+}
+
+func readBlob(conn *sql.Conn, id int64, offset int64, p []byte) error {
+	return errNoBlobIO
+}
+
+func writeBlob(conn *sql.Conn, id int64, r io.Reader) error {
+	return errNoBlobIO
+}
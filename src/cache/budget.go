@@ -0,0 +1,217 @@
+package cache
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TotalMaxSizeを指定すると、すべてのDBの使用量の合計をdiskUsageで管理する。
+// 書き込みで合計が予算を超えたら、最も長く使われていないDBを丸ごと削除し、
+// それでも足りなければ書き込み先のDBの中からエントリを削除する。
+
+type dbUsage struct {
+	table     string
+	tenantID  string
+	freshness string
+	bytes     int64
+	lastUsed  time.Time
+}
+
+// diskUsage tracks the bytes used by each DB key for the global budget
+type diskUsage struct {
+	mu  sync.Mutex
+	dbs map[string]*dbUsage
+}
+
+// load estimates the usage of the existing DB files under baseDir from their file sizes.
+// The estimate is replaced with the size in use the next time each DB is written.
+func (u *diskUsage) load(cm *CacheManager) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.dbs = make(map[string]*dbUsage)
+
+	paths, _ := filepath.Glob(filepath.Join(cm.config.BaseDir, "*", "*", "*.db"))
+	for _, dbPath := range paths {
+		stat, err := os.Stat(dbPath)
+		if err != nil {
+			continue
+		}
+		tenantDir := filepath.Dir(dbPath)
+		usage := &dbUsage{
+			table:     filepath.Base(filepath.Dir(tenantDir)),
+			tenantID:  filepath.Base(tenantDir),
+			freshness: strings.TrimSuffix(filepath.Base(dbPath), ".db"),
+			bytes:     stat.Size(),
+			lastUsed:  stat.ModTime(),
+		}
+		u.dbs[cm.getDBKey(usage.table, usage.tenantID, usage.freshness)] = usage
+	}
+}
+
+// update records the bytes used by the DB and marks it as used now
+func (u *diskUsage) update(key, table, tenantID, freshness string, bytes int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.dbs == nil {
+		u.dbs = make(map[string]*dbUsage)
+	}
+	usage, exists := u.dbs[key]
+	if !exists {
+		usage = &dbUsage{table: table, tenantID: tenantID, freshness: freshness}
+		u.dbs[key] = usage
+	}
+	usage.bytes = bytes
+	usage.lastUsed = time.Now()
+}
+
+// touch marks the DB as used now without changing its size
+func (u *diskUsage) touch(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if usage, exists := u.dbs[key]; exists {
+		usage.lastUsed = time.Now()
+	}
+}
+
+func (u *diskUsage) total() int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var total int64
+	for _, usage := range u.dbs {
+		total += usage.bytes
+	}
+	return total
+}
+
+// coldest returns the keys of all DBs except exclude, least recently used first
+func (u *diskUsage) coldest(exclude string) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	keys := make([]string, 0, len(u.dbs))
+	for key := range u.dbs {
+		if key != exclude {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return u.dbs[keys[i]].lastUsed.Before(u.dbs[keys[j]].lastUsed)
+	})
+	return keys
+}
+
+func (u *diskUsage) get(key string) (dbUsage, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if usage, exists := u.dbs[key]; exists {
+		return *usage, true
+	}
+	return dbUsage{}, false
+}
+
+func (u *diskUsage) forget(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.dbs, key)
+}
+
+// forgetPrefix drops the usage of all keys starting with prefix
+func (u *diskUsage) forgetPrefix(prefix string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key := range u.dbs {
+		if strings.HasPrefix(key, prefix) {
+			delete(u.dbs, key)
+		}
+	}
+}
+
+func (cm *CacheManager) budgetEnabled() bool {
+	return cm.config.TotalMaxSize > 0
+}
+
+// DiskUsage returns the bytes used by all DBs as tracked for TotalMaxSize.
+// It returns 0 when no global budget is configured.
+func (cm *CacheManager) DiskUsage() int64 {
+	if !cm.budgetEnabled() {
+		return 0
+	}
+	return cm.usage.total()
+}
+
+// enforceBudget records that the DB will use expected bytes and, if all DBs together would exceed
+// TotalMaxSize, deletes the least recently used other DBs. If that is not enough, entries are
+// evicted from db itself. The caller holds the tenant lock of db.
+func (cm *CacheManager) enforceBudget(table, tenantID string, freshness string, db *sql.DB, expected int64) error {
+	if !cm.budgetEnabled() {
+		return nil
+	}
+
+	key := cm.getDBKey(table, tenantID, freshness)
+	cm.usage.update(key, table, tenantID, freshness, expected)
+
+	over := cm.usage.total() - int64(cm.config.TotalMaxSize)*1024*1024
+	if over <= 0 {
+		return nil
+	}
+
+	for _, victim := range cm.usage.coldest(key) {
+		if over <= 0 {
+			return nil
+		}
+		if freed, ok := cm.dropColdDB(victim); ok {
+			over -= freed
+		}
+	}
+	if over <= 0 {
+		return nil
+	}
+
+	// 他のDBを削除できなければ、書き込み先のDBの中から削除する
+	if err := cm.evict(table, tenantID, freshness, db, over); err != nil {
+		return err
+	}
+	cm.usage.update(key, table, tenantID, freshness, max(expected-over, 0))
+	return nil
+}
+
+// dropColdDB closes and removes the DB file of key and returns the bytes it was using.
+// DBs whose tenant is busy, including the caller's own tenant, are skipped.
+func (cm *CacheManager) dropColdDB(key string) (int64, bool) {
+	usage, exists := cm.usage.get(key)
+	if !exists {
+		return 0, false
+	}
+
+	// 他のテナントのロックを待つとデッドロックしうるので、取れなければ諦める
+	unlock, ok := cm.tryLockTenant(usage.table, usage.tenantID)
+	if !ok {
+		return 0, false
+	}
+	defer unlock()
+
+	cm.closeDB(key)
+	dbPath := cm.getDBPath(usage.table, usage.tenantID, usage.freshness)
+	if err := removeDBFiles(dbPath); err != nil {
+		return 0, false
+	}
+
+	cm.usage.forget(key)
+	cm.counters.forget(key)
+	cm.forgetHotDB(usage.table, usage.tenantID, usage.freshness)
+	cm.publishMutation(MutationEvict, usage.table, usage.tenantID, usage.freshness, "")
+	cm.logger().Info("sqlite-cache: removed least recently used cache file", "path", dbPath, "bytes", usage.bytes)
+	return usage.bytes, true
+}
+
+func validateBudgetConfig(config CacheConfig) error {
+	if config.TotalMaxSize < 0 {
+		return fmt.Errorf("total max size must not be negative, got %d", config.TotalMaxSize)
+	}
+	return nil
+}
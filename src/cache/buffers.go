@@ -0,0 +1,23 @@
+package cache
+
+import "sync"
+
+// streamBuffers pools the streamChunkSize buffers used to copy values to and from the DB in chunks,
+// so that streaming many values does not allocate a new megabyte for each one
+var streamBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, streamChunkSize)
+		return &buf
+	},
+}
+
+func getStreamBuffer() *[]byte {
+	return streamBuffers.Get().(*[]byte)
+}
+
+// putStreamBuffer returns buf to the pool. The caller must not use it afterwards.
+func putStreamBuffer(buf *[]byte) {
+	if buf != nil {
+		streamBuffers.Put(buf)
+	}
+}
@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"context"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+const (
+	defaultBusyRetries    = 3
+	defaultBusyRetryDelay = 10 * time.Millisecond
+)
+
+// isBusyError reports whether err is a transient SQLITE_BUSY or SQLITE_LOCKED error,
+// which happens when another connection or process holds the DB lock beyond busy_timeout
+func isBusyError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if busy, ok := sqliteBusyCode(err); ok {
+		return busy
+	}
+	// ラップの途中で型が失われたエラーはメッセージで判定する
+	errStr := strings.ToLower(err.Error())
+	return strings.Contains(errStr, "database is locked") ||
+		strings.Contains(errStr, "database table is locked")
+}
+
+func (cm *CacheManager) busyRetries() int {
+	if cm.config.BusyRetries == 0 {
+		return defaultBusyRetries
+	}
+	return max(cm.config.BusyRetries, 0)
+}
+
+func (cm *CacheManager) busyRetryDelay() time.Duration {
+	if cm.config.BusyRetryDelay <= 0 {
+		return defaultBusyRetryDelay
+	}
+	return cm.config.BusyRetryDelay
+}
+
+// retryBusy runs fn and runs it again with exponential backoff while it fails with a busy error.
+// fn must have no effect when it fails, e.g. a single statement or a whole transaction.
+func (cm *CacheManager) retryBusy(ctx context.Context, fn func() error) error {
+	err := fn()
+	delay := cm.busyRetryDelay()
+	for retry := 0; retry < cm.busyRetries() && isBusyError(err); retry++ {
+		// 同時に失敗した呼び出しが揃って再試行しないよう、待ち時間をずらす
+		wait := delay/2 + rand.N(delay)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		delay *= 2
+		err = fn()
+	}
+	return err
+}
@@ -0,0 +1,151 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 変更フィードは上位のキャッシュを無効化するためのもので、エントリの中身は含めない。
+// 記録はテナントのロックを持ったまま行うので、同じテナントの変更は起きた順に届く。
+// 購読者を待たせないよう送信はブロックせず、バッファが溢れた購読者のチャネルは閉じる。
+// 閉じられた購読者は変更を取りこぼしているので、上位のキャッシュを捨ててから購読し直す。
+
+// MutationOp is the kind of change recorded in the change feed
+type MutationOp string
+
+const (
+	MutationSet    MutationOp = "set"
+	MutationDelete MutationOp = "delete"
+	MutationEvict  MutationOp = "evict"
+	MutationExpire MutationOp = "expire"
+)
+
+// Mutation is one change to the cache. An empty Bind covers every entry of the DB (table, tenant,
+// freshness), an empty Freshness every DB of the tenant, and an empty TenantID the whole table.
+type Mutation struct {
+	Op        MutationOp `json:"op"`
+	Table     string     `json:"table"`
+	TenantID  string     `json:"tenant_id,omitempty"`
+	Freshness string     `json:"freshness,omitempty"`
+	Bind      string     `json:"bind,omitempty"`
+	Time      time.Time  `json:"time"`
+}
+
+var errChangeFeedDisabled = errors.New("change feed is not enabled")
+
+// changeFeed delivers mutations to subscribers. A nil *changeFeed is disabled and publish is a no-op.
+type changeFeed struct {
+	mu     sync.Mutex
+	buffer int
+	subs   map[chan Mutation]struct{}
+}
+
+func newChangeFeed(buffer int) *changeFeed {
+	return &changeFeed{buffer: buffer, subs: make(map[chan Mutation]struct{})}
+}
+
+func (f *changeFeed) subscribe() chan Mutation {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ch := make(chan Mutation, f.buffer)
+	f.subs[ch] = struct{}{}
+	return ch
+}
+
+func (f *changeFeed) unsubscribe(ch chan Mutation) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, exists := f.subs[ch]; exists {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+func (f *changeFeed) publish(mutations ...Mutation) {
+	if f == nil || len(mutations) == 0 {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		for _, m := range mutations {
+			select {
+			case ch <- m:
+				continue
+			default:
+			}
+			// 取りこぼしたことが購読者にわかるよう閉じる
+			delete(f.subs, ch)
+			close(ch)
+			break
+		}
+	}
+}
+
+// closeAll closes the channels of all subscribers
+func (f *changeFeed) closeAll() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		delete(f.subs, ch)
+		close(ch)
+	}
+}
+
+// Subscribe returns a channel receiving the mutations made after the call. The channel is closed
+// when ctx is done, when the manager is closed, or when the subscriber falls more than
+// ChangeFeedBuffer mutations behind; in the last case mutations have been lost.
+func (cm *CacheManager) Subscribe(ctx context.Context) (<-chan Mutation, error) {
+	cm.mutex.RLock()
+	feed := cm.feed
+	cm.mutex.RUnlock()
+	if feed == nil {
+		return nil, errChangeFeedDisabled
+	}
+
+	ch := feed.subscribe()
+	go func() {
+		<-ctx.Done()
+		feed.unsubscribe(ch)
+	}()
+	return ch, nil
+}
+
+// publishMutation records a change of the DB (table, tenantID, freshness)
+func (cm *CacheManager) publishMutation(op MutationOp, table, tenantID string, freshness string, bind string) {
+	if cm.feed == nil {
+		return
+	}
+	cm.feed.publish(Mutation{Op: op, Table: table, TenantID: tenantID, Freshness: freshness, Bind: bind, Time: cm.now()})
+}
+
+// publishEntries records a change of each of the entries
+func (cm *CacheManager) publishEntries(op MutationOp, entries []EventEntry) {
+	if cm.feed == nil || len(entries) == 0 {
+		return
+	}
+	now := cm.now()
+	mutations := make([]Mutation, len(entries))
+	for i, entry := range entries {
+		mutations[i] = Mutation{Op: op, Table: entry.Table, TenantID: entry.TenantID, Freshness: entry.Freshness, Bind: entry.Key, Time: now}
+	}
+	cm.feed.publish(mutations...)
+}
+
+// publishBinds records a change of each bind in the DB (table, tenantID, freshness)
+func (cm *CacheManager) publishBinds(op MutationOp, table, tenantID string, freshness string, binds []string) {
+	if cm.feed == nil || len(binds) == 0 {
+		return
+	}
+	now := cm.now()
+	mutations := make([]Mutation, len(binds))
+	for i, bind := range binds {
+		mutations[i] = Mutation{Op: op, Table: table, TenantID: tenantID, Freshness: freshness, Bind: bind, Time: now}
+	}
+	cm.feed.publish(mutations...)
+}
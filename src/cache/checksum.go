@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// チェックサムは保存したバイト列 (圧縮・暗号化した後、チャンクに分ける前) から求めてchecksumカラムに入れる。
+// アルゴリズムは長さで区別するので、設定を変えても既存のエントリはそのまま照合できる。
+// チェックサムのないエントリ (設定前に書き込んだものなど) は照合しない。
+
+const (
+	ChecksumNone   = ""
+	ChecksumCRC32C = "crc32c"
+	ChecksumSHA256 = "sha256"
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func validateChecksumConfig(config CacheConfig) error {
+	switch config.Checksum {
+	case ChecksumNone, ChecksumCRC32C, ChecksumSHA256:
+		return nil
+	}
+	return fmt.Errorf("unsupported checksum %q", config.Checksum)
+}
+
+// newChecksumHash returns the hash of the algorithm, or nil for ChecksumNone
+func newChecksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case ChecksumCRC32C:
+		return crc32.New(crc32cTable)
+	case ChecksumSHA256:
+		return sha256.New()
+	}
+	return nil
+}
+
+// checksum returns the checksum of stored, or nil if checksums are disabled
+func (cm *CacheManager) checksum(stored []byte) []byte {
+	h := newChecksumHash(cm.config.Checksum)
+	if h == nil {
+		return nil
+	}
+	h.Write(stored)
+	return h.Sum(nil)
+}
+
+// checksumReader returns the checksum of the bytes read from r, or nil if checksums are disabled
+func (cm *CacheManager) checksumReader(r io.Reader) ([]byte, error) {
+	h := newChecksumHash(cm.config.Checksum)
+	if h == nil {
+		return nil, nil
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, fmt.Errorf("failed to compute checksum: %w", err)
+	}
+	return h.Sum(nil), nil
+}
+
+// checksumHashFor returns the hash that produced sum, or nil if sum is empty or of unknown length
+func checksumHashFor(sum []byte) hash.Hash {
+	switch len(sum) {
+	case crc32.Size:
+		return crc32.New(crc32cTable)
+	case sha256.Size:
+		return sha256.New()
+	}
+	return nil
+}
+
+// verifyChecksum reports whether stored matches sum. Empty sums and sums of unknown length are not checked.
+func verifyChecksum(stored, sum []byte) bool {
+	h := checksumHashFor(sum)
+	if h == nil {
+		return true
+	}
+	h.Write(stored)
+	return bytes.Equal(h.Sum(nil), sum)
+}
+
+// dropCorruptEntry deletes the entry id whose content did not match its checksum and reports it.
+// cause is returned so callers can write "return nil, cm.dropCorruptEntry(...)".
+func (cm *CacheManager) dropCorruptEntry(db *sql.DB, table, tenantID string, freshness string, id int64, bind string, cause error) error {
+	cm.hot.remove(flightKey(table, tenantID, freshness, bind))
+	if _, err := db.Exec("DELETE FROM cache WHERE id = ?", id); err != nil {
+		cm.logger().Warn("sqlite-cache: failed to delete entry with checksum mismatch", "table", table, "tenant", tenantID, "freshness", freshness, "bind", bind, "error", err)
+		return cause
+	}
+	cm.logger().Warn("sqlite-cache: deleted entry with checksum mismatch", "table", table, "tenant", tenantID, "freshness", freshness, "bind", bind)
+	cm.publishMutation(MutationDelete, table, tenantID, freshness, bind)
+	cm.notifyCorruption(table, tenantID, freshness, cause)
+	return cause
+}
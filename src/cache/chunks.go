@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// 大きなエントリはcacheのレコードには空のcontentとflagChunkedだけを置き、保存するバイト列
+// (圧縮・暗号化した後のもの) をChunkSizeごとに分けてcache_chunksに入れる。
+// チャンクはトリガーでcacheのレコードと一緒に削除されるので、LRUの削除などは1つのDELETEで
+// エントリ全体を取り除ける。
+
+// dbExecutor is implemented by both *sql.DB and *sql.Tx
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// chunkBytes returns the size in bytes above which stored content is split (0 means never)
+func (cm *CacheManager) chunkBytes() int {
+	return cm.config.ChunkSize * 1024 * 1024
+}
+
+// splitContent returns the content and flags to put in the cache row. If stored is larger than
+// ChunkSize, the row gets an empty content and the caller must write stored with writeChunks.
+func (cm *CacheManager) splitContent(stored []byte, flags int) ([]byte, int, bool) {
+	if n := cm.chunkBytes(); n > 0 && len(stored) > n {
+		return []byte{}, flags | flagChunked, true
+	}
+	return stored, flags, false
+}
+
+// writeChunks stores stored as the chunks of the entry id.
+// Chunks of the previous content have already been removed by the triggers.
+func (cm *CacheManager) writeChunks(q dbExecutor, id int64, stored []byte) error {
+	size := cm.chunkBytes()
+	for index := 0; index*size < len(stored); index++ {
+		end := min((index+1)*size, len(stored))
+		if _, err := q.Exec("INSERT INTO cache_chunks (entry_id, chunk_index, data) VALUES (?, ?, ?)",
+			id, index, stored[index*size:end]); err != nil {
+			return fmt.Errorf("failed to insert chunk: %w", err)
+		}
+	}
+	return nil
+}
+
+// readChunks reassembles the stored bytes of the chunked entry id
+func readChunks(q dbExecutor, id int64) ([]byte, error) {
+	rows, err := q.Query("SELECT data FROM cache_chunks WHERE entry_id = ? ORDER BY chunk_index", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chunks: %w", err)
+	}
+	defer rows.Close()
+
+	var stored []byte
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, fmt.Errorf("failed to scan chunk: %w", err)
+		}
+		stored = append(stored, data...)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read chunks: %w", err)
+	}
+	return stored, nil
+}
+
+// loadContent returns the original content of the entry id from the content, flags and checksum of
+// its row, reading the chunks first if the entry is chunked. aad is entryAAD of the row. It returns
+// ErrChecksumMismatch if the stored bytes do not match sum.
+func (cm *CacheManager) loadContent(q dbExecutor, id int64, content []byte, flags int, sum []byte, aad []byte) ([]byte, error) {
+	if flags&flagChunked != 0 {
+		var err error
+		if content, err = readChunks(q, id); err != nil {
+			return nil, err
+		}
+	}
+	if !verifyChecksum(content, sum) {
+		return nil, ErrChecksumMismatch
+	}
+	return cm.decodeContent(content, flags, aad)
+}
+
+// storeEntry runs query, which writes the cache row of stored and returns its id, and then writes
+// the chunks if the entry is chunked and replaces the tags of the entry unless tags is nil. All are
+// done in one transaction so that readers never see a chunked row without its chunks. It reports
+// false if query wrote no row.
+func (cm *CacheManager) storeEntry(ctx context.Context, db *sql.DB, stored []byte, chunked bool, tags []string, query string, args ...interface{}) (bool, error) {
+	stmt, err := cm.stmts.prepare(db, query)
+	if err != nil {
+		return false, err
+	}
+
+	if !chunked && tags == nil {
+		var id int64
+		if err := stmt.QueryRowContext(ctx, args...).Scan(&id); err != nil {
+			if err == sql.ErrNoRows {
+				return false, nil
+			}
+			return false, err
+		}
+		return true, nil
+	}
+
+	// ctxが終わればトランザクションはロールバックされる
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id int64
+	if err := tx.StmtContext(ctx, stmt).QueryRow(args...).Scan(&id); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	if chunked {
+		if err := cm.writeChunks(tx, id, stored); err != nil {
+			return false, err
+		}
+	}
+	if tags != nil {
+		if err := writeTags(tx, id, tags); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Clockはエントリの時刻 (last_accessed、updated_at、有効期限、ホットキャッシュとネガティブキャッシュの期限) と、
+// スイーパー・incremental_vacuum・スナップショットの周期に使う。操作にかかった時間の計測、ロック待ちや
+// busyの再試行のタイムアウト、DBファイル単位の管理 (TotalMaxSize、サイズの見積もり) は実際の時刻のまま。
+// EvictionPolicyはマネージャを持たないので、LFUPolicyのDecayPeriodも実際の時刻で減らす。
+// テストではManualClockを渡すと、sleepせずに期限切れやLRUの順序を確かめられる。
+
+// Clock tells the manager the current time and schedules its background work
+type Clock interface {
+	Now() time.Time
+	// NewTicker returns a Ticker that fires every d
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker delivers ticks on C until Stop is called, like time.Ticker
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// SystemClock is the Clock used when CacheConfig.Clock is nil
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time { return time.Now() }
+
+func (SystemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
+
+// clock returns the Clock of the config, or SystemClock if it is nil
+func (cm *CacheManager) clock() Clock {
+	if cm.config.Clock != nil {
+		return cm.config.Clock
+	}
+	return SystemClock{}
+}
+
+// now returns the current time of the Clock
+func (cm *CacheManager) now() time.Time {
+	return cm.clock().Now()
+}
+
+// ManualClock is a Clock that only moves when Advance or Set is called. Tickers fire, at most
+// once per call like time.Ticker, when the time passes their next tick.
+type ManualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers map[*manualTicker]struct{}
+}
+
+// NewManualClock returns a ManualClock starting at start
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start, tickers: make(map[*manualTicker]struct{})}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.setLocked(c.now.Add(d))
+	c.mu.Unlock()
+}
+
+// Set moves the clock to t. Moving it backward does not fire tickers.
+func (c *ManualClock) Set(t time.Time) {
+	c.mu.Lock()
+	c.setLocked(t)
+	c.mu.Unlock()
+}
+
+func (c *ManualClock) setLocked(t time.Time) {
+	c.now = t
+	for ticker := range c.tickers {
+		if t.Before(ticker.next) {
+			continue
+		}
+		// 時刻を大きく進めても、time.Tickerと同じく溜めずに1回だけ届ける
+		for !t.Before(ticker.next) {
+			ticker.next = ticker.next.Add(ticker.period)
+		}
+		select {
+		case ticker.c <- t:
+		default:
+		}
+	}
+}
+
+func (c *ManualClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("cache: non-positive interval for ManualClock.NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := &manualTicker{clock: c, c: make(chan time.Time, 1), period: d, next: c.now.Add(d)}
+	c.tickers[ticker] = struct{}{}
+	return ticker
+}
+
+type manualTicker struct {
+	clock  *ManualClock
+	c      chan time.Time
+	period time.Duration
+	next   time.Time
+}
+
+func (t *manualTicker) C() <-chan time.Time { return t.c }
+
+func (t *manualTicker) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	delete(t.clock.tickers, t)
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// flagsカラムのビット。エントリに適用した変換を記録し、読み込み時に逆変換する
+const (
+	flagGzip      = 1 << 0
+	flagZstd      = 1 << 1
+	flagEncrypted = 1 << 2
+	flagChunked   = 1 << 3 // contentは空で、保存したバイト列はcache_chunksにある
+	flagBoundAAD  = 1 << 4 // 暗号化のAADにテーブル・テナント・bindを使った。ないエントリはAADなしで暗号化されている
+)
+
+const (
+	CompressionNone = ""
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec returns the shared encoder/decoder. EncodeAll/DecodeAll are safe for concurrent use.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil)
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func validateCompressionConfig(config CacheConfig) error {
+	switch config.Compression {
+	case CompressionNone, CompressionGzip, CompressionZstd:
+	default:
+		return fmt.Errorf("unsupported compression %q", config.Compression)
+	}
+	if config.CompressionMinSize < 0 {
+		return fmt.Errorf("compression min size must not be negative, got %d", config.CompressionMinSize)
+	}
+	return nil
+}
+
+// encodeContent applies the codecs of the table, or compression if it has none, and then encryption
+// bound to the table, tenant and bind, returning the stored bytes and flags
+func (cm *CacheManager) encodeContent(table, tenantID string, bind string, content []byte) ([]byte, int, error) {
+	var stored []byte
+	var flags int
+	var err error
+	if list, ok := cm.codecs[table]; ok {
+		stored, flags, err = encodeCodecs(list, content)
+	} else {
+		stored, flags, err = cm.compressContent(content)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if cm.aead != nil {
+		if stored, err = cm.encrypt(stored, entryAAD(table, tenantID, bind)); err != nil {
+			return nil, 0, err
+		}
+		flags |= flagEncrypted | flagBoundAAD
+	}
+	return stored, flags, nil
+}
+
+// decodeContent reverses the transforms recorded in flags. Compression settings and codecs are taken from
+// the flags rather than the current config, so entries written with other settings remain readable.
+// aad is entryAAD of the row being read.
+func (cm *CacheManager) decodeContent(content []byte, flags int, aad []byte) ([]byte, error) {
+	if flags&flagEncrypted != 0 {
+		if flags&flagBoundAAD == 0 {
+			aad = nil
+		}
+		var err error
+		if content, err = cm.decrypt(content, aad); err != nil {
+			return nil, err
+		}
+	}
+	if flags&flagCodecMask != 0 {
+		return decodeCodecs(content, flags)
+	}
+	return decompressContent(content, flags)
+}
+
+// compressContent compresses content according to the config.
+// Content that does not shrink is stored as is.
+func (cm *CacheManager) compressContent(content []byte) ([]byte, int, error) {
+	if cm.config.Compression == CompressionNone || len(content) < cm.config.CompressionMinSize {
+		return content, 0, nil
+	}
+
+	var encoded []byte
+	var flag int
+	switch cm.config.Compression {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(content); err != nil {
+			return nil, 0, fmt.Errorf("failed to compress content: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, 0, fmt.Errorf("failed to compress content: %w", err)
+		}
+		encoded, flag = buf.Bytes(), flagGzip
+	case CompressionZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to initialize zstd: %w", err)
+		}
+		encoded, flag = enc.EncodeAll(content, nil), flagZstd
+	}
+
+	if len(encoded) >= len(content) {
+		return content, 0, nil
+	}
+	return encoded, flag, nil
+}
+
+func decompressContent(content []byte, flags int) ([]byte, error) {
+	switch {
+	case flags&flagGzip != 0:
+		r, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress content: %w", err)
+		}
+		defer r.Close()
+		decoded, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress content: %w", err)
+		}
+		return decoded, nil
+	case flags&flagZstd != 0:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize zstd: %w", err)
+		}
+		decoded, err := dec.DecodeAll(content, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress content: %w", err)
+		}
+		return decoded, nil
+	}
+	return content, nil
+}
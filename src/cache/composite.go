@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 複数の部分からなるbindは、各部分をエスケープして区切り文字を続けた1つの文字列としてbindカラムに保存する。
+// 区切りの後ろに来る部分は元の並びのまま連結されるので、先頭からいくつかの部分が一致するエントリは
+// bindのユニークインデックス上で連続した範囲になり、DeleteWhereはDeletePrefixと同じ範囲の削除で済む。
+// 区切り文字とエスケープ文字はどちらも制御文字なので、通常の文字列のbindとは混ざらない。
+
+const (
+	// partSeparator ends every part of a composite bind
+	partSeparator = '\x1f'
+	// partEscape precedes a separator or escape character inside a part
+	partEscape = '\x1e'
+)
+
+// CompositeBind returns the bind that stores an entry keyed by parts. Entries stored with
+// SetMulti can also be read and deleted with the other methods through this bind.
+func CompositeBind(parts ...string) string {
+	var b strings.Builder
+	for _, part := range parts {
+		for i := 0; i < len(part); i++ {
+			if part[i] == partSeparator || part[i] == partEscape {
+				b.WriteByte(partEscape)
+			}
+			b.WriteByte(part[i])
+		}
+		b.WriteByte(partSeparator)
+	}
+	return b.String()
+}
+
+// SplitCompositeBind returns the parts of a bind made by CompositeBind, such as the binds returned by ScanPrefix
+func SplitCompositeBind(bind string) ([]string, error) {
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(bind); i++ {
+		switch bind[i] {
+		case partEscape:
+			if i+1 == len(bind) {
+				return nil, fmt.Errorf("bind %q ends with an escape character", bind)
+			}
+			i++
+			part.WriteByte(bind[i])
+		case partSeparator:
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(bind[i])
+		}
+	}
+	if part.Len() > 0 || len(parts) == 0 {
+		return nil, fmt.Errorf("bind %q is not a composite bind", bind)
+	}
+	return parts, nil
+}
+
+// SetMulti stores content under a bind made of keyParts, like SetWithTTL
+func (cm *CacheManager) SetMulti(table, tenantID string, freshness string, keyParts []string, content []byte, ttl time.Duration) error {
+	if len(keyParts) == 0 {
+		return fmt.Errorf("key parts must not be empty")
+	}
+	return cm.SetWithTTL(table, tenantID, freshness, CompositeBind(keyParts...), content, ttl)
+}
+
+// GetMulti returns the content stored by SetMulti under keyParts
+func (cm *CacheManager) GetMulti(table, tenantID string, freshness string, keyParts []string) ([]byte, error) {
+	if len(keyParts) == 0 {
+		return nil, fmt.Errorf("key parts must not be empty")
+	}
+	return cm.Get(table, tenantID, freshness, CompositeBind(keyParts...))
+}
+
+// DeleteWhere removes every composite bind entry whose leading parts equal leadingParts and returns
+// how many were removed. The entries are found through the index on bind, as with DeletePrefix.
+func (cm *CacheManager) DeleteWhere(table, tenantID string, freshness string, leadingParts []string) (int64, error) {
+	if len(leadingParts) == 0 {
+		return 0, fmt.Errorf("leading parts must not be empty")
+	}
+	return cm.DeletePrefix(table, tenantID, freshness, CompositeBind(leadingParts...))
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"database/sql"
+	"os"
+)
+
+// GetIfChanged returns the entry like GetWithInfo unless its version equals knownVersion, in which
+// case it returns ErrNotModified without reading the content. Either way the access is recorded like
+// a Get. A knownVersion of 0 means the caller has no copy and always reads the entry.
+func (cm *CacheManager) GetIfChanged(table, tenantID string, freshness string, bind string, knownVersion int64) (*CacheEntry, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return nil, err
+	}
+	if knownVersion != 0 {
+		unchanged, err := cm.accessIfVersion(table, tenantID, freshness, bind, knownVersion)
+		if err != nil {
+			return nil, err
+		}
+		if unchanged {
+			cm.metrics.recordHits(table, tenantID, 1)
+			cm.counters.record(cm.getDBKey(table, tenantID, freshness), 1, 0)
+			return nil, ErrNotModified
+		}
+	}
+	// 変わっていれば (あるいは消えていれば) 通常のGetとして読む
+	return cm.GetWithInfo(table, tenantID, freshness, bind)
+}
+
+// accessIfVersion updates last_accessed and hits of the live entry whose version is version and
+// reports whether there was one
+func (cm *CacheManager) accessIfVersion(table, tenantID string, freshness string, bind string, version int64) (bool, error) {
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+
+	if _, err := os.Stat(cm.getDBPath(table, tenantID, freshness)); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		return false, err
+	}
+
+	now := cm.now().Unix()
+	key := cm.getDBKey(table, tenantID, freshness)
+	stored := cm.storedBind(bind)
+	if reader := cm.lookupReader(key); reader != nil {
+		// 読み取り専用の接続で確かめ、アクセスはGetと同じく後から書き込む
+		var exists int
+		err := reader.QueryRow("SELECT 1 FROM cache WHERE bind = ? AND version = ? AND (expires_at IS NULL OR expires_at > ?)",
+			stored, version, now).Scan(&exists)
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		cm.recordAccess(key, db, stored, now)
+		return true, nil
+	}
+
+	result, err := db.Exec(`
+	UPDATE cache SET last_accessed = ?, hits = hits + 1
+	WHERE bind = ? AND version = ? AND (expires_at IS NULL OR expires_at > ?)
+	`, now, stored, version, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return err == nil && n > 0, nil
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DBのサイズはファイルサイズではなくページ数から求める。WALモードではコミットした内容がチェックポイントまで
+// メインのファイルに書かれないが、page_countはWALの内容も含むので、書いた直後からサイズに数えられる。
+// Setのたびに問い合わせないよう、オープン中のDBごとに前回の値に書き込んだバイト数を足した見積もりを持つ。
+// 上書きや削除で縮んだ分は見積もりに入らないので大きめになるが、削除を判断する前とsizeRefreshIntervalごとに
+// 問い合わせ直すので、見積もりのせいで余計なエントリを削除することはない。
+
+// sizeRefreshInterval bounds how long an estimated DB size is used without asking SQLite
+const sizeRefreshInterval = 5 * time.Second
+
+type sizeEstimate struct {
+	bytes     int64
+	refreshed time.Time
+}
+
+// sizeCache keeps the estimated size of each open DB. Entries are dropped when the handle is closed.
+type sizeCache struct {
+	mu    sync.Mutex
+	sizes map[*sql.DB]*sizeEstimate
+}
+
+// estimate returns the cached size of db, asking SQLite when there is none or it is older than sizeRefreshInterval
+func (c *sizeCache) estimate(db *sql.DB) (int64, error) {
+	c.mu.Lock()
+	e, exists := c.sizes[db]
+	fresh := exists && time.Since(e.refreshed) < sizeRefreshInterval
+	var size int64
+	if fresh {
+		size = e.bytes
+	}
+	c.mu.Unlock()
+	if fresh {
+		return size, nil
+	}
+	return c.refresh(db)
+}
+
+// refresh reads the size of db from SQLite and caches it
+func (c *sizeCache) refresh(db *sql.DB) (int64, error) {
+	size, err := dbSizeBytes(db)
+	if err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sizes == nil {
+		c.sizes = make(map[*sql.DB]*sizeEstimate)
+	}
+	c.sizes[db] = &sizeEstimate{bytes: size, refreshed: time.Now()}
+	return size, nil
+}
+
+// add counts n bytes about to be written to db
+func (c *sizeCache) add(db *sql.DB, n int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, exists := c.sizes[db]; exists {
+		e.bytes += n
+	}
+}
+
+// forget drops the size of db, which is read again on next use. Call it when db is closed or shrinks.
+func (c *sizeCache) forget(db *sql.DB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.sizes, db)
+}
+
+// dbSizeBytes returns the bytes of the main database in use, i.e. (page_count - freelist_count) * page_size.
+// Free pages are reused by later writes, so they do not count toward MaxSize.
+func dbSizeBytes(db *sql.DB) (int64, error) {
+	var size int64
+	// PRAGMAの関数形式で、3つの値を1回の問い合わせで読む
+	err := db.QueryRow("SELECT (p.page_count - f.freelist_count) * s.page_size FROM pragma_page_count() p, pragma_freelist_count() f, pragma_page_size() s").Scan(&size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read database size: %w", err)
+	}
+	return size, nil
+}
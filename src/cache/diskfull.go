@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readOnlyProbeInterval is how often a write is let through in read-only mode
+// to find out whether space has been freed
+const readOnlyProbeInterval = 30 * time.Second
+
+// readOnlyState is the degraded mode entered when a write still fails with a disk full error
+// after emergency eviction. Reads keep working while writes return ErrReadOnly.
+type readOnlyState struct {
+	active atomic.Bool
+
+	mu        sync.Mutex
+	cause     error
+	lastProbe time.Time
+}
+
+// checkWritable returns ErrReadOnly while the manager is read-only, except for one probe write
+// per readOnlyProbeInterval. A successful probe leaves read-only mode.
+func (cm *CacheManager) checkWritable() error {
+	s := &cm.readOnly
+	if !s.active.Load() {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.active.Load() {
+		return nil
+	}
+	if time.Since(s.lastProbe) >= readOnlyProbeInterval {
+		s.lastProbe = time.Now()
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrReadOnly, s.cause)
+}
+
+func (cm *CacheManager) enterReadOnly(cause error) {
+	s := &cm.readOnly
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cause = cause
+	s.lastProbe = time.Now()
+	s.active.Store(true)
+}
+
+// ResetReadOnly leaves read-only mode, e.g. after an operator has freed disk space
+func (cm *CacheManager) ResetReadOnly() {
+	s := &cm.readOnly
+	if !s.active.Load() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cause = nil
+	s.active.Store(false)
+}
+
+// IsReadOnly reports whether writes are rejected because the disk is full
+func (cm *CacheManager) IsReadOnly() bool {
+	return cm.readOnly.active.Load()
+}
+
+// writeWithRetry runs write, which must be safe to run again after a failure. On a disk full error
+// it evicts entries from db, retries once and, if the disk is still full, switches the manager
+// to read-only mode. The caller holds the tenant lock of db.
+func (cm *CacheManager) writeWithRetry(table, tenantID string, freshness string, db *sql.DB, incoming int64, write func() error) error {
+	err := write()
+	if err == nil || !isNoSpaceError(err) {
+		if err == nil {
+			cm.ResetReadOnly()
+		}
+		cm.discardCorruptDB(table, tenantID, freshness, err)
+		return err
+	}
+
+	// 削除で空いたページはフリーリストに入り、再試行の書き込みに使われる
+	if evictErr := cm.emergencyEvict(table, tenantID, freshness, db, incoming); evictErr == nil {
+		if err = write(); err == nil {
+			cm.ResetReadOnly()
+			return nil
+		}
+		if !isNoSpaceError(err) {
+			return err
+		}
+	}
+
+	cm.enterReadOnly(err)
+	cm.logger().Warn("sqlite-cache: disk full, rejecting writes", "table", table, "tenant", tenantID, "error", err)
+	cm.notifyDiskFull(table, tenantID, freshness, err)
+	return fmt.Errorf("%w: %w", ErrReadOnly, err)
+}
+
+// emergencyEvict frees room for incoming bytes plus the part of db above Cap of its current size
+func (cm *CacheManager) emergencyEvict(table, tenantID string, freshness string, db *sql.DB, incoming int64) error {
+	size, err := dbSizeBytes(db)
+	if err != nil {
+		return err
+	}
+	return cm.evict(table, tenantID, freshness, db, incoming+int64(float64(size)*(1-cm.config.Cap)))
+}
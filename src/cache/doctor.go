@@ -0,0 +1,373 @@
+package cache
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Diagnoseはマネージャを使わずにキャッシュツリーを調べる。Fixを指定しなければ何も変更しない。
+// Fixは他のプロセスがツリーを使っていないときに実行する (使用中のDBファイルを削除・移行しないため)。
+
+const (
+	SeverityError   = "error"   // キャッシュとして使えない、または操作が失敗する
+	SeverityWarning = "warning" // 使えるが、無駄なディスク使用や移行の遅れがある
+	SeverityInfo    = "info"
+)
+
+// Finding is one problem found by Diagnose
+type Finding struct {
+	Severity string `json:"severity"`
+	Check    string `json:"check"` // permissions, integrity, schema, stale_freshness, leftover
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+	Fix      string `json:"fix,omitempty"` // DiagnoseOptions.Fixで行う修正。空なら手作業が必要
+	Fixed    bool   `json:"fixed,omitempty"`
+	FixError string `json:"fix_error,omitempty"`
+}
+
+// DiagnoseOptions configures Diagnose
+type DiagnoseOptions struct {
+	Fix             bool // 修正できるものを修正する
+	RetainFreshness int  // CacheConfig.RetainFreshnessと同じく、現在のもの以外に残すフレッシュネスの数
+}
+
+// cacheSchemaColumns is the columns of the cache table created by createTables
+var cacheSchemaColumns = []string{"id", "bind", "content", "last_accessed", "updated_at"}
+
+// Diagnose checks the cache tree under baseDir: permissions of the directories and DB files,
+// integrity_check of each DB, schema drift from this version, freshness files left next to the
+// current one, and files left over by crashed processes. With options.Fix the problems that can be
+// repaired are repaired and marked Fixed; no process may be using the tree then.
+func Diagnose(baseDir string, options DiagnoseOptions) ([]Finding, error) {
+	info, err := os.Stat(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", baseDir)
+	}
+
+	d := &doctor{baseDir: baseDir, options: options}
+	d.checkPermissions()
+	d.checkLeftovers()
+	paths, _ := filepath.Glob(filepath.Join(baseDir, "*", "*", "*.db"))
+	for _, dbPath := range paths {
+		if d.checkIntegrity(dbPath) {
+			d.checkSchema(dbPath)
+		}
+	}
+	d.checkStaleFreshness()
+	return d.findings, nil
+}
+
+type doctor struct {
+	baseDir  string
+	options  DiagnoseOptions
+	findings []Finding
+}
+
+// report records the finding and, with options.Fix, runs fix if given
+func (d *doctor) report(finding Finding, fix func() error) {
+	if d.options.Fix && fix != nil {
+		if err := fix(); err != nil {
+			finding.FixError = err.Error()
+		} else {
+			finding.Fixed = true
+		}
+	}
+	d.findings = append(d.findings, finding)
+}
+
+func (d *doctor) relPath(path string) string {
+	if rel, err := filepath.Rel(d.baseDir, path); err == nil {
+		return rel
+	}
+	return path
+}
+
+// checkPermissions reports directories and DB files the owner cannot write, on which Set fails
+func (d *doctor) checkPermissions() {
+	targets := []string{d.baseDir}
+	for _, pattern := range []string{"*", filepath.Join("*", "*"), filepath.Join("*", "*", "*.db")} {
+		matches, _ := filepath.Glob(filepath.Join(d.baseDir, pattern))
+		targets = append(targets, matches...)
+	}
+
+	for _, path := range targets {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		// ディレクトリはDBファイルとジャーナルの作成・削除にrwx、DBファイルはrwが必要
+		need := os.FileMode(0600)
+		if info.IsDir() {
+			need = 0700
+		} else if filepath.Ext(path) != ".db" {
+			continue
+		}
+		mode := info.Mode().Perm()
+		if mode&need == need {
+			continue
+		}
+		d.report(Finding{
+			Severity: SeverityError,
+			Check:    "permissions",
+			Path:     d.relPath(path),
+			Message:  fmt.Sprintf("mode %v lacks owner %v; writes under it fail", mode, need),
+			Fix:      fmt.Sprintf("chmod to %v", mode|need),
+		}, func() error {
+			return os.Chmod(path, mode|need)
+		})
+	}
+}
+
+// checkLeftovers reports the files and directories that Init with ReconcileOnInit would remove
+func (d *doctor) checkLeftovers() {
+	spools, _ := filepath.Glob(filepath.Join(d.baseDir, ".spool-*"))
+	for _, path := range spools {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleSpoolAge {
+			d.report(Finding{
+				Severity: SeverityWarning,
+				Check:    "leftover",
+				Path:     d.relPath(path),
+				Message:  fmt.Sprintf("SetFromReader spool file left by a crashed process (%d bytes)", info.Size()),
+				Fix:      "remove the file",
+			}, func() error {
+				return os.Remove(path)
+			})
+		}
+	}
+
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		journals, _ := filepath.Glob(filepath.Join(d.baseDir, "*", "*", "*.db"+suffix))
+		for _, path := range journals {
+			if _, err := os.Stat(strings.TrimSuffix(path, suffix)); !os.IsNotExist(err) {
+				continue
+			}
+			d.report(Finding{
+				Severity: SeverityWarning,
+				Check:    "leftover",
+				Path:     d.relPath(path),
+				Message:  "journal file without its DB file",
+				Fix:      "remove the file",
+			}, func() error {
+				return os.Remove(path)
+			})
+		}
+	}
+
+	// テナントのディレクトリを消してから、空になったテーブルのディレクトリを調べる
+	for _, pattern := range []string{filepath.Join("*", "*"), "*"} {
+		dirs, _ := filepath.Glob(filepath.Join(d.baseDir, pattern))
+		for _, dir := range dirs {
+			if entries, err := os.ReadDir(dir); err != nil || len(entries) > 0 {
+				continue
+			}
+			d.report(Finding{
+				Severity: SeverityInfo,
+				Check:    "leftover",
+				Path:     d.relPath(dir),
+				Message:  "empty directory",
+				Fix:      "remove the directory",
+			}, func() error {
+				return os.Remove(dir)
+			})
+		}
+	}
+}
+
+// checkIntegrity runs integrity_check and reports whether the DB file can be examined further
+func (d *doctor) checkIntegrity(dbPath string) bool {
+	db := openReadOnlyDB(dbPath)
+	err := integrityCheck(db)
+	db.Close()
+	if err == nil {
+		return true
+	}
+
+	if !errors.Is(err, ErrCorrupt) && !isCorruptError(err) {
+		d.report(Finding{
+			Severity: SeverityError,
+			Check:    "integrity",
+			Path:     d.relPath(dbPath),
+			Message:  err.Error(),
+		}, nil)
+		return false
+	}
+	// RepairRecreateと同じく削除し、最初の利用で空のDBを作り直させる
+	d.report(Finding{
+		Severity: SeverityError,
+		Check:    "integrity",
+		Path:     d.relPath(dbPath),
+		Message:  err.Error(),
+		Fix:      "remove the DB file; it is recreated empty on first use",
+	}, func() error {
+		return removeDBFiles(dbPath)
+	})
+	return false
+}
+
+// checkSchema compares the DB with the schema createTables makes. Older files are upgraded when the
+// cache opens them, so drift is reported as a warning with the same upgrade as the fix.
+func (d *doctor) checkSchema(dbPath string) {
+	db := openReadOnlyDB(dbPath)
+	missing, unknown, err := schemaDrift(db)
+	db.Close()
+	if err != nil {
+		d.report(Finding{Severity: SeverityError, Check: "schema", Path: d.relPath(dbPath), Message: err.Error()}, nil)
+		return
+	}
+
+	if len(unknown) > 0 {
+		d.report(Finding{
+			Severity: SeverityInfo,
+			Check:    "schema",
+			Path:     d.relPath(dbPath),
+			Message:  fmt.Sprintf("columns not known to this version: %s (written by a newer version?)", strings.Join(unknown, ", ")),
+		}, nil)
+	}
+	if len(missing) == 0 {
+		return
+	}
+	d.report(Finding{
+		Severity: SeverityWarning,
+		Check:    "schema",
+		Path:     d.relPath(dbPath),
+		Message:  fmt.Sprintf("schema is older than this version, missing %s; it is upgraded when the cache opens it", strings.Join(missing, ", ")),
+		Fix:      "upgrade the schema now",
+	}, func() error {
+		// 設定のないマネージャで、オープン時と同じ移行を行う
+		var cm CacheManager
+		db := cm.openSQLite(dbPath, cm.pragmas())
+		defer db.Close()
+		return cm.createTables(db)
+	})
+}
+
+// schemaDrift returns what createTables would add to the DB, and the cache columns it does not know
+func schemaDrift(db *sql.DB) ([]string, []string, error) {
+	var missing, unknown []string
+	objects := make(map[string]bool)
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type IN ('table', 'index', 'trigger')")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, nil, fmt.Errorf("failed to read schema: %w", err)
+		}
+		objects[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	if len(objects) > 0 && !objects["cache"] {
+		return nil, nil, fmt.Errorf("not a cache DB: no cache table; move the file out of the cache directory")
+	}
+
+	for _, name := range []string{"cache", "cache_chunks", "cache_tags", "idx_priority_last_accessed", "idx_bind_unique",
+		"idx_cache_tags_entry", "cache_chunks_delete", "cache_chunks_update", "cache_tags_delete"} {
+		if !objects[name] {
+			missing = append(missing, name)
+		}
+	}
+	if objects["cache"] {
+		columns := make(map[string]bool)
+		rows, err := db.Query("SELECT name FROM pragma_table_info('cache')")
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read table info: %w", err)
+		}
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return nil, nil, fmt.Errorf("failed to read table info: %w", err)
+			}
+			columns[name] = true
+		}
+		rows.Close()
+
+		known := make(map[string]bool)
+		expected := append([]string(nil), cacheSchemaColumns...)
+		for _, col := range cacheColumns {
+			expected = append(expected, col.name)
+		}
+		for _, name := range expected {
+			known[name] = true
+			if !columns[name] {
+				missing = append(missing, "column "+name)
+			}
+		}
+		for name := range columns {
+			if !known[name] {
+				unknown = append(unknown, name)
+			}
+		}
+		sort.Strings(unknown)
+	}
+
+	var autoVacuum int
+	if err := db.QueryRow("PRAGMA auto_vacuum").Scan(&autoVacuum); err != nil {
+		return nil, nil, fmt.Errorf("failed to read auto_vacuum: %w", err)
+	}
+	if autoVacuum != 2 {
+		missing = append(missing, "auto_vacuum=incremental")
+	}
+	return missing, unknown, nil
+}
+
+// checkStaleFreshness reports the freshness files beyond RetainFreshness next to the current one, most
+// recently modified. The cache removes them only when the tenant is written with the new freshness.
+func (d *doctor) checkStaleFreshness() {
+	all, err := InspectTree(d.baseDir)
+	if err != nil {
+		return
+	}
+	// 壊れたDBはintegrityで報告済みなので、現在のものとして扱わない
+	var infos []DBFileInfo
+	for _, info := range all {
+		if info.Error == "" {
+			infos = append(infos, info)
+		}
+	}
+	for start := 0; start < len(infos); {
+		end := start + 1
+		for end < len(infos) && infos[end].Table == infos[start].Table && infos[end].TenantID == infos[start].TenantID {
+			end++
+		}
+		// InspectTreeはテナントごとに新しいものから並べるので、先頭が現在のフレッシュネス
+		if stale := infos[min(start+1+d.options.RetainFreshness, end):end]; len(stale) > 0 {
+			names := make([]string, len(stale))
+			var size int64
+			for i, info := range stale {
+				names[i] = info.Freshness
+				size += info.FileBytes
+			}
+			d.report(Finding{
+				Severity: SeverityWarning,
+				Check:    "stale_freshness",
+				Path:     filepath.Join(infos[start].Table, infos[start].TenantID),
+				Message: fmt.Sprintf("%d old freshness files (%s, %d bytes) next to the current %s",
+					len(stale), strings.Join(names, ", "), size, infos[start].Freshness),
+				Fix: "remove the old freshness files",
+			}, func() error {
+				for _, info := range stale {
+					if err := removeDBFiles(info.Path); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+		}
+		start = end
+	}
+}
@@ -0,0 +1,40 @@
+//go:build cgo && !purego && !wasip1
+
+package cache
+
+import (
+	"database/sql/driver"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteFileLocking reports whether connections to the same file can be used at the same time
+const sqliteFileLocking = true
+
+// newSQLiteDriver returns the mattn/go-sqlite3 (cgo) driver that runs pragmas on every new connection
+func newSQLiteDriver(pragmas []string) driver.Driver {
+	return &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			return runPragmas(pragmas, func(pragma string) error {
+				_, err := conn.Exec(pragma, nil)
+				return err
+			})
+		},
+	}
+}
+
+// sqliteDSN returns the DSN the driver opens for dsn
+func sqliteDSN(dsn string) string {
+	return dsn
+}
+
+// sqliteBusyCode reports whether err has the code SQLITE_BUSY or SQLITE_LOCKED. ok is false when
+// err has no SQLite error code.
+func sqliteBusyCode(err error) (busy bool, ok bool) {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false, false
+	}
+	return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked, true
+}
@@ -0,0 +1,56 @@
+//go:build !cgo || purego || wasip1
+
+package cache
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/ncruces/go-sqlite3"
+	sqlitedriver "github.com/ncruces/go-sqlite3/driver"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/ncruces/go-sqlite3/vfs"
+)
+
+// purego・wasip1のビルドでは、cgoを使わないgithub.com/ncruces/go-sqlite3 (wazeroで動かすSQLite) を使う。
+// wasip1のようにファイルロックのない環境では、DSNにnolock=1を付け、DBファイルごとに接続を1つに限る
+// (ロックなしで複数の接続から書き込むとファイルが壊れる)。incremental blob I/Oは使わない。
+
+// sqliteFileLocking reports whether connections to the same file can be used at the same time
+const sqliteFileLocking = vfs.SupportsFileLocking
+
+// newSQLiteDriver returns the pure Go driver that runs pragmas on every new connection
+func newSQLiteDriver(pragmas []string) driver.Driver {
+	return &sqlitedriver.SQLite{
+		Init: func(conn *sqlite3.Conn) error {
+			return runPragmas(pragmas, conn.Exec)
+		},
+	}
+}
+
+// sqliteDSN returns the DSN the driver opens for dsn, a file path or a file: URI
+func sqliteDSN(dsn string) string {
+	if sqliteFileLocking {
+		return dsn
+	}
+	if strings.HasPrefix(dsn, "file:") {
+		if strings.Contains(dsn, "?") {
+			return dsn + "&nolock=1"
+		}
+		return dsn + "?nolock=1"
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(dsn), RawQuery: "nolock=1"}).String()
+}
+
+// sqliteBusyCode reports whether err has the code SQLITE_BUSY or SQLITE_LOCKED. ok is false when
+// err has no SQLite error code.
+func sqliteBusyCode(err error) (busy bool, ok bool) {
+	var sqliteErr *sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false, false
+	}
+	return sqliteErr.Code() == sqlite3.BUSY || sqliteErr.Code() == sqlite3.LOCKED, true
+}
@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// loadEncryptionKey resolves the key from the config: EncryptionKey, then EncryptionKeyFunc,
+// then the base64 encoded environment variable named by EncryptionKeyEnv. It returns nil when
+// encryption is not configured.
+func loadEncryptionKey(config CacheConfig) ([]byte, error) {
+	switch {
+	case len(config.EncryptionKey) > 0:
+		return config.EncryptionKey, nil
+	case config.EncryptionKeyFunc != nil:
+		key, err := config.EncryptionKeyFunc()
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch encryption key: %w", err)
+		}
+		return key, nil
+	case config.EncryptionKeyEnv != "":
+		encoded := os.Getenv(config.EncryptionKeyEnv)
+		if encoded == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", config.EncryptionKeyEnv)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode encryption key from %s: %w", config.EncryptionKeyEnv, err)
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// newAEAD returns AES-GCM for a 16, 24 or 32 byte key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize AES-GCM: %w", err)
+	}
+	return aead, nil
+}
+
+// entryAAD returns the additional data that binds a ciphertext to the table, tenant and bind of its
+// entry, so that content copied to another row or DB file fails to decrypt
+func entryAAD(table, tenantID string, bind string) []byte {
+	aad := make([]byte, 0, 12+len(table)+len(tenantID)+len(bind))
+	// 長さを前に付けて、区切りの位置が違う組み合わせと同じにならないようにする
+	for _, s := range []string{table, tenantID, bind} {
+		aad = binary.BigEndian.AppendUint32(aad, uint32(len(s)))
+		aad = append(aad, s...)
+	}
+	return aad
+}
+
+// encrypt returns nonce || ciphertext, authenticated together with aad
+func (cm *CacheManager) encrypt(plain []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, cm.aead.NonceSize(), cm.aead.NonceSize()+len(plain)+cm.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return cm.aead.Seal(nonce, nonce, plain, aad), nil
+}
+
+// decrypt reverses encrypt. aad must be the one the content was encrypted with, nil for entries
+// written before flagBoundAAD.
+func (cm *CacheManager) decrypt(stored []byte, aad []byte) ([]byte, error) {
+	if cm.aead == nil {
+		return nil, fmt.Errorf("entry is encrypted but no encryption key is configured")
+	}
+	nonceSize := cm.aead.NonceSize()
+	if len(stored) < nonceSize {
+		return nil, fmt.Errorf("failed to decrypt content: ciphertext too short")
+	}
+	plain, err := cm.aead.Open(nil, stored[:nonceSize], stored[nonceSize:], aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt content: %w", err)
+	}
+	return plain, nil
+}
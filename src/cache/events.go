@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"database/sql"
+	"sync/atomic"
+)
+
+// EventEntry describes an entry removed by eviction or expiry
+type EventEntry struct {
+	Table     string
+	TenantID  string
+	Freshness string
+	Key       string
+	Size      int64 // 保存しているcontentのバイト数
+}
+
+// Events receives notifications about entries and DB files that the manager removes or gives up on.
+// Each notification is delivered in its own goroutine after the tenant lock is released, so the
+// methods may call back into the manager, e.g. to repopulate critical keys.
+type Events interface {
+	// OnEvict is called with the entries removed because their DB exceeded its size limit
+	OnEvict(entries []EventEntry)
+	// OnExpire is called with expired entries when they are deleted by Get or the sweeper
+	OnExpire(entries []EventEntry)
+	// OnDiskFull is called when a write fails for lack of space and the manager becomes read-only
+	OnDiskFull(table, tenantID string, freshness string, err error)
+	// OnCorruption is called when a DB file is found to be corrupt
+	OnCorruption(table, tenantID string, freshness string, err error)
+}
+
+// NopEvents implements Events with methods that do nothing. Embed it to handle only some events.
+type NopEvents struct{}
+
+func (NopEvents) OnEvict([]EventEntry)                       {}
+func (NopEvents) OnExpire([]EventEntry)                      {}
+func (NopEvents) OnDiskFull(string, string, string, error)   {}
+func (NopEvents) OnCorruption(string, string, string, error) {}
+
+// eventsHolder lets Events be replaced while operations are running
+type eventsHolder struct {
+	events atomic.Pointer[Events]
+}
+
+func (h *eventsHolder) set(events Events) {
+	if events == nil {
+		h.events.Store(nil)
+		return
+	}
+	h.events.Store(&events)
+}
+
+// get returns the current Events, or nil if none is set
+func (h *eventsHolder) get() Events {
+	if p := h.events.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// SetEvents replaces the Events receiving notifications. nil stops the notifications.
+func (cm *CacheManager) SetEvents(events Events) {
+	cm.events.set(events)
+}
+
+func (cm *CacheManager) notifyEvict(entries []EventEntry) {
+	cm.publishEntries(MutationEvict, entries)
+	if events := cm.events.get(); events != nil && len(entries) > 0 {
+		go events.OnEvict(entries)
+	}
+}
+
+func (cm *CacheManager) notifyExpire(entries []EventEntry) {
+	cm.publishEntries(MutationExpire, entries)
+	if events := cm.events.get(); events != nil && len(entries) > 0 {
+		go events.OnExpire(entries)
+	}
+}
+
+func (cm *CacheManager) notifyDiskFull(table, tenantID string, freshness string, err error) {
+	if events := cm.events.get(); events != nil {
+		go events.OnDiskFull(table, tenantID, freshness, err)
+	}
+}
+
+func (cm *CacheManager) notifyCorruption(table, tenantID string, freshness string, err error) {
+	if events := cm.events.get(); events != nil {
+		go events.OnCorruption(table, tenantID, freshness, err)
+	}
+}
+
+// scanEventEntries reads the (bind, size) rows returned by a DELETE of the DB (table, tenantID, freshness)
+// and closes rows
+func scanEventEntries(rows *sql.Rows, table, tenantID string, freshness string) ([]EventEntry, error) {
+	defer rows.Close()
+
+	var entries []EventEntry
+	for rows.Next() {
+		entry := EventEntry{Table: table, TenantID: tenantID, Freshness: freshness}
+		if err := rows.Scan(&entry.Key, &entry.Size); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,302 @@
+package cache
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// EvictionPolicy chooses which entries to remove when a DB exceeds its size limit
+type EvictionPolicy interface {
+	// SelectVictims returns the ids of entries whose sizes add up to at least targetBytes.
+	// The built-in policies choose entries of lower priority first and never pinned ones;
+	// pinned entries returned by other policies are not deleted.
+	SelectVictims(db *sql.DB, targetBytes int64) ([]int64, error)
+}
+
+// LRUPolicy evicts the least recently accessed entries first
+type LRUPolicy struct{}
+
+func (LRUPolicy) SelectVictims(db *sql.DB, targetBytes int64) ([]int64, error) {
+	return selectVictimsInOrder(db, "last_accessed ASC, id ASC", targetBytes)
+}
+
+// LFUPolicy evicts the least frequently read entries first, oldest access breaking ties.
+// hits is incremented by every Get and reset when the entry is overwritten, so a one-off
+// sequential read does not push out entries that are read again and again.
+type LFUPolicy struct {
+	// 0より大きければ、最後のアクセスからこの時間が経つごとにhitsを1ずつ減らして比べる。
+	// 以前よく読まれたが今は読まれないエントリが残り続けないようにする
+	DecayPeriod time.Duration
+}
+
+func (p LFUPolicy) SelectVictims(db *sql.DB, targetBytes int64) ([]int64, error) {
+	period := int64(p.DecayPeriod / time.Second)
+	if period <= 0 {
+		return selectVictimsInOrder(db, "hits ASC, last_accessed ASC, id ASC", targetBytes)
+	}
+	return selectVictimsInOrder(db, "max(hits - (? - CAST(last_accessed AS INTEGER)) / ?, 0) ASC, last_accessed ASC, id ASC",
+		targetBytes, time.Now().Unix(), period)
+}
+
+// SampledLRUPolicy approximates LRU the way Redis does: instead of ordering the whole table it reads
+// SampleSize random entries at a time and evicts the least recently accessed quarter of each sample.
+// On DBs with millions of entries this touches only the victims and their samples, at the cost of
+// sometimes evicting an entry that is not quite the oldest.
+type SampledLRUPolicy struct {
+	SampleSize int // 1回に調べるエントリの数 (0なら16)
+}
+
+// sampledLRUMinSpan is the id range, in samples, below which SampledLRUPolicy orders the whole table
+const sampledLRUMinSpan = 64
+
+type evictionCandidate struct {
+	id, size, lastAccessed int64
+	priority               Priority
+}
+
+func (p SampledLRUPolicy) SelectVictims(db *sql.DB, targetBytes int64) ([]int64, error) {
+	if targetBytes <= 0 {
+		return nil, nil
+	}
+	sampleSize := p.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = 16
+	}
+
+	var minID, maxID sql.NullInt64
+	if err := db.QueryRow("SELECT min(id), max(id) FROM cache").Scan(&minID, &maxID); err != nil {
+		return nil, fmt.Errorf("failed to select eviction victims: %w", err)
+	}
+	if !minID.Valid {
+		return nil, nil
+	}
+	span := maxID.Int64 - minID.Int64 + 1
+	// 小さいDBでは全体を並べても安いので、正確なLRUで選ぶ
+	if span < int64(sampleSize)*sampledLRUMinSpan {
+		return LRUPolicy{}.SelectVictims(db, targetBytes)
+	}
+
+	// idは削除で飛び飛びになるので、乱数のid以上で最初のエントリを標本にする
+	stmt, err := db.Prepare("SELECT id, size, CAST(last_accessed AS INTEGER), priority FROM cache WHERE id >= ? AND priority < ? ORDER BY id LIMIT 1")
+	if err != nil {
+		return nil, fmt.Errorf("failed to select eviction victims: %w", err)
+	}
+	defer stmt.Close()
+
+	chosen := make(map[int64]bool)
+	var victims []int64
+	var selected int64
+	// 選び済みのエントリしか引けない回が続いたら、残りは正確なLRUで選ぶ
+	for idle := 0; selected < targetBytes && idle < 3; {
+		sample := make([]evictionCandidate, 0, sampleSize)
+		for i := 0; i < sampleSize; i++ {
+			var c evictionCandidate
+			err := stmt.QueryRow(minID.Int64+rand.Int63n(span), PriorityPin).Scan(&c.id, &c.size, &c.lastAccessed, &c.priority)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to select eviction victims: %w", err)
+			}
+			if !chosen[c.id] {
+				chosen[c.id] = true
+				sample = append(sample, c)
+			}
+		}
+		if len(sample) == 0 {
+			idle++
+			continue
+		}
+		idle = 0
+
+		sort.Slice(sample, func(i, j int) bool {
+			if sample[i].priority != sample[j].priority {
+				return sample[i].priority < sample[j].priority
+			}
+			if sample[i].lastAccessed != sample[j].lastAccessed {
+				return sample[i].lastAccessed < sample[j].lastAccessed
+			}
+			return sample[i].id < sample[j].id
+		})
+		// 選ばなかったエントリは次の標本で引けるように戻す
+		picked := max(len(sample)/4, 1)
+		for i, c := range sample {
+			if i < picked && selected < targetBytes {
+				victims = append(victims, c.id)
+				selected += c.size
+			} else {
+				delete(chosen, c.id)
+			}
+		}
+	}
+	if selected >= targetBytes {
+		return victims, nil
+	}
+
+	rows, err := db.Query("SELECT id, size FROM cache WHERE priority < ? ORDER BY priority ASC, last_accessed ASC, id ASC", PriorityPin)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select eviction victims: %w", err)
+	}
+	defer rows.Close()
+	for selected < targetBytes && rows.Next() {
+		var id, size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			return nil, fmt.Errorf("failed to select eviction victims: %w", err)
+		}
+		if !chosen[id] {
+			victims = append(victims, id)
+			selected += size
+		}
+	}
+	return victims, rows.Err()
+}
+
+// FIFOPolicy evicts the oldest written entries first regardless of reads
+type FIFOPolicy struct{}
+
+func (FIFOPolicy) SelectVictims(db *sql.DB, targetBytes int64) ([]int64, error) {
+	return selectVictimsInOrder(db, "updated_at ASC, id ASC", targetBytes)
+}
+
+// EvictionPolicyByName returns the built-in policy for "lru", "sampled-lru", "lfu" or "fifo"
+// (LFU without decay; set LFUPolicy.DecayPeriod for aging)
+func EvictionPolicyByName(name string) (EvictionPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "lru":
+		return LRUPolicy{}, nil
+	case "sampled-lru":
+		return SampledLRUPolicy{}, nil
+	case "lfu":
+		return LFUPolicy{}, nil
+	case "fifo":
+		return FIFOPolicy{}, nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// selectVictimsInOrder walks the entries that are not pinned, lower priorities first and each
+// priority in the given order, until their sizes reach targetBytes
+func selectVictimsInOrder(db *sql.DB, orderBy string, targetBytes int64, args ...interface{}) ([]int64, error) {
+	if targetBytes <= 0 {
+		return nil, nil
+	}
+
+	// LRUではidx_priority_last_accessedを順にたどるだけで済む
+	args = append([]interface{}{PriorityPin}, args...)
+	rows, err := db.Query("SELECT id, size FROM cache WHERE priority < ? ORDER BY priority ASC, "+orderBy, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select eviction victims: %w", err)
+	}
+	defer rows.Close()
+
+	var victims []int64
+	var selected int64
+	for selected < targetBytes && rows.Next() {
+		var id, size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			return nil, fmt.Errorf("failed to select eviction victims: %w", err)
+		}
+		victims = append(victims, id)
+		selected += size
+	}
+	return victims, rows.Err()
+}
+
+// evictionPolicy returns the policy of the table, falling back to CacheConfig.EvictionPolicy and then LRU
+func (cm *CacheManager) evictionPolicy(table string) EvictionPolicy {
+	if policy, ok := cm.config.TableEvictionPolicies[table]; ok && policy != nil {
+		return policy
+	}
+	if cm.config.EvictionPolicy != nil {
+		return cm.config.EvictionPolicy
+	}
+	return LRUPolicy{}
+}
+
+// evict removes entries chosen by the eviction policy until at least targetBytes are freed
+func (cm *CacheManager) evict(table, tenantID string, freshness string, db *sql.DB, targetBytes int64) error {
+	if targetBytes <= 0 {
+		return nil
+	}
+	// 読み取り専用の接続で読んだアクセスをlast_accessedに反映してから選ぶ
+	cm.flushAccesses(cm.getDBKey(table, tenantID, freshness), db)
+
+	victims, err := cm.evictionPolicy(table).SelectVictims(db, targetBytes)
+	if err != nil {
+		return err
+	}
+	if len(victims) == 0 {
+		return nil
+	}
+
+	removed, err := deleteByIDs(db, victims)
+	if err != nil {
+		return fmt.Errorf("failed to delete old entries: %w", err)
+	}
+	var evicted, evictedBytes int64
+	for i := range removed {
+		removed[i].Table, removed[i].TenantID, removed[i].Freshness = table, tenantID, freshness
+		evicted++
+		evictedBytes += removed[i].Size
+	}
+	cm.sizes.forget(db)
+	cm.metrics.recordEviction(table, tenantID, evicted, evictedBytes)
+	cm.counters.recordEviction(cm.getDBKey(table, tenantID, freshness))
+	cm.notifyEvict(removed)
+	cm.logger().Debug("sqlite-cache: evicted entries", "table", table, "tenant", tenantID, "freshness", freshness,
+		"entries", evicted, "bytes", evictedBytes)
+
+	// 空いたページはフリーリストに入って次の書き込みで再利用される。
+	// ファイルの縮小はvacuumSchedulerのincremental_vacuumに任せる
+	return nil
+}
+
+// deleteByIDs deletes the rows that are not pinned and returns the binds and content sizes of the removed entries
+func deleteByIDs(db *sql.DB, ids []int64) ([]EventEntry, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	removed := make([]EventEntry, 0, len(ids))
+	for start := 0; start < len(ids); start += mgetChunkSize {
+		end := start + mgetChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := ids[start:end]
+
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		// 独自のポリシーが選んでも固定したエントリは削除しない
+		query := fmt.Sprintf("DELETE FROM cache WHERE id IN (%s) AND priority < %d RETURNING "+listedBind+", size", placeholders(len(chunk)), PriorityPin)
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var entry EventEntry
+			if err := rows.Scan(&entry.Key, &entry.Size); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			removed = append(removed, entry)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
@@ -0,0 +1,160 @@
+package cache
+
+import (
+	"container/list"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// openHandle is an open DB tracked in the manager's LRU list of handles
+type openHandle struct {
+	key      string
+	table    string
+	tenantID string
+	db       *sql.DB
+	reader   *sql.DB // 読み取り専用の接続。ReadConnectionsが0ならnil
+	elem     *list.Element
+}
+
+// lookupDB returns an already open handle and marks it as recently used
+func (cm *CacheManager) lookupDB(key string) (*sql.DB, bool) {
+	cm.dbsMu.Lock()
+	defer cm.dbsMu.Unlock()
+
+	h, exists := cm.dbs[key]
+	if !exists {
+		return nil, false
+	}
+	cm.dbLRU.MoveToFront(h.elem)
+	return h.db, true
+}
+
+// lookupReader returns the read-only connections of an open handle, or nil if it has none
+func (cm *CacheManager) lookupReader(key string) *sql.DB {
+	cm.dbsMu.Lock()
+	defer cm.dbsMu.Unlock()
+
+	if h, exists := cm.dbs[key]; exists {
+		return h.reader
+	}
+	return nil
+}
+
+// isOpen reports whether the handle for key is open, without marking it as used
+func (cm *CacheManager) isOpen(key string) bool {
+	cm.dbsMu.Lock()
+	defer cm.dbsMu.Unlock()
+	_, exists := cm.dbs[key]
+	return exists
+}
+
+// registerDB adds a newly opened handle. If another caller registered the same key first,
+// db and reader are closed and the existing handle is returned.
+func (cm *CacheManager) registerDB(key, table, tenantID string, db, reader *sql.DB) *sql.DB {
+	cm.dbsMu.Lock()
+	defer cm.dbsMu.Unlock()
+
+	if h, exists := cm.dbs[key]; exists {
+		db.Close()
+		if reader != nil {
+			reader.Close()
+		}
+		cm.dbLRU.MoveToFront(h.elem)
+		return h.db
+	}
+
+	h := &openHandle{key: key, table: table, tenantID: tenantID, db: db, reader: reader}
+	h.elem = cm.dbLRU.PushFront(h)
+	cm.dbs[key] = h
+
+	cm.evictOpenHandles()
+	return db
+}
+
+// evictOpenHandles closes least recently used handles while more than MaxOpenDBs are open.
+// Handles whose tenant lock is currently held are in use and skipped. Caller must hold cm.dbsMu.
+func (cm *CacheManager) evictOpenHandles() {
+	if cm.config.MaxOpenDBs <= 0 {
+		return
+	}
+
+	elem := cm.dbLRU.Back()
+	for len(cm.dbs) > cm.config.MaxOpenDBs && elem != nil {
+		prev := elem.Prev()
+		h := elem.Value.(*openHandle)
+
+		lock := cm.tenantLocks.get(h.table, h.tenantID)
+		if lock.TryLock() {
+			cm.closeHandle(h)
+			cm.dbLRU.Remove(elem)
+			delete(cm.dbs, h.key)
+			lock.Unlock()
+		}
+		elem = prev
+	}
+}
+
+// closeDB closes and forgets the handle for key if it is open
+func (cm *CacheManager) closeDB(key string) {
+	cm.dbsMu.Lock()
+	defer cm.dbsMu.Unlock()
+
+	if h, exists := cm.dbs[key]; exists {
+		cm.closeHandle(h)
+		cm.dbLRU.Remove(h.elem)
+		delete(cm.dbs, key)
+	}
+}
+
+// closeDBsWithPrefix closes all handles whose key starts with prefix
+func (cm *CacheManager) closeDBsWithPrefix(prefix string) {
+	cm.dbsMu.Lock()
+	defer cm.dbsMu.Unlock()
+
+	for key, h := range cm.dbs {
+		if strings.HasPrefix(key, prefix) {
+			cm.closeHandle(h)
+			cm.dbLRU.Remove(h.elem)
+			delete(cm.dbs, key)
+		}
+	}
+}
+
+// closeAllDBs closes every open handle. In WAL mode the WAL is checkpointed into the DB file first.
+func (cm *CacheManager) closeAllDBs() error {
+	cm.dbsMu.Lock()
+	defer cm.dbsMu.Unlock()
+
+	wal := strings.EqualFold(cm.config.JournalMode, "WAL")
+	var firstErr error
+	for _, h := range cm.dbs {
+		// チェックポイントの後に書き込まないよう、溜まったアクセスを先に書き込む
+		cm.flushAccesses(h.key, h.db)
+		if wal {
+			if _, err := h.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("failed to checkpoint WAL: %w", err)
+			}
+		}
+		if err := cm.closeHandle(h); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	cm.dbs = make(map[string]*openHandle)
+	cm.dbLRU.Init()
+	return firstErr
+}
+
+// closeHandle writes the pending accesses of h and closes its statements and connections.
+// It does not remove h from cm.dbs.
+func (cm *CacheManager) closeHandle(h *openHandle) error {
+	// 読み取り専用の接続やHotCacheSizeのメモリから返したGetのアクセスを書き込む
+	cm.flushAccesses(h.key, h.db)
+	if h.reader != nil {
+		cm.stmts.forget(h.reader)
+		h.reader.Close()
+	}
+	cm.stmts.forget(h.db)
+	cm.sizes.forget(h.db)
+	return h.db.Close()
+}
@@ -0,0 +1,57 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// HashBindsOverを指定すると、それより長いbindは先頭の(HashBindsOver-64)バイトに'#'とbind全体の
+// SHA-256を続けたキーとしてbindカラムに保存し、元のbindはlong_bindに保存する。
+// キーはHashBindsOver+1バイトになり、ハッシュしないbind (HashBindsOverバイト以下) とは衝突しない。
+// 先頭を残すので、プレフィックスの検索も先頭の範囲はインデックスで絞れる。
+// 一覧・イベント・変更フィードには元のbindを返す。
+
+// minHashBindsOver is the smallest HashBindsOver, leaving some of the bind before the hash
+const minHashBindsOver = 128
+
+// listedBind is the SQL expression of the bind as given by the caller, for listing
+const listedBind = "COALESCE(long_bind, bind)"
+
+// storedBind returns the key of bind in the bind column
+func (cm *CacheManager) storedBind(bind string) string {
+	n := cm.config.HashBindsOver
+	if n <= 0 || len(bind) <= n {
+		return bind
+	}
+	sum := sha256.Sum256([]byte(bind))
+	return bind[:n-sha256.Size*2] + "#" + hex.EncodeToString(sum[:])
+}
+
+// longBind returns the value of the long_bind column for bind: the bind itself if it is hashed, and NULL otherwise
+func (cm *CacheManager) longBind(bind string) interface{} {
+	if cm.config.HashBindsOver <= 0 || len(bind) <= cm.config.HashBindsOver {
+		return nil
+	}
+	return bind
+}
+
+// prefixRange returns the condition matching entries whose bind starts with prefix. The range on the
+// bind column uses the index; a prefix longer than the part kept before the hash is checked on the
+// original bind as well.
+func (cm *CacheManager) prefixRange(prefix string) (string, []interface{}) {
+	n := cm.config.HashBindsOver
+	if n <= 0 || len(prefix) <= n-sha256.Size*2 {
+		return bindRange("bind", prefix)
+	}
+	where, args := bindRange("bind", prefix[:n-sha256.Size*2])
+	longWhere, longArgs := bindRange(listedBind, prefix)
+	return where + " AND " + longWhere, append(args, longArgs...)
+}
+
+func validateHashBindsConfig(config CacheConfig) error {
+	if config.HashBindsOver < 0 || (config.HashBindsOver > 0 && config.HashBindsOver < minHashBindsOver) {
+		return fmt.Errorf("hash binds over must be 0 or at least %d bytes, got %d", minHashBindsOver, config.HashBindsOver)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+)
+
+// プローブのDBは.spool-*と同じくBaseDir直下の隠しファイルとして作るので、テーブルと混ざらない。
+// キャッシュと同じPRAGMAで開くので、ジャーナルモードなどの設定で開けない場合も失敗する。
+
+// CheckHealth verifies that BaseDir is writable and that a SQLite DB can be created there, by
+// writing a probe DB under a hidden name and removing it. It does not touch the cache files.
+func (cm *CacheManager) CheckHealth() error {
+	if cm.config.BaseDir == "" {
+		return fmt.Errorf("cache manager not initialized")
+	}
+	f, err := os.CreateTemp(cm.config.BaseDir, ".health-*.db")
+	if err != nil {
+		return fmt.Errorf("base directory is not writable: %w", err)
+	}
+	path := f.Name()
+	f.Close()
+	defer func() {
+		for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+			os.Remove(path + suffix)
+		}
+	}()
+
+	db := cm.openSQLite(path, cm.pragmas())
+	defer db.Close()
+	if _, err := db.Exec("CREATE TABLE probe (x INTEGER); INSERT INTO probe VALUES (1)"); err != nil {
+		return fmt.Errorf("failed to write probe database: %w", err)
+	}
+	return nil
+}
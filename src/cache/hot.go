@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+// hotItem is one content held in memory, keyed by flightKey
+type hotItem struct {
+	key       string
+	content   []byte
+	expiresAt int64 // 0なら期限なし
+}
+
+// hotCache is an in-process LRU of contents bounded by bytes, consulted before SQLite on Get.
+// A nil *hotCache is disabled and all methods are no-ops.
+type hotCache struct {
+	mu       sync.Mutex
+	clock    Clock
+	maxBytes int64
+	bytes    int64
+	lru      *list.List // 先頭が最新
+	items    map[string]*list.Element
+}
+
+func newHotCache(maxBytes int64, clock Clock) *hotCache {
+	return &hotCache{
+		clock:    clock,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns a copy of the content for key if it is held and not expired
+func (h *hotCache) get(key string) ([]byte, bool) {
+	if h == nil {
+		return nil, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	elem, exists := h.items[key]
+	if !exists {
+		return nil, false
+	}
+	item := elem.Value.(*hotItem)
+	if item.expiresAt > 0 && item.expiresAt <= h.clock.Now().Unix() {
+		h.removeElement(elem)
+		return nil, false
+	}
+	h.lru.MoveToFront(elem)
+	// 呼び出し側が書き換えても保持している値が変わらないようにコピーを返す
+	return append([]byte{}, item.content...), true
+}
+
+// put stores a copy of content, evicting the least recently used contents beyond maxBytes.
+// Contents larger than a quarter of maxBytes are not held so that one value cannot flush the rest.
+func (h *hotCache) put(key string, content []byte, expiresAt int64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if elem, exists := h.items[key]; exists {
+		h.removeElement(elem)
+	}
+	if int64(len(content)) > h.maxBytes/4 {
+		return
+	}
+
+	item := &hotItem{key: key, content: append([]byte{}, content...), expiresAt: expiresAt}
+	h.items[key] = h.lru.PushFront(item)
+	h.bytes += int64(len(item.content))
+	for h.bytes > h.maxBytes {
+		h.removeElement(h.lru.Back())
+	}
+}
+
+// remove drops the content for key
+func (h *hotCache) remove(key string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if elem, exists := h.items[key]; exists {
+		h.removeElement(elem)
+	}
+}
+
+// removePrefix drops the contents of all keys starting with prefix
+func (h *hotCache) removePrefix(prefix string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, elem := range h.items {
+		if strings.HasPrefix(key, prefix) {
+			h.removeElement(elem)
+		}
+	}
+}
+
+// removeElement unlinks elem. Caller must hold h.mu.
+func (h *hotCache) removeElement(elem *list.Element) {
+	item := elem.Value.(*hotItem)
+	h.lru.Remove(elem)
+	delete(h.items, item.key)
+	h.bytes -= int64(len(item.content))
+}
+
+// forgetHotDB drops the hot contents of one DB, e.g. when its file is removed
+func (cm *CacheManager) forgetHotDB(table, tenantID string, freshness string) {
+	cm.hot.removePrefix(pathName(table) + "\x00" + pathName(tenantID) + "\x00" + pathName(freshness) + "\x00")
+}
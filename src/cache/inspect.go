@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// InspectTreeは動いているマネージャを必要とせず、DBファイルを読み取り専用で開く。
+// スキーマの移行もしないので、古い形式のファイルもそのまま調べられる。
+
+// DBFileInfo describes one cache DB file found by InspectTree
+type DBFileInfo struct {
+	Table        string    `json:"table"`
+	TenantID     string    `json:"tenant_id"`
+	Freshness    string    `json:"freshness"`
+	Path         string    `json:"path"`
+	FileBytes    int64     `json:"file_bytes"`    // DBファイルとジャーナルの合計
+	FreeBytes    int64     `json:"free_bytes"`    // 削除で空いたままのページ
+	Entries      int64     `json:"entries"`       // 期限切れのものを含む
+	Expired      int64     `json:"expired"`       // 期限切れでまだ削除されていないエントリ
+	ContentBytes int64     `json:"content_bytes"` // 保存しているcontentのバイト数の合計
+	ModTime      time.Time `json:"mod_time"`
+	Error        string    `json:"error,omitempty"` // 読めなかったファイルの理由
+}
+
+// InspectTree reads every cache DB file under baseDir without modifying it and returns them ordered
+// by table, tenant and then freshness, most recently modified (the current one) first.
+// Files that cannot be read are included with Error set.
+func InspectTree(baseDir string) ([]DBFileInfo, error) {
+	if _, err := os.Stat(baseDir); err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(baseDir, "*", "*", "*.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]DBFileInfo, 0, len(paths))
+	for _, dbPath := range paths {
+		table, tenantID, freshness := splitDBPath(dbPath)
+		info := DBFileInfo{Table: table, TenantID: tenantID, Freshness: freshness, Path: dbPath}
+		stat, err := os.Stat(dbPath)
+		if err != nil {
+			continue
+		}
+		info.ModTime = stat.ModTime()
+		info.FileBytes = stat.Size()
+		for _, suffix := range []string{"-wal", "-journal"} {
+			if journal, err := os.Stat(dbPath + suffix); err == nil {
+				info.FileBytes += journal.Size()
+			}
+		}
+		if err := inspectDB(dbPath, &info); err != nil {
+			info.Error = err.Error()
+		}
+		infos = append(infos, info)
+	}
+
+	sort.SliceStable(infos, func(i, j int) bool {
+		a, b := infos[i], infos[j]
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		if a.TenantID != b.TenantID {
+			return a.TenantID < b.TenantID
+		}
+		return a.ModTime.After(b.ModTime)
+	})
+	return infos, nil
+}
+
+// openReadOnlyDB opens the DB file read-only without applying any PRAGMA
+func openReadOnlyDB(dbPath string) *sql.DB {
+	return openSQLiteHandle(readOnlyDSN(dbPath), nil)
+}
+
+func inspectDB(dbPath string, info *DBFileInfo) error {
+	db := openReadOnlyDB(dbPath)
+	defer db.Close()
+
+	var freePages, pageSize int64
+	if err := db.QueryRow("PRAGMA freelist_count").Scan(&freePages); err != nil {
+		return err
+	}
+	if err := db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return err
+	}
+	info.FreeBytes = freePages * pageSize
+
+	query := "SELECT COUNT(*), COALESCE(SUM(size), 0), COUNT(CASE WHEN expires_at <= ? THEN 1 END) FROM cache"
+	err := db.QueryRow(query, time.Now().Unix()).Scan(&info.Entries, &info.ContentBytes, &info.Expired)
+	if err != nil && strings.Contains(err.Error(), "no such column") {
+		// size・expires_atを追加する前の形式のファイル
+		err = db.QueryRow("SELECT COUNT(*), COALESCE(SUM(length(content)), 0) FROM cache").Scan(&info.Entries, &info.ContentBytes)
+	}
+	return err
+}
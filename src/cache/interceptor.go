@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// インターセプターはGet・Set・DeleteEntryを包む関数で、メトリクス・トレース・contentの変換・
+// リクエストの書き換えなどを操作のコードを変えずに差し込むためのもの。先にUseしたものほど外側で呼ばれる。
+// 各インターセプターはOpを書き換えてからnextを呼び、nextが返った後にGetの結果 (Op.Content) を書き換えてもよい。
+// nextを呼ばずに返せば操作は実行されない。アクセスログはインターセプターの外側で、呼び出し側が渡した名前で記録する。
+// MGet・MSet・Append・ストリーミング・ApplyBatch・DeletePrefixなどのまとめて扱う操作は通らない。
+
+// OpKind is the kind of operation passed through the interceptors
+type OpKind string
+
+const (
+	OpGet    OpKind = "get"
+	OpSet    OpKind = "set"
+	OpDelete OpKind = "delete"
+)
+
+// Op is one operation passed through the interceptors. Content is the content to store for OpSet,
+// and is set to the content read by next for OpGet.
+type Op struct {
+	Kind      OpKind
+	Table     string
+	TenantID  string
+	Freshness string
+	Bind      string
+	Content   []byte
+	TTL       time.Duration // OpSetの有効期限 (0以下なら期限なし)
+}
+
+// OpFunc runs an operation
+type OpFunc func(ctx context.Context, op *Op) error
+
+// Interceptor wraps the OpFunc of the next interceptor, or of the operation itself
+type Interceptor func(next OpFunc) OpFunc
+
+// interceptorChain holds the interceptors. Operations read it without locking.
+type interceptorChain struct {
+	mu           sync.Mutex // Useを1つずつ行う
+	interceptors atomic.Pointer[[]Interceptor]
+}
+
+// Use adds interceptors around Get, Set and DeleteEntry and their variants. Interceptors added
+// earlier are called first. They apply to the operations started after Use returns.
+func (cm *CacheManager) Use(interceptors ...Interceptor) {
+	cm.chain.mu.Lock()
+	defer cm.chain.mu.Unlock()
+	var current []Interceptor
+	if p := cm.chain.interceptors.Load(); p != nil {
+		current = *p
+	}
+	// 実行中の操作が読んでいるスライスは変えずに、新しいスライスに置き換える
+	next := make([]Interceptor, 0, len(current)+len(interceptors))
+	next = append(next, current...)
+	for _, interceptor := range interceptors {
+		if interceptor != nil {
+			next = append(next, interceptor)
+		}
+	}
+	cm.chain.interceptors.Store(&next)
+}
+
+// intercept runs final through the interceptors
+func (cm *CacheManager) intercept(ctx context.Context, op *Op, final OpFunc) error {
+	p := cm.chain.interceptors.Load()
+	if p == nil {
+		return final(ctx, op)
+	}
+	run := final
+	for i := len(*p) - 1; i >= 0; i-- {
+		run = (*p)[i](run)
+	}
+	return run(ctx, op)
+}
+
+// interceptGet runs get as an OpGet and returns its entry with the content the interceptors left in the Op.
+// An interceptor that answers without calling next gets an entry with only Key and Content.
+func (cm *CacheManager) interceptGet(ctx context.Context, table, tenantID string, freshness string, bind string, get func(ctx context.Context, op *Op) (*CacheEntry, error)) (*CacheEntry, error) {
+	var entry *CacheEntry
+	op := &Op{Kind: OpGet, Table: table, TenantID: tenantID, Freshness: freshness, Bind: bind}
+	err := cm.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		if entry, err = get(ctx, op); entry != nil {
+			op.Content = entry.Content
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		entry = &CacheEntry{Key: op.Bind}
+	}
+	entry.Content = op.Content
+	return entry, nil
+}
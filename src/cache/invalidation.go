@@ -0,0 +1,148 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// 各ノードが自分のBaseDirを持つ構成で、DeleteEntry・DeleteTenant・RotateをInvalidationBusに流し、
+// 他のノードから届いたものを同じように適用する。受け取った無効化は流し直さないので、ノードの間でループしない。
+// RedisやNATSのクライアントはこのパッケージの依存に含めないので、InvalidationBusを実装して渡す。
+
+// InvalidationBus is the pub/sub channel shared by the nodes, e.g. a Redis pub/sub channel or a NATS subject.
+// Implementations must be safe for concurrent use.
+type InvalidationBus interface {
+	// Publish sends msg to every subscriber, which may include the publishing node itself
+	Publish(ctx context.Context, msg []byte) error
+	// Subscribe calls handle with each message received until ctx is done. It returns when ctx is
+	// done or the subscription fails, in which case the manager subscribes again.
+	Subscribe(ctx context.Context, handle func(msg []byte)) error
+}
+
+// InvalidationOp is the operation carried by an Invalidation
+type InvalidationOp string
+
+const (
+	InvalidateEntry  InvalidationOp = "delete_entry"
+	InvalidateTenant InvalidationOp = "delete_tenant"
+	InvalidateRotate InvalidationOp = "rotate"
+)
+
+// Invalidation is the message published on the InvalidationBus
+type Invalidation struct {
+	Origin    string         `json:"origin"` // 送信したノードのNodeID
+	Op        InvalidationOp `json:"op"`
+	Table     string         `json:"table"`
+	TenantID  string         `json:"tenant_id"`
+	Freshness string         `json:"freshness,omitempty"` // Rotateでは新しいフレッシュネス
+	Bind      string         `json:"bind,omitempty"`
+}
+
+// invalidationRetryDelay is the wait before subscribing again after Subscribe failed
+const invalidationRetryDelay = time.Second
+
+// invalidationListener applies the invalidations received from the bus
+type invalidationListener struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newInvalidationListener(cm *CacheManager, bus InvalidationBus) *invalidationListener {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &invalidationListener{cancel: cancel, done: make(chan struct{})}
+	go l.run(ctx, cm, bus)
+	return l
+}
+
+func (l *invalidationListener) run(ctx context.Context, cm *CacheManager, bus InvalidationBus) {
+	defer close(l.done)
+	for {
+		err := bus.Subscribe(ctx, cm.applyInvalidation)
+		if ctx.Err() != nil {
+			return
+		}
+		cm.logger().Warn("sqlite-cache: invalidation subscription ended", "error", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(invalidationRetryDelay):
+		}
+	}
+}
+
+func (l *invalidationListener) shutdown() {
+	l.cancel()
+	<-l.done
+}
+
+// stopInvalidationListener stops the listener. Like stopEvictionWorker it must be called
+// before taking cm.mutex exclusively.
+func (cm *CacheManager) stopInvalidationListener() {
+	if cm.listener != nil {
+		cm.listener.shutdown()
+	}
+}
+
+// newNodeID returns a random ID for a node without CacheConfig.NodeID
+func newNodeID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// broadcastInvalidation publishes inv to the other nodes. The local operation has already
+// succeeded, so a failure is only logged.
+func (cm *CacheManager) broadcastInvalidation(ctx context.Context, inv Invalidation) {
+	bus := cm.config.InvalidationBus
+	if bus == nil {
+		return
+	}
+	inv.Origin = cm.config.NodeID
+	msg, err := json.Marshal(inv)
+	if err == nil {
+		err = bus.Publish(ctx, msg)
+	}
+	if err != nil {
+		cm.logger().Warn("sqlite-cache: failed to publish invalidation", "op", inv.Op, "table", inv.Table, "tenant", inv.TenantID, "error", err)
+	}
+}
+
+// applyInvalidation applies an invalidation received from another node
+func (cm *CacheManager) applyInvalidation(msg []byte) {
+	var inv Invalidation
+	if err := json.Unmarshal(msg, &inv); err != nil {
+		cm.logger().Warn("sqlite-cache: ignored malformed invalidation", "error", err)
+		return
+	}
+	if inv.Origin == cm.config.NodeID {
+		return
+	}
+	// 他のノードから届いた名前がBaseDirの外を指さないようにする
+	if !isPathElement(inv.Table) || !isPathElement(inv.TenantID) || (inv.Op != InvalidateTenant && !isPathElement(inv.Freshness)) {
+		cm.logger().Warn("sqlite-cache: ignored invalidation with bad names", "table", inv.Table, "tenant", inv.TenantID, "freshness", inv.Freshness)
+		return
+	}
+
+	var err error
+	switch inv.Op {
+	case InvalidateEntry:
+		ctx, cancel := cm.withTimeout(context.Background())
+		err = cm.deleteEntry(ctx, inv.Table, inv.TenantID, inv.Freshness, inv.Bind)
+		cancel()
+	case InvalidateTenant:
+		err = cm.deleteTenant(inv.Table, inv.TenantID)
+	case InvalidateRotate:
+		err = cm.rotate(inv.Table, inv.TenantID, inv.Freshness)
+	default:
+		cm.logger().Warn("sqlite-cache: ignored invalidation with unknown op", "op", inv.Op)
+		return
+	}
+	if err != nil {
+		cm.logger().Warn("sqlite-cache: failed to apply invalidation", "op", inv.Op, "table", inv.Table, "tenant", inv.TenantID, "error", err)
+		return
+	}
+	cm.logger().Debug("sqlite-cache: applied invalidation", "op", inv.Op, "table", inv.Table, "tenant", inv.TenantID, "origin", inv.Origin)
+}
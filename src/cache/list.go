@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// ListTables returns the names of the tables under BaseDir in sorted order
+func (cm *CacheManager) ListTables() ([]string, error) {
+	return cm.listTables()
+}
+
+// ListTenants returns the tenant IDs of the table in sorted order. A table without a directory
+// has no tenants.
+func (cm *CacheManager) ListTenants(table string) ([]string, error) {
+	if err := cm.checkNames(table); err != nil {
+		return nil, err
+	}
+	return listDirs(cm.tableDir(table))
+}
+
+// listDirs returns the names of the directories in dir, skipping hidden ones
+func listDirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		// 一時ファイルなどのファイルは含めない
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sync"
+)
+
+// tenantLockStripes is the number of locks shared by all (table, tenant) pairs
+const tenantLockStripes = 256
+
+// tenantLocks serializes access per tenant so that a slow operation on one tenant
+// (e.g. VACUUM during LRU cleanup) does not block other tenants.
+type tenantLocks [tenantLockStripes]sync.RWMutex
+
+func (l *tenantLocks) get(table, tenantID string) *sync.RWMutex {
+	// ディレクトリから読んだハッシュ済みの名前でも同じロックを取るよう、ディスク上の名前で選ぶ
+	h := fnv.New32a()
+	h.Write([]byte(pathName(table)))
+	h.Write([]byte{0})
+	h.Write([]byte(pathName(tenantID)))
+	return &l[h.Sum32()%tenantLockStripes]
+}
+
+// lockTenant takes the tenant lock exclusively and returns the unlock function.
+// cm.mutex is read-held as well so that table-wide operations and Close wait for it.
+func (cm *CacheManager) lockTenant(table, tenantID string) func() {
+	cm.mutex.RLock()
+	lock := cm.tenantLocks.get(table, tenantID)
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		cm.mutex.RUnlock()
+	}
+}
+
+// rlockTenant takes the tenant lock shared and returns the unlock function
+func (cm *CacheManager) rlockTenant(table, tenantID string) func() {
+	cm.mutex.RLock()
+	lock := cm.tenantLocks.get(table, tenantID)
+	lock.RLock()
+	return func() {
+		lock.RUnlock()
+		cm.mutex.RUnlock()
+	}
+}
+
+// lockTenantContext is lockTenant that gives up when ctx is done
+func (cm *CacheManager) lockTenantContext(ctx context.Context, table, tenantID string) (func(), error) {
+	return lockContext(ctx, func() (func(), bool) { return cm.tryLockTenant(table, tenantID) },
+		func() func() { return cm.lockTenant(table, tenantID) })
+}
+
+// rlockTenantContext is rlockTenant that gives up when ctx is done
+func (cm *CacheManager) rlockTenantContext(ctx context.Context, table, tenantID string) (func(), error) {
+	return lockContext(ctx, func() (func(), bool) { return cm.tryRLockTenant(table, tenantID) },
+		func() func() { return cm.rlockTenant(table, tenantID) })
+}
+
+// lockContext takes a lock with try if it is free, and otherwise waits for lock in another
+// goroutine until ctx is done. A lock acquired after giving up is released right away.
+func lockContext(ctx context.Context, try func() (func(), bool), lock func() func()) (func(), error) {
+	if unlock, ok := try(); ok {
+		return unlock, nil
+	}
+	if ctx.Done() == nil {
+		return lock(), nil
+	}
+
+	acquired := make(chan func(), 1)
+	go func() {
+		acquired <- lock()
+	}()
+	select {
+	case unlock := <-acquired:
+		return unlock, nil
+	case <-ctx.Done():
+		go func() {
+			(<-acquired)()
+		}()
+		return nil, fmt.Errorf("failed to lock tenant: %w", ctx.Err())
+	}
+}
+
+// tryRLockTenant is rlockTenant without waiting. ok is false if either lock is busy.
+func (cm *CacheManager) tryRLockTenant(table, tenantID string) (unlock func(), ok bool) {
+	if !cm.mutex.TryRLock() {
+		return nil, false
+	}
+	lock := cm.tenantLocks.get(table, tenantID)
+	if !lock.TryRLock() {
+		cm.mutex.RUnlock()
+		return nil, false
+	}
+	return func() {
+		lock.RUnlock()
+		cm.mutex.RUnlock()
+	}, true
+}
+
+// tryLockTenant is lockTenant without waiting. ok is false if either lock is busy.
+func (cm *CacheManager) tryLockTenant(table, tenantID string) (unlock func(), ok bool) {
+	if !cm.mutex.TryRLock() {
+		return nil, false
+	}
+	lock := cm.tenantLocks.get(table, tenantID)
+	if !lock.TryLock() {
+		cm.mutex.RUnlock()
+		return nil, false
+	}
+	return func() {
+		lock.Unlock()
+		cm.mutex.RUnlock()
+	}, true
+}
+
+// cleanupIfMissing removes old freshness files when the DB file for freshness does not exist,
+// and reports whether it was missing. The caller must not hold the tenant lock.
+func (cm *CacheManager) cleanupIfMissing(table, tenantID string, freshness string) (bool, error) {
+	dbPath := cm.getDBPath(table, tenantID, freshness)
+	if _, err := os.Stat(dbPath); !os.IsNotExist(err) {
+		return false, nil
+	}
+
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+
+	if err := cm.cleanupOldCacheFiles(table, tenantID, freshness, cm.config.RetainFreshness); err != nil {
+		return true, fmt.Errorf("failed to cleanup old cache files: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,30 @@
+package cache
+
+import (
+	"log/slog"
+	"time"
+)
+
+// ログの出し分け:
+//   Debug: DBのオープン、サイズ超過による削除、期限切れのエントリの削除
+//   Info:  古いフレッシュネスや使われていないDBファイルの削除、起動時の走査の結果
+//   Warn:  壊れたDB、ディスクフル、SlowOperationThresholdを超えた操作
+
+// logger returns the Logger of the config, or slog.Default() if it is nil
+func (cm *CacheManager) logger() *slog.Logger {
+	if cm.config.Logger != nil {
+		return cm.config.Logger
+	}
+	return slog.Default()
+}
+
+// logSlow logs the operation started at start if it took longer than SlowOperationThreshold
+func (cm *CacheManager) logSlow(table, tenantID, op string, start time.Time) {
+	if cm.config.SlowOperationThreshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed > cm.config.SlowOperationThreshold {
+		cm.logger().Warn("sqlite-cache: slow operation",
+			"op", op, "table", table, "tenant", tenantID, "elapsed", elapsed)
+	}
+}
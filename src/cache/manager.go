@@ -1,20 +1,26 @@
 package cache
 
 import (
+	"container/list"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
-
-	_ "github.com/mattn/go-sqlite3"
+	"time"
 )
 
 func NewCacheManager(config CacheConfig) *CacheManager {
-	return &CacheManager{
+	cm := &CacheManager{
 		config: config,
-		dbs:    make(map[string]*sql.DB),
+		dbs:    make(map[string]*openHandle),
+		dbLRU:  list.New(),
 	}
+	cm.events.set(config.Events)
+	return cm
 }
 
 func (cm *CacheManager) Init(baseDir string, maxSize int, cap float64) error {
@@ -24,13 +30,61 @@ func (cm *CacheManager) Init(baseDir string, maxSize int, cap float64) error {
 	if cap < 0 || cap > 0.95 {
 		return fmt.Errorf("cap must be between 0 and 0.95, got %f", cap)
 	}
+	if err := validatePragmaConfig(cm.config); err != nil {
+		return err
+	}
+	if err := validateCompressionConfig(cm.config); err != nil {
+		return err
+	}
+	if err := validateChecksumConfig(cm.config); err != nil {
+		return err
+	}
+	if err := validateWatermarkConfig(cm.config); err != nil {
+		return err
+	}
+	if err := validateHashBindsConfig(cm.config); err != nil {
+		return err
+	}
+	if err := validateQuotaConfig(cm.config); err != nil {
+		return err
+	}
+	if err := validateRepairConfig(cm.config); err != nil {
+		return err
+	}
+	if err := validateBudgetConfig(cm.config); err != nil {
+		return err
+	}
+	if err := validateReaderConfig(cm.config); err != nil {
+		return err
+	}
+	if err := validateRetainConfig(cm.config); err != nil {
+		return err
+	}
+	if err := validateAccessLogConfig(cm.config); err != nil {
+		return err
+	}
+
+	codecs, err := resolveTableCodecs(cm.config)
+	if err != nil {
+		return err
+	}
+	cm.codecs = codecs
 
-	cm.config = CacheConfig{
-		BaseDir: baseDir,
-		MaxSize: maxSize,
-		Cap:     cap,
+	key, err := loadEncryptionKey(cm.config)
+	if err != nil {
+		return err
+	}
+	cm.aead = nil
+	if key != nil {
+		if cm.aead, err = newAEAD(key); err != nil {
+			return err
+		}
 	}
 
+	cm.config.BaseDir = baseDir
+	cm.config.MaxSize = maxSize
+	cm.config.Cap = cap
+
 	// ベースディレクトリを作成
 	if err := os.MkdirAll(baseDir, 0755); err != nil {
 		if isNoSpaceError(err) {
@@ -38,22 +92,96 @@ func (cm *CacheManager) Init(baseDir string, maxSize int, cap float64) error {
 		}
 		return fmt.Errorf("failed to create base directory: %w", err)
 	}
+	if err := cm.createMemoryDir(); err != nil {
+		return err
+	}
+	if cm.config.HydrateOnInit && cm.config.SnapshotStore != nil {
+		cm.hydrate(context.Background())
+	}
+	if cm.budgetEnabled() {
+		cm.usage.load(cm)
+	}
+	cm.hot = nil
+	if cm.config.HotCacheSize > 0 {
+		cm.hot = newHotCache(cm.config.HotCacheSize, cm.clock())
+	}
+	cm.negative = nil
+	if cm.config.NegativeCacheTTL > 0 {
+		cm.negative = newNegativeCache(cm.config.NegativeCacheTTL, cm.clock())
+	}
+	if cm.config.ReconcileOnInit {
+		cm.reconciled = cm.reconcile()
+	}
+
+	// 失敗しうる準備を済ませてからワーカーを起動する (エラーで返したときに動き続けないように)
+	openedAccess := false
+	if cm.access == nil {
+		if cm.access, err = cm.openAccessLog(); err != nil {
+			return err
+		}
+		openedAccess = true
+	}
+
+	if cm.config.Metrics || cm.config.MetricsAddr != "" {
+		cm.metrics = newMetrics()
+	}
+	if cm.config.MetricsAddr != "" && cm.metricsServer == nil {
+		if err := cm.startMetricsServer(cm.config.MetricsAddr); err != nil {
+			if openedAccess {
+				cm.access.close()
+				cm.access = nil
+			}
+			return err
+		}
+	}
+
+	if cm.config.BackgroundEviction && cm.evictor == nil {
+		cm.evictor = newEvictionWorker()
+		go cm.evictor.run(cm)
+	}
+	if cm.config.VacuumInterval >= 0 && cm.vacuumer == nil {
+		cm.vacuumer = newVacuumScheduler(cm.vacuumInterval())
+		go cm.vacuumer.run(cm)
+	}
+	if cm.config.SweepInterval > 0 && cm.sweeper == nil {
+		cm.sweeper = newSweepScheduler(cm.config.SweepInterval)
+		go cm.sweeper.run(cm)
+	}
+	if cm.config.ChangeFeedBuffer > 0 && cm.feed == nil {
+		cm.feed = newChangeFeed(cm.config.ChangeFeedBuffer)
+	}
+	if cm.config.InvalidationBus != nil && cm.listener == nil {
+		if cm.config.NodeID == "" {
+			cm.config.NodeID = newNodeID()
+		}
+		cm.listener = newInvalidationListener(cm, cm.config.InvalidationBus)
+	}
+	if cm.config.SnapshotStore != nil && cm.config.SnapshotInterval > 0 && cm.syncer == nil {
+		cm.syncer = newSnapshotSyncer(cm.config.SnapshotInterval)
+		go cm.syncer.run(cm)
+	}
 
 	return nil
 }
 
 func (cm *CacheManager) getDBPath(table, tenantID string, freshness string) string {
-	return filepath.Join(cm.config.BaseDir, table, tenantID, fmt.Sprintf("%s.db", freshness))
+	return filepath.Join(cm.tenantDir(table, tenantID), fmt.Sprintf("%s.db", pathName(freshness)))
 }
 
+// getDBKey returns the handle key of the DB. It is built from the on-disk names, so names read back
+// from the directory tree (hashed with HashUnsafeNames) refer to the same handle.
 func (cm *CacheManager) getDBKey(table, tenantID string, freshness string) string {
-	return fmt.Sprintf("%s:%s:%s", table, tenantID, freshness)
+	return fmt.Sprintf("%s:%s:%s", pathName(table), pathName(tenantID), pathName(freshness))
 }
 
+// openDB returns the handle for the DB, opening it if needed. The caller must hold the tenant lock.
 func (cm *CacheManager) openDB(table, tenantID string, freshness string) (*sql.DB, error) {
 	dbKey := cm.getDBKey(table, tenantID, freshness)
+	if cm.budgetEnabled() {
+		cm.usage.touch(dbKey)
+	}
 
-	if db, exists := cm.dbs[dbKey]; exists {
+	if db, exists := cm.lookupDB(dbKey); exists {
 		return db, nil
 	}
 
@@ -67,48 +195,62 @@ func (cm *CacheManager) openDB(table, tenantID string, freshness string) (*sql.D
 		return nil, fmt.Errorf("failed to create directory: %w", err)
 	}
 
-	db, err := sql.Open("sqlite3", dbPath)
+	db, err := cm.openSQLiteDB(dbPath)
+	if errors.Is(err, ErrCorrupt) {
+		cm.notifyCorruption(table, tenantID, freshness, err)
+		if cm.config.RepairPolicy == RepairRecreate {
+			return cm.recreateDB(table, tenantID, freshness, err)
+		}
+	}
 	if err != nil {
+		return nil, err
+	}
+
+	cm.logger().Debug("sqlite-cache: opened database", "path", dbPath)
+	// 共有ロックで同時にオープンされた場合は、先に登録されたハンドルを使う
+	return cm.registerDB(dbKey, table, tenantID, db, cm.openReader(db, dbPath)), nil
+}
+
+// openSQLiteDB opens the DB file and creates the tables. With a RepairPolicy other than RepairNone
+// the file is checked first, and ErrCorrupt is returned if it is damaged.
+func (cm *CacheManager) openSQLiteDB(dbPath string) (*sql.DB, error) {
+	// PRAGMA設定は接続ごとに適用される
+	pragmas := cm.pragmas()
+	if cm.isMemoryPath(dbPath) {
+		// メモリ上のファイルは電源断で残らないので、fsyncしない
+		pragmas = append(pragmas, "PRAGMA synchronous = OFF")
+	}
+	db := cm.openSQLite(dbPath, pragmas)
+	// 他のプロセスが作成中のDBでは、接続時のPRAGMAがロックで失敗することがある
+	if err := cm.retryBusy(context.Background(), db.Ping); err != nil {
+		db.Close()
 		if isNoSpaceError(err) {
 			return nil, fmt.Errorf("disk full error while opening database: %w", err)
 		}
+		if cm.config.RepairPolicy != RepairNone && isCorruptError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	// PRAGMA設定を適用
-	if err := cm.configurePragmas(db); err != nil {
-		db.Close()
-		return nil, fmt.Errorf("failed to configure pragmas: %w", err)
+	if cm.config.RepairPolicy != RepairNone {
+		if err := quickCheck(db); err != nil {
+			db.Close()
+			return nil, err
+		}
 	}
 
 	// テーブルを作成
 	if err := cm.createTables(db); err != nil {
 		db.Close()
+		if cm.config.RepairPolicy != RepairNone && isCorruptError(err) {
+			return nil, fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
 		return nil, fmt.Errorf("failed to create tables: %w", err)
 	}
-
-	cm.dbs[dbKey] = db
 	return db, nil
 }
 
-func (cm *CacheManager) configurePragmas(db *sql.DB) error {
-	pragmas := []string{
-		"PRAGMA journal_mode = OFF",
-		"PRAGMA synchronous = NORMAL",
-	}
-
-	for _, pragma := range pragmas {
-		if _, err := db.Exec(pragma); err != nil {
-			if isNoSpaceError(err) {
-				return fmt.Errorf("disk full error during pragma execution '%s': %w", pragma, err)
-			}
-			return fmt.Errorf("failed to execute pragma '%s': %w", pragma, err)
-		}
-	}
-
-	return nil
-}
-
 func (cm *CacheManager) createTables(db *sql.DB) error {
 	query := `
 	CREATE TABLE IF NOT EXISTS cache (
@@ -116,71 +258,291 @@ func (cm *CacheManager) createTables(db *sql.DB) error {
 		bind TEXT NOT NULL,
 		content BLOB NOT NULL,
 		last_accessed TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		expires_at INTEGER,
+		flags INTEGER NOT NULL DEFAULT 0,
+		hits INTEGER NOT NULL DEFAULT 0,
+		size INTEGER NOT NULL DEFAULT 0,
+		version INTEGER NOT NULL DEFAULT 0,
+		metadata TEXT,
+		checksum BLOB,
+		priority INTEGER NOT NULL DEFAULT 0,
+		long_bind TEXT
 	);
-	CREATE INDEX IF NOT EXISTS idx_bind ON cache (bind);
-	CREATE INDEX IF NOT EXISTS idx_last_accessed ON cache (last_accessed);
+	CREATE TABLE IF NOT EXISTS cache_chunks (
+		entry_id INTEGER NOT NULL,
+		chunk_index INTEGER NOT NULL,
+		data BLOB NOT NULL,
+		PRIMARY KEY (entry_id, chunk_index)
+	) WITHOUT ROWID;
+	CREATE TRIGGER IF NOT EXISTS cache_chunks_delete AFTER DELETE ON cache BEGIN
+		DELETE FROM cache_chunks WHERE entry_id = old.id;
+	END;
+	CREATE TRIGGER IF NOT EXISTS cache_chunks_update AFTER UPDATE OF content ON cache BEGIN
+		DELETE FROM cache_chunks WHERE entry_id = old.id;
+	END;
+	CREATE TABLE IF NOT EXISTS cache_tags (
+		tag TEXT NOT NULL,
+		entry_id INTEGER NOT NULL,
+		PRIMARY KEY (tag, entry_id)
+	) WITHOUT ROWID;
+	CREATE INDEX IF NOT EXISTS idx_cache_tags_entry ON cache_tags (entry_id);
+	CREATE TRIGGER IF NOT EXISTS cache_tags_delete AFTER DELETE ON cache BEGIN
+		DELETE FROM cache_tags WHERE entry_id = old.id;
+	END;
 	`
 	_, err := db.Exec(query)
-	if err != nil && isNoSpaceError(err) {
-		return fmt.Errorf("disk full error during table creation: %w", err)
+	if err != nil {
+		if isNoSpaceError(err) {
+			return fmt.Errorf("disk full error during table creation: %w", err)
+		}
+		return err
 	}
-	return err
+
+	if err := convertToIncrementalVacuum(db); err != nil {
+		return err
+	}
+	return cm.migrateSchema(db)
 }
 
-func (cm *CacheManager) cleanupOldCacheFiles(table, tenantID string, currentFreshness string) error {
-	tenantDir := filepath.Join(cm.config.BaseDir, table, tenantID)
+// cacheColumns lists columns added after the initial schema. Older DB files
+// are upgraded in place with ALTER TABLE when they are opened, and backfill
+// (if any) is run once right after the column is added.
+var cacheColumns = []struct {
+	name       string
+	definition string
+	backfill   string
+}{
+	{"expires_at", "INTEGER", ""},
+	{"flags", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"hits", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"size", "INTEGER NOT NULL DEFAULT 0", "UPDATE cache SET size = length(content)"},
+	{"version", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"metadata", "TEXT", ""},
+	{"checksum", "BLOB", ""},
+	{"priority", "INTEGER NOT NULL DEFAULT 0", ""},
+	{"long_bind", "TEXT", ""},
+}
 
-	entries, err := os.ReadDir(tenantDir)
+func (cm *CacheManager) migrateSchema(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(cache)")
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
+		return fmt.Errorf("failed to read table info: %w", err)
+	}
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan table info: %w", err)
 		}
-		return err
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to read table info: %w", err)
 	}
 
-	for _, entry := range entries {
-		if entry.IsDir() {
+	for _, col := range cacheColumns {
+		if existing[col.name] {
 			continue
 		}
+		query := fmt.Sprintf("ALTER TABLE cache ADD COLUMN %s %s", col.name, col.definition)
+		if _, err := db.Exec(query); err != nil {
+			if isNoSpaceError(err) {
+				return fmt.Errorf("disk full error during schema migration: %w", err)
+			}
+			return fmt.Errorf("failed to add column '%s': %w", col.name, err)
+		}
+		if col.backfill != "" {
+			if _, err := db.Exec(col.backfill); err != nil {
+				if isNoSpaceError(err) {
+					return fmt.Errorf("disk full error during schema migration: %w", err)
+				}
+				return fmt.Errorf("failed to backfill column '%s': %w", col.name, err)
+			}
+		}
+	}
 
-		fileName := entry.Name()
-		if !strings.HasSuffix(fileName, ".db") {
-			continue
+	if err := migrateBindIndex(db); err != nil {
+		return err
+	}
+	return migrateEvictionIndex(db)
+}
+
+// migrateEvictionIndex indexes last_accessed within each priority, so that LRU eviction walks the
+// index in priority order. Older DB files had an index on last_accessed alone, which is replaced.
+func migrateEvictionIndex(db *sql.DB) error {
+	statements := []string{
+		"CREATE INDEX IF NOT EXISTS idx_priority_last_accessed ON cache (priority, last_accessed)",
+		"DROP INDEX IF EXISTS idx_last_accessed",
+	}
+	for _, stmt := range statements {
+		if _, err := db.Exec(stmt); err != nil {
+			if isNoSpaceError(err) {
+				return fmt.Errorf("disk full error during schema migration: %w", err)
+			}
+			return fmt.Errorf("failed to migrate eviction index: %w", err)
 		}
+	}
+	return nil
+}
 
-		// ファイル名からフレッシュネス値を取得
-		freshnessStr := strings.TrimSuffix(fileName, ".db")
+// migrateBindIndex makes bind unique. Older DB files had a non-unique index, so INSERT OR REPLACE
+// could leave several rows per bind; only the newest row of each bind is kept.
+func migrateBindIndex(db *sql.DB) error {
+	var exists bool
+	query := "SELECT EXISTS (SELECT 1 FROM sqlite_master WHERE type = 'index' AND name = 'idx_bind_unique')"
+	if err := db.QueryRow(query).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to read indexes: %w", err)
+	}
+	if exists {
+		return nil
+	}
 
-		// 現在のフレッシュネス値と異なる場合は削除
-		if freshnessStr != currentFreshness {
-			filePath := filepath.Join(tenantDir, fileName)
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-			// DBキャッシュからも削除
-			dbKey := cm.getDBKey(table, tenantID, freshnessStr)
-			if db, exists := cm.dbs[dbKey]; exists {
-				db.Close()
-				delete(cm.dbs, dbKey)
+	statements := []string{
+		"DELETE FROM cache WHERE id NOT IN (SELECT MAX(id) FROM cache GROUP BY bind)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_bind_unique ON cache (bind)",
+		"DROP INDEX IF EXISTS idx_bind",
+	}
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			if isNoSpaceError(err) {
+				return fmt.Errorf("disk full error during schema migration: %w", err)
 			}
-
-			os.Remove(filePath)
+			return fmt.Errorf("failed to migrate bind index: %w", err)
 		}
 	}
+	return tx.Commit()
+}
+
+// cleanupOldCacheFiles deletes DB files of other freshness values, except the retain most recently
+// modified ones. The caller must hold the tenant lock exclusively.
+func (cm *CacheManager) cleanupOldCacheFiles(table, tenantID string, currentFreshness string, retain int) error {
+	others, err := cm.otherFreshness(table, tenantID, currentFreshness)
+	if err != nil {
+		return err
+	}
+	if retain >= len(others) {
+		return nil
+	}
 
+	for _, freshness := range others[max(retain, 0):] {
+		// DBキャッシュからも削除
+		key := cm.getDBKey(table, tenantID, freshness)
+		cm.closeDB(key)
+		cm.counters.forget(key)
+		cm.usage.forget(key)
+		cm.forgetHotDB(table, tenantID, freshness)
+
+		dbPath := cm.getDBPath(table, tenantID, freshness)
+		if err := removeDBFiles(dbPath); err != nil {
+			cm.logger().Warn("sqlite-cache: failed to remove old cache file", "path", dbPath, "error", err)
+			continue
+		}
+		cm.logger().Info("sqlite-cache: removed old cache file", "path", dbPath)
+		cm.publishMutation(MutationDelete, table, tenantID, freshness, "")
+	}
 	return nil
 }
 
+// otherFreshness returns the freshness values of the tenant's DB files other than current,
+// most recently modified first
+func (cm *CacheManager) otherFreshness(table, tenantID string, current string) ([]string, error) {
+	tenantDir := cm.tenantDir(table, tenantID)
+
+	entries, err := os.ReadDir(tenantDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var others []string
+	modTimes := make(map[string]time.Time)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".db") {
+			continue
+		}
+
+		// ファイル名からフレッシュネス値を取得
+		freshness := strings.TrimSuffix(entry.Name(), ".db")
+		if freshness == current {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// 調べている間に削除された
+			continue
+		}
+		others = append(others, freshness)
+		modTimes[freshness] = info.ModTime()
+	}
+
+	sort.SliceStable(others, func(i, j int) bool {
+		return modTimes[others[i]].After(modTimes[others[j]])
+	})
+	return others, nil
+}
+
 func (cm *CacheManager) Close() error {
+	// ワーカーとスケジューラはテナントロックを取るので、マネージャのロックより先に止める
+	cm.stopEvictionWorker()
+
+	cm.stopVacuumScheduler()
+	cm.stopSweepScheduler()
+	cm.stopSnapshotSyncer()
+	cm.stopInvalidationListener()
+
 	cm.mutex.Lock()
 	defer cm.mutex.Unlock()
+	cm.evictor = nil
+	cm.vacuumer = nil
+	cm.sweeper = nil
+	cm.syncer = nil
+	cm.listener = nil
+	cm.feed.closeAll()
+	cm.feed = nil
+
+	// 一部のDBを閉じられなくても残りの後始末は続け、エラーはまとめて返す
+	var errs []error
+	if err := cm.closeAllDBs(); err != nil {
+		errs = append(errs, err)
+	}
+	// 処理中の操作はテナントのロックを離してから記録するので、閉じた後の記録は捨てる
+	err := cm.access.close()
+	cm.access = nil
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to close access log: %w", err))
+	}
+	if err := cm.removeMemoryDir(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to remove memory directory: %w", err))
+	}
+	if err := cm.stopMetricsServer(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
 
-	for _, db := range cm.dbs {
-		if err := db.Close(); err != nil {
-			return err
-		}
+// withTimeout applies OperationTimeout to ctx unless ctx already has a deadline
+func (cm *CacheManager) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if cm.config.OperationTimeout <= 0 {
+		return ctx, func() {}
 	}
-	cm.dbs = make(map[string]*sql.DB)
-	return nil
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, cm.config.OperationTimeout)
 }
 
 // isNoSpaceError checks if the error is related to disk space issues
@@ -191,5 +553,6 @@ func isNoSpaceError(err error) bool {
 	errStr := strings.ToLower(err.Error())
 	return strings.Contains(errStr, "no space left on device") ||
 		strings.Contains(errStr, "disk full") ||
+		strings.Contains(errStr, "database or disk is full") ||
 		strings.Contains(errStr, "not enough space")
 }
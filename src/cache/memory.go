@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// MemoryTablesのテーブルは、BaseDirではなくメモリ上のファイルシステム (tmpfs) に作ったディレクトリに
+// 同じtable/tenant/freshness.dbの構成で置く。SQLiteの:memory:は接続ごとに別のDBになり、ファイルの有無で
+// フレッシュネスを判断する処理とも合わないので、ファイルのままメモリに置く。APIと削除の動作は変わらない。
+// ディレクトリはInitで空の状態から作り、Closeで削除するので、プロセスをまたいで残らない。
+// スナップショットの対象にはしない。
+
+// defaultMemoryDir is the tmpfs mount used for memory tables when MemoryDir is not set
+const defaultMemoryDir = "/dev/shm"
+
+// isMemoryTable reports whether the table is stored in memory
+func (cm *CacheManager) isMemoryTable(table string) bool {
+	return slices.Contains(cm.config.MemoryTables, table) || slices.Contains(cm.config.MemoryTables, "*")
+}
+
+// tableRoot returns the directory holding the table's directory
+func (cm *CacheManager) tableRoot(table string) string {
+	if cm.memDir != "" && cm.isMemoryTable(table) {
+		return cm.memDir
+	}
+	return cm.config.BaseDir
+}
+
+// isMemoryPath reports whether the path is under the memory directory
+func (cm *CacheManager) isMemoryPath(path string) bool {
+	return cm.memDir != "" && strings.HasPrefix(path, cm.memDir+string(filepath.Separator))
+}
+
+// dataRoots returns BaseDir and, with memory tables, the memory directory
+func (cm *CacheManager) dataRoots() []string {
+	if cm.memDir == "" {
+		return []string{cm.config.BaseDir}
+	}
+	return []string{cm.config.BaseDir, cm.memDir}
+}
+
+// globData returns the paths matching pattern under every data root
+func (cm *CacheManager) globData(pattern string) ([]string, error) {
+	var paths []string
+	for _, root := range cm.dataRoots() {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// createMemoryDir creates an empty directory for the memory tables on the tmpfs mount
+func (cm *CacheManager) createMemoryDir() error {
+	if len(cm.config.MemoryTables) == 0 || cm.memDir != "" {
+		return nil
+	}
+	root := cm.config.MemoryDir
+	if root == "" {
+		root = defaultMemoryDir
+		if info, err := os.Stat(root); err != nil || !info.IsDir() {
+			// /dev/shmがない環境では一時ディレクトリを使う (メモリ上にあるとは限らない)
+			root = os.TempDir()
+		}
+	}
+	dir, err := os.MkdirTemp(root, "sqcache-*")
+	if err != nil {
+		return fmt.Errorf("failed to create memory directory: %w", err)
+	}
+	cm.memDir = dir
+	return nil
+}
+
+// removeMemoryDir removes the memory tables. The caller must have closed their DBs.
+func (cm *CacheManager) removeMemoryDir() error {
+	if cm.memDir == "" {
+		return nil
+	}
+	err := os.RemoveAll(cm.memDir)
+	cm.memDir = ""
+	return err
+}
+
+// listTables returns the table directories under every data root in sorted order
+func (cm *CacheManager) listTables() ([]string, error) {
+	var tables []string
+	for _, root := range cm.dataRoots() {
+		names, err := listDirs(root)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, names...)
+	}
+	sort.Strings(tables)
+	return slices.Compact(tables), nil
+}
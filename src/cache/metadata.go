@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// maxMetadataSize bounds the metadata of one entry. Metadata is meant for small values such as a
+// content type, the ETag of the source or a schema version.
+const maxMetadataSize = 64 * 1024
+
+// SetWithMetadata stores content like SetWithTTL together with metadata, a small string that is
+// returned by GetWithInfo. JSON metadata can be searched with FindByMetadata.
+func (cm *CacheManager) SetWithMetadata(table, tenantID string, freshness string, bind string, content []byte, ttl time.Duration, metadata string) error {
+	_, _, err := cm.set(context.Background(), table, tenantID, freshness, bind, content, ttl, entryAttrs{metadata: metadata}, setAlways, 0)
+	return err
+}
+
+// FindByMetadata returns the live entries of every freshness DB of the tenant whose JSON metadata has
+// value at jsonPath (e.g. "$.content_type"), in freshness and bind order. Entries whose metadata is
+// not valid JSON never match. value is compared as SQLite compares the result of json_extract, so
+// JSON numbers must be given as Go numbers and JSON booleans as 1 or 0.
+func (cm *CacheManager) FindByMetadata(table, tenantID string, jsonPath string, value interface{}) ([]BindInfo, error) {
+	if err := cm.checkNames(table, tenantID); err != nil {
+		return nil, err
+	}
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+
+	freshnesses, err := cm.otherFreshness(table, tenantID, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache files: %w", err)
+	}
+	sort.Strings(freshnesses)
+
+	result := []BindInfo{}
+	for _, freshness := range freshnesses {
+		db, err := cm.openReadDB(table, tenantID, freshness)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open database: %w", err)
+		}
+
+		// json_validで絞ってから評価するので、JSONでないメタデータがあってもエラーにならない
+		rows, err := db.Query(`
+		SELECT `+listedBind+`, size, CAST(updated_at AS INTEGER), COALESCE(expires_at, 0), metadata FROM cache
+		WHERE metadata IS NOT NULL AND (expires_at IS NULL OR expires_at > ?)
+			AND CASE WHEN json_valid(metadata) THEN json_extract(metadata, ?) = ? ELSE 0 END
+		ORDER BY bind
+		`, cm.now().Unix(), jsonPath, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query metadata: %w", err)
+		}
+		for rows.Next() {
+			info := BindInfo{Freshness: freshness}
+			if err := rows.Scan(&info.Bind, &info.Size, &info.UpdatedAt, &info.ExpiresAt, &info.Metadata); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan row: %w", err)
+			}
+			result = append(result, info)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to query metadata: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// checkMetadata returns ErrEntryTooLarge if metadata exceeds maxMetadataSize
+func checkMetadata(metadata string) error {
+	if len(metadata) > maxMetadataSize {
+		return fmt.Errorf("%w: metadata of %d bytes exceeds the limit of %d bytes", ErrEntryTooLarge, len(metadata), maxMetadataSize)
+	}
+	return nil
+}
+
+// nullIfEmpty stores an empty string as NULL
+func nullIfEmpty(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
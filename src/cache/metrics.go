@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds (seconds) of the operation latency histogram
+var latencyBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type metricsKey struct {
+	table    string
+	tenantID string
+}
+
+// LatencyStats is a cumulative histogram of operation latencies
+type LatencyStats struct {
+	Count   uint64
+	Sum     time.Duration
+	Buckets []uint64 // latencyBucketsと同じ順序の累積カウント
+}
+
+// TenantStats holds the counters collected for one (table, tenant) pair
+type TenantStats struct {
+	Table        string
+	TenantID     string
+	Hits         uint64
+	Misses       uint64
+	Sets         uint64
+	Evictions    uint64
+	EvictedBytes uint64
+	DBSizeBytes  int64
+	Latencies    map[string]LatencyStats // 操作名ごと
+}
+
+type metrics struct {
+	mu      sync.Mutex
+	tenants map[metricsKey]*TenantStats
+}
+
+func newMetrics() *metrics {
+	return &metrics{tenants: make(map[metricsKey]*TenantStats)}
+}
+
+// entry returns the stats for the key. Caller must hold m.mu.
+func (m *metrics) entry(table, tenantID string) *TenantStats {
+	key := metricsKey{table: table, tenantID: tenantID}
+	ts, exists := m.tenants[key]
+	if !exists {
+		ts = &TenantStats{
+			Table:     table,
+			TenantID:  tenantID,
+			Latencies: make(map[string]LatencyStats),
+		}
+		m.tenants[key] = ts
+	}
+	return ts
+}
+
+// 以下のメソッドはnilレシーバでも呼べる（メトリクス無効時は何もしない）
+
+func (m *metrics) recordHits(table, tenantID string, n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entry(table, tenantID).Hits += uint64(n)
+}
+
+func (m *metrics) recordMisses(table, tenantID string, n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entry(table, tenantID).Misses += uint64(n)
+}
+
+func (m *metrics) recordSets(table, tenantID string, n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entry(table, tenantID).Sets += uint64(n)
+}
+
+func (m *metrics) recordEviction(table, tenantID string, entries, bytes int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := m.entry(table, tenantID)
+	ts.Evictions += uint64(entries)
+	ts.EvictedBytes += uint64(bytes)
+}
+
+func (m *metrics) recordDBSize(table, tenantID string, size int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.entry(table, tenantID).DBSizeBytes = size
+}
+
+// observe records the latency of an operation started at start
+func (m *metrics) observe(table, tenantID, op string, start time.Time) {
+	if m == nil {
+		return
+	}
+	elapsed := time.Since(start)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ts := m.entry(table, tenantID)
+	ls := ts.Latencies[op]
+	if ls.Buckets == nil {
+		ls.Buckets = make([]uint64, len(latencyBuckets))
+	}
+	ls.Count++
+	ls.Sum += elapsed
+	for i, bound := range latencyBuckets {
+		if elapsed.Seconds() <= bound {
+			ls.Buckets[i]++
+		}
+	}
+	ts.Latencies[op] = ls
+}
+
+func (m *metrics) forgetTable(table string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key := range m.tenants {
+		if key.table == table {
+			delete(m.tenants, key)
+		}
+	}
+}
+
+func (m *metrics) forgetTenant(table, tenantID string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tenants, metricsKey{table: table, tenantID: tenantID})
+}
+
+// snapshot returns a copy of all counters sorted by table and tenant
+func (m *metrics) snapshot() []TenantStats {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]TenantStats, 0, len(m.tenants))
+	for _, ts := range m.tenants {
+		c := *ts
+		c.Latencies = make(map[string]LatencyStats, len(ts.Latencies))
+		for op, ls := range ts.Latencies {
+			ls.Buckets = append([]uint64(nil), ls.Buckets...)
+			c.Latencies[op] = ls
+		}
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Table != result[j].Table {
+			return result[i].Table < result[j].Table
+		}
+		return result[i].TenantID < result[j].TenantID
+	})
+	return result
+}
+
+// writePrometheus writes all counters in the Prometheus text exposition format
+func (m *metrics) writePrometheus(w *strings.Builder) {
+	stats := m.snapshot()
+
+	counters := []struct {
+		name  string
+		help  string
+		kind  string
+		value func(ts TenantStats) string
+	}{
+		{"sqcache_hits_total", "Number of cache hits.", "counter", func(ts TenantStats) string { return fmt.Sprint(ts.Hits) }},
+		{"sqcache_misses_total", "Number of cache misses.", "counter", func(ts TenantStats) string { return fmt.Sprint(ts.Misses) }},
+		{"sqcache_sets_total", "Number of stored entries.", "counter", func(ts TenantStats) string { return fmt.Sprint(ts.Sets) }},
+		{"sqcache_evictions_total", "Number of evicted entries.", "counter", func(ts TenantStats) string { return fmt.Sprint(ts.Evictions) }},
+		{"sqcache_evicted_bytes_total", "Content bytes removed by eviction.", "counter", func(ts TenantStats) string { return fmt.Sprint(ts.EvictedBytes) }},
+		{"sqcache_db_size_bytes", "Size of the current cache DB file.", "gauge", func(ts TenantStats) string { return fmt.Sprint(ts.DBSizeBytes) }},
+	}
+
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.kind)
+		for _, ts := range stats {
+			fmt.Fprintf(w, "%s{%s} %s\n", c.name, promLabels(ts.Table, ts.TenantID), c.value(ts))
+		}
+	}
+
+	const histName = "sqcache_operation_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of cache operations.\n# TYPE %s histogram\n", histName, histName)
+	for _, ts := range stats {
+		ops := make([]string, 0, len(ts.Latencies))
+		for op := range ts.Latencies {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+
+		for _, op := range ops {
+			ls := ts.Latencies[op]
+			labels := promLabels(ts.Table, ts.TenantID) + fmt.Sprintf(`,op="%s"`, op)
+			for i, bound := range latencyBuckets {
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", histName, labels, bound, ls.Buckets[i])
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", histName, labels, ls.Count)
+			fmt.Fprintf(w, "%s_sum{%s} %g\n", histName, labels, ls.Sum.Seconds())
+			fmt.Fprintf(w, "%s_count{%s} %d\n", histName, labels, ls.Count)
+		}
+	}
+}
+
+func promLabels(table, tenantID string) string {
+	return fmt.Sprintf(`table="%s",tenant="%s"`, escapeLabel(table), escapeLabel(tenantID))
+}
+
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+// startMetricsServer starts the /metrics listener on addr
+func (cm *CacheManager) startMetricsServer(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on metrics address %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		var sb strings.Builder
+		cm.metrics.writePrometheus(&sb)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write([]byte(sb.String()))
+	})
+
+	cm.metricsServer = &http.Server{Handler: mux}
+	go cm.metricsServer.Serve(listener)
+	return nil
+}
+
+func (cm *CacheManager) stopMetricsServer() error {
+	if cm.metricsServer == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := cm.metricsServer.Shutdown(ctx)
+	cm.metricsServer = nil
+	return err
+}
+
+// TenantMetrics returns a snapshot of the per-(table, tenant) metrics counters.
+// It returns nil when metrics are disabled.
+func (cm *CacheManager) TenantMetrics() []TenantStats {
+	return cm.metrics.snapshot()
+}
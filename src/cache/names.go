@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// テーブル名・テナントID・フレッシュネスはそのままBaseDir以下のディレクトリ名とファイル名になるので、
+// 外部から受け取った値でBaseDirの外を指せないよう、1つのパス要素として安全な名前だけを受け付ける。
+// HashUnsafeNamesを指定すると、安全でない名前は拒否せず、ハッシュした名前のディレクトリ・ファイルに保存する。
+// パスを作るときは常にpathNameを通すので、検査を通らない名前がパスに入ることはない。
+
+// maxNameLength bounds table, tenant and freshness names, leaving room for the ".db-journal"
+// and temporary file suffixes within the usual 255 byte limit of a file name
+const maxNameLength = 200
+
+// hashedNamePrefix starts the on-disk name of a hashed name. pathName keeps such a name as is, so
+// names read back from the directory tree refer to the same path, but checkNames rejects it from
+// callers so that a given name cannot collide with a hashed one.
+const hashedNamePrefix = "~"
+
+// NameError reports a table, tenant or freshness name that cannot be used as a path element
+type NameError struct {
+	Kind   string // "table"、"tenant"、"freshness"のいずれか
+	Name   string
+	Reason string
+}
+
+func (e *NameError) Error() string {
+	return fmt.Sprintf("%v: %s %q %s", ErrInvalidName, e.Kind, e.Name, e.Reason)
+}
+
+// Unwrap lets errors.Is match ErrInvalidName
+func (e *NameError) Unwrap() error {
+	return ErrInvalidName
+}
+
+// unsafeNameReason returns why name is not a safe path element, or "" if it is
+func unsafeNameReason(name string) string {
+	switch {
+	case name == "":
+		return "is empty"
+	case name == "." || name == "..":
+		return "is a relative path element"
+	case strings.HasPrefix(name, "."):
+		// BaseDir直下の.spool-*や.snapshot-*などの一時ファイルと区別する
+		return "starts with a dot"
+	case strings.ContainsAny(name, `/\`):
+		return "contains a path separator"
+	case strings.ContainsFunc(name, func(r rune) bool { return r < 0x20 || r == 0x7f }):
+		return "contains a control character"
+	case len(name) > maxNameLength:
+		return fmt.Sprintf("is longer than %d bytes", maxNameLength)
+	}
+	return ""
+}
+
+// checkNames validates the table, tenant and freshness names given in that order
+func (cm *CacheManager) checkNames(names ...string) error {
+	kinds := []string{"table", "tenant", "freshness"}
+	for i, name := range names {
+		if strings.HasPrefix(name, hashedNamePrefix) {
+			return &NameError{Kind: kinds[i], Name: name, Reason: "starts with " + strconv.Quote(hashedNamePrefix)}
+		}
+		reason := unsafeNameReason(name)
+		// 空の名前はハッシュしない (テーブルの削除がBaseDir全体の削除になるのを防ぐ)
+		if reason == "" || (cm.config.HashUnsafeNames && name != "") {
+			continue
+		}
+		return &NameError{Kind: kinds[i], Name: name, Reason: reason}
+	}
+	return nil
+}
+
+// pathName returns the directory or file name for a table, tenant or freshness name:
+// the name itself if it is safe, and a hash of it otherwise
+func pathName(name string) string {
+	if unsafeNameReason(name) == "" {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return hashedNamePrefix + hex.EncodeToString(sum[:16])
+}
+
+func (cm *CacheManager) tableDir(table string) string {
+	return filepath.Join(cm.tableRoot(table), pathName(table))
+}
+
+func (cm *CacheManager) tenantDir(table, tenantID string) string {
+	return filepath.Join(cm.tableDir(table), pathName(tenantID))
+}
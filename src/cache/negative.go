@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxNegativeEntries bounds the number of remembered misses
+const maxNegativeEntries = 100000
+
+type negativeEntry struct {
+	err   error // ErrCacheNotFoundまたはErrEntryNotFound
+	until time.Time
+}
+
+// negativeCache remembers recent misses per bind so that repeated lookups of missing binds do not
+// touch SQLite. A nil *negativeCache is disabled and all methods are no-ops.
+type negativeCache struct {
+	mu      sync.Mutex
+	clock   Clock
+	ttl     time.Duration
+	entries map[string]negativeEntry
+	// 書き込みのたびに増やす。検索中に書き込みがあったミスは記録しない
+	generation uint64
+}
+
+func newNegativeCache(ttl time.Duration, clock Clock) *negativeCache {
+	return &negativeCache{clock: clock, ttl: ttl, entries: make(map[string]negativeEntry)}
+}
+
+// get returns the remembered miss for key, if it has not expired
+func (c *negativeCache) get(key string) (error, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, exists := c.entries[key]
+	if !exists {
+		return nil, false
+	}
+	if c.clock.Now().After(entry.until) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.err, true
+}
+
+// begin returns the generation to pass to put after looking up SQLite
+func (c *negativeCache) begin() uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// put remembers the miss for key unless a write happened since begin returned generation
+func (c *negativeCache) put(key string, err error, generation uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return
+	}
+
+	now := c.clock.Now()
+	if len(c.entries) >= maxNegativeEntries {
+		for k, entry := range c.entries {
+			if now.After(entry.until) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= maxNegativeEntries {
+			return
+		}
+	}
+	c.entries[key] = negativeEntry{err: err, until: now.Add(c.ttl)}
+}
+
+// remove forgets the miss for key before the bind is written
+func (c *negativeCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	delete(c.entries, key)
+}
+
+// removePrefix forgets the misses of all keys starting with prefix, e.g. when a DB file is replaced
+func (c *negativeCache) removePrefix(prefix string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for key := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -1,29 +1,113 @@
 package cache
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"math/rand/v2"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 )
 
 func (cm *CacheManager) Get(table, tenantID string, freshness string, bind string) ([]byte, error) {
-	cm.mutex.RLock()
-	defer cm.mutex.RUnlock()
+	return cm.GetContext(context.Background(), table, tenantID, freshness, bind)
+}
+
+// GetContext is Get that gives up when ctx is done, while waiting for the tenant lock or
+// running the query. Without a deadline in ctx, OperationTimeout applies.
+func (cm *CacheManager) GetContext(ctx context.Context, table, tenantID string, freshness string, bind string) ([]byte, error) {
+	entry, err := cm.interceptGet(ctx, table, tenantID, freshness, bind, func(ctx context.Context, op *Op) (*CacheEntry, error) {
+		content, err := cm.get(ctx, op.Table, op.TenantID, op.Freshness, op.Bind)
+		// 他の呼び出しが既にミスを受け取っていれば、そのSetを待ってから再検索する
+		if cm.config.StampedeWait > 0 && IsNotFound(err) && cm.misses.wait(flightKey(op.Table, op.TenantID, op.Freshness, op.Bind), cm.config.StampedeWait) {
+			content, err = cm.get(ctx, op.Table, op.TenantID, op.Freshness, op.Bind)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &CacheEntry{Key: op.Bind, Content: content}, nil
+	})
+	cm.logAccess(ctx, "get", table, tenantID, freshness, bind, entrySize(entry), accessResult(true, err))
+	if err != nil {
+		return nil, err
+	}
+	return entry.Content, nil
+}
 
-	dbPath := cm.getDBPath(table, tenantID, freshness)
+func (cm *CacheManager) get(ctx context.Context, table, tenantID string, freshness string, bind string) ([]byte, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return nil, err
+	}
+	key := flightKey(table, tenantID, freshness, bind)
+	if content, ok := cm.hot.get(key); ok {
+		dbKey := cm.getDBKey(table, tenantID, freshness)
+		cm.metrics.recordHits(table, tenantID, 1)
+		cm.counters.record(dbKey, 1, 0)
+		// LRU・LFUの順序がメモリから返したアクセスでずれないよう、last_accessedとhitsは
+		// 読み取り専用の接続と同じく溜めておき、削除するエントリを選ぶ前とDBを閉じる前に書き込む
+		cm.accesses.record(dbKey, cm.storedBind(bind), cm.now().Unix())
+		return content, nil
+	}
+	if err, ok := cm.negative.get(key); ok {
+		cm.metrics.recordMisses(table, tenantID, 1)
+		cm.counters.record(cm.getDBKey(table, tenantID, freshness), 0, 1)
+		return nil, err
+	}
 
-	// キャッシュファイルが存在しない場合
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		// 古いキャッシュファイルを削除
-		if cleanErr := cm.cleanupOldCacheFiles(table, tenantID, freshness); cleanErr != nil {
-			return nil, fmt.Errorf("failed to cleanup old cache files: %w", cleanErr)
+	generation := cm.negative.begin()
+	entry, err := cm.getWithInfo(ctx, table, tenantID, freshness, bind)
+	if err != nil {
+		if IsNotFound(err) {
+			cm.negative.put(key, err, generation)
 		}
-		return nil, fmt.Errorf("cache not found")
+		return nil, err
+	}
+	return entry.Content, nil
+}
+
+// GetWithInfo returns the entry like Get, together with its version for SetCAS and its timestamps
+func (cm *CacheManager) GetWithInfo(table, tenantID string, freshness string, bind string) (*CacheEntry, error) {
+	entry, err := cm.interceptGet(context.Background(), table, tenantID, freshness, bind, func(ctx context.Context, op *Op) (*CacheEntry, error) {
+		return cm.getWithInfo(ctx, op.Table, op.TenantID, op.Freshness, op.Bind)
+	})
+	cm.logAccess(context.Background(), "get", table, tenantID, freshness, bind, entrySize(entry), accessResult(true, err))
+	return entry, err
+}
+
+func (cm *CacheManager) getWithInfo(ctx context.Context, table, tenantID string, freshness string, bind string) (*CacheEntry, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return nil, err
+	}
+	ctx, cancel := cm.withTimeout(ctx)
+	defer cancel()
+
+	entry, err := cm.getEntry(ctx, table, tenantID, freshness, bind)
+	// 壊れたDBは削除して、以降の呼び出しが失敗し続けないようにする
+	cm.repairIfCorrupt(table, tenantID, freshness, err)
+	return entry, err
+}
+
+func (cm *CacheManager) getEntry(ctx context.Context, table, tenantID string, freshness string, bind string) (*CacheEntry, error) {
+	defer cm.metrics.observe(table, tenantID, "get", time.Now())
+	defer cm.logSlow(table, tenantID, "get", time.Now())
+
+	// キャッシュファイルが存在しない場合は、古いキャッシュファイルを削除
+	if missing, err := cm.cleanupIfMissing(table, tenantID, freshness); err != nil {
+		return nil, err
+	} else if missing {
+		cm.metrics.recordMisses(table, tenantID, 1)
+		cm.counters.record(cm.getDBKey(table, tenantID, freshness), 0, 1)
+		return nil, ErrCacheNotFound
 	}
 
+	unlock, err := cm.rlockTenantContext(ctx, table, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	db, err := cm.openDB(table, tenantID, freshness)
 	if err != nil {
 		if isDiskFullError(err) {
@@ -33,14 +117,64 @@ func (cm *CacheManager) Get(table, tenantID string, freshness string, bind strin
 	}
 
 	// UPDATE...RETURNINGを使って、最新アクセス時刻を更新しつつコンテンツを取得
-	now := time.Now().Unix()
-	var content []byte
+	now := cm.now().Unix()
+	entry := &CacheEntry{Key: bind}
+	key := cm.storedBind(bind)
 
-	query := "UPDATE cache SET last_accessed = ? WHERE bind = ? RETURNING content"
-	err = db.QueryRow(query, now, bind).Scan(&content)
+	// 期限切れのエントリは対象外とする
+	// (TIMESTAMP型のカラムはドライバがtime.Timeに変換するので、整数にキャストして返す)
+	query := `
+	UPDATE cache SET last_accessed = ?, hits = hits + 1
+	WHERE bind = ? AND (expires_at IS NULL OR expires_at > ?)
+	RETURNING id, content, flags, version, CAST(last_accessed AS INTEGER), CAST(updated_at AS INTEGER), COALESCE(expires_at, 0), COALESCE(metadata, ''), checksum
+	`
+	args := []interface{}{now, key, now}
+	dbKey := cm.getDBKey(table, tenantID, freshness)
+	readDB := db
+	reader := cm.lookupReader(dbKey)
+	if reader != nil {
+		readDB = reader
+		// 読み取り専用の接続では更新せず、アクセスはrecordAccessで後から書き込む
+		query = `
+		SELECT id, content, flags, version, CAST(last_accessed AS INTEGER), CAST(updated_at AS INTEGER), COALESCE(expires_at, 0), COALESCE(metadata, ''), checksum
+		FROM cache WHERE bind = ? AND (expires_at IS NULL OR expires_at > ?)
+		`
+		args = []interface{}{key, now}
+	}
+	var id int64
+	var flags int
+	var sum []byte
+	err = cm.retryBusy(ctx, func() error {
+		stmt, err := cm.stmts.prepare(readDB, query)
+		if err != nil {
+			return err
+		}
+		return stmt.QueryRowContext(ctx, args...).Scan(&id, &entry.Content, &flags, &entry.Version, &entry.LastAccessed, &entry.CreatedAt, &entry.ExpiresAt, &entry.Metadata, &sum)
+	})
 	if err != nil {
+		if err == sql.ErrNoRows && reader != nil {
+			// ミスのたびに書き込まないよう、期限切れのエントリは残しておき、Setや削除で取り除く
+			cm.metrics.recordMisses(table, tenantID, 1)
+			cm.counters.record(dbKey, 0, 1)
+			return nil, ErrEntryNotFound
+		}
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("cache entry not found")
+			// 期限切れのエントリが残っていれば削除する
+			stmt, delErr := cm.stmts.prepare(db, "DELETE FROM cache WHERE bind = ? AND expires_at <= ? RETURNING "+listedBind+", size")
+			var expired []EventEntry
+			if delErr == nil {
+				var rows *sql.Rows
+				if rows, delErr = stmt.QueryContext(ctx, key, now); delErr == nil {
+					expired, delErr = scanEventEntries(rows, table, tenantID, freshness)
+				}
+			}
+			if delErr != nil {
+				return nil, fmt.Errorf("failed to delete expired entry: %w", delErr)
+			}
+			cm.notifyExpire(expired)
+			cm.metrics.recordMisses(table, tenantID, 1)
+			cm.counters.record(cm.getDBKey(table, tenantID, freshness), 0, 1)
+			return nil, ErrEntryNotFound
 		}
 		if isDiskFullError(err) {
 			return nil, fmt.Errorf("disk full error during cache update: %w", err)
@@ -48,18 +182,538 @@ func (cm *CacheManager) Get(table, tenantID string, freshness string, bind strin
 		return nil, fmt.Errorf("failed to update and query cache: %w", err)
 	}
 
-	return content, nil
+	entry.Content, err = cm.loadContent(readDB, id, entry.Content, flags, sum, entryAAD(table, tenantID, bind))
+	if err != nil {
+		if errors.Is(err, ErrChecksumMismatch) {
+			cm.metrics.recordMisses(table, tenantID, 1)
+			cm.counters.record(dbKey, 0, 1)
+			return nil, cm.dropCorruptEntry(db, table, tenantID, freshness, id, bind, fmt.Errorf("%w: %s", err, bind))
+		}
+		return nil, err
+	}
+	if reader != nil {
+		entry.LastAccessed = now
+		cm.recordAccess(dbKey, db, key, now)
+	}
+	// 書き込みと入れ違いに古い値を残さないよう、テナントのロックを持っている間に入れる
+	cm.hot.put(flightKey(table, tenantID, freshness, bind), entry.Content, entry.ExpiresAt)
+
+	cm.metrics.recordHits(table, tenantID, 1)
+	cm.counters.record(cm.getDBKey(table, tenantID, freshness), 1, 0)
+	return entry, nil
+}
+
+// Peek returns the content like Get but does not update last_accessed or hit counters,
+// so inspecting entries does not change the eviction order
+func (cm *CacheManager) Peek(table, tenantID string, freshness string, bind string) ([]byte, error) {
+	entry, err := cm.peekEntry(table, tenantID, freshness, bind)
+	cm.logAccess(context.Background(), "peek", table, tenantID, freshness, bind, entrySize(entry), accessResult(true, err))
+	if err != nil {
+		return nil, err
+	}
+	return entry.Content, nil
+}
+
+// peekEntry is Peek returning the whole entry. Unlike getEntry it never removes other freshness files.
+func (cm *CacheManager) peekEntry(table, tenantID string, freshness string, bind string) (*CacheEntry, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return nil, err
+	}
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+
+	if _, err := os.Stat(cm.getDBPath(table, tenantID, freshness)); os.IsNotExist(err) {
+		return nil, ErrCacheNotFound
+	}
+
+	db, err := cm.openReadDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return nil, fmt.Errorf("disk full error: %w", err)
+		}
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	entry, id, err := cm.readLiveEntry(db, table, tenantID, bind)
+	if err != nil {
+		if errors.Is(err, ErrChecksumMismatch) {
+			// 読み込み用の接続では削除できないので、書き込み用の接続で消す
+			if writer, openErr := cm.openDB(table, tenantID, freshness); openErr == nil {
+				return nil, cm.dropCorruptEntry(writer, table, tenantID, freshness, id, bind, fmt.Errorf("%w: %s", err, bind))
+			}
+			return nil, fmt.Errorf("%w: %s", err, bind)
+		}
+		return nil, err
+	}
+	return entry, nil
+}
+
+// readLiveEntry reads an unexpired entry without updating its access time. On ErrChecksumMismatch
+// the row id is returned with the error so that the caller can drop the row.
+func (cm *CacheManager) readLiveEntry(db *sql.DB, table, tenantID string, bind string) (*CacheEntry, int64, error) {
+	var id int64
+	var flags int
+	var sum []byte
+	entry := &CacheEntry{Key: bind}
+	query := `
+	SELECT id, content, flags, version, CAST(last_accessed AS INTEGER), CAST(updated_at AS INTEGER), COALESCE(expires_at, 0), COALESCE(metadata, ''), checksum
+	FROM cache WHERE bind = ? AND (expires_at IS NULL OR expires_at > ?)
+	`
+	err := db.QueryRow(query, cm.storedBind(bind), cm.now().Unix()).Scan(&id, &entry.Content, &flags, &entry.Version, &entry.LastAccessed, &entry.CreatedAt, &entry.ExpiresAt, &entry.Metadata, &sum)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, 0, ErrEntryNotFound
+		}
+		return nil, 0, fmt.Errorf("failed to query cache: %w", err)
+	}
+	if entry.Content, err = cm.loadContent(db, id, entry.Content, flags, sum, entryAAD(table, tenantID, bind)); err != nil {
+		return nil, id, err
+	}
+	return entry, id, nil
+}
+
+// GetOrLoad returns the cached content, or on miss calls loader, stores its result and returns it.
+// Concurrent misses for the same bind call loader only once and share the result.
+func (cm *CacheManager) GetOrLoad(table, tenantID string, freshness string, bind string, loader func() ([]byte, error)) ([]byte, error) {
+	get := func() ([]byte, error) {
+		entry, err := cm.interceptGet(context.Background(), table, tenantID, freshness, bind, func(ctx context.Context, op *Op) (*CacheEntry, error) {
+			content, err := cm.get(ctx, op.Table, op.TenantID, op.Freshness, op.Bind)
+			if err != nil {
+				return nil, err
+			}
+			return &CacheEntry{Key: op.Bind, Content: content}, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return entry.Content, nil
+	}
+	content, err := get()
+	cm.logAccess(context.Background(), "get", table, tenantID, freshness, bind, int64(len(content)), accessResult(true, err))
+	if err == nil || !IsNotFound(err) {
+		return content, err
+	}
+
+	return cm.loads.do(flightKey(table, tenantID, freshness, bind), func() ([]byte, error) {
+		// 待っている間に他の呼び出しが登録した可能性があるので再確認
+		if content, err := get(); err == nil || !IsNotFound(err) {
+			return content, err
+		}
+
+		content, err := loader()
+		if err != nil {
+			return nil, fmt.Errorf("loader failed: %w", err)
+		}
+		if content == nil {
+			content = []byte{}
+		}
+
+		if err := cm.Set(table, tenantID, freshness, bind, content); err != nil {
+			return nil, err
+		}
+		return content, nil
+	})
+}
+
+// mgetChunkSize keeps the number of bound parameters per statement well below SQLite's limit
+const mgetChunkSize = 500
+
+type mgetEntry struct {
+	id    int64
+	bind  string
+	flags int
+	sum   []byte
+}
+
+// MGet fetches multiple binds in a single transaction. Binds that miss are absent from the result.
+// Entries whose checksum does not match are deleted and treated as misses.
+func (cm *CacheManager) MGet(table, tenantID string, freshness string, binds []string) (map[string][]byte, error) {
+	result, err := cm.mget(table, tenantID, freshness, binds)
+	if cm.access != nil {
+		for _, bind := range binds {
+			content, hit := result[bind]
+			switch {
+			case err != nil:
+				cm.logAccess(context.Background(), "get", table, tenantID, freshness, bind, 0, accessResult(true, err))
+			case hit:
+				cm.logAccess(context.Background(), "get", table, tenantID, freshness, bind, int64(len(content)), "hit")
+			default:
+				cm.logAccess(context.Background(), "get", table, tenantID, freshness, bind, 0, "miss")
+			}
+		}
+	}
+	return result, err
+}
+
+func (cm *CacheManager) mget(table, tenantID string, freshness string, binds []string) (map[string][]byte, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return nil, err
+	}
+	defer cm.metrics.observe(table, tenantID, "mget", time.Now())
+	defer cm.logSlow(table, tenantID, "mget", time.Now())
+
+	result := make(map[string][]byte, len(binds))
+	if len(binds) == 0 {
+		return result, nil
+	}
+
+	// キャッシュファイルが存在しない場合は、すべてキャッシュミス
+	if missing, err := cm.cleanupIfMissing(table, tenantID, freshness); err != nil {
+		return nil, err
+	} else if missing {
+		cm.metrics.recordMisses(table, tenantID, len(binds))
+		cm.counters.record(cm.getDBKey(table, tenantID, freshness), 0, len(binds))
+		return result, nil
+	}
+
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return nil, fmt.Errorf("disk full error: %w", err)
+		}
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := cm.now().Unix()
+	var corrupt []mgetEntry
+	for start := 0; start < len(binds); start += mgetChunkSize {
+		end := start + mgetChunkSize
+		if end > len(binds) {
+			end = len(binds)
+		}
+		chunk := binds[start:end]
+
+		args := make([]interface{}, 0, len(chunk)+2)
+		args = append(args, now)
+		for _, bind := range chunk {
+			args = append(args, cm.storedBind(bind))
+		}
+		args = append(args, now)
+
+		// 最新アクセス時刻をまとめて更新しつつコンテンツを取得
+		query := fmt.Sprintf(`
+		UPDATE cache SET last_accessed = ?, hits = hits + 1
+		WHERE bind IN (%s) AND (expires_at IS NULL OR expires_at > ?)
+		RETURNING id, %s, content, flags, checksum
+		`, placeholders(len(chunk)), listedBind)
+		rows, err := tx.Query(query, args...)
+		if err != nil {
+			if isDiskFullError(err) {
+				return nil, fmt.Errorf("disk full error during cache update: %w", err)
+			}
+			return nil, fmt.Errorf("failed to update and query cache: %w", err)
+		}
+		var chunked []mgetEntry
+		for rows.Next() {
+			var entry mgetEntry
+			var content []byte
+			if err := rows.Scan(&entry.id, &entry.bind, &content, &entry.flags, &entry.sum); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to scan cache entry: %w", err)
+			}
+			if entry.flags&flagChunked != 0 {
+				// チャンクは結果を読み終えてから同じトランザクションで読む
+				chunked = append(chunked, entry)
+				continue
+			}
+			if content, err = cm.loadContent(tx, entry.id, content, entry.flags, entry.sum, entryAAD(table, tenantID, entry.bind)); err != nil {
+				if errors.Is(err, ErrChecksumMismatch) {
+					corrupt = append(corrupt, entry)
+					continue
+				}
+				rows.Close()
+				return nil, err
+			}
+			result[entry.bind] = content
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read cache entries: %w", err)
+		}
+		for _, entry := range chunked {
+			content, err := cm.loadContent(tx, entry.id, nil, entry.flags, entry.sum, entryAAD(table, tenantID, entry.bind))
+			if err != nil {
+				if errors.Is(err, ErrChecksumMismatch) {
+					corrupt = append(corrupt, entry)
+					continue
+				}
+				return nil, err
+			}
+			result[entry.bind] = content
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		if isDiskFullError(err) {
+			return nil, fmt.Errorf("disk full error during commit: %w", err)
+		}
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	// チェックサムが一致しないエントリはミスとして扱い、削除する
+	for _, entry := range corrupt {
+		cm.dropCorruptEntry(db, table, tenantID, freshness, entry.id, entry.bind, fmt.Errorf("%w: %s", ErrChecksumMismatch, entry.bind))
+	}
+
+	cm.metrics.recordHits(table, tenantID, len(result))
+	cm.metrics.recordMisses(table, tenantID, len(binds)-len(result))
+	cm.counters.record(cm.getDBKey(table, tenantID, freshness), len(result), len(binds)-len(result))
+	return result, nil
+}
+
+// placeholders returns "?, ?, ..." with n parameters for IN clauses
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.Repeat("?, ", n-1) + "?"
 }
 
 func (cm *CacheManager) Set(table, tenantID string, freshness string, bind string, content []byte) error {
-	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
+	return cm.SetWithTTL(table, tenantID, freshness, bind, content, 0)
+}
+
+// SetWithTTL stores content that expires after ttl. A ttl of zero or less means no expiry.
+func (cm *CacheManager) SetWithTTL(table, tenantID string, freshness string, bind string, content []byte, ttl time.Duration) error {
+	return cm.SetContext(context.Background(), table, tenantID, freshness, bind, content, ttl)
+}
+
+// SetContext is SetWithTTL that gives up when ctx is done, while waiting for the tenant lock or
+// writing the entry. Without a deadline in ctx, OperationTimeout applies.
+func (cm *CacheManager) SetContext(ctx context.Context, table, tenantID string, freshness string, bind string, content []byte, ttl time.Duration) error {
+	_, _, err := cm.set(ctx, table, tenantID, freshness, bind, content, ttl, entryAttrs{}, setAlways, 0)
+	return err
+}
+
+// SetNX stores content only if no live entry exists for bind and reports whether it was stored.
+// An expired entry counts as absent and is replaced.
+func (cm *CacheManager) SetNX(table, tenantID string, freshness string, bind string, content []byte, ttl time.Duration) (bool, error) {
+	_, stored, err := cm.set(context.Background(), table, tenantID, freshness, bind, content, ttl, entryAttrs{}, setIfAbsent, 0)
+	return stored, err
+}
+
+// SetCAS replaces the entry only if its version still equals version (as returned by GetWithInfo)
+// and returns the new version. It returns ErrConflict if the entry was changed, deleted or has expired.
+func (cm *CacheManager) SetCAS(table, tenantID string, freshness string, bind string, content []byte, ttl time.Duration, version int64) (int64, error) {
+	newVersion, stored, err := cm.set(context.Background(), table, tenantID, freshness, bind, content, ttl, entryAttrs{}, setIfVersion, version)
+	if err != nil {
+		return 0, err
+	}
+	if !stored {
+		return 0, ErrConflict
+	}
+	return newVersion, nil
+}
+
+// entryAttrs are the optional attributes written together with the content
+type entryAttrs struct {
+	tags     []string // nilならタグを付けない
+	metadata string   // 空ならメタデータなし
+	priority Priority
+}
+
+type setCondition int
 
-	dbPath := cm.getDBPath(table, tenantID, freshness)
+const (
+	setAlways    setCondition = iota
+	setIfAbsent               // 有効なエントリがない場合だけ
+	setIfVersion              // versionが一致する場合だけ
+)
+
+// set stores the entry with attrs according to cond and returns its new version and whether it was stored
+func (cm *CacheManager) set(ctx context.Context, table, tenantID string, freshness string, bind string, content []byte, ttl time.Duration, attrs entryAttrs, cond setCondition, expected int64) (int64, bool, error) {
+	var version int64
+	var stored bool
+	op := &Op{Kind: OpSet, Table: table, TenantID: tenantID, Freshness: freshness, Bind: bind, Content: content, TTL: ttl}
+	err := cm.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		var err error
+		version, stored, err = cm.setEntry(ctx, op.Table, op.TenantID, op.Freshness, op.Bind, op.Content, op.TTL, attrs, cond, expected)
+		return err
+	})
+	result := accessResult(false, err)
+	if err == nil && !stored {
+		result = "not_stored"
+	}
+	cm.logAccess(ctx, "set", table, tenantID, freshness, bind, int64(len(content)), result)
+	return version, stored, err
+}
+
+func (cm *CacheManager) setEntry(ctx context.Context, table, tenantID string, freshness string, bind string, content []byte, ttl time.Duration, attrs entryAttrs, cond setCondition, expected int64) (int64, bool, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return 0, false, err
+	}
+	if err := cm.checkEntrySize(int64(len(content))); err != nil {
+		return 0, false, err
+	}
+	if err := checkMetadata(attrs.metadata); err != nil {
+		return 0, false, err
+	}
+	if err := cm.checkWritable(); err != nil {
+		return 0, false, err
+	}
+
+	ctx, cancel := cm.withTimeout(ctx)
+	defer cancel()
+	unlock, err := cm.lockTenantContext(ctx, table, tenantID)
+	if err != nil {
+		return 0, false, err
+	}
+	defer unlock()
+	defer cm.metrics.observe(table, tenantID, "set", time.Now())
+	defer cm.logSlow(table, tenantID, "set", time.Now())
 
 	// キャッシュファイルが存在しない場合、古いファイルを削除
-	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
-		if cleanErr := cm.cleanupOldCacheFiles(table, tenantID, freshness); cleanErr != nil {
+	if !cm.dbFileExists(table, tenantID, freshness) {
+		if cleanErr := cm.cleanupOldCacheFiles(table, tenantID, freshness, cm.config.RetainFreshness); cleanErr != nil {
+			return 0, false, fmt.Errorf("failed to cleanup old cache files: %w", cleanErr)
+		}
+	}
+
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return 0, false, fmt.Errorf("disk full error: %w", err)
+		}
+		return 0, false, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	now := cm.now().Unix()
+
+	stored, flags, err := cm.encodeContent(table, tenantID, bind, content)
+	if err != nil {
+		return 0, false, err
+	}
+
+	// 事前にサイズチェックとLRU削除を実行
+	if err := cm.enforceSize(table, tenantID, freshness, db, int64(len(stored))); err != nil {
+		return 0, false, fmt.Errorf("failed to enforce size limits before insert: %w", err)
+	}
+
+	var expiresAt interface{}
+	if ttl > 0 {
+		expiresAt = cm.now().Add(ttl).Unix()
+	}
+
+	version := newVersion()
+	rowContent, flags, chunked := cm.splitContent(stored, flags)
+	args := []interface{}{cm.storedBind(bind), rowContent, now, now, expiresAt, flags, len(stored), version, nullIfEmpty(attrs.metadata), cm.checksum(stored), attrs.priority, cm.longBind(bind)}
+
+	// エントリを挿入または更新
+	query := `
+	INSERT OR REPLACE INTO cache (bind, content, last_accessed, updated_at, expires_at, flags, size, version, metadata, checksum, priority, long_bind)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	RETURNING id
+	`
+	switch cond {
+	case setIfAbsent:
+		// 既存のエントリが期限切れの場合だけ置き換える
+		query = `
+		INSERT INTO cache (bind, content, last_accessed, updated_at, expires_at, flags, size, version, metadata, checksum, priority, long_bind)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (bind) DO UPDATE SET
+			content = excluded.content, last_accessed = excluded.last_accessed, updated_at = excluded.updated_at,
+			expires_at = excluded.expires_at, flags = excluded.flags, size = excluded.size, version = excluded.version, hits = 0,
+			metadata = excluded.metadata, checksum = excluded.checksum, priority = excluded.priority,
+			long_bind = excluded.long_bind
+		WHERE cache.expires_at IS NOT NULL AND cache.expires_at <= excluded.updated_at
+		RETURNING id
+		`
+	case setIfVersion:
+		query = `
+		UPDATE cache SET content = ?2, last_accessed = ?3, updated_at = ?4, expires_at = ?5, flags = ?6, size = ?7, version = ?8, metadata = ?9, checksum = ?10, priority = ?11, long_bind = ?12
+		WHERE bind = ?1 AND version = ?13 AND (expires_at IS NULL OR expires_at > ?4)
+		RETURNING id
+		`
+		args = append(args, expected)
+	}
+	// INSERT OR REPLACEでは置き換えたレコードのタグがトリガーで消えるが、更新では残るので明示的に消す
+	tags := attrs.tags
+	if tags == nil && cond != setAlways {
+		tags = []string{}
+	}
+	// 失敗したときに書き込み前の値が残っているとは限らないので、先に外しておく
+	hotKey := flightKey(table, tenantID, freshness, bind)
+	cm.hot.remove(hotKey)
+	cm.negative.remove(hotKey)
+
+	var written bool
+	err = cm.writeWithRetry(table, tenantID, freshness, db, int64(len(stored)), func() error {
+		return cm.retryBusy(ctx, func() error {
+			var err error
+			written, err = cm.storeEntry(ctx, db, stored, chunked, tags, query, args...)
+			return err
+		})
+	})
+	if err != nil {
+		if isDiskFullError(err) {
+			return 0, false, fmt.Errorf("disk full error during cache insert: %w", err)
+		}
+		return 0, false, fmt.Errorf("failed to insert cache entry: %w", err)
+	}
+	if !written {
+		return 0, false, nil
+	}
+	expiry, _ := expiresAt.(int64)
+	cm.hot.put(hotKey, content, expiry)
+	cm.publishMutation(MutationSet, table, tenantID, freshness, bind)
+
+	cm.metrics.recordSets(table, tenantID, 1)
+	cm.recordDBSize(table, tenantID, db)
+	if cm.config.StampedeWait > 0 {
+		cm.misses.release(flightKey(table, tenantID, freshness, bind))
+	}
+	return version, true, nil
+}
+
+// checkEntrySize returns ErrEntryTooLarge if content of n bytes exceeds MaxEntrySize
+func (cm *CacheManager) checkEntrySize(n int64) error {
+	if cm.config.MaxEntrySize > 0 && n > cm.config.MaxEntrySize {
+		return fmt.Errorf("%w: %d bytes exceeds the limit of %d bytes", ErrEntryTooLarge, n, cm.config.MaxEntrySize)
+	}
+	return nil
+}
+
+// newVersion returns a random version token. Tokens are not reused when an entry is
+// deleted and set again, unlike a per-DB counter.
+func newVersion() int64 {
+	return rand.Int64()
+}
+
+// Append adds data to the end of the content of bind, creating the entry if it does not exist.
+// Plain content is concatenated in a single statement. Content stored compressed, encrypted or
+// in chunks is decoded, joined and stored again. The expiry of an existing entry is kept.
+func (cm *CacheManager) Append(table, tenantID string, freshness string, bind string, data []byte) error {
+	err := cm.appendBind(table, tenantID, freshness, bind, data)
+	cm.logAccess(context.Background(), "append", table, tenantID, freshness, bind, int64(len(data)), accessResult(false, err))
+	return err
+}
+
+func (cm *CacheManager) appendBind(table, tenantID string, freshness string, bind string, data []byte) error {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return err
+	}
+	if err := cm.checkEntrySize(int64(len(data))); err != nil {
+		return err
+	}
+	if err := cm.checkWritable(); err != nil {
+		return err
+	}
+
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+	defer cm.metrics.observe(table, tenantID, "append", time.Now())
+	defer cm.logSlow(table, tenantID, "append", time.Now())
+
+	if !cm.dbFileExists(table, tenantID, freshness) {
+		if cleanErr := cm.cleanupOldCacheFiles(table, tenantID, freshness, cm.config.RetainFreshness); cleanErr != nil {
 			return fmt.Errorf("failed to cleanup old cache files: %w", cleanErr)
 		}
 	}
@@ -72,106 +726,652 @@ func (cm *CacheManager) Set(table, tenantID string, freshness string, bind strin
 		return fmt.Errorf("failed to open database: %w", err)
 	}
 
-	now := time.Now().Unix()
-
-	// 事前にサイズチェックとLRU削除を実行
-	if err := cm.enforceSize(db); err != nil {
+	if err := cm.enforceSize(table, tenantID, freshness, db, int64(len(data))); err != nil {
 		return fmt.Errorf("failed to enforce size limits before insert: %w", err)
 	}
 
-	// エントリを挿入または更新
+	now := cm.now().Unix()
+	cm.hot.remove(flightKey(table, tenantID, freshness, bind))
+	cm.negative.remove(flightKey(table, tenantID, freshness, bind))
+	err = cm.writeWithRetry(table, tenantID, freshness, db, int64(len(data)), func() error {
+		return cm.retryBusy(context.Background(), func() error {
+			return cm.appendEntry(db, table, tenantID, bind, data, now)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	cm.publishMutation(MutationSet, table, tenantID, freshness, bind)
+
+	cm.metrics.recordSets(table, tenantID, 1)
+	cm.recordDBSize(table, tenantID, db)
+	if cm.config.StampedeWait > 0 {
+		cm.misses.release(flightKey(table, tenantID, freshness, bind))
+	}
+	return nil
+}
+
+// appendEntry appends data in SQL if possible and falls back to appendRewrite otherwise.
+// Caller must hold the tenant lock.
+func (cm *CacheManager) appendEntry(db *sql.DB, table, tenantID string, bind string, data []byte, now int64) error {
+	appended := false
+	chunkBytes := cm.chunkBytes()
+	// 圧縮を設定していれば、連結した値を圧縮して保存し直す
+	if cm.aead == nil && cm.config.Compression == CompressionNone && len(cm.codecs[table]) == 0 && cm.config.Checksum == ChecksumNone && (chunkBytes == 0 || len(data) <= chunkBytes) {
+		// 期限切れのエントリは新しく作り直す。変換済みのcontentやチェックサムのあるcontentには連結できないので更新しない
+		// (||はTEXTを返すので、BLOBにキャストしておく)
+		query := `
+		INSERT INTO cache (bind, content, last_accessed, updated_at, expires_at, flags, size, version, long_bind)
+		VALUES (?1, ?2, ?3, ?3, NULL, 0, length(?2), ?4, ?7)
+		ON CONFLICT (bind) DO UPDATE SET
+			content = CASE WHEN cache.expires_at <= excluded.updated_at THEN excluded.content
+				ELSE CAST(cache.content || excluded.content AS BLOB) END,
+			size = CASE WHEN cache.expires_at <= excluded.updated_at THEN excluded.size
+				ELSE cache.size + excluded.size END,
+			hits = CASE WHEN cache.expires_at <= excluded.updated_at THEN 0 ELSE cache.hits END,
+			priority = CASE WHEN cache.expires_at <= excluded.updated_at THEN 0 ELSE cache.priority END,
+			expires_at = CASE WHEN cache.expires_at <= excluded.updated_at THEN NULL ELSE cache.expires_at END,
+			last_accessed = excluded.last_accessed, updated_at = excluded.updated_at, version = excluded.version
+		WHERE cache.flags = 0 AND cache.checksum IS NULL AND (?5 = 0 OR cache.size + excluded.size <= ?5)
+			AND (?6 <= 0 OR cache.size + excluded.size <= ?6)
+		`
+		result, err := db.Exec(query, cm.storedBind(bind), data, now, newVersion(), chunkBytes, cm.config.MaxEntrySize, cm.longBind(bind))
+		if err != nil {
+			if isDiskFullError(err) {
+				return fmt.Errorf("disk full error during cache insert: %w", err)
+			}
+			return fmt.Errorf("failed to append to cache entry: %w", err)
+		}
+		n, err := result.RowsAffected()
+		appended = err == nil && n > 0
+	}
+	if !appended {
+		return cm.appendRewrite(db, table, tenantID, bind, data, now)
+	}
+	return nil
+}
+
+// appendRewrite appends by reading, decoding and storing the whole content again.
+// Caller must hold the tenant lock.
+func (cm *CacheManager) appendRewrite(db *sql.DB, table, tenantID string, bind string, data []byte, now int64) error {
+	var id int64
+	var content []byte
+	var flags int
+	var expiresAt sql.NullInt64
+	var hits int64
+	var metadata sql.NullString
+	var sum []byte
+	var priority Priority
+	err := db.QueryRow(`
+	SELECT id, content, flags, expires_at, hits, metadata, checksum, priority FROM cache
+	WHERE bind = ? AND (expires_at IS NULL OR expires_at > ?)
+	`, cm.storedBind(bind), now).Scan(&id, &content, &flags, &expiresAt, &hits, &metadata, &sum, &priority)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("failed to query cache: %w", err)
+	}
+	// INSERT OR REPLACEで消えるタグとメタデータと優先度を引き継ぐ
+	var tags []string
+	if err == nil {
+		if content, err = cm.loadContent(db, id, content, flags, sum, entryAAD(table, tenantID, bind)); err != nil {
+			return err
+		}
+		if tags, err = readTags(db, id); err != nil {
+			return err
+		}
+	}
+
+	if err := cm.checkEntrySize(int64(len(content) + len(data))); err != nil {
+		return err
+	}
+	stored, flags, err := cm.encodeContent(table, tenantID, bind, append(content, data...))
+	if err != nil {
+		return err
+	}
+	content, flags, chunked := cm.splitContent(stored, flags)
 	query := `
-	INSERT OR REPLACE INTO cache (bind, content, last_accessed, updated_at)
-	VALUES (?, ?, ?, ?)
+	INSERT OR REPLACE INTO cache (bind, content, last_accessed, updated_at, expires_at, flags, hits, size, version, metadata, checksum, priority, long_bind)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	RETURNING id
 	`
-	_, err = db.Exec(query, bind, content, now, now)
+	if _, err := cm.storeEntry(context.Background(), db, stored, chunked, tags, query, cm.storedBind(bind), content, now, now, expiresAt, flags, hits, len(stored), newVersion(), metadata, cm.checksum(stored), priority, cm.longBind(bind)); err != nil {
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error during cache insert: %w", err)
+		}
+		return fmt.Errorf("failed to append to cache entry: %w", err)
+	}
+	return nil
+}
+
+// iteratePageSize is the number of rows Iterate reads per query
+const iteratePageSize = 500
+
+type iterRow struct {
+	id        int64
+	bind      string
+	content   []byte
+	metadata  string
+	expiresAt int64 // 期限がなければ0
+}
+
+// Iterate calls fn for every live entry in insertion order without updating access times.
+// Rows are read in pages so that the tenant lock is not held while fn runs; returning an error from fn stops the iteration.
+func (cm *CacheManager) Iterate(table, tenantID string, freshness string, fn func(bind string, content []byte) error) error {
+	// 渡したcontentのバイト数を記録する
+	var size int64
+	err := cm.iterate(table, tenantID, freshness, func(bind string, content []byte) error {
+		size += int64(len(content))
+		return fn(bind, content)
+	})
+	cm.logAccess(context.Background(), "scan", table, tenantID, freshness, "", size, accessResult(false, err))
+	return err
+}
+
+func (cm *CacheManager) iterate(table, tenantID string, freshness string, fn func(bind string, content []byte) error) error {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return err
+	}
+	if _, err := os.Stat(cm.getDBPath(table, tenantID, freshness)); os.IsNotExist(err) {
+		return ErrCacheNotFound
+	}
+
+	var lastID int64
+	for {
+		page, err := cm.iteratePage(table, tenantID, freshness, lastID)
+		if err != nil {
+			return err
+		}
+		for _, row := range page {
+			if err := fn(row.bind, row.content); err != nil {
+				return err
+			}
+		}
+		if len(page) < iteratePageSize {
+			return nil
+		}
+		lastID = page[len(page)-1].id
+	}
+}
+
+func (cm *CacheManager) iteratePage(table, tenantID string, freshness string, afterID int64) ([]iterRow, error) {
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+
+	// 途中でフレッシュネスが切り替わってファイルが消えていれば終了する
+	if _, err := os.Stat(cm.getDBPath(table, tenantID, freshness)); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	rows, err := db.Query(`
+	SELECT id, `+listedBind+`, content, flags, checksum, COALESCE(metadata, ''), COALESCE(expires_at, 0) FROM cache
+	WHERE id > ? AND (expires_at IS NULL OR expires_at > ?)
+	ORDER BY id LIMIT ?
+	`, afterID, cm.now().Unix(), iteratePageSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cache: %w", err)
+	}
+
+	var page []iterRow
+	var flags []int
+	var sums [][]byte
+	for rows.Next() {
+		var row iterRow
+		var rowFlags int
+		var sum []byte
+		if err := rows.Scan(&row.id, &row.bind, &row.content, &rowFlags, &sum, &row.metadata, &row.expiresAt); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+		page = append(page, row)
+		flags = append(flags, rowFlags)
+		sums = append(sums, sum)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// チャンクは別の接続で読むので、結果を読み終えてから復元する
+	for i := range page {
+		if page[i].content, err = cm.loadContent(db, page[i].id, page[i].content, flags[i], sums[i], entryAAD(table, tenantID, page[i].bind)); err != nil {
+			if errors.Is(err, ErrChecksumMismatch) {
+				return nil, fmt.Errorf("%w: %s", err, page[i].bind)
+			}
+			return nil, err
+		}
+	}
+	return page, nil
+}
+
+// MSet stores multiple entries in a single transaction. CacheEntry.Key is used as the bind.
+func (cm *CacheManager) MSet(table, tenantID string, freshness string, entries []CacheEntry) error {
+	err := cm.mset(table, tenantID, freshness, entries)
+	if cm.access != nil {
+		result := accessResult(false, err)
+		for _, entry := range entries {
+			cm.logAccess(context.Background(), "set", table, tenantID, freshness, entry.Key, int64(len(entry.Content)), result)
+		}
+	}
+	return err
+}
+
+func (cm *CacheManager) mset(table, tenantID string, freshness string, entries []CacheEntry) error {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return err
+	}
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+	defer cm.metrics.observe(table, tenantID, "mset", time.Now())
+	defer cm.logSlow(table, tenantID, "mset", time.Now())
+
+	if len(entries) == 0 {
+		return nil
+	}
+	for _, entry := range entries {
+		if err := cm.checkEntrySize(int64(len(entry.Content))); err != nil {
+			return fmt.Errorf("%s: %w", entry.Key, err)
+		}
+	}
+	if err := cm.checkWritable(); err != nil {
+		return err
+	}
+
+	// キャッシュファイルが存在しない場合、古いファイルを削除
+	if !cm.dbFileExists(table, tenantID, freshness) {
+		if cleanErr := cm.cleanupOldCacheFiles(table, tenantID, freshness, cm.config.RetainFreshness); cleanErr != nil {
+			return fmt.Errorf("failed to cleanup old cache files: %w", cleanErr)
+		}
+	}
+
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error: %w", err)
+		}
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// 圧縮・暗号化を先に行い、バッチ全体のサイズを求める
+	stored := make([][]byte, len(entries))
+	flags := make([]int, len(entries))
+	var incoming int64
+	for i, entry := range entries {
+		if stored[i], flags[i], err = cm.encodeContent(table, tenantID, entry.Key, entry.Content); err != nil {
+			return err
+		}
+		incoming += int64(len(stored[i]))
+	}
+
+	// サイズチェックとLRU削除はバッチごとに1回だけ実行
+	if err := cm.enforceSize(table, tenantID, freshness, db, incoming); err != nil {
+		return fmt.Errorf("failed to enforce size limits before insert: %w", err)
+	}
+
+	for _, entry := range entries {
+		cm.hot.remove(flightKey(table, tenantID, freshness, entry.Key))
+		cm.negative.remove(flightKey(table, tenantID, freshness, entry.Key))
+	}
+	err = cm.writeWithRetry(table, tenantID, freshness, db, incoming, func() error {
+		return cm.retryBusy(context.Background(), func() error {
+			return cm.insertBatch(db, entries, stored, flags)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	binds := make([]string, len(entries))
+	for i, entry := range entries {
+		cm.hot.put(flightKey(table, tenantID, freshness, entry.Key), entry.Content, 0)
+		binds[i] = entry.Key
+	}
+	cm.publishBinds(MutationSet, table, tenantID, freshness, binds)
+	cm.metrics.recordSets(table, tenantID, len(entries))
+	cm.recordDBSize(table, tenantID, db)
+	if cm.config.StampedeWait > 0 {
+		for _, entry := range entries {
+			cm.misses.release(flightKey(table, tenantID, freshness, entry.Key))
+		}
+	}
+	return nil
+}
+
+// batchInsertSQL stores one entry without an expiry, returning the row id for the chunks
+const batchInsertSQL = `
+	INSERT OR REPLACE INTO cache (bind, content, last_accessed, updated_at, expires_at, flags, size, version, checksum, long_bind)
+	VALUES (?, ?, ?, ?, NULL, ?, ?, ?, ?, ?)
+	RETURNING id
+	`
+
+// insertEncoded stores one encoded content with stmt, a prepared batchInsertSQL of tx
+func (cm *CacheManager) insertEncoded(tx *sql.Tx, stmt *sql.Stmt, bind string, stored []byte, flags int, now int64) error {
+	content, rowFlags, chunked := cm.splitContent(stored, flags)
+	var id int64
+	err := stmt.QueryRow(cm.storedBind(bind), content, now, now, rowFlags, len(stored), newVersion(), cm.checksum(stored), cm.longBind(bind)).Scan(&id)
+	if err == nil && chunked {
+		err = cm.writeChunks(tx, id, stored)
+	}
 	if err != nil {
 		if isDiskFullError(err) {
 			return fmt.Errorf("disk full error during cache insert: %w", err)
 		}
 		return fmt.Errorf("failed to insert cache entry: %w", err)
 	}
-
 	return nil
 }
 
-func (cm *CacheManager) Delete(table string) error {
-	cm.mutex.Lock()
-	defer cm.mutex.Unlock()
+// insertBatch stores the encoded contents of entries in one transaction
+func (cm *CacheManager) insertBatch(db *sql.DB, entries []CacheEntry, stored [][]byte, flags []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
 
-	tableDir := filepath.Join(cm.config.BaseDir, table)
+	stmt, err := tx.Prepare(batchInsertSQL)
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert statement: %w", err)
+	}
+	defer stmt.Close()
 
-	// 該当テーブルのDBキャッシュをクローズ
-	for key, db := range cm.dbs {
-		if len(key) > len(table) && key[:len(table)] == table && key[len(table)] == ':' {
-			db.Close()
-			delete(cm.dbs, key)
+	now := cm.now().Unix()
+	for i, entry := range entries {
+		if err := cm.insertEncoded(tx, stmt, entry.Key, stored[i], flags[i], now); err != nil {
+			return err
 		}
 	}
 
-	// テーブルディレクトリを削除
-	return os.RemoveAll(tableDir)
+	if err := tx.Commit(); err != nil {
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error during commit: %w", err)
+		}
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
 }
 
-func (cm *CacheManager) enforceSize(db *sql.DB) error {
-	// データベースファイルサイズをチェック
-	dbPath := ""
-	row := db.QueryRow("PRAGMA database_list")
-	var seq int
-	var name string
-	if err := row.Scan(&seq, &name, &dbPath); err != nil {
+// Touch updates last_accessed of a live entry without reading its content. If ttl is positive the
+// entry expires ttl from now, otherwise its expiry is left unchanged. It returns ErrEntryNotFound on miss.
+func (cm *CacheManager) Touch(table, tenantID string, freshness string, bind string, ttl time.Duration) error {
+	err := cm.touch(table, tenantID, freshness, bind, ttl)
+	cm.logAccess(context.Background(), "touch", table, tenantID, freshness, bind, 0, accessResult(false, err))
+	return err
+}
+
+func (cm *CacheManager) touch(table, tenantID string, freshness string, bind string, ttl time.Duration) error {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
 		return err
 	}
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
 
-	if stat, err := os.Stat(dbPath); err == nil {
-		sizeMB := float64(stat.Size()) / (1024 * 1024)
+	if _, err := os.Stat(cm.getDBPath(table, tenantID, freshness)); os.IsNotExist(err) {
+		return ErrCacheNotFound
+	}
 
-		if sizeMB > float64(cm.config.MaxSize) {
-			// LRUアルゴリズムで古いレコードを削除
-			return cm.lruCleanup(db)
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error: %w", err)
 		}
+		return fmt.Errorf("failed to open database: %w", err)
 	}
 
+	now := cm.now()
+	var expiresAt interface{}
+	if ttl > 0 {
+		expiresAt = now.Add(ttl).Unix()
+	}
+	query := `
+	UPDATE cache SET last_accessed = ?, expires_at = COALESCE(?, expires_at)
+	WHERE bind = ? AND (expires_at IS NULL OR expires_at > ?)
+	`
+	result, err := db.Exec(query, now.Unix(), expiresAt, cm.storedBind(bind), now.Unix())
+	if err != nil {
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error during cache update: %w", err)
+		}
+		return fmt.Errorf("failed to touch cache entry: %w", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrEntryNotFound
+	}
+	if ttl > 0 {
+		// メモリ上の値は古い有効期限を持っているので外す
+		cm.hot.remove(flightKey(table, tenantID, freshness, bind))
+	}
 	return nil
 }
 
-func (cm *CacheManager) lruCleanup(db *sql.DB) error {
-	// 現在のレコード数を取得
-	var totalCount int
-	err := db.QueryRow("SELECT COUNT(*) FROM cache").Scan(&totalCount)
+// Exists reports whether a live entry exists for bind, without reading its content or updating last_accessed
+func (cm *CacheManager) Exists(table, tenantID string, freshness string, bind string) (bool, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return false, err
+	}
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+
+	if !cm.dbFileExists(table, tenantID, freshness) {
+		return false, nil
+	}
+
+	db, err := cm.openReadDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return false, fmt.Errorf("disk full error: %w", err)
+		}
+		return false, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	var exists bool
+	query := "SELECT EXISTS (SELECT 1 FROM cache WHERE bind = ? AND (expires_at IS NULL OR expires_at > ?))"
+	if err := db.QueryRow(query, cm.storedBind(bind), cm.now().Unix()).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to query cache: %w", err)
+	}
+	return exists, nil
+}
+
+// DeleteEntry removes a single bind. Deleting a missing entry is not an error.
+func (cm *CacheManager) DeleteEntry(table, tenantID string, freshness string, bind string) error {
+	return cm.DeleteEntryContext(context.Background(), table, tenantID, freshness, bind)
+}
+
+// DeleteEntryContext is DeleteEntry that gives up when ctx is done, while waiting for the tenant
+// lock or deleting the entry. Without a deadline in ctx, OperationTimeout applies.
+func (cm *CacheManager) DeleteEntryContext(ctx context.Context, table, tenantID string, freshness string, bind string) error {
+	ctx, cancel := cm.withTimeout(ctx)
+	defer cancel()
+	op := &Op{Kind: OpDelete, Table: table, TenantID: tenantID, Freshness: freshness, Bind: bind}
+	err := cm.intercept(ctx, op, func(ctx context.Context, op *Op) error {
+		if err := cm.deleteEntry(ctx, op.Table, op.TenantID, op.Freshness, op.Bind); err != nil {
+			return err
+		}
+		cm.broadcastInvalidation(ctx, Invalidation{Op: InvalidateEntry, Table: op.Table, TenantID: op.TenantID, Freshness: op.Freshness, Bind: op.Bind})
+		return nil
+	})
+	cm.logAccess(ctx, "delete", table, tenantID, freshness, bind, 0, accessResult(false, err))
+	return err
+}
+
+func (cm *CacheManager) deleteEntry(ctx context.Context, table, tenantID string, freshness string, bind string) error {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return err
+	}
+	unlock, err := cm.lockTenantContext(ctx, table, tenantID)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	// 残すべき数を計算し、削除する数を決定
-	keepCount := int(float64(totalCount) * cm.config.Cap)
-	deleteCount := totalCount - keepCount
-	if deleteCount <= 0 {
+	if !cm.dbFileExists(table, tenantID, freshness) {
 		return nil
 	}
 
-	// 古いレコードを削除
-	query := `
-	DELETE FROM cache 
-	WHERE id IN (
-		SELECT id FROM cache 
-		ORDER BY last_accessed ASC 
-		LIMIT ?
-	)
-	`
-	_, err = db.Exec(query, deleteCount)
+	db, err := cm.openDB(table, tenantID, freshness)
 	if err != nil {
-		return fmt.Errorf("failed to delete old entries: %w", err)
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error: %w", err)
+		}
+		return fmt.Errorf("failed to open database: %w", err)
 	}
 
-	// VACUUMでデータベースを最適化
-	_, err = db.Exec("VACUUM")
-	if err != nil && isDiskFullError(err) {
-		return fmt.Errorf("disk full error during vacuum: %w", err)
+	cm.hot.remove(flightKey(table, tenantID, freshness, bind))
+	err = cm.retryBusy(ctx, func() error {
+		stmt, err := cm.stmts.prepare(db, "DELETE FROM cache WHERE bind = ?")
+		if err != nil {
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, cm.storedBind(bind))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete cache entry: %w", err)
 	}
+	cm.publishMutation(MutationDelete, table, tenantID, freshness, bind)
+
+	return nil
+}
+
+// Delete closes and removes the cache files of every tenant of table
+func (cm *CacheManager) Delete(table string) error {
+	err := cm.deleteTable(table)
+	cm.logAccess(context.Background(), "delete_table", table, "", "", "", 0, accessResult(false, err))
 	return err
 }
 
+func (cm *CacheManager) deleteTable(table string) error {
+	if err := cm.checkNames(table); err != nil {
+		return err
+	}
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	tableDir := cm.tableDir(table)
+
+	// 該当テーブルのDBキャッシュをクローズ
+	cm.closeDBsWithPrefix(pathName(table) + ":")
+
+	cm.metrics.forgetTable(table)
+	cm.counters.forgetPrefix(pathName(table) + ":")
+	cm.hot.removePrefix(pathName(table) + "\x00")
+	cm.usage.forgetPrefix(pathName(table) + ":")
+
+	// テーブルディレクトリを削除
+	if err := os.RemoveAll(tableDir); err != nil {
+		return err
+	}
+	cm.publishMutation(MutationDelete, table, "", "", "")
+	return nil
+}
+
+// DeleteTenant closes and removes all cache files of one tenant, leaving other tenants untouched
+func (cm *CacheManager) DeleteTenant(table, tenantID string) error {
+	err := cm.deleteTenant(table, tenantID)
+	cm.logAccess(context.Background(), "delete_tenant", table, tenantID, "", "", 0, accessResult(false, err))
+	if err != nil {
+		return err
+	}
+	cm.broadcastInvalidation(context.Background(), Invalidation{Op: InvalidateTenant, Table: table, TenantID: tenantID})
+	return nil
+}
+
+func (cm *CacheManager) deleteTenant(table, tenantID string) error {
+	if err := cm.checkNames(table, tenantID); err != nil {
+		return err
+	}
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+
+	tenantDir := cm.tenantDir(table, tenantID)
+
+	// 該当テナントのDBキャッシュをクローズ
+	prefix := pathName(table) + ":" + pathName(tenantID) + ":"
+	cm.closeDBsWithPrefix(prefix)
+
+	cm.metrics.forgetTenant(table, tenantID)
+	cm.counters.forgetPrefix(prefix)
+	cm.hot.removePrefix(pathName(table) + "\x00" + pathName(tenantID) + "\x00")
+	cm.usage.forgetPrefix(prefix)
+
+	// テナントディレクトリを削除
+	if err := os.RemoveAll(tenantDir); err != nil {
+		return err
+	}
+	cm.publishMutation(MutationDelete, table, tenantID, "", "")
+	return nil
+}
+
+// enforceSize evicts entries when the DB plus incoming bytes would exceed the hard watermark of the
+// tenant's limit (MaxSize or its quota), shrinking it to Cap of the limit. With background eviction
+// enabled, crossing the soft watermark only schedules gradual eviction so that writers do not wait for it,
+// and crossing the hard watermark evicts just down to the soft watermark before leaving the rest to it.
+// The global TotalMaxSize is enforced afterwards by enforceBudget.
+func (cm *CacheManager) enforceSize(table, tenantID string, freshness string, db *sql.DB, incoming int64) error {
+	// データベースのサイズをページ数から求める。見積もりが削除を始めるサイズを超えたときと、
+	// TotalMaxSizeで他のDBを削除することがあるときは、正確な値で判断する
+	size, err := cm.sizes.estimate(db)
+	if err != nil {
+		return err
+	}
+	maxBytes := cm.maxBytes(table, tenantID)
+	if size+incoming > cm.softWatermarkBytes(maxBytes) || cm.budgetEnabled() {
+		if size, err = cm.sizes.refresh(db); err != nil {
+			return err
+		}
+	}
+	cm.sizes.add(db, incoming)
+
+	if size+incoming <= cm.hardWatermarkBytes(maxBytes) {
+		if cm.evictor != nil && size+incoming > cm.softWatermarkBytes(maxBytes) {
+			cm.evictor.enqueue(evictionJob{table: table, tenantID: tenantID, freshness: freshness})
+		}
+	} else {
+		// 削除ポリシー（既定はLRU）に従って古いレコードを削除
+		targetBytes := size + incoming - int64(float64(maxBytes)*cm.config.Cap)
+		if cm.evictor != nil {
+			// 書き込みを待たせるのは最小限にして、残りはバックグラウンドで少しずつ削除する
+			targetBytes = size + incoming - cm.softWatermarkBytes(maxBytes)
+		}
+		if err := cm.evict(table, tenantID, freshness, db, targetBytes); err != nil {
+			return err
+		}
+		if cm.evictor != nil {
+			cm.evictor.enqueue(evictionJob{table: table, tenantID: tenantID, freshness: freshness})
+		}
+		if cm.budgetEnabled() {
+			if size, err = dbSizeBytes(db); err != nil {
+				return err
+			}
+		}
+	}
+
+	return cm.enforceBudget(table, tenantID, freshness, db, size+incoming)
+}
+
+// recordDBSize updates the DB size gauge when metrics are enabled
+func (cm *CacheManager) recordDBSize(table, tenantID string, db *sql.DB) {
+	if cm.metrics == nil {
+		return
+	}
+	if size, err := cm.sizes.estimate(db); err == nil {
+		cm.metrics.recordDBSize(table, tenantID, size)
+	}
+}
+
+// dbFileExists reports whether the DB file exists. An open handle implies its file, so only DBs
+// that are not open are looked up on disk.
+func (cm *CacheManager) dbFileExists(table, tenantID string, freshness string) bool {
+	if cm.isOpen(cm.getDBKey(table, tenantID, freshness)) {
+		return true
+	}
+	_, err := os.Stat(cm.getDBPath(table, tenantID, freshness))
+	return !os.IsNotExist(err)
+}
+
 // isDiskFullError checks if the error is related to disk space issues
 func isDiskFullError(err error) bool {
 	if err == nil {
@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"os"
+)
+
+const (
+	// defaultScanLimit is the page size of ScanPrefix when limit is 0 or less
+	defaultScanLimit = 100
+	// maxScanLimit bounds the page size of ScanPrefix
+	maxScanLimit = 10000
+)
+
+// BindInfo describes an entry without its content
+type BindInfo struct {
+	Bind      string `json:"bind"`
+	Freshness string `json:"freshness,omitempty"` // FindByMetadataで見つかったDBのフレッシュネス
+	Size      int64  `json:"size"`                // 保存しているcontentのバイト数
+	UpdatedAt int64  `json:"updated_at"`          // 最後に登録された時刻
+	ExpiresAt int64  `json:"expires_at"`          // 0なら期限なし
+	Metadata  string `json:"metadata,omitempty"`
+}
+
+// ScanPrefix returns up to limit live entries whose bind starts with prefix, in bind order (binds hashed
+// by HashBindsOver in the order of the part kept before the hash), without
+// updating access times. Pass "" as cursor to start and then the returned cursor, which is "" once
+// there are no more entries. The range is read with the unique index on bind.
+func (cm *CacheManager) ScanPrefix(table, tenantID string, freshness string, prefix string, cursor string, limit int) ([]BindInfo, string, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	limit = min(limit, maxScanLimit)
+	after, err := decodeScanCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+
+	if _, err := os.Stat(cm.getDBPath(table, tenantID, freshness)); os.IsNotExist(err) {
+		return nil, "", ErrCacheNotFound
+	}
+
+	db, err := cm.openReadDB(table, tenantID, freshness)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to open database: %w", err)
+	}
+	return cm.scanDB(db, prefix, cursor, after, limit)
+}
+
+// scanDB reads the page of ScanPrefix from db. after is the decoded cursor.
+func (cm *CacheManager) scanDB(db *sql.DB, prefix string, cursor string, after string, limit int) ([]BindInfo, string, error) {
+	where, args := cm.prefixRange(prefix)
+	if cursor != "" {
+		where += " AND bind > ?"
+		args = append(args, after)
+	}
+	// カーソルは保存したキーで続ける
+	query := "SELECT bind, " + listedBind + ", size, CAST(updated_at AS INTEGER), COALESCE(expires_at, 0), COALESCE(metadata, '') FROM cache WHERE " + where +
+		" AND (expires_at IS NULL OR expires_at > ?) ORDER BY bind LIMIT ?"
+	args = append(args, cm.now().Unix(), limit)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to scan cache: %w", err)
+	}
+	defer rows.Close()
+
+	var binds []BindInfo
+	var last string
+	for rows.Next() {
+		var info BindInfo
+		if err := rows.Scan(&last, &info.Bind, &info.Size, &info.UpdatedAt, &info.ExpiresAt, &info.Metadata); err != nil {
+			return nil, "", fmt.Errorf("failed to scan row: %w", err)
+		}
+		binds = append(binds, info)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("failed to scan cache: %w", err)
+	}
+
+	next := ""
+	if len(binds) == limit {
+		next = encodeScanCursor(last)
+	}
+	return binds, next, nil
+}
+
+// Scan returns up to limit live entries of the DB in bind order, like ScanPrefix with an empty prefix.
+// The order is stable, so entries present for the whole scan are returned exactly once.
+func (cm *CacheManager) Scan(table, tenantID string, freshness string, cursor string, limit int) ([]BindInfo, string, error) {
+	return cm.ScanPrefix(table, tenantID, freshness, "", cursor, limit)
+}
+
+// DeletePrefix removes every entry whose bind starts with prefix and returns how many were removed
+func (cm *CacheManager) DeletePrefix(table, tenantID string, freshness string, prefix string) (int64, error) {
+	deleted, err := cm.deletePrefix(table, tenantID, freshness, prefix)
+	cm.logAccess(context.Background(), "delete_prefix", table, tenantID, freshness, prefix, 0, accessResult(false, err))
+	return deleted, err
+}
+
+func (cm *CacheManager) deletePrefix(table, tenantID string, freshness string, prefix string) (int64, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return 0, err
+	}
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+
+	if _, err := os.Stat(cm.getDBPath(table, tenantID, freshness)); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return 0, fmt.Errorf("disk full error: %w", err)
+		}
+		return 0, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	where, args := cm.prefixRange(prefix)
+	var binds []string
+	err = cm.retryBusy(context.Background(), func() error {
+		rows, err := db.Query("DELETE FROM cache WHERE "+where+" RETURNING "+listedBind, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		binds = binds[:0]
+		for rows.Next() {
+			var bind string
+			if err := rows.Scan(&bind); err != nil {
+				return err
+			}
+			binds = append(binds, bind)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete cache entries: %w", err)
+	}
+
+	for _, bind := range binds {
+		cm.hot.remove(flightKey(table, tenantID, freshness, bind))
+	}
+	cm.publishBinds(MutationDelete, table, tenantID, freshness, binds)
+	return int64(len(binds)), nil
+}
+
+// bindRange returns the condition matching values of column that start with prefix as a range,
+// so that the index on bind is used unlike LIKE, which also ignores case
+func bindRange(column, prefix string) (string, []interface{}) {
+	// 末尾の0xffは繰り上がるので取り除き、最後のバイトを1つ増やしたものを上限とする
+	upper := []byte(prefix)
+	for len(upper) > 0 && upper[len(upper)-1] == 0xff {
+		upper = upper[:len(upper)-1]
+	}
+	if len(upper) == 0 {
+		return column + " >= ?", []interface{}{prefix}
+	}
+	upper[len(upper)-1]++
+	return column + " >= ? AND " + column + " < ?", []interface{}{prefix, string(upper)}
+}
+
+// encodeScanCursor returns the cursor continuing after bind
+func encodeScanCursor(bind string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(bind))
+}
+
+func decodeScanCursor(cursor string) (string, error) {
+	after, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", fmt.Errorf("invalid scan cursor: %w", err)
+	}
+	return string(after), nil
+}
@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// マニフェストは1行に1つのJSON ({"bind": ..., "content": ...}、バイナリはcontent_base64) か、Exportのアーカイブ。
+// 先頭がzstdのマジックナンバーならアーカイブとして読む。エントリはpreloadBatchEntriesかpreloadBatchBytesまで貯めて
+// MSetで1つのトランザクションとして書き込むので、Setを1件ずつ呼ぶよりずっと速い。
+// 有効期限とメタデータは持たない。アーカイブの期限切れのエントリは読み飛ばす。
+
+const (
+	// preloadBatchEntries and preloadBatchBytes bound the entries written in one transaction by Preload
+	preloadBatchEntries = 1000
+	preloadBatchBytes   = 16 * 1024 * 1024
+
+	// preloadMaxLine bounds a line of a newline-delimited JSON manifest
+	preloadMaxLine = 256 * 1024 * 1024
+)
+
+// zstdMagic starts every zstd frame, and so every archive written by Export
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// PreloadProgress is passed to the progress callback of Preload after each committed transaction
+type PreloadProgress struct {
+	Loaded  int   // entries stored so far
+	Skipped int   // expired archive entries skipped so far
+	Bytes   int64 // content bytes stored so far
+}
+
+// preloadRecord is one line of a newline-delimited JSON manifest
+type preloadRecord struct {
+	Bind          string  `json:"bind"`
+	Content       *string `json:"content"`
+	ContentBase64 []byte  `json:"content_base64"`
+}
+
+// Preload bulk-loads the entries of manifest into one cache file, in transactions of up to
+// preloadBatchEntries entries, and returns the number of entries stored. manifest is either newline-delimited
+// JSON or an archive written by Export, whose table, tenant and freshness are ignored. progress, if not nil,
+// is called after each transaction. On error the entries of the transactions already committed are kept.
+func (cm *CacheManager) Preload(table, tenantID string, freshness string, manifest io.Reader, progress func(PreloadProgress)) (int, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return 0, err
+	}
+
+	var p PreloadProgress
+	var batch []CacheEntry
+	var batchBytes int64
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := cm.MSet(table, tenantID, freshness, batch); err != nil {
+			return err
+		}
+		p.Loaded += len(batch)
+		p.Bytes += batchBytes
+		batch, batchBytes = batch[:0], 0
+		if progress != nil {
+			progress(p)
+		}
+		return nil
+	}
+	add := func(bind string, content []byte) error {
+		batch = append(batch, CacheEntry{Key: bind, Content: content})
+		batchBytes += int64(len(content))
+		if len(batch) >= preloadBatchEntries || batchBytes >= preloadBatchBytes {
+			return flush()
+		}
+		return nil
+	}
+
+	r := bufio.NewReader(manifest)
+	var err error
+	if magic, _ := r.Peek(len(zstdMagic)); bytes.Equal(magic, zstdMagic) {
+		err = cm.readPreloadArchive(r, add, &p)
+	} else {
+		err = readPreloadLines(r, add)
+	}
+	if err == nil {
+		err = flush()
+	}
+	return p.Loaded, err
+}
+
+// readPreloadLines passes the entries of a newline-delimited JSON manifest to add
+func readPreloadLines(r io.Reader, add func(string, []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, preloadMaxLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var record preloadRecord
+		if err := json.Unmarshal(text, &record); err != nil {
+			return fmt.Errorf("invalid manifest line %d: %w", line, err)
+		}
+		if record.Bind == "" {
+			return fmt.Errorf("invalid manifest line %d: bind is required", line)
+		}
+		content := record.ContentBase64
+		if record.Content != nil {
+			content = []byte(*record.Content)
+		}
+		if err := add(record.Bind, content); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return nil
+}
+
+// readPreloadArchive passes the live entries of an Export archive to add
+func (cm *CacheManager) readPreloadArchive(r io.Reader, add func(string, []byte) error, p *PreloadProgress) error {
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+
+	header, err := tr.Next()
+	if err != nil || header.Name != archiveManifestName {
+		return fmt.Errorf("invalid archive: manifest not found")
+	}
+	var manifest archiveManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return fmt.Errorf("invalid archive: %w", err)
+	}
+	if manifest.Version != archiveVersion {
+		return fmt.Errorf("unsupported archive version %d", manifest.Version)
+	}
+
+	now := cm.now().Unix()
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		bind, ok := header.PAXRecords[paxBind]
+		if !ok {
+			return fmt.Errorf("invalid archive: %s has no bind", header.Name)
+		}
+		if expiresAt, _ := strconv.ParseInt(header.PAXRecords[paxExpiresAt], 10, 64); expiresAt > 0 && expiresAt <= now {
+			p.Skipped++
+			continue
+		}
+		// MSetでまとめて検査するが、大きすぎるエントリを読み込む前に止める
+		if err := cm.checkEntrySize(header.Size); err != nil {
+			return fmt.Errorf("%s: %w", bind, err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		if err := add(bind, content); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// EvictionPreview is what size eviction would remove from one cache DB file at its current size
+type EvictionPreview struct {
+	Table     string   `json:"table"`
+	TenantID  string   `json:"tenant_id"`
+	Freshness string   `json:"freshness"`
+	Size      int64    `json:"size"`   // 使用中のページのバイト数 (MaxSizeと比べる値)
+	Limit     int64    `json:"limit"`  // MaxSizeまたはテナントの上限
+	Target    int64    `json:"target"` // 削除する必要のあるバイト数。0なら何も削除しない
+	Binds     []string `json:"binds"`  // 削除ポリシーが選ぶ順
+	Bytes     int64    `json:"bytes"`  // Bindsのcontentの合計バイト数
+}
+
+// PreviewEviction returns, for every freshness DB of the tenant, the entries the eviction policy would
+// remove at the current size, without deleting them. TotalMaxSize is not taken into account, and
+// SampledLRUPolicy may choose different entries each time.
+func (cm *CacheManager) PreviewEviction(table, tenantID string) ([]EvictionPreview, error) {
+	if err := cm.checkNames(table, tenantID); err != nil {
+		return nil, err
+	}
+	// 実際の削除と同じ順序になるよう、溜まったアクセスを書き込むので排他ロックを取る
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+
+	freshnesses, err := cm.otherFreshness(table, tenantID, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache files: %w", err)
+	}
+	sort.Strings(freshnesses)
+
+	result := make([]EvictionPreview, 0, len(freshnesses))
+	for _, freshness := range freshnesses {
+		preview := EvictionPreview{Table: table, TenantID: tenantID, Freshness: freshness, Binds: []string{}}
+		db, err := cm.openDB(table, tenantID, freshness)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open database: %w", err)
+		}
+		if preview.Size, err = dbSizeBytes(db); err != nil {
+			return nil, err
+		}
+		preview.Limit = cm.maxBytes(table, tenantID)
+		preview.Target = cm.pendingEvictionBytes(table, tenantID, preview.Size)
+
+		if preview.Target > 0 {
+			cm.flushAccesses(cm.getDBKey(table, tenantID, freshness), db)
+			victims, err := cm.evictionPolicy(table).SelectVictims(db, preview.Target)
+			if err != nil {
+				return nil, err
+			}
+			entries, err := entriesByIDs(db, victims)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				preview.Binds = append(preview.Binds, entry.Key)
+				preview.Bytes += entry.Size
+			}
+		}
+		result = append(result, preview)
+	}
+	return result, nil
+}
+
+// pendingEvictionBytes returns the bytes eviction would remove from a DB of the tenant using size bytes:
+// down to Cap of the limit once the hard watermark is exceeded, or, with background eviction,
+// down to its target once the soft watermark is exceeded
+func (cm *CacheManager) pendingEvictionBytes(table, tenantID string, size int64) int64 {
+	maxBytes := cm.maxBytes(table, tenantID)
+	if cm.evictor != nil && size > cm.softWatermarkBytes(maxBytes) {
+		return size - cm.backgroundTargetBytes(maxBytes)
+	}
+	if size > cm.hardWatermarkBytes(maxBytes) {
+		return max(size-int64(float64(maxBytes)*cm.config.Cap), 0)
+	}
+	return 0
+}
+
+// entriesByIDs returns the binds and content sizes of the entries in the order of ids, skipping pinned
+// entries and ids that no longer exist
+func entriesByIDs(db *sql.DB, ids []int64) ([]EventEntry, error) {
+	found := make(map[int64]EventEntry, len(ids))
+	for start := 0; start < len(ids); start += mgetChunkSize {
+		chunk := ids[start:min(start+mgetChunkSize, len(ids))]
+		args := make([]interface{}, len(chunk))
+		for i, id := range chunk {
+			args[i] = id
+		}
+		query := fmt.Sprintf("SELECT id, "+listedBind+", size FROM cache WHERE id IN (%s) AND priority < %d", placeholders(len(chunk)), PriorityPin)
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read eviction victims: %w", err)
+		}
+		for rows.Next() {
+			var id int64
+			var entry EventEntry
+			if err := rows.Scan(&id, &entry.Key, &entry.Size); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("failed to read eviction victims: %w", err)
+			}
+			found[id] = entry
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read eviction victims: %w", err)
+		}
+	}
+
+	entries := make([]EventEntry, 0, len(found))
+	for _, id := range ids {
+		if entry, ok := found[id]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 優先度はcacheのpriorityに保存する。サイズ超過で削除するときは優先度の低いエントリから
+// 削除ポリシーの順に選び、PriorityPinのエントリは選ばない。期限切れや明示的な削除では優先度に関わらず消える。
+// Set・SetNX・SetCAS・MSet・SetFromReaderで登録し直したエントリはPriorityNormalになり、Appendではそのまま残る。
+
+// Priority decides which entries are evicted first when a DB exceeds its size limit
+type Priority int
+
+const (
+	PriorityLow    Priority = -1 // 他のエントリより先に削除する
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1 // LowとNormalのエントリがなくなってから削除する
+	PriorityPin    Priority = 2 // サイズ超過では削除しない
+)
+
+var priorityNames = map[Priority]string{
+	PriorityLow:    "low",
+	PriorityNormal: "normal",
+	PriorityHigh:   "high",
+	PriorityPin:    "pin",
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority returns the priority for "low", "normal", "high" or "pin"
+func ParsePriority(name string) (Priority, error) {
+	for p, n := range priorityNames {
+		if strings.EqualFold(name, n) {
+			return p, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q: expected low, normal, high or pin", name)
+}
+
+// SetWithPriority stores content like SetWithTTL with the eviction priority of the entry.
+// Pinned entries still count toward MaxSize, so a DB holding only pinned entries may grow beyond it.
+func (cm *CacheManager) SetWithPriority(table, tenantID string, freshness string, bind string, content []byte, ttl time.Duration, priority Priority) error {
+	if _, ok := priorityNames[priority]; !ok {
+		return fmt.Errorf("invalid priority %d", int(priority))
+	}
+	_, _, err := cm.set(context.Background(), table, tenantID, freshness, bind, content, ttl, entryAttrs{priority: priority}, setAlways, 0)
+	return err
+}
@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxBytes returns the size limit in bytes of the tenant's DB. The most specific setting wins:
+// TenantQuotas["table/tenant"], TenantQuotas["tenant"], TenantQuota, and finally MaxSize.
+func (cm *CacheManager) maxBytes(table, tenantID string) int64 {
+	mb := cm.config.MaxSize
+	if quota, ok := cm.config.TenantQuotas[table+"/"+tenantID]; ok {
+		mb = quota
+	} else if quota, ok := cm.config.TenantQuotas[tenantID]; ok {
+		mb = quota
+	} else if cm.config.TenantQuota > 0 {
+		mb = cm.config.TenantQuota
+	}
+	return int64(mb) * 1024 * 1024
+}
+
+func validateQuotaConfig(config CacheConfig) error {
+	if config.TenantQuota < 0 {
+		return fmt.Errorf("tenant quota must not be negative, got %d", config.TenantQuota)
+	}
+	for key, quota := range config.TenantQuotas {
+		if quota <= 0 {
+			return fmt.Errorf("quota of %q must be positive, got %d", key, quota)
+		}
+		if key == "" || strings.Count(key, "/") > 1 {
+			return fmt.Errorf("invalid quota key %q: use \"tenant_id\" or \"table/tenant_id\"", key)
+		}
+	}
+	return nil
+}
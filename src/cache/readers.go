@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ReadConnectionsを指定すると、DBごとに書き込み用の接続を1つに絞り、Get・Peek・Existsは別に開いた
+// 読み取り専用の接続で読む。WALでは読み込みが書き込みを待たずに並行して進む。
+// 読み取り専用の接続ではlast_accessedとhitsを更新できないので、Getのアクセスはメモリに溜めておき、
+// 削除するエントリを選ぶ前とDBを閉じる前に書き込み用の接続でまとめて書き込む。
+
+// maxPendingAccesses is the number of binds per DB whose accesses are buffered before they are written
+const maxPendingAccesses = 1000
+
+type pendingAccess struct {
+	lastAccessed int64
+	hits         int
+}
+
+// accessBuffer collects the accesses of Gets served by read-only connections, per DB key and bind
+type accessBuffer struct {
+	mu      sync.Mutex
+	pending map[string]map[string]pendingAccess
+}
+
+// record adds an access and returns the number of binds pending for key
+func (b *accessBuffer) record(key, bind string, now int64) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending == nil {
+		b.pending = make(map[string]map[string]pendingAccess)
+	}
+	binds := b.pending[key]
+	if binds == nil {
+		binds = make(map[string]pendingAccess)
+		b.pending[key] = binds
+	}
+	access := binds[bind]
+	access.lastAccessed = max(access.lastAccessed, now)
+	access.hits++
+	binds[bind] = access
+	return len(binds)
+}
+
+// take removes and returns the accesses pending for key
+func (b *accessBuffer) take(key string) map[string]pendingAccess {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	binds := b.pending[key]
+	delete(b.pending, key)
+	return binds
+}
+
+func validateReaderConfig(config CacheConfig) error {
+	if config.ReadConnections < 0 {
+		return fmt.Errorf("read connections must not be negative, got %d", config.ReadConnections)
+	}
+	if config.ReadConnections > 0 && !strings.EqualFold(config.JournalMode, "WAL") {
+		return fmt.Errorf("read connections require WAL journal mode, got %q", config.JournalMode)
+	}
+	if config.ReadConnections > 0 && !sqliteFileLocking {
+		return fmt.Errorf("read connections require file locking, which this build does not have")
+	}
+	return nil
+}
+
+// openReader limits db to a single writer connection and returns a pool of read-only connections
+// to the same file, or nil if ReadConnections is not set
+func (cm *CacheManager) openReader(db *sql.DB, dbPath string) *sql.DB {
+	if cm.config.ReadConnections <= 0 {
+		return nil
+	}
+	db.SetMaxOpenConns(1)
+
+	reader := cm.openSQLite(readOnlyDSN(dbPath), cm.readerPragmas())
+	reader.SetMaxOpenConns(cm.config.ReadConnections)
+	reader.SetMaxIdleConns(cm.config.ReadConnections)
+	return reader
+}
+
+// readOnlyDSN returns the DSN that opens dbPath read-only
+func readOnlyDSN(dbPath string) string {
+	// mode=roはURI形式のファイル名でしか指定できない
+	path, err := filepath.Abs(dbPath)
+	if err != nil {
+		path = dbPath
+	}
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path), RawQuery: "mode=ro"}).String()
+}
+
+// readerPragmas returns the PRAGMAs of read-only connections, which must not change the file
+func (cm *CacheManager) readerPragmas() []string {
+	var pragmas []string
+	for _, pragma := range cm.pragmas() {
+		if strings.HasPrefix(pragma, "PRAGMA auto_vacuum") || strings.HasPrefix(pragma, "PRAGMA journal_mode") {
+			continue
+		}
+		pragmas = append(pragmas, pragma)
+	}
+	return pragmas
+}
+
+// openReadDB opens the DB like openDB and returns its read-only connections if there are any
+func (cm *CacheManager) openReadDB(table, tenantID string, freshness string) (*sql.DB, error) {
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		return nil, err
+	}
+	if reader := cm.lookupReader(cm.getDBKey(table, tenantID, freshness)); reader != nil {
+		return reader, nil
+	}
+	return db, nil
+}
+
+// recordAccess remembers a Get served by a read-only connection. When enough accesses are pending
+// they are written through db, the writer connection.
+func (cm *CacheManager) recordAccess(key string, db *sql.DB, bind string, now int64) {
+	if cm.accesses.record(key, bind, now) >= maxPendingAccesses {
+		// 削除の順序が少しずれるだけなので、失敗しても読み込みは成功させる
+		cm.flushAccesses(key, db)
+	}
+}
+
+// flushAccesses writes the pending accesses of the DB key to last_accessed and hits
+func (cm *CacheManager) flushAccesses(key string, db *sql.DB) error {
+	binds := cm.accesses.take(key)
+	if len(binds) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE cache SET last_accessed = max(last_accessed, ?), hits = hits + ? WHERE bind = ?")
+	if err != nil {
+		return fmt.Errorf("failed to prepare access update: %w", err)
+	}
+	defer stmt.Close()
+
+	for bind, access := range binds {
+		if _, err := stmt.Exec(access.lastAccessed, access.hits, bind); err != nil {
+			return fmt.Errorf("failed to update access time: %w", err)
+		}
+	}
+	return tx.Commit()
+}
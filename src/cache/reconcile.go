@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// staleSpoolAge is the age after which a spool file of SetFromReader is considered left over
+	// from a crashed process. Other processes sharing BaseDir may still be writing younger ones.
+	staleSpoolAge = time.Hour
+	// reconcilePreopenLimit bounds the DBs opened at startup when MaxOpenDBs is not set
+	reconcilePreopenLimit = 64
+)
+
+// ReconcileReport summarizes the startup scan run by Init when ReconcileOnInit is set
+type ReconcileReport struct {
+	Databases    int           `json:"databases"`     // 見つかったDBファイルの数
+	Opened       int           `json:"opened"`        // 事前にオープンしたDBの数
+	Corrupt      int           `json:"corrupt"`       // quick_checkで壊れていたDBの数
+	Recreated    int           `json:"recreated"`     // 壊れていたため削除したDBの数 (RepairRecreateの場合)
+	RemovedFiles int           `json:"removed_files"` // 削除した一時ファイルと、DBファイルのないジャーナル
+	RemovedDirs  int           `json:"removed_dirs"`  // 削除した空のテナント・テーブルのディレクトリ
+	Duration     time.Duration `json:"duration"`
+}
+
+// ReconcileReport returns the result of the startup scan. It is the zero value if
+// ReconcileOnInit is not set.
+func (cm *CacheManager) ReconcileReport() ReconcileReport {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.reconciled
+}
+
+// reconcile walks BaseDir on startup. Init holds cm.mutex exclusively, so no other operation runs
+// and the tenant locks are not needed.
+func (cm *CacheManager) reconcile() ReconcileReport {
+	start := time.Now()
+	var report ReconcileReport
+
+	// 異常終了したプロセスが残したSetFromReaderの一時ファイル
+	spools, _ := filepath.Glob(filepath.Join(cm.config.BaseDir, ".spool-*"))
+	for _, path := range spools {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleSpoolAge {
+			if os.Remove(path) == nil {
+				report.RemovedFiles++
+			}
+		}
+	}
+
+	// DBファイルが消えた後に残ったジャーナル。DBファイルがあるジャーナルは復旧に必要なので残す
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		journals, _ := filepath.Glob(filepath.Join(cm.config.BaseDir, "*", "*", "*.db"+suffix))
+		for _, path := range journals {
+			if _, err := os.Stat(strings.TrimSuffix(path, suffix)); os.IsNotExist(err) && os.Remove(path) == nil {
+				report.RemovedFiles++
+			}
+		}
+	}
+
+	dirs, _ := filepath.Glob(filepath.Join(cm.config.BaseDir, "*", "*"))
+	for _, dir := range dirs {
+		if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 && os.Remove(dir) == nil {
+			report.RemovedDirs++
+		}
+	}
+	tableDirs, _ := filepath.Glob(filepath.Join(cm.config.BaseDir, "*"))
+	for _, dir := range tableDirs {
+		if entries, err := os.ReadDir(dir); err == nil && len(entries) == 0 && os.Remove(dir) == nil {
+			report.RemovedDirs++
+		}
+	}
+
+	paths, _ := filepath.Glob(filepath.Join(cm.config.BaseDir, "*", "*", "*.db"))
+	modTimes := make(map[string]time.Time)
+	var healthy []string
+	for _, dbPath := range paths {
+		info, err := os.Stat(dbPath)
+		if err != nil {
+			continue
+		}
+		report.Databases++
+		if cm.config.ReconcileCheck && cm.reconcileCheck(dbPath, &report) {
+			continue
+		}
+		healthy = append(healthy, dbPath)
+		modTimes[dbPath] = info.ModTime()
+	}
+
+	// 最近更新されたDBから、最初のリクエストより前にオープンしておく
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return modTimes[healthy[i]].After(modTimes[healthy[j]])
+	})
+	limit := cm.config.MaxOpenDBs
+	if limit <= 0 {
+		limit = reconcilePreopenLimit
+	}
+	for _, dbPath := range healthy[:min(limit, len(healthy))] {
+		table, tenantID, freshness := splitDBPath(dbPath)
+		if _, err := cm.openDB(table, tenantID, freshness); err == nil {
+			report.Opened++
+		}
+	}
+
+	report.Duration = time.Since(start)
+	cm.logger().Info("sqlite-cache: reconciled base directory", "databases", report.Databases, "opened", report.Opened,
+		"corrupt", report.Corrupt, "removed_files", report.RemovedFiles, "removed_dirs", report.RemovedDirs, "duration", report.Duration)
+	return report
+}
+
+// reconcileCheck runs quick_check on the DB file and reports whether it is corrupt.
+// With RepairRecreate a corrupt file is removed, to be recreated empty on first use.
+func (cm *CacheManager) reconcileCheck(dbPath string, report *ReconcileReport) bool {
+	db := cm.openSQLite(dbPath, cm.pragmas())
+	err := quickCheck(db)
+	db.Close()
+	if !errors.Is(err, ErrCorrupt) && !isCorruptError(err) {
+		return false
+	}
+
+	report.Corrupt++
+	table, tenantID, freshness := splitDBPath(dbPath)
+	cm.notifyCorruption(table, tenantID, freshness, err)
+	if cm.config.RepairPolicy == RepairRecreate {
+		cm.logger().Warn("sqlite-cache: removing corrupt database", "path", dbPath, "error", err)
+		if removeDBFiles(dbPath) == nil {
+			cm.usage.forget(cm.getDBKey(table, tenantID, freshness))
+			report.Recreated++
+		}
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	RepairNone     = ""         // 検査しない
+	RepairCheck    = "check"    // オープン時にquick_checkし、壊れていればErrCorruptを返す
+	RepairRecreate = "recreate" // 壊れたDBファイルを削除して空のDBを作り直す
+)
+
+func validateRepairConfig(config CacheConfig) error {
+	switch config.RepairPolicy {
+	case RepairNone, RepairCheck, RepairRecreate:
+		return nil
+	}
+	return fmt.Errorf("unsupported repair policy %q", config.RepairPolicy)
+}
+
+// isCorruptError reports whether err means the DB file is damaged
+func isCorruptError(err error) bool {
+	if err == nil {
+		return false
+	}
+	errStr := strings.ToLower(err.Error())
+	return strings.Contains(errStr, "database disk image is malformed") ||
+		strings.Contains(errStr, "file is not a database")
+}
+
+// quickCheck runs PRAGMA quick_check and returns ErrCorrupt if the DB is damaged
+func quickCheck(db *sql.DB) error {
+	return checkDB(db, "quick_check")
+}
+
+// integrityCheck is quickCheck with PRAGMA integrity_check, which also verifies the indexes
+func integrityCheck(db *sql.DB) error {
+	return checkDB(db, "integrity_check")
+}
+
+func checkDB(db *sql.DB, pragma string) error {
+	rows, err := db.Query("PRAGMA " + pragma)
+	if err != nil {
+		if isCorruptError(err) {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		return fmt.Errorf("failed to run %s: %w", pragma, err)
+	}
+	defer rows.Close()
+
+	// 問題がなければ"ok"の1行だけが返る
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return fmt.Errorf("failed to read %s: %w", pragma, err)
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		if isCorruptError(err) {
+			return fmt.Errorf("%w: %v", ErrCorrupt, err)
+		}
+		return fmt.Errorf("failed to read %s: %w", pragma, err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrCorrupt, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// removeDBFiles deletes the DB file together with its journal files
+func removeDBFiles(dbPath string) error {
+	err := os.Remove(dbPath)
+	// WALなどのジャーナルファイルも削除
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		os.Remove(dbPath + suffix)
+	}
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// recreateDB replaces the corrupt DB file with an empty one. Concurrent readers may find the
+// same corruption, so the first one recreates the file and the others use its handle.
+func (cm *CacheManager) recreateDB(table, tenantID string, freshness string, cause error) (*sql.DB, error) {
+	key := cm.getDBKey(table, tenantID, freshness)
+	dbPath := cm.getDBPath(table, tenantID, freshness)
+
+	cm.repairMu.Lock()
+	defer cm.repairMu.Unlock()
+
+	if db, exists := cm.lookupDB(key); exists {
+		return db, nil
+	}
+
+	cm.logger().Warn("sqlite-cache: recreating corrupt database", "path", dbPath, "error", cause)
+	if err := removeDBFiles(dbPath); err != nil {
+		return nil, fmt.Errorf("failed to remove corrupt database: %w", err)
+	}
+	cm.counters.forget(key)
+	cm.usage.forget(key)
+	cm.forgetHotDB(table, tenantID, freshness)
+	cm.publishMutation(MutationDelete, table, tenantID, freshness, "")
+
+	db, err := cm.openSQLiteDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	return cm.registerDB(key, table, tenantID, db, cm.openReader(db, dbPath)), nil
+}
+
+// discardCorruptDB closes and removes the DB if err shows that it is corrupt and RepairPolicy is
+// RepairRecreate, so that the next operation starts with an empty DB. The caller must hold the
+// tenant lock exclusively.
+func (cm *CacheManager) discardCorruptDB(table, tenantID string, freshness string, err error) {
+	if cm.config.RepairPolicy != RepairRecreate || !isCorruptError(err) {
+		return
+	}
+	key := cm.getDBKey(table, tenantID, freshness)
+	dbPath := cm.getDBPath(table, tenantID, freshness)
+	cm.logger().Warn("sqlite-cache: removing corrupt database", "path", dbPath, "error", err)
+	cm.notifyCorruption(table, tenantID, freshness, err)
+
+	cm.closeDB(key)
+	removeDBFiles(dbPath)
+	cm.counters.forget(key)
+	cm.usage.forget(key)
+	cm.forgetHotDB(table, tenantID, freshness)
+	cm.publishMutation(MutationDelete, table, tenantID, freshness, "")
+}
+
+// repairIfCorrupt is discardCorruptDB for callers that do not hold the tenant lock.
+// The DB may have been recreated while waiting for the lock, so it is checked again first.
+func (cm *CacheManager) repairIfCorrupt(table, tenantID string, freshness string, err error) {
+	if cm.config.RepairPolicy != RepairRecreate || !isCorruptError(err) {
+		return
+	}
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+
+	// 閉じられていれば、次のオープン時のquick_checkに任せる
+	db, exists := cm.lookupDB(cm.getDBKey(table, tenantID, freshness))
+	if !exists || quickCheck(db) == nil {
+		return
+	}
+	cm.discardCorruptDB(table, tenantID, freshness, err)
+}
@@ -0,0 +1,201 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// レプリケーションは変更フィードの上に作る。プライマリは登録と削除をReplicationRecordとして送り、
+// 登録は送る時点の値をPeekで読んで付ける。途中の値を飛ばしても、最後の登録の値は必ず届く。
+// LRU削除と期限切れは送らず、レプリカがそれぞれのMaxSizeと有効期限で行う。
+// 購読が遅れて変更を取りこぼしたら、レプリカはスナップショットから取り直す。
+
+// ReplicationRecord is one change sent from a primary to its replicas. Op is MutationSet or MutationDelete,
+// and the names of a delete cover as much as those of a Mutation.
+type ReplicationRecord struct {
+	Op        MutationOp `json:"op"`
+	Table     string     `json:"table"`
+	TenantID  string     `json:"tenant_id,omitempty"`
+	Freshness string     `json:"freshness,omitempty"`
+	Bind      string     `json:"bind,omitempty"`
+	Content   []byte     `json:"content,omitempty"`
+	ExpiresAt int64      `json:"expires_at,omitempty"` // 0なら期限なし
+	Metadata  string     `json:"metadata,omitempty"`
+}
+
+// replicationReset starts a snapshot. The replica drops its entries, which may include some deleted
+// on the primary while it was disconnected, and receives every live entry again.
+const replicationReset MutationOp = "reset"
+
+var errReplicaLagged = errors.New("replica fell behind the change feed")
+
+// Replicate calls send with the changes made from now on until ctx is done. With snapshot, a reset
+// and then every live entry as a set, oldest freshness first, are sent first so that the replica catches up.
+// It requires ChangeFeedBuffer, which must hold the changes made while the snapshot is sent; when a
+// replica falls further behind, Replicate returns an error and the replica must start over with a snapshot.
+func (cm *CacheManager) Replicate(ctx context.Context, snapshot bool, send func(ReplicationRecord) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// スナップショットの間の変更も取りこぼさないよう、先に購読する
+	mutations, err := cm.Subscribe(ctx)
+	if err != nil {
+		return err
+	}
+	if snapshot {
+		if err := send(ReplicationRecord{Op: replicationReset}); err != nil {
+			return err
+		}
+		if err := cm.sendSnapshot(send); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case m, ok := <-mutations:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				return errReplicaLagged
+			}
+			record, ok, err := cm.replicationRecord(m)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if err := send(record); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replicationRecord returns the record of m, or false if replicas do not need it
+func (cm *CacheManager) replicationRecord(m Mutation) (ReplicationRecord, bool, error) {
+	record := ReplicationRecord{Op: m.Op, Table: m.Table, TenantID: m.TenantID, Freshness: m.Freshness, Bind: m.Bind}
+	switch m.Op {
+	case MutationDelete:
+		return record, true, nil
+	case MutationSet:
+		entry, err := cm.peekEntry(m.Table, m.TenantID, m.Freshness, m.Bind)
+		if err != nil {
+			// その後に削除されていれば、削除も届くので飛ばす
+			if IsNotFound(err) || errors.Is(err, ErrChecksumMismatch) {
+				return record, false, nil
+			}
+			return record, false, err
+		}
+		record.Content, record.ExpiresAt, record.Metadata = entry.Content, entry.ExpiresAt, entry.Metadata
+		return record, true, nil
+	}
+	return record, false, nil
+}
+
+func (cm *CacheManager) sendSnapshot(send func(ReplicationRecord) error) error {
+	tables, err := cm.ListTables()
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		tenants, err := cm.ListTenants(table)
+		if err != nil {
+			return err
+		}
+		for _, tenantID := range tenants {
+			freshnesses, err := cm.otherFreshness(table, tenantID, "")
+			if err != nil {
+				return err
+			}
+			// 新しいフレッシュネスの登録でレプリカの古いファイルが削除されるので、古いものから送る
+			for i := len(freshnesses) - 1; i >= 0; i-- {
+				if err := cm.sendDB(table, tenantID, freshnesses[i], send); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (cm *CacheManager) sendDB(table, tenantID string, freshness string, send func(ReplicationRecord) error) error {
+	var lastID int64
+	for {
+		page, err := cm.iteratePage(table, tenantID, freshness, lastID)
+		if err != nil {
+			return err
+		}
+		for _, row := range page {
+			record := ReplicationRecord{
+				Op: MutationSet, Table: table, TenantID: tenantID, Freshness: freshness, Bind: row.bind,
+				Content: row.content, ExpiresAt: row.expiresAt, Metadata: row.metadata,
+			}
+			if err := send(record); err != nil {
+				return err
+			}
+		}
+		if len(page) < iteratePageSize {
+			return nil
+		}
+		lastID = page[len(page)-1].id
+	}
+}
+
+// ApplyReplication applies a record received from the primary. Deletes are not published on the
+// InvalidationBus, since every replica receives them from the primary.
+func (cm *CacheManager) ApplyReplication(record ReplicationRecord) error {
+	if record.Op == replicationReset {
+		tables, err := cm.ListTables()
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if err := cm.Delete(table); err != nil {
+				return fmt.Errorf("failed to reset table %s: %w", table, err)
+			}
+		}
+		return nil
+	}
+
+	// プライマリから届いた名前がBaseDirの外を指さないようにする
+	if !isPathElement(record.Table) ||
+		(record.TenantID != "" && !isPathElement(record.TenantID)) ||
+		(record.Freshness != "" && !isPathElement(record.Freshness)) {
+		return fmt.Errorf("invalid replication record: bad names %q/%q/%q", record.Table, record.TenantID, record.Freshness)
+	}
+
+	switch record.Op {
+	case MutationSet:
+		if record.TenantID == "" || record.Freshness == "" {
+			return fmt.Errorf("invalid replication record: set without tenant or freshness")
+		}
+		var ttl time.Duration
+		if record.ExpiresAt > 0 {
+			if ttl = time.Unix(record.ExpiresAt, 0).Sub(cm.now()); ttl <= 0 {
+				return nil
+			}
+		}
+		return cm.SetWithMetadata(record.Table, record.TenantID, record.Freshness, record.Bind, record.Content, ttl, record.Metadata)
+	case MutationDelete:
+		switch {
+		case record.TenantID == "":
+			return cm.Delete(record.Table)
+		case record.Freshness == "":
+			return cm.deleteTenant(record.Table, record.TenantID)
+		case record.Bind == "":
+			// DB全体が削除または置き換えられた
+			_, err := cm.DeletePrefix(record.Table, record.TenantID, record.Freshness, "")
+			return err
+		}
+		ctx, cancel := cm.withTimeout(context.Background())
+		defer cancel()
+		return cm.deleteEntry(ctx, record.Table, record.TenantID, record.Freshness, record.Bind)
+	}
+	return fmt.Errorf("invalid replication record: unknown op %q", record.Op)
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// スナップショット (BackupAllの出力など) はBaseDirと同じtable/tenant/freshness.dbの構成で置く。
+// ファイルはまずテナントのディレクトリに隠しファイルとしてコピーし、テナントのロックを取って
+// 開いているハンドルを閉じてからrenameで置き換えるので、途中の状態のファイルが見えることはない。
+
+// Restore installs the snapshot DB files under srcDir, laid out like BaseDir, into BaseDir and
+// returns the number of files installed. Every file is checked before any is installed, so a
+// damaged snapshot leaves the cache unchanged. A file replaces the DB of the same freshness;
+// DB files of other freshness values are left as they are.
+func (cm *CacheManager) Restore(srcDir string) (int, error) {
+	if within, err := isWithin(srcDir, cm.config.BaseDir); err != nil {
+		return 0, err
+	} else if within {
+		return 0, fmt.Errorf("restore directory must be outside the base directory: %s", srcDir)
+	}
+	if _, err := os.Stat(srcDir); err != nil {
+		return 0, fmt.Errorf("failed to read restore directory: %w", err)
+	}
+	if err := cm.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(srcDir, "*", "*", "*.db"))
+	if err != nil {
+		return 0, err
+	}
+	var snapshots []string
+	for _, srcPath := range paths {
+		table, tenantID, _ := splitDBPath(srcPath)
+		// BaseDirと同じく、隠しディレクトリは対象にしない
+		if strings.HasPrefix(table, ".") || strings.HasPrefix(tenantID, ".") {
+			continue
+		}
+		if err := cm.checkSnapshot(srcPath); err != nil {
+			return 0, fmt.Errorf("invalid snapshot %s: %w", srcPath, err)
+		}
+		snapshots = append(snapshots, srcPath)
+	}
+
+	for i, srcPath := range snapshots {
+		if err := cm.restoreDB(srcPath); err != nil {
+			return i, err
+		}
+	}
+	return len(snapshots), nil
+}
+
+// checkSnapshot opens the snapshot read-only and verifies that it is an intact cache DB
+func (cm *CacheManager) checkSnapshot(srcPath string) error {
+	db := cm.openSQLite(readOnlyDSN(srcPath), nil)
+	defer db.Close()
+
+	if err := quickCheck(db); err != nil {
+		return err
+	}
+	var tables int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'cache'").Scan(&tables); err != nil {
+		return fmt.Errorf("failed to read schema: %w", err)
+	}
+	if tables == 0 {
+		return fmt.Errorf("cache table not found")
+	}
+	return nil
+}
+
+// restoreDB copies the snapshot next to the DB it replaces and swaps it in under the tenant lock
+func (cm *CacheManager) restoreDB(srcPath string) error {
+	table, tenantID, freshness := splitDBPath(srcPath)
+	dbPath := cm.getDBPath(table, tenantID, freshness)
+
+	// コピーには時間がかかるので、ロックを取る前に済ませる
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	tmpPath, err := copySnapshot(src, filepath.Dir(dbPath))
+	src.Close()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+
+	if err := cm.installDB(tmpPath, table, tenantID, freshness); err != nil {
+		return err
+	}
+	cm.logger().Info("sqlite-cache: restored cache file", "path", dbPath, "source", srcPath)
+	return nil
+}
+
+// installDB replaces the DB file with tmpPath, which must be in the same directory, and forgets
+// what was cached about the old file. The caller must hold the tenant lock exclusively, or cm.mutex.
+func (cm *CacheManager) installDB(tmpPath string, table, tenantID string, freshness string) error {
+	key := cm.getDBKey(table, tenantID, freshness)
+	dbPath := cm.getDBPath(table, tenantID, freshness)
+	cm.closeDB(key)
+	// 古いファイルのジャーナルが新しいファイルに適用されないよう、置き換える前に消す
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		os.Remove(dbPath + suffix)
+	}
+	if err := os.Rename(tmpPath, dbPath); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+
+	cm.counters.forget(key)
+	cm.usage.forget(key)
+	cm.forgetHotDB(table, tenantID, freshness)
+	cm.negative.removePrefix(pathName(table) + "\x00" + pathName(tenantID) + "\x00" + pathName(freshness) + "\x00")
+	cm.publishMutation(MutationDelete, table, tenantID, freshness, "")
+	return nil
+}
+
+// copySnapshot copies src to a hidden temporary file in dir and returns its path
+func copySnapshot(src io.Reader, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, ".restore-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	_, err = io.Copy(tmp, src)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		if isNoSpaceError(err) {
+			return "", fmt.Errorf("disk full error during restore: %w", err)
+		}
+		return "", fmt.Errorf("failed to copy snapshot: %w", err)
+	}
+	return tmp.Name(), nil
+}
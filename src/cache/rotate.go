@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// GetOptions changes how GetWithOptions looks up an entry
+type GetOptions struct {
+	// 現在のフレッシュネスでミスした場合、Rotateで残した直前のフレッシュネスのDBから読む。
+	// そこで見つかった値はCacheEntry.Staleがtrueになる
+	AllowStale bool
+}
+
+func validateRetainConfig(config CacheConfig) error {
+	if config.RetainFreshness < 0 {
+		return fmt.Errorf("retained freshness count must not be negative, got %d", config.RetainFreshness)
+	}
+	return nil
+}
+
+// Rotate switches the tenant to newFreshness. The new DB is created empty, the most recent previous
+// freshness DBs (at least one, for stale reads, or RetainFreshness) are kept, and older ones are
+// deleted. Rotating to the freshness that already exists does nothing.
+func (cm *CacheManager) Rotate(table, tenantID string, newFreshness string) error {
+	if err := cm.rotate(table, tenantID, newFreshness); err != nil {
+		return err
+	}
+	cm.broadcastInvalidation(context.Background(), Invalidation{Op: InvalidateRotate, Table: table, TenantID: tenantID, Freshness: newFreshness})
+	return nil
+}
+
+func (cm *CacheManager) rotate(table, tenantID string, newFreshness string) error {
+	if err := cm.checkNames(table, tenantID, newFreshness); err != nil {
+		return err
+	}
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+
+	if _, err := os.Stat(cm.getDBPath(table, tenantID, newFreshness)); err == nil {
+		return nil
+	}
+	if err := cm.checkWritable(); err != nil {
+		return err
+	}
+
+	// 直前のフレッシュネスはstaleな読み込みのために必ず残す
+	if err := cm.cleanupOldCacheFiles(table, tenantID, newFreshness, max(cm.config.RetainFreshness, 1)); err != nil {
+		return fmt.Errorf("failed to cleanup old cache files: %w", err)
+	}
+	if _, err := cm.openDB(table, tenantID, newFreshness); err != nil {
+		if isDiskFullError(err) {
+			return fmt.Errorf("disk full error: %w", err)
+		}
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	return nil
+}
+
+// GetWithOptions returns the entry like GetWithInfo. With AllowStale, a miss in freshness falls back
+// to the most recent previous freshness DB, and the entry found there is marked Stale.
+func (cm *CacheManager) GetWithOptions(table, tenantID string, freshness string, bind string, opts GetOptions) (*CacheEntry, error) {
+	entry, err := cm.interceptGet(context.Background(), table, tenantID, freshness, bind, func(ctx context.Context, op *Op) (*CacheEntry, error) {
+		return cm.getWithOptions(op.Table, op.TenantID, op.Freshness, op.Bind, opts)
+	})
+	cm.logAccess(context.Background(), "get", table, tenantID, freshness, bind, entrySize(entry), accessResult(true, err))
+	return entry, err
+}
+
+func (cm *CacheManager) getWithOptions(table, tenantID string, freshness string, bind string, opts GetOptions) (*CacheEntry, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return nil, err
+	}
+	if !opts.AllowStale {
+		return cm.getWithInfo(context.Background(), table, tenantID, freshness, bind)
+	}
+
+	// 現在のDBがなければ、getEntryが古いファイルを削除する前に直前のフレッシュネスから読む
+	var err error = ErrCacheNotFound
+	if _, statErr := os.Stat(cm.getDBPath(table, tenantID, freshness)); statErr == nil {
+		entry, getErr := cm.getWithInfo(context.Background(), table, tenantID, freshness, bind)
+		if !IsNotFound(getErr) {
+			return entry, getErr
+		}
+		err = getErr
+	}
+
+	previous, ok, prevErr := cm.previousFreshness(table, tenantID, freshness)
+	if prevErr != nil {
+		return nil, prevErr
+	}
+	if !ok {
+		return nil, err
+	}
+	// 直前のDBの削除の順序を変えないよう、last_accessedは更新しない
+	entry, staleErr := cm.peekEntry(table, tenantID, previous, bind)
+	if staleErr != nil {
+		if IsNotFound(staleErr) {
+			return nil, err
+		}
+		return nil, staleErr
+	}
+	entry.Stale = true
+	return entry, nil
+}
+
+// previousFreshness returns the most recently modified freshness of the tenant other than current
+func (cm *CacheManager) previousFreshness(table, tenantID string, current string) (string, bool, error) {
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+
+	others, err := cm.otherFreshness(table, tenantID, current)
+	if err != nil {
+		return "", false, err
+	}
+	if len(others) == 0 {
+		return "", false, nil
+	}
+	return others[0], true, nil
+}
@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+)
+
+// flightCall is an in-flight or completed load
+type flightCall struct {
+	wg  sync.WaitGroup
+	val []byte
+	err error
+}
+
+// flightGroup deduplicates concurrent calls that share a key
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// do runs fn once per key at a time. Callers arriving while fn is running wait for and share its result.
+// If fn panics, the waiting callers get an error and the panic continues in the caller that ran fn.
+func (g *flightGroup) do(key string, fn func() ([]byte, error)) ([]byte, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if c, exists := g.calls[key]; exists {
+		g.mu.Unlock()
+		c.wg.Wait()
+		return c.val, c.err
+	}
+	c := &flightCall{}
+	c.wg.Add(1)
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	// fnがpanicしてもキーを残さず、待っている呼び出しを解放する
+	completed := false
+	defer func() {
+		if !completed {
+			c.err = fmt.Errorf("load of %q panicked", key)
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		c.wg.Done()
+	}()
+	c.val, c.err = fn()
+	completed = true
+	return c.val, c.err
+}
+
+func flightKey(table, tenantID, freshness, bind string) string {
+	return pathName(table) + "\x00" + pathName(tenantID) + "\x00" + pathName(freshness) + "\x00" + bind
+}
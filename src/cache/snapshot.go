@@ -0,0 +1,331 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// スナップショットはBackupと同じくVACUUM INTOで取ったDBファイルで、BaseDirと同じ
+// table/tenant/freshness.dbの構成のキーでSnapshotStoreに置く。オートスケールで起動したノードは
+// HydrateOnInitで、まだDBファイルのないテナントのスナップショットをダウンロードしてから動き始める。
+// S3やGCSのクライアントはこのパッケージの依存に含めないので、SnapshotStoreを実装して渡す。
+
+// SnapshotStore is the object storage that snapshots are uploaded to. Keys are slash-separated.
+// Implementations must be safe for concurrent use.
+type SnapshotStore interface {
+	// Put stores the bytes read from r under key, replacing any existing object
+	Put(ctx context.Context, key string, r io.Reader) error
+	// Get returns the object stored under key
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// List returns the keys that start with prefix
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes the object under key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// DirSnapshotStore is a SnapshotStore on a local directory, e.g. a mounted bucket or a shared volume
+type DirSnapshotStore struct {
+	Dir string
+}
+
+func (s DirSnapshotStore) path(key string) string {
+	return filepath.Join(s.Dir, filepath.FromSlash(key))
+}
+
+func (s DirSnapshotStore) Put(ctx context.Context, key string, r io.Reader) error {
+	dest := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	// 書き込み中のファイルを読まれないよう、一時ファイルに書いてから置き換える
+	tmpPath, err := copySnapshot(r, filepath.Dir(dest))
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, dest); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+func (s DirSnapshotStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(s.path(key))
+}
+
+func (s DirSnapshotStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Putの一時ファイルは含めない
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, p)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (s DirSnapshotStore) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var errNoSnapshotStore = errors.New("snapshot store is not configured")
+
+// fileStamp identifies the state of a DB file when it was uploaded
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// snapshotState remembers the DB files uploaded by SyncSnapshots, so unchanged files are skipped
+type snapshotState struct {
+	mu       sync.Mutex // SyncSnapshotsを1つずつ実行する
+	uploaded map[string]fileStamp
+}
+
+// snapshotSyncer periodically uploads snapshots
+type snapshotSyncer struct {
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newSnapshotSyncer(interval time.Duration) *snapshotSyncer {
+	return &snapshotSyncer{
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *snapshotSyncer) run(cm *CacheManager) {
+	defer close(s.done)
+	ticker := cm.clock().NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C():
+			if _, err := cm.SyncSnapshots(context.Background()); err != nil {
+				cm.logger().Warn("sqlite-cache: failed to sync snapshots", "error", err)
+			}
+		}
+	}
+}
+
+func (s *snapshotSyncer) shutdown() {
+	close(s.stop)
+	<-s.done
+}
+
+// stopSnapshotSyncer stops the syncer. Like stopEvictionWorker it must be called
+// before taking cm.mutex exclusively.
+func (cm *CacheManager) stopSnapshotSyncer() {
+	if cm.syncer != nil {
+		cm.syncer.shutdown()
+	}
+}
+
+// snapshotKey returns the key of the snapshot of the DB
+func (cm *CacheManager) snapshotKey(table, tenantID string, freshness string) string {
+	return cm.config.SnapshotPrefix + path.Join(table, tenantID, freshness+".db")
+}
+
+// dbFileStamp returns the stamp of the DB file, including its WAL, whose writes do not touch the DB file
+func dbFileStamp(dbPath string) (fileStamp, error) {
+	stat, err := os.Stat(dbPath)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	stamp := fileStamp{modTime: stat.ModTime(), size: stat.Size()}
+	if wal, err := os.Stat(dbPath + "-wal"); err == nil {
+		if wal.ModTime().After(stamp.modTime) {
+			stamp.modTime = wal.ModTime()
+		}
+		stamp.size += wal.Size()
+	}
+	return stamp, nil
+}
+
+// SyncSnapshots uploads a snapshot of every DB file under BaseDir that changed since it was last
+// uploaded, and deletes the snapshots of other freshness values of the uploaded tenants.
+// It returns the number of snapshots uploaded.
+func (cm *CacheManager) SyncSnapshots(ctx context.Context) (int, error) {
+	store := cm.config.SnapshotStore
+	if store == nil {
+		return 0, errNoSnapshotStore
+	}
+	cm.snapshots.mu.Lock()
+	defer cm.snapshots.mu.Unlock()
+	if cm.snapshots.uploaded == nil {
+		cm.snapshots.uploaded = make(map[string]fileStamp)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(cm.config.BaseDir, "*", "*", "*.db"))
+	if err != nil {
+		return 0, err
+	}
+	tmpDir, err := os.MkdirTemp(cm.config.BaseDir, ".snapshot-*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	uploaded := 0
+	for _, dbPath := range paths {
+		table, tenantID, freshness := splitDBPath(dbPath)
+		key := cm.snapshotKey(table, tenantID, freshness)
+		stamp, err := dbFileStamp(dbPath)
+		if err != nil || cm.snapshots.uploaded[key] == stamp {
+			continue
+		}
+
+		if err := cm.uploadSnapshot(ctx, store, tmpDir, key, table, tenantID, freshness); err != nil {
+			if err == ErrCacheNotFound {
+				continue
+			}
+			return uploaded, err
+		}
+		cm.snapshots.uploaded[key] = stamp
+		uploaded++
+
+		// ローカルで削除されたフレッシュネスのスナップショットは、ハイドレートで古い値を使わないよう消す
+		keys, err := store.List(ctx, cm.config.SnapshotPrefix+path.Join(table, tenantID)+"/")
+		if err != nil {
+			return uploaded, fmt.Errorf("failed to list snapshots: %w", err)
+		}
+		for _, other := range keys {
+			local := filepath.Join(cm.config.BaseDir, filepath.FromSlash(strings.TrimPrefix(other, cm.config.SnapshotPrefix)))
+			if _, err := os.Stat(local); err == nil {
+				continue
+			}
+			if err := store.Delete(ctx, other); err != nil {
+				return uploaded, fmt.Errorf("failed to delete snapshot %s: %w", other, err)
+			}
+			delete(cm.snapshots.uploaded, other)
+		}
+	}
+	return uploaded, nil
+}
+
+func (cm *CacheManager) uploadSnapshot(ctx context.Context, store SnapshotStore, tmpDir, key string, table, tenantID string, freshness string) error {
+	tmpPath := filepath.Join(tmpDir, "snapshot.db")
+	defer os.Remove(tmpPath)
+	if err := cm.Backup(table, tenantID, freshness, tmpPath); err != nil {
+		return err
+	}
+
+	file, err := os.Open(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := store.Put(ctx, key, file); err != nil {
+		return fmt.Errorf("failed to upload snapshot %s: %w", key, err)
+	}
+	cm.logger().Debug("sqlite-cache: uploaded snapshot", "key", key)
+	return nil
+}
+
+// hydrate downloads the snapshots of the tenants that have no DB file under BaseDir and returns the
+// number installed. Snapshots that cannot be downloaded or are damaged are skipped, so a cold node
+// still starts when the store is unavailable. It is called from Init, which holds cm.mutex.
+func (cm *CacheManager) hydrate(ctx context.Context) int {
+	store := cm.config.SnapshotStore
+	keys, err := store.List(ctx, cm.config.SnapshotPrefix)
+	if err != nil {
+		cm.logger().Warn("sqlite-cache: failed to list snapshots", "error", err)
+		return 0
+	}
+
+	installed := 0
+	hasLocal := make(map[string]bool) // テナントのディレクトリ → 起動時にDBファイルがあったか
+	for _, key := range keys {
+		table, tenantID, freshness, ok := parseSnapshotKey(strings.TrimPrefix(key, cm.config.SnapshotPrefix))
+		// メモリ上のテーブルは空で始める
+		if !ok || cm.isMemoryTable(table) {
+			continue
+		}
+		tenantDir := cm.tenantDir(table, tenantID)
+		local, checked := hasLocal[tenantDir]
+		if !checked {
+			matches, _ := filepath.Glob(filepath.Join(tenantDir, "*.db"))
+			local = len(matches) > 0
+			hasLocal[tenantDir] = local
+		}
+		if local {
+			continue
+		}
+
+		if err := cm.hydrateDB(ctx, store, key, table, tenantID, freshness); err != nil {
+			cm.logger().Warn("sqlite-cache: failed to hydrate from snapshot", "key", key, "error", err)
+			continue
+		}
+		installed++
+	}
+	if installed > 0 {
+		cm.logger().Info("sqlite-cache: hydrated cache files from snapshots", "files", installed)
+	}
+	return installed
+}
+
+func (cm *CacheManager) hydrateDB(ctx context.Context, store SnapshotStore, key string, table, tenantID string, freshness string) error {
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	tmpPath, err := copySnapshot(r, cm.tenantDir(table, tenantID))
+	r.Close()
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	if err := cm.checkSnapshot(tmpPath); err != nil {
+		return err
+	}
+	return cm.installDB(tmpPath, table, tenantID, freshness)
+}
+
+// parseSnapshotKey splits "table/tenant/freshness.db" and rejects keys that would point outside BaseDir
+func parseSnapshotKey(key string) (string, string, string, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 3 || !strings.HasSuffix(parts[2], ".db") {
+		return "", "", "", false
+	}
+	table, tenantID, freshness := parts[0], parts[1], strings.TrimSuffix(parts[2], ".db")
+	for _, name := range []string{table, tenantID, freshness} {
+		if !isPathElement(name) || strings.HasPrefix(name, ".") {
+			return "", "", "", false
+		}
+	}
+	return table, tenantID, freshness, true
+}
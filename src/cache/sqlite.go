@@ -0,0 +1,115 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"strings"
+)
+
+var (
+	validJournalModes = []string{"OFF", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL"}
+	validSynchronous  = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+// sqliteConnector opens SQLite connections that run the configured PRAGMAs on every new connection.
+// PRAGMAs such as synchronous and busy_timeout are per connection, so running them once through
+// database/sql would leave the other pooled connections unconfigured.
+type sqliteConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c *sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+func (c *sqliteConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// openSQLite returns a handle whose connections run pragmas, usually cm.pragmas()
+func (cm *CacheManager) openSQLite(dsn string, pragmas []string) *sql.DB {
+	return openSQLiteHandle(dsn, pragmas)
+}
+
+// openSQLiteHandle opens dsn with the driver of the build (driver_cgo.go or driver_purego.go)
+func openSQLiteHandle(dsn string, pragmas []string) *sql.DB {
+	db := sql.OpenDB(&sqliteConnector{dsn: sqliteDSN(dsn), driver: newSQLiteDriver(pragmas)})
+	if !sqliteFileLocking {
+		// ロックがないので、同じファイルに複数の接続から書き込ませない
+		db.SetMaxOpenConns(1)
+	}
+	return db
+}
+
+// runPragmas runs pragmas on a new connection through exec
+func runPragmas(pragmas []string, exec func(string) error) error {
+	for _, pragma := range pragmas {
+		if err := exec(pragma); err != nil {
+			if isNoSpaceError(err) {
+				return fmt.Errorf("disk full error during pragma execution '%s': %w", pragma, err)
+			}
+			return fmt.Errorf("failed to execute pragma '%s': %w", pragma, err)
+		}
+	}
+	return nil
+}
+
+// pragmas returns the PRAGMA statements derived from the config
+func (cm *CacheManager) pragmas() []string {
+	journalMode := "OFF"
+	if cm.config.JournalMode != "" {
+		journalMode = strings.ToUpper(cm.config.JournalMode)
+	}
+	synchronous := "NORMAL"
+	if cm.config.Synchronous != "" {
+		synchronous = strings.ToUpper(cm.config.Synchronous)
+	}
+
+	pragmas := []string{
+		// 新規DBではテーブル作成前に設定する必要がある。既存DBはcreateTablesで変換する
+		"PRAGMA auto_vacuum = INCREMENTAL",
+		fmt.Sprintf("PRAGMA journal_mode = %s", journalMode),
+		fmt.Sprintf("PRAGMA synchronous = %s", synchronous),
+		// INSERT OR REPLACEで置き換えたレコードにもチャンク削除のトリガーを発火させる
+		"PRAGMA recursive_triggers = ON",
+	}
+	if cm.config.BusyTimeout > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA busy_timeout = %d", cm.config.BusyTimeout.Milliseconds()))
+	}
+	if cm.config.MmapSize > 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA mmap_size = %d", cm.config.MmapSize))
+	}
+	if cm.config.CacheSize != 0 {
+		pragmas = append(pragmas, fmt.Sprintf("PRAGMA cache_size = %d", cm.config.CacheSize))
+	}
+	return pragmas
+}
+
+// validatePragmaConfig rejects values that would otherwise be interpolated into PRAGMA statements
+func validatePragmaConfig(config CacheConfig) error {
+	if config.JournalMode != "" && !containsFold(validJournalModes, config.JournalMode) {
+		return fmt.Errorf("invalid journal mode %q, must be one of %s", config.JournalMode, strings.Join(validJournalModes, ", "))
+	}
+	if config.Synchronous != "" && !containsFold(validSynchronous, config.Synchronous) {
+		return fmt.Errorf("invalid synchronous level %q, must be one of %s", config.Synchronous, strings.Join(validSynchronous, ", "))
+	}
+	if config.MmapSize < 0 {
+		return fmt.Errorf("mmap size must not be negative, got %d", config.MmapSize)
+	}
+	if config.BusyTimeout < 0 {
+		return fmt.Errorf("busy timeout must not be negative, got %s", config.BusyTimeout)
+	}
+	return nil
+}
+
+func containsFold(values []string, v string) bool {
+	for _, candidate := range values {
+		if strings.EqualFold(candidate, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// pendingMiss marks a bind whose miss has been handed to one caller who is expected to Set it
+type pendingMiss struct {
+	done   chan struct{}
+	since  time.Time
+	expiry *time.Timer // Setされないまま時間切れになったら取り除く
+}
+
+// missGate coalesces concurrent misses for the same bind (cache stampede protection)
+type missGate struct {
+	mu      sync.Mutex
+	pending map[string]*pendingMiss
+}
+
+// wait returns false if the caller is the first to miss and should regenerate the value.
+// Otherwise it blocks until the value is Set or timeout elapses, and returns true.
+func (g *missGate) wait(key string, timeout time.Duration) bool {
+	g.mu.Lock()
+	if g.pending == nil {
+		g.pending = make(map[string]*pendingMiss)
+	}
+	p, exists := g.pending[key]
+	// 前回ミスを受け取った呼び出しがSetしないまま時間が経った場合は、この呼び出しに任せ直す
+	if !exists || time.Since(p.since) > timeout {
+		if exists {
+			g.remove(key, p)
+		}
+		p = &pendingMiss{done: make(chan struct{}), since: time.Now()}
+		g.pending[key] = p
+		// ミスしたまま一度もSetされないbindがpendingに残り続けないよう、時間切れで消す
+		p.expiry = time.AfterFunc(timeout, func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+			if g.pending[key] == p {
+				g.remove(key, p)
+			}
+		})
+		g.mu.Unlock()
+		return false
+	}
+	g.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.done:
+	case <-timer.C:
+	}
+	return true
+}
+
+// release wakes callers waiting for key
+func (g *missGate) release(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if p, exists := g.pending[key]; exists {
+		g.remove(key, p)
+	}
+}
+
+// remove wakes the callers waiting for p and drops it. Caller must hold g.mu.
+func (g *missGate) remove(key string, p *pendingMiss) {
+	p.expiry.Stop()
+	close(p.done)
+	delete(g.pending, key)
+}
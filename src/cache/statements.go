@@ -0,0 +1,73 @@
+package cache
+
+import (
+	"database/sql"
+	"sync"
+	"sync/atomic"
+)
+
+// StatementStats reports how often the prepared statements of Get, Set and DeleteEntry were reused
+type StatementStats struct {
+	Prepared uint64 `json:"prepared"` // SQLを解析して準備した回数
+	Reused   uint64 `json:"reused"`   // 準備済みの文を使い回した回数
+	Cached   int    `json:"cached"`   // 現在保持している準備済みの文の数
+}
+
+// statementCache keeps the prepared statements of each open DB. The statements are dropped when
+// the handle is closed.
+type statementCache struct {
+	mu       sync.Mutex
+	stmts    map[*sql.DB]map[string]*sql.Stmt
+	prepared atomic.Uint64
+	reused   atomic.Uint64
+}
+
+// prepare returns the prepared statement of query for db, preparing it on first use
+func (c *statementCache) prepare(db *sql.DB, query string) (*sql.Stmt, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stmt, exists := c.stmts[db][query]; exists {
+		c.reused.Add(1)
+		return stmt, nil
+	}
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if c.stmts == nil {
+		c.stmts = make(map[*sql.DB]map[string]*sql.Stmt)
+	}
+	if c.stmts[db] == nil {
+		c.stmts[db] = make(map[string]*sql.Stmt)
+	}
+	c.stmts[db][query] = stmt
+	c.prepared.Add(1)
+	return stmt, nil
+}
+
+// forget closes the statements of db. Call it before closing db.
+func (c *statementCache) forget(db *sql.DB) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, stmt := range c.stmts[db] {
+		stmt.Close()
+	}
+	delete(c.stmts, db)
+}
+
+func (c *statementCache) stats() StatementStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := StatementStats{Prepared: c.prepared.Load(), Reused: c.reused.Load()}
+	for _, stmts := range c.stmts {
+		stats.Cached += len(stmts)
+	}
+	return stats
+}
+
+// StatementStats returns the prepared statement counters since the manager was created
+func (cm *CacheManager) StatementStats() StatementStats {
+	return cm.stmts.stats()
+}
@@ -0,0 +1,180 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DBStats describes one cache DB file, i.e. one (table, tenant, freshness)
+type DBStats struct {
+	Table           string    `json:"table"`
+	TenantID        string    `json:"tenant_id"`
+	Freshness       string    `json:"freshness"`
+	Entries         int64     `json:"entries"`
+	Bytes           int64     `json:"bytes"`            // 保存しているcontentの合計バイト数
+	FileSize        int64     `json:"file_size"`        // DBファイルのサイズ
+	Limit           int64     `json:"limit"`            // 削除を始めるサイズ (MaxSizeまたはテナントの上限)
+	PendingEviction int64     `json:"pending_eviction"` // 今のサイズで削除が必要なバイト数。どのエントリかはPreviewEvictionで調べる
+	Hits            uint64    `json:"hits"`             // 起動してからの回数
+	Misses          uint64    `json:"misses"`
+	LastEviction    time.Time `json:"last_eviction"` // 一度も削除していなければゼロ値
+	ReadOnly        bool      `json:"read_only"`     // ディスクフルでマネージャ全体が読み取り専用になっている
+}
+
+type dbCounter struct {
+	hits         uint64
+	misses       uint64
+	lastEviction time.Time
+}
+
+// dbCounters keeps hit/miss counters per DB key. Unlike metrics it is always enabled.
+type dbCounters struct {
+	mu       sync.Mutex
+	counters map[string]*dbCounter
+}
+
+// entry returns the counter for key. Caller must hold c.mu.
+func (c *dbCounters) entry(key string) *dbCounter {
+	if c.counters == nil {
+		c.counters = make(map[string]*dbCounter)
+	}
+	dc, exists := c.counters[key]
+	if !exists {
+		dc = &dbCounter{}
+		c.counters[key] = dc
+	}
+	return dc
+}
+
+func (c *dbCounters) record(key string, hits, misses int) {
+	if hits <= 0 && misses <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dc := c.entry(key)
+	dc.hits += uint64(hits)
+	dc.misses += uint64(misses)
+}
+
+func (c *dbCounters) recordEviction(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entry(key).lastEviction = time.Now()
+}
+
+func (c *dbCounters) get(key string) dbCounter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if dc, exists := c.counters[key]; exists {
+		return *dc
+	}
+	return dbCounter{}
+}
+
+func (c *dbCounters) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.counters, key)
+}
+
+// forgetPrefix drops the counters of all keys starting with prefix
+func (c *dbCounters) forgetPrefix(prefix string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.counters {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.counters, key)
+		}
+	}
+}
+
+// Stats returns entry counts, sizes and counters of every cache DB file under BaseDir,
+// sorted by table, tenant and freshness.
+func (cm *CacheManager) Stats() ([]DBStats, error) {
+	paths, err := cm.globData(filepath.Join("*", "*", "*.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]DBStats, 0, len(paths))
+	for _, dbPath := range paths {
+		var stats DBStats
+		stats.Table, stats.TenantID, stats.Freshness = splitDBPath(dbPath)
+
+		ok, err := cm.collectDBStats(&stats, dbPath)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			result = append(result, stats)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Table != b.Table {
+			return a.Table < b.Table
+		}
+		if a.TenantID != b.TenantID {
+			return a.TenantID < b.TenantID
+		}
+		return a.Freshness < b.Freshness
+	})
+	return result, nil
+}
+
+// StatsFor returns the stats of one cache DB file without scanning the others, or ErrCacheNotFound
+// if the file does not exist
+func (cm *CacheManager) StatsFor(table, tenantID string, freshness string) (DBStats, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return DBStats{}, err
+	}
+	stats := DBStats{Table: table, TenantID: tenantID, Freshness: freshness}
+	ok, err := cm.collectDBStats(&stats, cm.getDBPath(table, tenantID, freshness))
+	if err != nil {
+		return DBStats{}, err
+	}
+	if !ok {
+		return DBStats{}, ErrCacheNotFound
+	}
+	return stats, nil
+}
+
+// collectDBStats fills stats for the DB file. It reports false if the file was removed meanwhile.
+func (cm *CacheManager) collectDBStats(stats *DBStats, dbPath string) (bool, error) {
+	unlock := cm.rlockTenant(stats.Table, stats.TenantID)
+	defer unlock()
+
+	stat, err := os.Stat(dbPath)
+	if err != nil {
+		return false, nil
+	}
+	stats.FileSize = stat.Size()
+	stats.Limit = cm.maxBytes(stats.Table, stats.TenantID)
+
+	db, err := cm.openDB(stats.Table, stats.TenantID, stats.Freshness)
+	if err != nil {
+		return false, fmt.Errorf("failed to open database: %w", err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*), COALESCE(SUM(size), 0) FROM cache").Scan(&stats.Entries, &stats.Bytes); err != nil {
+		return false, fmt.Errorf("failed to count entries: %w", err)
+	}
+	size, err := dbSizeBytes(db)
+	if err != nil {
+		return false, err
+	}
+	stats.PendingEviction = cm.pendingEvictionBytes(stats.Table, stats.TenantID, size)
+
+	counter := cm.counters.get(cm.getDBKey(stats.Table, stats.TenantID, stats.Freshness))
+	stats.Hits = counter.hits
+	stats.Misses = counter.misses
+	stats.LastEviction = counter.lastEviction
+	stats.ReadOnly = cm.IsReadOnly()
+	return true, nil
+}
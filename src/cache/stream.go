@@ -0,0 +1,494 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// streamChunkSize is the number of bytes read from or written to the DB at a time when streaming
+const streamChunkSize = 1 << 20
+
+// 値はincremental blob I/O (blob.go、mattn/go-sqlite3のビルドのみ) で分割して読み書きする。ドライバの接続からsqlite3の
+// ハンドルを取れない場合は、読み込みはsubstr()で、書き込みは一時テーブルを経由して分割する。
+
+// GetReader returns the content like Get, but reads it from the DB in chunks instead of loading
+// the whole value into memory. Encrypted content is decrypted at once and served from memory.
+// Reading fails with ErrConflict if the entry is replaced or deleted before it has been read to the end.
+// The checksum is verified as the stored bytes are read, so a mismatch is reported by the last Read.
+func (cm *CacheManager) GetReader(table, tenantID string, freshness string, bind string) (io.ReadCloser, error) {
+	r, err := cm.getReader(table, tenantID, freshness, bind)
+	// 読み出すバイト数は呼び出し側が読むまでわからないので記録しない
+	cm.logAccess(context.Background(), "get", table, tenantID, freshness, bind, 0, accessResult(true, err))
+	return r, err
+}
+
+func (cm *CacheManager) getReader(table, tenantID string, freshness string, bind string) (io.ReadCloser, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return nil, err
+	}
+	defer cm.metrics.observe(table, tenantID, "get", time.Now())
+	defer cm.logSlow(table, tenantID, "get", time.Now())
+
+	if missing, err := cm.cleanupIfMissing(table, tenantID, freshness); err != nil {
+		return nil, err
+	} else if missing {
+		cm.metrics.recordMisses(table, tenantID, 1)
+		cm.counters.record(cm.getDBKey(table, tenantID, freshness), 0, 1)
+		return nil, ErrCacheNotFound
+	}
+
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return nil, fmt.Errorf("disk full error: %w", err)
+		}
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	now := cm.now().Unix()
+	br := &blobReader{cm: cm, table: table, tenantID: tenantID, freshness: freshness}
+	var flags int
+	query := `
+	UPDATE cache SET last_accessed = ?, hits = hits + 1
+	WHERE bind = ? AND (expires_at IS NULL OR expires_at > ?)
+	RETURNING id, version, flags, length(content), checksum
+	`
+	err = db.QueryRow(query, now, cm.storedBind(bind), now).Scan(&br.id, &br.version, &flags, &br.size, &br.sum)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			cm.metrics.recordMisses(table, tenantID, 1)
+			cm.counters.record(cm.getDBKey(table, tenantID, freshness), 0, 1)
+			return nil, ErrEntryNotFound
+		}
+		return nil, fmt.Errorf("failed to update and query cache: %w", err)
+	}
+	cm.metrics.recordHits(table, tenantID, 1)
+	cm.counters.record(cm.getDBKey(table, tenantID, freshness), 1, 0)
+	br.chunked = flags&flagChunked != 0
+	br.hash = checksumHashFor(br.sum)
+
+	if flags&(flagEncrypted|flagCodecMask) != 0 {
+		// AES-GCMとTableCodecsの変換は値全体でないと戻せない
+		var content, sum []byte
+		if err := db.QueryRow("SELECT content, checksum FROM cache WHERE id = ?", br.id).Scan(&content, &sum); err != nil {
+			return nil, fmt.Errorf("failed to query cache: %w", err)
+		}
+		if content, err = cm.loadContent(db, br.id, content, flags, sum, entryAAD(table, tenantID, bind)); err != nil {
+			if errors.Is(err, ErrChecksumMismatch) {
+				return nil, cm.dropCorruptEntry(db, table, tenantID, freshness, br.id, bind, fmt.Errorf("%w: %s", err, bind))
+			}
+			return nil, err
+		}
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+
+	switch {
+	case flags&flagGzip != 0:
+		zr, err := gzip.NewReader(bufio.NewReader(br))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress content: %w", err)
+		}
+		return zr, nil
+	case flags&flagZstd != 0:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress content: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(br), nil
+}
+
+// blobReader reads the stored content of one row in chunks, or the rows of cache_chunks one by one
+// for a chunked entry. Each chunk takes the tenant lock on its own, so other operations on the
+// tenant can run between reads.
+type blobReader struct {
+	cm        *CacheManager
+	table     string
+	tenantID  string
+	freshness string
+
+	id      int64
+	version int64
+	size    int64
+	offset  int64
+	buf     []byte
+	scratch *[]byte // blobを読むバッファ。最後まで読んだらプールに返す
+
+	chunked   bool
+	nextChunk int
+	done      bool
+
+	sum  []byte
+	hash hash.Hash // 読んだバイト列のチェックサム。sumがなければnil
+}
+
+func (r *blobReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.done || (!r.chunked && r.offset >= r.size) {
+			putStreamBuffer(r.scratch)
+			r.scratch = nil
+			return 0, r.verify()
+		}
+		if err := r.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *blobReader) fill() error {
+	unlock := r.cm.rlockTenant(r.table, r.tenantID)
+	defer unlock()
+
+	db, err := r.cm.openDB(r.table, r.tenantID, r.freshness)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// contentを書き換える操作はテナントのロックを排他で取るので、確認した後に変わることはない
+	var version int64
+	if err := conn.QueryRowContext(ctx, "SELECT version FROM cache WHERE id = ?", r.id).Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrConflict
+		}
+		return fmt.Errorf("failed to read cache entry: %w", err)
+	}
+	if version != r.version {
+		return ErrConflict
+	}
+
+	if r.chunked {
+		var chunk []byte
+		err := conn.QueryRowContext(ctx, "SELECT data FROM cache_chunks WHERE entry_id = ? AND chunk_index = ?",
+			r.id, r.nextChunk).Scan(&chunk)
+		if err == sql.ErrNoRows {
+			r.done = true
+			return r.verify()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read chunk: %w", err)
+		}
+		r.nextChunk++
+		r.buf = chunk
+		r.write(chunk)
+		return nil
+	}
+
+	if r.scratch == nil {
+		r.scratch = getStreamBuffer()
+	}
+	// 前のチャンクはReadで読み終わっているので、同じバッファに上書きしてよい
+	chunk := (*r.scratch)[:min(streamChunkSize, r.size-r.offset)]
+	err = readBlob(conn, r.id, r.offset, chunk)
+	if errors.Is(err, errNoBlobIO) {
+		// substrは値全体を読み込むので遅いが、どのドライバでも使える (位置は1から数える)
+		err = conn.QueryRowContext(ctx, "SELECT substr(content, ?, ?) FROM cache WHERE id = ?",
+			r.offset+1, len(chunk), r.id).Scan(&chunk)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cache entry: %w", err)
+	}
+	if len(chunk) == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	r.offset += int64(len(chunk))
+	r.buf = chunk
+	r.write(chunk)
+	return nil
+}
+
+func (r *blobReader) write(chunk []byte) {
+	if r.hash != nil {
+		r.hash.Write(chunk)
+	}
+}
+
+// verify returns io.EOF if the bytes read match the checksum of the entry, and ErrChecksumMismatch otherwise
+func (r *blobReader) verify() error {
+	if r.hash != nil && !bytes.Equal(r.hash.Sum(nil), r.sum) {
+		return ErrChecksumMismatch
+	}
+	return io.EOF
+}
+
+// SetFromReader stores the content read from r and returns the number of bytes read.
+// r is first copied to a temporary file under BaseDir, so a slow reader does not hold the tenant lock.
+// When Compression is set, streamed content is compressed regardless of CompressionMinSize.
+// Encrypted content and content of tables with TableCodecs are read into memory, as AES-GCM and
+// codecs transform the whole value at once.
+func (cm *CacheManager) SetFromReader(table, tenantID string, freshness string, bind string, r io.Reader, ttl time.Duration) (int64, error) {
+	n, err := cm.setFromReader(table, tenantID, freshness, bind, r, ttl)
+	cm.logAccess(context.Background(), "set", table, tenantID, freshness, bind, n, accessResult(false, err))
+	return n, err
+}
+
+func (cm *CacheManager) setFromReader(table, tenantID string, freshness string, bind string, r io.Reader, ttl time.Duration) (int64, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return 0, err
+	}
+	if cm.config.MaxEntrySize > 0 {
+		// 上限を1バイトでも超えたら読むのをやめる
+		r = io.LimitReader(r, cm.config.MaxEntrySize+1)
+	}
+
+	if _, ok := cm.codecs[table]; ok || cm.aead != nil {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read content: %w", err)
+		}
+		return int64(len(content)), cm.SetWithTTL(table, tenantID, freshness, bind, content, ttl)
+	}
+	if err := cm.checkWritable(); err != nil {
+		return 0, err
+	}
+
+	spool, read, flags, err := cm.spoolContent(r)
+	if err != nil {
+		return read, err
+	}
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	if cm.config.MaxEntrySize > 0 && read > cm.config.MaxEntrySize {
+		return read, fmt.Errorf("%w: content exceeds the limit of %d bytes", ErrEntryTooLarge, cm.config.MaxEntrySize)
+	}
+
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+	defer cm.metrics.observe(table, tenantID, "set", time.Now())
+	defer cm.logSlow(table, tenantID, "set", time.Now())
+
+	if !cm.dbFileExists(table, tenantID, freshness) {
+		if cleanErr := cm.cleanupOldCacheFiles(table, tenantID, freshness, cm.config.RetainFreshness); cleanErr != nil {
+			return read, fmt.Errorf("failed to cleanup old cache files: %w", cleanErr)
+		}
+	}
+
+	db, err := cm.openDB(table, tenantID, freshness)
+	if err != nil {
+		if isDiskFullError(err) {
+			return read, fmt.Errorf("disk full error: %w", err)
+		}
+		return read, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	stat, err := spool.Stat()
+	if err != nil {
+		return read, err
+	}
+	if err := cm.enforceSize(table, tenantID, freshness, db, stat.Size()); err != nil {
+		return read, fmt.Errorf("failed to enforce size limits before insert: %w", err)
+	}
+	sum, err := cm.checksumReader(spool)
+	if err != nil {
+		return read, err
+	}
+
+	cm.hot.remove(flightKey(table, tenantID, freshness, bind))
+	cm.negative.remove(flightKey(table, tenantID, freshness, bind))
+	err = cm.writeWithRetry(table, tenantID, freshness, db, stat.Size(), func() error {
+		return cm.retryBusy(context.Background(), func() error {
+			if _, err := spool.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			return insertFromSpool(db, spool, cm.storedBind(bind), cm.longBind(bind), flags, sum, stat.Size(), cm.now(), ttl, cm.chunkBytes())
+		})
+	})
+	if err != nil {
+		if isDiskFullError(err) {
+			return read, fmt.Errorf("disk full error during cache insert: %w", err)
+		}
+		return read, fmt.Errorf("failed to insert cache entry: %w", err)
+	}
+	cm.publishMutation(MutationSet, table, tenantID, freshness, bind)
+
+	cm.metrics.recordSets(table, tenantID, 1)
+	cm.recordDBSize(table, tenantID, db)
+	if cm.config.StampedeWait > 0 {
+		cm.misses.release(flightKey(table, tenantID, freshness, bind))
+	}
+	return read, nil
+}
+
+// spoolContent copies r to a temporary file, compressing it if configured.
+// It returns the file positioned at the start, the bytes read from r and the flags of the stored bytes.
+func (cm *CacheManager) spoolContent(r io.Reader) (*os.File, int64, int, error) {
+	if err := os.MkdirAll(cm.config.BaseDir, 0755); err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to create base directory: %w", err)
+	}
+	spool, err := os.CreateTemp(cm.config.BaseDir, ".spool-*")
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to create spool file: %w", err)
+	}
+	fail := func(err error) (*os.File, int64, int, error) {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, 0, 0, err
+	}
+
+	var w io.WriteCloser
+	var flags int
+	switch cm.config.Compression {
+	case CompressionGzip:
+		w, flags = gzip.NewWriter(spool), flagGzip
+	case CompressionZstd:
+		enc, err := zstd.NewWriter(spool)
+		if err != nil {
+			return fail(fmt.Errorf("failed to initialize zstd: %w", err))
+		}
+		w, flags = enc, flagZstd
+	}
+
+	var read int64
+	if w != nil {
+		read, err = io.Copy(w, r)
+		if closeErr := w.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("failed to compress content: %w", closeErr)
+		}
+	} else {
+		read, err = io.Copy(spool, r)
+	}
+	if err != nil {
+		if isNoSpaceError(err) {
+			return fail(fmt.Errorf("disk full error during spooling: %w", err))
+		}
+		return fail(fmt.Errorf("failed to read content: %w", err))
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return fail(err)
+	}
+	return spool, read, flags, nil
+}
+
+// insertFromSpool stores the spooled bytes as the entry. The row is inserted with a zeroblob of
+// the final size and filled by blob I/O, so the value is never held in memory as a whole.
+// If size exceeds chunkBytes (when positive), the bytes are written to cache_chunks instead.
+// at is the time of the write, from which ttl counts.
+func insertFromSpool(db *sql.DB, spool io.Reader, bind string, longBind interface{}, flags int, sum []byte, size int64, at time.Time, ttl time.Duration, chunkBytes int) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	now := at.Unix()
+	var expiresAt interface{}
+	if ttl > 0 {
+		expiresAt = at.Add(ttl).Unix()
+	}
+
+	// 分割する場合とblob I/Oを使えない場合は空で登録し、後からチャンクを書き込む
+	chunked := chunkBytes > 0 && size > int64(chunkBytes)
+	blobIO := !chunked && hasBlobIO(conn)
+	reserved := size
+	if !blobIO {
+		reserved = 0
+	}
+	if chunked {
+		flags |= flagChunked
+	}
+	query := `
+	INSERT OR REPLACE INTO cache (bind, content, last_accessed, updated_at, expires_at, flags, size, version, checksum, long_bind)
+	VALUES (?, zeroblob(?), ?, ?, ?, ?, ?, ?, ?, ?)
+	RETURNING id
+	`
+	var id int64
+	err = conn.QueryRowContext(ctx, query, bind, reserved, now, now, expiresAt, flags, size, newVersion(), sum, longBind).Scan(&id)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case chunked:
+		err = writeSpoolChunks(ctx, conn, spool, id, chunkBytes)
+	case blobIO:
+		err = writeBlob(conn, id, spool)
+	default:
+		err = concatChunks(ctx, conn, spool, id)
+	}
+	if err != nil {
+		// 途中まで書いたエントリは残さない
+		conn.ExecContext(ctx, "DELETE FROM cache WHERE id = ?", id)
+		return err
+	}
+	return nil
+}
+
+// writeSpoolChunks writes r to cache_chunks as the chunks of the entry id
+func writeSpoolChunks(ctx context.Context, conn *sql.Conn, r io.Reader, id int64, chunkBytes int) error {
+	buf := make([]byte, chunkBytes)
+	for index := 0; ; index++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := conn.ExecContext(ctx, "INSERT INTO cache_chunks (entry_id, chunk_index, data) VALUES (?, ?, ?)", id, index, buf[:n]); err != nil {
+				return fmt.Errorf("failed to insert chunk: %w", err)
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// concatChunks writes r into a temporary table chunk by chunk and then sets the concatenation
+// as the content of row id in a single statement. Temporary tables belong to one connection.
+func concatChunks(ctx context.Context, conn *sql.Conn, r io.Reader, id int64) error {
+	if _, err := conn.ExecContext(ctx, "CREATE TEMP TABLE IF NOT EXISTS stream_chunks (seq INTEGER PRIMARY KEY, data BLOB NOT NULL)"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "DELETE FROM temp.stream_chunks")
+
+	pooled := getStreamBuffer()
+	defer putStreamBuffer(pooled)
+	buf := *pooled
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := conn.ExecContext(ctx, "INSERT INTO temp.stream_chunks (seq, data) VALUES (?, ?)", seq, buf[:n]); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// group_concatはTEXTを返すので、BLOBにキャストしておく
+	_, err := conn.ExecContext(ctx, `
+	UPDATE cache SET content = (
+		SELECT CAST(COALESCE(group_concat(data, '' ORDER BY seq), x'') AS BLOB) FROM temp.stream_chunks
+	) WHERE id = ?
+	`, id)
+	return err
+}
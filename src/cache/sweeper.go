@@ -0,0 +1,220 @@
+package cache
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSweepBatchSize = 1000
+	// sweepColdDBsPerTick bounds how many DBs that are not open are opened per sweep
+	sweepColdDBsPerTick = 16
+)
+
+// sweepScheduler periodically removes expired entries that are never read again, and tenant
+// directories left without DB files
+type sweepScheduler struct {
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once // Closeが並行して呼ばれても一度だけ閉じる
+	cursor   int       // 次の周期で最初に開く、オープンしていないDBの位置
+}
+
+func newSweepScheduler(interval time.Duration) *sweepScheduler {
+	return &sweepScheduler{
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *sweepScheduler) run(cm *CacheManager) {
+	defer close(s.done)
+	ticker := cm.clock().NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C():
+			cm.sweep(false, &s.cursor)
+		}
+	}
+}
+
+func (s *sweepScheduler) shutdown() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+// stopSweepScheduler stops the scheduler. Like stopEvictionWorker it must be called
+// before taking cm.mutex exclusively.
+func (cm *CacheManager) stopSweepScheduler() {
+	cm.mutex.RLock()
+	s := cm.sweeper
+	cm.mutex.RUnlock()
+	if s != nil {
+		s.shutdown()
+	}
+}
+
+func (cm *CacheManager) sweepBatchSize() int {
+	if cm.config.SweepBatchSize <= 0 {
+		return defaultSweepBatchSize
+	}
+	return cm.config.SweepBatchSize
+}
+
+// SweepExpired removes the expired entries of every DB file under BaseDir, waiting for busy tenants,
+// and removes tenant directories without DB files. It returns the number of removed entries.
+func (cm *CacheManager) SweepExpired() (int64, error) {
+	return cm.sweep(true, nil)
+}
+
+// sweep purges expired entries. With wait false, busy tenants are skipped, and if cursor is not nil
+// only sweepColdDBsPerTick DBs that are not open are swept, continuing from *cursor.
+func (cm *CacheManager) sweep(wait bool, cursor *int) (int64, error) {
+	paths, err := cm.globData(filepath.Join("*", "*", "*.db"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(paths)
+
+	var open, cold []string
+	cm.dbsMu.Lock()
+	for _, dbPath := range paths {
+		table, tenantID, freshness := splitDBPath(dbPath)
+		if _, exists := cm.dbs[cm.getDBKey(table, tenantID, freshness)]; exists {
+			open = append(open, dbPath)
+		} else {
+			cold = append(cold, dbPath)
+		}
+	}
+	cm.dbsMu.Unlock()
+
+	// オープンしていないDBは周期ごとに少しずつ開く
+	if cursor != nil && len(cold) > sweepColdDBsPerTick {
+		start := *cursor % len(cold)
+		cold = append(cold[start:], cold[:start]...)[:sweepColdDBsPerTick]
+		*cursor = start + sweepColdDBsPerTick
+	}
+
+	var removed int64
+	var firstErr error
+	for _, dbPath := range append(open, cold...) {
+		table, tenantID, freshness := splitDBPath(dbPath)
+		n, err := cm.sweepDB(table, tenantID, freshness, wait)
+		removed += n
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	cm.removeEmptyTenantDirs(wait)
+	return removed, firstErr
+}
+
+// sweepDB deletes the expired entries of one DB, SweepBatchSize at a time. The tenant lock is
+// taken for each batch, so other operations on the tenant can run in between.
+func (cm *CacheManager) sweepDB(table, tenantID string, freshness string, wait bool) (int64, error) {
+	batch := cm.sweepBatchSize()
+	var removed int64
+	for {
+		n, err := cm.sweepBatch(table, tenantID, freshness, batch, wait)
+		removed += n
+		if err != nil || n < int64(batch) {
+			return removed, err
+		}
+	}
+}
+
+func (cm *CacheManager) sweepBatch(table, tenantID string, freshness string, batch int, wait bool) (int64, error) {
+	unlock, ok := cm.lockTenantIf(table, tenantID, wait)
+	if !ok {
+		return 0, nil
+	}
+	defer unlock()
+
+	dbPath := cm.getDBPath(table, tenantID, freshness)
+	if _, err := os.Stat(dbPath); err != nil {
+		return 0, nil
+	}
+
+	// オープンしていないDBは、ハンドルの利用順や使用量の記録を変えないよう、登録せずに開いて閉じる
+	cm.dbsMu.Lock()
+	h, exists := cm.dbs[cm.getDBKey(table, tenantID, freshness)]
+	cm.dbsMu.Unlock()
+	var db *sql.DB
+	if exists {
+		db = h.db
+	} else {
+		var err error
+		if db, err = cm.openSQLiteDB(dbPath); err != nil {
+			return 0, err
+		}
+		defer db.Close()
+	}
+
+	rows, err := db.Query(`
+	DELETE FROM cache WHERE id IN (
+		SELECT id FROM cache WHERE expires_at IS NOT NULL AND expires_at <= ? LIMIT ?
+	) RETURNING `+listedBind+`, size`, cm.now().Unix(), batch)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired entries: %w", err)
+	}
+	expired, err := scanEventEntries(rows, table, tenantID, freshness)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete expired entries: %w", err)
+	}
+	cm.notifyExpire(expired)
+	if len(expired) > 0 {
+		cm.logger().Debug("sqlite-cache: removed expired entries", "table", table, "tenant", tenantID, "freshness", freshness,
+			"entries", len(expired))
+	}
+	return int64(len(expired)), nil
+}
+
+// lockTenantIf takes the tenant lock exclusively, waiting for it if wait is true and otherwise
+// giving up if it is held
+func (cm *CacheManager) lockTenantIf(table, tenantID string, wait bool) (func(), bool) {
+	if wait {
+		return cm.lockTenant(table, tenantID), true
+	}
+	return cm.tryLockTenant(table, tenantID)
+}
+
+// removeEmptyTenantDirs removes tenant directories without files, and then table directories
+// without tenants
+func (cm *CacheManager) removeEmptyTenantDirs(wait bool) {
+	dirs, err := cm.globData(filepath.Join("*", "*"))
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			continue
+		}
+		unlock, ok := cm.lockTenantIf(filepath.Base(filepath.Dir(dir)), filepath.Base(dir), wait)
+		if !ok {
+			continue
+		}
+		// 空でなければ失敗するので、待っている間に作られたDBは消えない
+		os.Remove(dir)
+		unlock()
+		os.Remove(filepath.Dir(dir))
+	}
+}
+
+// splitDBPath returns the table, tenant and freshness of a DB file path under BaseDir
+func splitDBPath(dbPath string) (string, string, string) {
+	tenantDir := filepath.Dir(dbPath)
+	return filepath.Base(filepath.Dir(tenantDir)), filepath.Base(tenantDir), strings.TrimSuffix(filepath.Base(dbPath), ".db")
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// タグはcache_tagsに(tag, entry_id)として保存し、cacheのレコードが削除されるとトリガーで一緒に消える。
+// Set・SetNX・SetCAS・MSet・SetFromReaderで登録し直したエントリはタグを持たなくなり、Appendではそのまま残る。
+
+// SetWithTags stores content like SetWithTTL and attaches tags to the entry, replacing its previous tags
+func (cm *CacheManager) SetWithTags(table, tenantID string, freshness string, bind string, content []byte, ttl time.Duration, tags []string) error {
+	if tags == nil {
+		tags = []string{}
+	}
+	_, _, err := cm.set(context.Background(), table, tenantID, freshness, bind, content, ttl, entryAttrs{tags: tags}, setAlways, 0)
+	return err
+}
+
+// InvalidateTag deletes the entries carrying tag from every freshness DB of the tenant and returns
+// how many entries were deleted
+func (cm *CacheManager) InvalidateTag(table, tenantID string, tag string) (int64, error) {
+	deleted, err := cm.invalidateTag(table, tenantID, tag)
+	// DeletePrefixのprefixと同じく、タグはbindの欄に記録する
+	cm.logAccess(context.Background(), "invalidate_tag", table, tenantID, "", tag, 0, accessResult(false, err))
+	return deleted, err
+}
+
+func (cm *CacheManager) invalidateTag(table, tenantID string, tag string) (int64, error) {
+	if err := cm.checkNames(table, tenantID); err != nil {
+		return 0, err
+	}
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+
+	freshnesses, err := cm.otherFreshness(table, tenantID, "")
+	if err != nil {
+		return 0, fmt.Errorf("failed to list cache files: %w", err)
+	}
+
+	var deleted int64
+	for _, freshness := range freshnesses {
+		db, err := cm.openDB(table, tenantID, freshness)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to open database: %w", err)
+		}
+
+		var binds []string
+		err = cm.retryBusy(context.Background(), func() error {
+			rows, err := db.Query("DELETE FROM cache WHERE id IN (SELECT entry_id FROM cache_tags WHERE tag = ?) RETURNING "+listedBind, tag)
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			binds = binds[:0]
+			for rows.Next() {
+				var bind string
+				if err := rows.Scan(&bind); err != nil {
+					return err
+				}
+				binds = append(binds, bind)
+			}
+			return rows.Err()
+		})
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete tagged entries: %w", err)
+		}
+
+		for _, bind := range binds {
+			cm.hot.remove(flightKey(table, tenantID, freshness, bind))
+		}
+		cm.publishBinds(MutationDelete, table, tenantID, freshness, binds)
+		deleted += int64(len(binds))
+	}
+	return deleted, nil
+}
+
+// Tags returns the tags of the entry, or ErrEntryNotFound if there is no live entry for bind
+func (cm *CacheManager) Tags(table, tenantID string, freshness string, bind string) ([]string, error) {
+	if err := cm.checkNames(table, tenantID, freshness); err != nil {
+		return nil, err
+	}
+	unlock := cm.rlockTenant(table, tenantID)
+	defer unlock()
+
+	if _, err := os.Stat(cm.getDBPath(table, tenantID, freshness)); os.IsNotExist(err) {
+		return nil, ErrCacheNotFound
+	}
+
+	db, err := cm.openReadDB(table, tenantID, freshness)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	var id int64
+	err = db.QueryRow("SELECT id FROM cache WHERE bind = ? AND (expires_at IS NULL OR expires_at > ?)", cm.storedBind(bind), cm.now().Unix()).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrEntryNotFound
+		}
+		return nil, fmt.Errorf("failed to query cache: %w", err)
+	}
+	return readTags(db, id)
+}
+
+// writeTags replaces the tags of the entry id
+func writeTags(q dbExecutor, id int64, tags []string) error {
+	if _, err := q.Exec("DELETE FROM cache_tags WHERE entry_id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete tags: %w", err)
+	}
+	for _, tag := range tags {
+		if _, err := q.Exec("INSERT OR IGNORE INTO cache_tags (tag, entry_id) VALUES (?, ?)", tag, id); err != nil {
+			return fmt.Errorf("failed to insert tag: %w", err)
+		}
+	}
+	return nil
+}
+
+// readTags returns the tags of the entry id in sorted order
+func readTags(q dbExecutor, id int64) ([]string, error) {
+	rows, err := q.Query("SELECT tag FROM cache_tags WHERE entry_id = ? ORDER BY tag", id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tags: %w", err)
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, fmt.Errorf("failed to scan tag: %w", err)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, rows.Err()
+}
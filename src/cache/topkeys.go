@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"fmt"
+	"sort"
+)
+
+// hitsはGetのUPDATE...RETURNINGでlast_accessedと一緒に増やすので、数えるための書き込みは増えない。
+// 読み取り専用の接続やHotCacheSizeのメモリから返したGetは溜めておき、TopKeysの前に書き込む。
+// Setで上書きすると0に戻るので、値を登録し直してからの回数になる。
+
+// KeyHits is the read count of one entry, returned by TopKeys
+type KeyHits struct {
+	Bind         string `json:"bind"`
+	Freshness    string `json:"freshness"`
+	Size         int64  `json:"size"` // 保存しているcontentのバイト数
+	Hits         int64  `json:"hits"` // 登録してからGetで読まれた回数
+	LastAccessed int64  `json:"last_accessed"`
+}
+
+// TopKeysResult holds the most and the least read entries of a tenant
+type TopKeysResult struct {
+	Hottest []KeyHits `json:"hottest"` // hitsの多い順
+	Coldest []KeyHits `json:"coldest"` // hitsの少ない順
+}
+
+// TopKeys returns the n most read and the n least read live entries over every freshness DB of the
+// tenant, with their sizes, to show which binds are worth caching
+func (cm *CacheManager) TopKeys(table, tenantID string, n int) (*TopKeysResult, error) {
+	if err := cm.checkNames(table, tenantID); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, fmt.Errorf("n must be positive, got %d", n)
+	}
+	// 溜まったアクセスを書き込むので排他ロックを取る
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+
+	freshnesses, err := cm.otherFreshness(table, tenantID, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache files: %w", err)
+	}
+
+	result := &TopKeysResult{Hottest: []KeyHits{}, Coldest: []KeyHits{}}
+	now := cm.now().Unix()
+	for _, freshness := range freshnesses {
+		db, err := cm.openDB(table, tenantID, freshness)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open database: %w", err)
+		}
+		cm.flushAccesses(cm.getDBKey(table, tenantID, freshness), db)
+
+		for _, order := range []struct {
+			keys    *[]KeyHits
+			orderBy string
+		}{
+			{&result.Hottest, "hits DESC, last_accessed DESC, bind"},
+			{&result.Coldest, "hits ASC, last_accessed ASC, bind"},
+		} {
+			rows, err := db.Query(`
+			SELECT `+listedBind+`, size, hits, CAST(last_accessed AS INTEGER) FROM cache
+			WHERE expires_at IS NULL OR expires_at > ?
+			ORDER BY `+order.orderBy+` LIMIT ?`, now, n)
+			if err != nil {
+				return nil, fmt.Errorf("failed to query hit counters: %w", err)
+			}
+			for rows.Next() {
+				key := KeyHits{Freshness: freshness}
+				if err := rows.Scan(&key.Bind, &key.Size, &key.Hits, &key.LastAccessed); err != nil {
+					rows.Close()
+					return nil, fmt.Errorf("failed to scan row: %w", err)
+				}
+				*order.keys = append(*order.keys, key)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return nil, fmt.Errorf("failed to query hit counters: %w", err)
+			}
+		}
+	}
+
+	// DBごとの上位n件を合わせてから、全体の上位n件に絞る
+	sort.SliceStable(result.Hottest, func(i, j int) bool {
+		a, b := result.Hottest[i], result.Hottest[j]
+		if a.Hits != b.Hits {
+			return a.Hits > b.Hits
+		}
+		return a.LastAccessed > b.LastAccessed
+	})
+	sort.SliceStable(result.Coldest, func(i, j int) bool {
+		a, b := result.Coldest[i], result.Coldest[j]
+		if a.Hits != b.Hits {
+			return a.Hits < b.Hits
+		}
+		return a.LastAccessed < b.LastAccessed
+	})
+	result.Hottest = result.Hottest[:min(n, len(result.Hottest))]
+	result.Coldest = result.Coldest[:min(n, len(result.Coldest))]
+	return result, nil
+}
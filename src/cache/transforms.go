@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// TableCodecsはテーブルごとに、contentに適用する変換 (圧縮・暗号化・シリアライズなど) の名前を書き込む順に並べたもの。
+// 変換はRegisterCodecでプロセス全体に登録し、エントリには適用した変換の番号をflagsカラムの上位ビット
+// (flagCodecShiftから7ビットずつ、適用した順) に記録する。読み込み時はflagsに記録された変換を逆順に戻すので、
+// TableCodecsを変えても既存のエントリは書き込んだときの変換で読める。番号はエントリの意味を決めるので、
+// 再起動しても同じ番号で登録すること。TableCodecsにあるテーブルにはCompressionを適用しない (空のリストなら変換しない)。
+// EncryptionKeyを指定していれば、変換した後にAES-GCMで暗号化する。
+
+const (
+	CodecGzip = 1 // 組み込みの"gzip"
+	CodecZstd = 2 // 組み込みの"zstd"
+
+	flagCodecShift = 8
+	flagCodecBits  = 7
+	// maxTableCodecs bounds the codecs of a table, so that their ids fit in the flags.
+	// 32ビットのintでも符号ビットにかからないよう、8〜28ビット目に収める
+	maxTableCodecs = 3
+	maxCodecID     = 1<<flagCodecBits - 1
+	flagCodecMask  = (1<<(flagCodecBits*maxTableCodecs) - 1) << flagCodecShift
+)
+
+// Codec is a value transform registered with RegisterCodec. Encode must not modify its argument.
+type Codec interface {
+	Encode(content []byte) ([]byte, error)
+	Decode(content []byte) ([]byte, error)
+}
+
+type registeredCodec struct {
+	id    int
+	name  string
+	codec Codec
+}
+
+var codecs = struct {
+	mu     sync.RWMutex
+	byName map[string]*registeredCodec
+	byID   map[int]*registeredCodec
+}{
+	byName: map[string]*registeredCodec{
+		"gzip": {id: CodecGzip, name: "gzip", codec: gzipCodec{}},
+		"zstd": {id: CodecZstd, name: "zstd", codec: zstdTransform{}},
+	},
+}
+
+func init() {
+	codecs.byID = make(map[int]*registeredCodec, len(codecs.byName))
+	for _, c := range codecs.byName {
+		codecs.byID[c.id] = c
+	}
+}
+
+// RegisterCodec registers codec under name for CacheConfig.TableCodecs. id, from 1 to 127, is recorded
+// in each entry written with the codec and is used to read it back, so it must not change across
+// restarts. 1 and 2 are the built-in "gzip" and "zstd".
+func RegisterCodec(id int, name string, codec Codec) error {
+	if id < 1 || id > maxCodecID {
+		return fmt.Errorf("codec id must be between 1 and %d, got %d", maxCodecID, id)
+	}
+	if name == "" {
+		return fmt.Errorf("codec name is required")
+	}
+	if codec == nil {
+		return fmt.Errorf("codec %s is nil", name)
+	}
+	codecs.mu.Lock()
+	defer codecs.mu.Unlock()
+	if _, exists := codecs.byName[name]; exists {
+		return fmt.Errorf("codec %s is already registered", name)
+	}
+	if c, exists := codecs.byID[id]; exists {
+		return fmt.Errorf("codec id %d is already registered as %s", id, c.name)
+	}
+	c := &registeredCodec{id: id, name: name, codec: codec}
+	codecs.byName[name] = c
+	codecs.byID[id] = c
+	return nil
+}
+
+// lookupCodecs returns the registered codecs of names
+func lookupCodecs(names []string) ([]*registeredCodec, error) {
+	if len(names) > maxTableCodecs {
+		return nil, fmt.Errorf("too many codecs: %d (max %d)", len(names), maxTableCodecs)
+	}
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+	resolved := make([]*registeredCodec, len(names))
+	for i, name := range names {
+		c, ok := codecs.byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown codec %q", name)
+		}
+		resolved[i] = c
+	}
+	return resolved, nil
+}
+
+// resolveTableCodecs returns the codecs of each table of TableCodecs
+func resolveTableCodecs(config CacheConfig) (map[string][]*registeredCodec, error) {
+	if len(config.TableCodecs) == 0 {
+		return nil, nil
+	}
+	resolved := make(map[string][]*registeredCodec, len(config.TableCodecs))
+	for table, names := range config.TableCodecs {
+		c, err := lookupCodecs(names)
+		if err != nil {
+			return nil, fmt.Errorf("invalid codecs for table %s: %w", table, err)
+		}
+		resolved[table] = c
+	}
+	return resolved, nil
+}
+
+// encodeCodecs applies the codecs in order and returns the flags recording them
+func encodeCodecs(list []*registeredCodec, content []byte) ([]byte, int, error) {
+	flags := 0
+	for i, c := range list {
+		encoded, err := c.codec.Encode(content)
+		if err != nil {
+			return nil, 0, fmt.Errorf("codec %s failed to encode content: %w", c.name, err)
+		}
+		content = encoded
+		flags |= c.id << (flagCodecShift + i*flagCodecBits)
+	}
+	return content, flags, nil
+}
+
+// decodeCodecs reverses the codecs recorded in flags, last applied first
+func decodeCodecs(content []byte, flags int) ([]byte, error) {
+	var list []*registeredCodec
+	codecs.mu.RLock()
+	for i := 0; i < maxTableCodecs; i++ {
+		id := flags >> (flagCodecShift + i*flagCodecBits) & maxCodecID
+		if id == 0 {
+			break
+		}
+		c, ok := codecs.byID[id]
+		if !ok {
+			codecs.mu.RUnlock()
+			return nil, fmt.Errorf("unknown codec id %d: register it with RegisterCodec to read the entry", id)
+		}
+		list = append(list, c)
+	}
+	codecs.mu.RUnlock()
+	for i := len(list) - 1; i >= 0; i-- {
+		c := list[i]
+		decoded, err := c.codec.Decode(content)
+		if err != nil {
+			return nil, fmt.Errorf("codec %s failed to decode content: %w", c.name, err)
+		}
+		content = decoded
+	}
+	return content, nil
+}
+
+// gzipCodec and zstdTransform are the built-in codecs. Unlike Compression, they compress content
+// even when it does not shrink, as the codecs applied to an entry are recorded together.
+type gzipCodec struct{}
+
+func (gzipCodec) Encode(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) Decode(content []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type zstdTransform struct{}
+
+func (zstdTransform) Encode(content []byte) ([]byte, error) {
+	enc, _, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(content, nil), nil
+}
+
+func (zstdTransform) Decode(content []byte) ([]byte, error) {
+	_, dec, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	return dec.DecodeAll(content, nil)
+}
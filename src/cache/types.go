@@ -1,25 +1,252 @@
 package cache
 
 import (
-	"database/sql"
+	"container/list"
+	"crypto/cipher"
+	"errors"
+	"log/slog"
+	"net/http"
 	"sync"
+	"time"
 )
 
+var (
+	ErrCacheNotFound    = errors.New("cache not found")
+	ErrEntryNotFound    = errors.New("cache entry not found")
+	ErrConflict         = errors.New("cache entry was modified")
+	ErrEntryTooLarge    = errors.New("cache entry too large")
+	ErrReadOnly         = errors.New("cache is read-only after a disk full error")
+	ErrCorrupt          = errors.New("cache database is corrupt")
+	ErrNotModified      = errors.New("cache entry not modified")
+	ErrChecksumMismatch = errors.New("cache entry checksum mismatch")
+	ErrInvalidName      = errors.New("invalid cache name")
+)
+
+// IsNotFound reports whether err is a cache miss
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrCacheNotFound) || errors.Is(err, ErrEntryNotFound)
+}
+
 type CacheConfig struct {
 	BaseDir string
 	MaxSize int     // MB単位
 	Cap     float64 // 削除する割合 (0~0.95)
+
+	// バイト単位。これより大きいcontentの登録はErrEntryTooLargeで拒否する (0なら無制限)
+	MaxEntrySize int64
+
+	// テナントごとのDBの上限 (MB単位)。1つのテナントがMaxSizeまで使い切らないように、
+	// MaxSizeの代わりに使う。TenantQuotasのキーは"table/tenant_id"または"tenant_id"で、
+	// 該当するものがなければTenantQuota、それも0ならMaxSizeを使う
+	TenantQuota  int
+	TenantQuotas map[string]int
+
+	// MB単位。すべてのDBの合計の上限で、超えたら最も長く使われていないDBから削除する (0なら無制限)
+	TotalMaxSize int
+
+	// メトリクス
+	Metrics     bool   // ヒット数などのカウンタを収集する
+	MetricsAddr string // 空でなければ /metrics を公開するアドレス (例: ":9090")
+
+	// 同じbindへの同時ミスを1つにまとめる。ミスは最初の呼び出しにだけ返し、
+	// 他の呼び出しはSetされるまで最大この時間だけ待つ (0なら無効)
+	StampedeWait time.Duration
+
+	// 同時にオープンしておくDBハンドルの上限。超えたら最も使われていないものを閉じる (0なら無制限)
+	MaxOpenDBs int
+
+	// PRAGMA設定 (各接続に適用する)
+	JournalMode string        // OFF, DELETE, TRUNCATE, PERSIST, MEMORY, WAL (空ならOFF)
+	Synchronous string        // OFF, NORMAL, FULL, EXTRA (空ならNORMAL)
+	MmapSize    int64         // mmap_size (バイト、0ならSQLiteの既定値)
+	CacheSize   int           // cache_size (負の値はKiB単位、0ならSQLiteの既定値)
+	BusyTimeout time.Duration // busy_timeout (0ならドライバの既定値)
+
+	// busy_timeoutを過ぎてもSQLITE_BUSY/SQLITE_LOCKEDで失敗した操作を再試行する回数 (0なら3回、負なら再試行しない)。
+	// 待ち時間はBusyRetryDelay (0なら10ms) から再試行のたびに倍にする
+	BusyRetries    int
+	BusyRetryDelay time.Duration
+
+	// 値の圧縮
+	Compression        string // "", "gzip", "zstd"
+	CompressionMinSize int    // このバイト数以上のコンテンツだけを圧縮する
+
+	// テーブルごとにcontentに適用する変換 (RegisterCodecで登録した名前) を書き込む順に並べる。
+	// 指定したテーブルにはCompressionを適用しない
+	TableCodecs map[string][]string
+
+	// contentのAES-GCM暗号化。鍵は16/24/32バイトで、EncryptionKey、EncryptionKeyFunc、
+	// EncryptionKeyEnv（base64でエンコードした鍵を持つ環境変数名）の順に参照する
+	EncryptionKey     []byte
+	EncryptionKeyFunc func() ([]byte, error) // KMSなどから鍵を取得する
+	EncryptionKeyEnv  string
+
+	// 保存したバイト列のチェックサム ("", "crc32c", "sha256")。Getで照合し、一致しないエントリは削除する
+	Checksum string
+
+	// 0より大きければ (128以上)、このバイト数より長いbindは先頭とSHA-256を合わせた短いキーで保存し、
+	// 元のbindは一覧のために別のカラムに持つ。長いURLやシリアライズしたクエリをbindにしても
+	// bindのインデックスが大きくならない。途中で変えると、それまでの長いbindのエントリはミスになる
+	HashBindsOver int
+
+	// trueにすると、パスに使えないテーブル名・テナントID・フレッシュネス ("..", "/"や制御文字を含むもの、
+	// 200バイトを超えるものなど) をErrInvalidNameで拒否せず、ハッシュした名前のディレクトリ・ファイルに保存する。
+	// 一覧やディレクトリから読んだ名前はハッシュした名前になる。空の名前と"~"で始まる名前は常に拒否する
+	HashUnsafeNames bool
+
+	// メモリ上に置くテーブル ("*"ならすべてのテーブル)。MemoryDir (既定は/dev/shm) に作ったディレクトリに
+	// キャッシュファイルを置き、Closeで削除する。ディスクに残さずに同じAPIで使いたいキャッシュや、
+	// 利用側のテスト向け
+	MemoryTables []string
+	MemoryDir    string
+
+	// MaxSizeを超えたときに削除するエントリの選び方 (nilならLRU)
+	EvictionPolicy EvictionPolicy
+	// テーブルごとの削除するエントリの選び方。含まれないテーブルはEvictionPolicyを使う。
+	// 順に読み流すテーブルはLRU、繰り返し読まれるものを残したいテーブルはLFUのように使い分ける
+	TableEvictionPolicies map[string]EvictionPolicy
+
+	// ログの出力先 (nilならslog.Default())。DBのオープンや削除はDebug、古いDBファイルの削除はInfo、
+	// 壊れたDBやディスクフルはWarnで出力する
+	Logger *slog.Logger
+	// 0より大きければ、Get・Set・MGet・MSet・Appendとストリーミングでこの時間を超えたものをWarnで出力する
+	SlowOperationThreshold time.Duration
+
+	// 削除・期限切れ・ディスクフル・DBの破損を通知する先 (nilなら通知しない)。SetEventsで後から変更できる
+	Events Events
+
+	// DBのサイズがMaxSizeのHardWatermarkの割合 (0なら1.0) を超える書き込みは、Setの中で同期的に削除してから書き込む。
+	// BackgroundEvictionを有効にすると、SoftWatermarkの割合 (0なら0.9) を超えた時点でバックグラウンドで
+	// EvictionBatchSizeバイト (0ならMaxSizeの1%) ずつ、バッチごとにテナントのロックを取り直しながらCapの割合まで削除する。
+	// その場合、同期的な削除はSoftWatermarkまでにとどめ、残りはバックグラウンドに任せる
+	BackgroundEviction bool
+	SoftWatermark      float64
+	HardWatermark      float64
+	EvictionBatchSize  int64
+
+	// DBはauto_vacuum = INCREMENTALで作成され、削除で空いたページはこの間隔ごとに
+	// オープン中のDBからVacuumPagesページずつ解放される (0なら1分、負なら無効)。
+	// 完全なVACUUMはCompactでのみ実行する
+	VacuumInterval time.Duration
+	VacuumPages    int // 1回に解放するページ数 (0なら1024)
+
+	// 0より大きければ、この間隔ごとに期限切れのエントリを削除する。オープン中のDBに加えて、オープンしていないDBも
+	// 周期ごとに16個ずつ開いて調べる。DBファイルがなくなったテナントのディレクトリも削除する
+	SweepInterval  time.Duration
+	SweepBatchSize int // 1つのDELETEで削除するエントリの数 (0なら1000)。バッチごとにテナントのロックを取り直す
+
+	// バイト単位。0より大きければ、Getで読んだ値と登録した値をこのサイズまでメモリにも持ち、
+	// 次のGetではSQLiteを読まずに返す。同じBaseDirを他のプロセスと共有する場合は使わない
+	HotCacheSize int64
+
+	// 0より大きければ、Getのミスをbindごとにこの時間だけメモリに覚え、その間の同じGetはファイルを調べずにミスを返す。
+	// そのbindへの書き込みで忘れる。HotCacheSizeと同じく、BaseDirを他のプロセスと共有する場合は使わない
+	NegativeCacheTTL time.Duration
+
+	// Initの際にBaseDirを走査し、空のテナント・テーブルのディレクトリ、異常終了で残った一時ファイル、
+	// DBファイルのないジャーナルを削除して、最近更新されたDBを (MaxOpenDBsまたは64個まで) オープンしておく。
+	// ReconcileCheckを指定すると各DBにquick_checkを実行し、壊れたDBはオープンしない (RepairRecreateなら削除する)。
+	// 結果はReconcileReportで取得できる
+	ReconcileOnInit bool
+	ReconcileCheck  bool
+
+	// 新しいフレッシュネスのDBを作るときに残す、それ以前のフレッシュネスのDBの数 (新しく更新されたものから)。
+	// 0なら現在のもの以外はすべて削除する。上流のデータを以前のフレッシュネスに戻したときに、そのDBをそのまま使える
+	RetainFreshness int
+
+	// 0より大きければ、DBごとに書き込みを1つの接続に絞り、Get・Peek・Existsはこの数までの読み取り専用の接続で読む。
+	// JournalModeがWALの場合だけ指定できる
+	ReadConnections int
+
+	// MB単位。保存するバイト数がこれを超えるエントリは、このサイズごとに分けて別のテーブルに保存する (0なら分割しない)
+	ChunkSize int
+
+	// 壊れたDBファイルの扱い。RepairNone (検査しない)、RepairCheck (オープン時にquick_checkしてErrCorruptを返す)、
+	// RepairRecreate (削除して空のDBを作り直す) のいずれか
+	RepairPolicy string
+
+	// Get、Set、DeleteEntryとそのContext版で、呼び出し側のctxに期限がなければ使うタイムアウト (0なら無制限)。
+	// テナントのロック待ちやクエリの実行がこの時間を超えたらcontext.DeadlineExceededで失敗する
+	OperationTimeout time.Duration
+
+	// スナップショットを置くオブジェクトストレージ (nilなら無効)。SnapshotIntervalごとに、前回から変わったDBファイルを
+	// VACUUM INTOで写して"SnapshotPrefix + table/tenant/freshness.db"のキーでアップロードする (0ならSyncSnapshotsを呼んだときだけ)。
+	// HydrateOnInitを指定すると、InitでDBファイルのないテナントのスナップショットをダウンロードして使う
+	SnapshotStore    SnapshotStore
+	SnapshotPrefix   string
+	SnapshotInterval time.Duration
+	HydrateOnInit    bool
+
+	// 0より大きければ、登録・削除・LRU削除・期限切れを変更フィードに記録し、Subscribeで受け取れるようにする。
+	// 購読者ごとにこの数までバッファし、溢れた購読者のチャネルは閉じる
+	ChangeFeedBuffer int
+
+	// ノードの間で共有するpub/sub (nilなら無効)。DeleteEntry・DeleteTenant・Rotateを流し、他のノードから届いたものを適用する。
+	// NodeIDは自分が流したものを見分けるためのもので、空ならInitでランダムに決める
+	InvalidationBus InvalidationBus
+	NodeID          string
+
+	// 空でなければ、Get・Peek・Set・Append・DeleteEntryなどの操作を誰が (WithAccessor)・いつ・どのbindに行ったかを
+	// このファイルに追記する。AccessLogFormatは"ndjson" (1行に1つのJSON、既定) か"sqlite" (access_logテーブル)。
+	// AccessLogSampleRate (0なら1.0) の割合の操作だけを記録する。contentは記録しない
+	AccessLogPath       string
+	AccessLogFormat     string
+	AccessLogSampleRate float64
+
+	// エントリの時刻・有効期限と、スイーパーなどのバックグラウンド処理の周期に使う時計 (nilならSystemClock)。
+	// テストでManualClockを渡すと、sleepせずに期限切れやLRUの順序を確かめられる
+	Clock Clock
 }
 
 type CacheManager struct {
 	config CacheConfig
-	mutex  sync.RWMutex
-	dbs    map[string]*sql.DB
+	mutex  sync.RWMutex // Init/Close/Deleteは排他、テナント単位の操作は共有で取得する
+	dbs    map[string]*openHandle
+	dbLRU  *list.List // オープン済みDBの利用順 (先頭が最新)
+	dbsMu  sync.Mutex // dbsとdbLRUを保護する
+
+	tenantLocks tenantLocks
+
+	counters      dbCounters     // Statsで返すDBごとのヒット・ミス数
+	stmts         statementCache // Get・Set・DeleteEntryの準備済みの文
+	sizes         sizeCache      // オープン中のDBのサイズの見積もり
+	accesses      accessBuffer   // 読み取り専用の接続で読んだGetのアクセス
+	usage         diskUsage      // TotalMaxSizeのためのDBごとの使用量
+	readOnly      readOnlyState
+	repairMu      sync.Mutex // 壊れたDBの作り直しを1つずつ行う
+	events        eventsHolder
+	chain         interceptorChain // Useで追加したインターセプター
+	metrics       *metrics
+	metricsServer *http.Server
+
+	codecs map[string][]*registeredCodec // TableCodecsを解決したもの
+
+	aead     cipher.AEAD           // 暗号化が無効ならnil
+	hot      *hotCache             // HotCacheSizeが0ならnil
+	negative *negativeCache        // NegativeCacheTTLが0ならnil
+	evictor  *evictionWorker       // バックグラウンド削除が無効ならnil
+	vacuumer *vacuumScheduler      // incremental_vacuumが無効ならnil
+	sweeper  *sweepScheduler       // SweepIntervalが0ならnil
+	syncer   *snapshotSyncer       // SnapshotStoreまたはSnapshotIntervalがなければnil
+	feed     *changeFeed           // ChangeFeedBufferが0ならnil
+	listener *invalidationListener // InvalidationBusがなければnil
+	access   *accessLog            // AccessLogPathが空ならnil
+
+	snapshots  snapshotState   // アップロードしたDBファイルの状態
+	reconciled ReconcileReport // ReconcileOnInitによる起動時の走査の結果
+	memDir     string          // MemoryTablesのキャッシュファイルを置くディレクトリ。なければ空
+
+	loads  flightGroup // GetOrLoadのローダー呼び出しの重複排除
+	misses missGate    // Getの同時ミスの集約
 }
 
 type CacheEntry struct {
 	Key          string
 	Content      []byte
 	LastAccessed int64
-	CreatedAt    int64
+	CreatedAt    int64  // 最後に登録された時刻 (updated_at)
+	ExpiresAt    int64  // 0なら期限なし
+	Version      int64  // 登録のたびに変わるトークン。SetCASに渡す
+	Stale        bool   // GetWithOptionsのAllowStaleで、直前のフレッシュネスから読んだ
+	Metadata     string // SetWithMetadataで登録したメタデータ (なければ空)
 }
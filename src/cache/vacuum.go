@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultVacuumInterval = time.Minute
+	defaultVacuumPages    = 1024
+)
+
+// vacuumScheduler periodically returns free pages of the open DBs to the filesystem
+type vacuumScheduler struct {
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once // Closeが並行して呼ばれても一度だけ閉じる
+}
+
+func newVacuumScheduler(interval time.Duration) *vacuumScheduler {
+	return &vacuumScheduler{
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+func (s *vacuumScheduler) run(cm *CacheManager) {
+	defer close(s.done)
+	ticker := cm.clock().NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C():
+			cm.vacuumOpenDBs()
+		}
+	}
+}
+
+func (s *vacuumScheduler) shutdown() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+}
+
+func (cm *CacheManager) vacuumInterval() time.Duration {
+	if cm.config.VacuumInterval == 0 {
+		return defaultVacuumInterval
+	}
+	return cm.config.VacuumInterval
+}
+
+func (cm *CacheManager) vacuumPages() int {
+	if cm.config.VacuumPages <= 0 {
+		return defaultVacuumPages
+	}
+	return cm.config.VacuumPages
+}
+
+// vacuumOpenDBs runs incremental_vacuum on every open DB whose tenant is not busy
+func (cm *CacheManager) vacuumOpenDBs() {
+	cm.dbsMu.Lock()
+	handles := make([]openHandle, 0, len(cm.dbs))
+	for _, h := range cm.dbs {
+		handles = append(handles, openHandle{key: h.key, table: h.table, tenantID: h.tenantID})
+	}
+	cm.dbsMu.Unlock()
+
+	for _, h := range handles {
+		// 使用中のテナントは次の周期に回す
+		unlock, ok := cm.tryLockTenant(h.table, h.tenantID)
+		if !ok {
+			continue
+		}
+		// LRUの順序を変えないようlookupDBは使わない
+		cm.dbsMu.Lock()
+		current, exists := cm.dbs[h.key]
+		cm.dbsMu.Unlock()
+		if exists {
+			incrementalVacuum(current.db, cm.vacuumPages())
+		}
+		unlock()
+	}
+}
+
+// incrementalVacuum frees up to pages pages from the freelist.
+// The PRAGMA frees one page per step, so its result rows must be consumed with Query instead of Exec.
+func incrementalVacuum(db *sql.DB, pages int) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA incremental_vacuum(%d)", pages))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// convertToIncrementalVacuum switches a DB created without auto_vacuum to incremental mode.
+// The connection already requested INCREMENTAL, but an existing file only changes mode on VACUUM.
+func convertToIncrementalVacuum(db *sql.DB) error {
+	var mode int
+	if err := db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return fmt.Errorf("failed to read auto_vacuum: %w", err)
+	}
+	if mode == 2 {
+		return nil
+	}
+
+	if _, err := db.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return fmt.Errorf("failed to set auto_vacuum: %w", err)
+	}
+	if _, err := db.Exec("VACUUM"); err != nil {
+		if isNoSpaceError(err) {
+			return fmt.Errorf("disk full error during vacuum: %w", err)
+		}
+		return fmt.Errorf("failed to vacuum: %w", err)
+	}
+	return nil
+}
+
+// Compact runs a full VACUUM and PRAGMA optimize on every DB file of the tenant, or of every tenant
+// of the table if tenantID is empty, and returns the number of bytes reclaimed. The tenant is locked
+// while its files are rewritten, so it is meant to be run off-peak rather than in the write path.
+func (cm *CacheManager) Compact(table, tenantID string) (int64, error) {
+	if tenantID != "" {
+		if err := cm.checkNames(table, tenantID); err != nil {
+			return 0, err
+		}
+		return cm.compactTenant(table, tenantID)
+	}
+	tenants, err := cm.ListTenants(table)
+	if err != nil {
+		return 0, err
+	}
+	var reclaimed int64
+	for _, tenantID := range tenants {
+		n, err := cm.compactTenant(table, tenantID)
+		reclaimed += n
+		if err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// compactTenant compacts the DB files of one tenant. tenantID may be an on-disk name read by ListTenants.
+func (cm *CacheManager) compactTenant(table, tenantID string) (int64, error) {
+	unlock := cm.lockTenant(table, tenantID)
+	defer unlock()
+
+	paths, err := filepath.Glob(filepath.Join(cm.tenantDir(table, tenantID), "*.db"))
+	if err != nil {
+		return 0, err
+	}
+
+	var reclaimed int64
+	for _, dbPath := range paths {
+		freshness := strings.TrimSuffix(filepath.Base(dbPath), ".db")
+
+		before, err := os.Stat(dbPath)
+		if err != nil {
+			continue
+		}
+
+		db, err := cm.openDB(table, tenantID, freshness)
+		if err != nil {
+			return reclaimed, err
+		}
+		if _, err := db.Exec("VACUUM"); err != nil {
+			if isDiskFullError(err) {
+				return reclaimed, fmt.Errorf("disk full error during vacuum: %w", err)
+			}
+			return reclaimed, fmt.Errorf("failed to vacuum: %w", err)
+		}
+		// VACUUMで作り直したインデックスの統計を更新する
+		if _, err := db.Exec("PRAGMA optimize"); err != nil {
+			return reclaimed, fmt.Errorf("failed to optimize: %w", err)
+		}
+
+		if after, err := os.Stat(dbPath); err == nil {
+			reclaimed += before.Size() - after.Size()
+		}
+		cm.sizes.forget(db)
+		cm.recordDBSize(table, tenantID, db)
+	}
+	return reclaimed, nil
+}
+
+// stopVacuumScheduler stops the scheduler. Like stopEvictionWorker it must be called
+// before taking cm.mutex exclusively.
+func (cm *CacheManager) stopVacuumScheduler() {
+	cm.mutex.RLock()
+	s := cm.vacuumer
+	cm.mutex.RUnlock()
+	if s != nil {
+		s.shutdown()
+	}
+}
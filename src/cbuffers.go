@@ -0,0 +1,87 @@
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+import (
+	"math/bits"
+	"sync"
+	"unsafe"
+)
+
+// Getが返すCのメモリは、2の累乗のサイズクラスごとにプールして使い回す。FreeMemはプールから貸したバッファを
+// 解放せずに戻すので、高いQPSでも値ごとにmallocとfreeをしない。クラスより大きい値はこれまでどおり確保・解放する。
+const (
+	minCBufferShift = 12 // 4KB
+	maxCBufferShift = 20 // 1MB
+	// maxIdleCBytes bounds the memory kept in the pool while no one uses it
+	maxIdleCBytes = 16 << 20
+)
+
+type cBufferPool struct {
+	mu        sync.Mutex
+	free      [maxCBufferShift - minCBufferShift + 1][]unsafe.Pointer
+	idleBytes int
+	lent      map[unsafe.Pointer]int // 貸し出し中のバッファのサイズクラス
+}
+
+var cBuffers = cBufferPool{lent: make(map[unsafe.Pointer]int)}
+
+// cBufferClass returns the size class that holds n bytes, or -1 if n is too large to pool
+func cBufferClass(n int) int {
+	if n > 1<<maxCBufferShift {
+		return -1
+	}
+	shift := minCBufferShift
+	if n > 1 {
+		shift = max(bits.Len(uint(n-1)), minCBufferShift)
+	}
+	return shift - minCBufferShift
+}
+
+// copyToC returns a C copy of data, to be released with FreeMem
+func (p *cBufferPool) copyToC(data []byte) *C.char {
+	class := cBufferClass(len(data))
+	if class < 0 {
+		return (*C.char)(C.CBytes(data))
+	}
+
+	p.mu.Lock()
+	var ptr unsafe.Pointer
+	if free := p.free[class]; len(free) > 0 {
+		ptr = free[len(free)-1]
+		p.free[class] = free[:len(free)-1]
+		p.idleBytes -= 1 << (class + minCBufferShift)
+	}
+	p.mu.Unlock()
+	if ptr == nil {
+		ptr = C.malloc(C.size_t(1) << (class + minCBufferShift))
+	}
+	copy(unsafe.Slice((*byte)(ptr), len(data)), data)
+
+	p.mu.Lock()
+	p.lent[ptr] = class
+	p.mu.Unlock()
+	return (*C.char)(ptr)
+}
+
+// release takes back ptr if it was lent by copyToC and reports whether it did
+func (p *cBufferPool) release(ptr unsafe.Pointer) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	class, ok := p.lent[ptr]
+	if !ok {
+		return false
+	}
+	delete(p.lent, ptr)
+
+	size := 1 << (class + minCBufferShift)
+	if p.idleBytes+size > maxIdleCBytes {
+		C.free(ptr)
+		return true
+	}
+	p.free[class] = append(p.free[class], ptr)
+	p.idleBytes += size
+	return true
+}
@@ -2,11 +2,22 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"sqlite-cache/src/server"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Version is set at build time via ldflags
@@ -22,6 +33,24 @@ func runCommandLine() {
 		case "help":
 			printHelp()
 			return
+		case "serve":
+			if err := runServe(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "stats", "ls", "du", "doctor", "compact", "bench", "exec":
+			run := map[string]func([]string) error{
+				"stats": runStats, "ls": runLs, "du": runDu, "doctor": runDoctor, "compact": runCompact, "bench": runBench, "exec": runExec,
+			}[os.Args[1]]
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "--json":
+			runJSON()
+			return
 		default:
 			fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
 			os.Exit(1)
@@ -29,108 +58,1071 @@ func runCommandLine() {
 	}
 
 	// インタラクティブモードまたはパイプモード
-	scanner := bufio.NewScanner(os.Stdin)
+	reader := bufio.NewReader(os.Stdin)
+	writer := bufio.NewWriter(os.Stdout)
+	// 端末から実行したときだけ、プロンプトを出して行編集と履歴を使う
+	terminalEditor = newLineEditor(reader)
+	handleSignals()
+	replyWriter = writer
+	framed := false
+	useBase64 := false
+	var pendingErr error // 先読みしたフレームのエラー。その前のコマンドを実行してから扱う
+	var tx *multiTx      // MULTIからEXECまでの間だけnilでない
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+	for {
+		var commands [][]string
+		var err error
+		if pendingErr != nil {
+			err, pendingErr = pendingErr, nil
+		} else if framed {
+			commands, err = readPipelined(reader)
+			if len(commands) > 0 {
+				pendingErr, err = err, nil
+			}
+		} else {
+			var line string
+			if terminalEditor != nil {
+				line, err = terminalEditor.readLine(replPrompt)
+				if err == nil {
+					var parseErr error
+					if commands, parseErr = splitCommands(line); parseErr != nil {
+						writeText(writer, errorReply(parseErr.Error()))
+						writer.Flush()
+						continue
+					}
+				}
+			} else if line, err = readLine(reader); err == nil {
+				// パイプから読む行は従来どおり空白だけで区切る。クォートや;を解釈すると、
+				// 既存のスクリプトで"や;を含むcontentの値が変わってしまう
+				commands = [][]string{strings.Fields(line)}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if framed {
+				// フレームの途中で壊れた入力は読み直せないので終了する
+				writeFramed(writer, reply{status: "ERROR", text: "protocol error: " + err.Error()})
+				writer.Flush()
+			}
+			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+			os.Exit(1)
 		}
 
-		// シンプルなテキストコマンドをパース
-		parts := strings.Fields(line)
-		if len(parts) == 0 {
-			fmt.Println("ERROR: empty command")
-			continue
+		// ;で区切ったコマンドやパイプラインで届いたフレームは順に実行し、それぞれの応答を返す
+		for i := 0; i < len(commands); {
+			args := commands[i]
+			if len(args) == 0 {
+				i++
+				continue
+			}
+
+			commandMu.Lock()
+			var replies []reply
+			n := 1
+			rep, handled := multiCommand(args, &tx, useBase64)
+			if !handled {
+				n = sameFileSets(commands[i:])
+			}
+			switch {
+			case handled:
+				replies = []reply{rep}
+			case n > 1:
+				replies = runCoalescedSets(commands[i:i+n], useBase64)
+			case strings.ToUpper(args[0]) == "PROTO":
+				replies = []reply{switchProto(args, &framed)}
+			case strings.ToUpper(args[0]) == "ENCODING":
+				replies = []reply{switchEncoding(args, &useBase64)}
+			case strings.ToUpper(args[0]) == "HELLO":
+				replies = []reply{helloReply(args, framed, useBase64)}
+			case useBase64:
+				replies = []reply{executeBase64(args)}
+			default:
+				replies = []reply{execute(args)}
+			}
+
+			for _, rep := range replies {
+				if framed {
+					writeFramed(writer, rep)
+				} else {
+					writeText(writer, rep)
+				}
+			}
+			// 続きのコマンドを受信済みなら、それも実行してからまとめて書き出す
+			if i+n == len(commands) && (terminalEditor != nil || reader.Buffered() == 0) {
+				writer.Flush()
+			}
+			commandMu.Unlock()
+
+			if !handled && strings.ToUpper(args[0]) == "SHUTDOWN" {
+				writer.Flush()
+				return
+			}
+			i += n
 		}
+	}
+}
 
-		command := strings.ToUpper(parts[0])
-		var success bool
-		var result string
+// replyWriter buffers the replies of the interactive mode, which are written out before a signal exits
+var replyWriter *bufio.Writer
 
-		switch command {
-		case "INIT":
-			if len(parts) != 4 {
-				fmt.Println("ERROR: INIT requires 3 arguments: base_dir max_size cap")
-				continue
+// commandMu is held while a command runs, so that a signal shuts down only between commands
+var commandMu sync.Mutex
+
+// handleSignals closes all DBs before exiting on SIGINT/SIGTERM. With journaling disabled,
+// a process killed in the middle of a write can leave a broken DB file.
+func handleSignals() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		if terminalEditor != nil {
+			terminalEditor.restore()
+		}
+		// 実行中のコマンドが応答を書き終えるまで待つ
+		commandMu.Lock()
+		if replyWriter != nil {
+			replyWriter.Flush()
+		}
+		if err := api.Shutdown(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error closing cache: %v\n", err)
+		}
+		// シェルの慣習に合わせて128+シグナル番号で終了する
+		os.Exit(128 + int(sig.(syscall.Signal)))
+	}()
+}
+
+// reply is the result of one command, rendered by writeText or writeFramed
+type reply struct {
+	status string // OK, ERROR, MISS
+	text   string
+	value  []byte // GETなどで返すデータ。nilでなければtextの代わりに返す
+	err    error  // 失敗したコマンドの元のエラー
+}
+
+func okReply(text string) reply {
+	return reply{status: "OK", text: text}
+}
+
+func errorReply(text string) reply {
+	return reply{status: "ERROR", text: text}
+}
+
+// resultReply returns "OK: result" on success and "ERROR: failed to result" on failure
+func resultReply(err error, result string) reply {
+	if err != nil {
+		return reply{status: "ERROR", text: "failed to " + result, err: err}
+	}
+	return okReply(result)
+}
+
+// execute runs one command of the stdin protocol
+func execute(parts []string) reply {
+	command := strings.ToUpper(parts[0])
+
+	switch command {
+	case "INIT":
+		if len(parts) != 4 {
+			return errorReply("INIT requires 3 arguments: base_dir max_size cap")
+		}
+		baseDir := parts[1]
+		maxSize, err1 := strconv.Atoi(parts[2])
+		cap, err2 := strconv.ParseFloat(parts[3], 64)
+		if err1 != nil || err2 != nil {
+			return errorReply("invalid number format")
+		}
+		return resultReply(api.Init(baseDir, maxSize, cap), "initialized")
+
+	case "SET":
+		if len(parts) != 6 {
+			return errorReply("SET requires 5 arguments: table tenant_id freshness bind content")
+		}
+		table, tenantId, freshness, bind, contentStr := parts[1], parts[2], parts[3], parts[4], parts[5]
+		return resultReply(api.Set(table, tenantId, freshness, bind, []byte(contentStr)), "set")
+
+	case "SET_TAGGED":
+		if len(parts) != 7 {
+			return errorReply("SET_TAGGED requires 6 arguments: table tenant_id freshness bind content tags")
+		}
+		// タグはカンマ区切り
+		tags := strings.Split(parts[6], ",")
+		return resultReply(api.SetWithTags(parts[1], parts[2], parts[3], parts[4], []byte(parts[5]), 0, tags), "set")
+
+	case "SET_PRIORITY":
+		if len(parts) != 7 {
+			return errorReply("SET_PRIORITY requires 6 arguments: table tenant_id freshness bind content priority")
+		}
+		priority, err := cache.ParsePriority(parts[6])
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return resultReply(api.SetWithPriority(parts[1], parts[2], parts[3], parts[4], []byte(parts[5]), 0, priority), "set")
+
+	case "INVALIDATE_TAG":
+		if len(parts) != 4 {
+			return errorReply("INVALIDATE_TAG requires 3 arguments: table tenant_id tag")
+		}
+		deleted, err := api.InvalidateTag(parts[1], parts[2], parts[3])
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return okReply(strconv.FormatInt(deleted, 10))
+
+	case "APPEND":
+		if len(parts) != 6 {
+			return errorReply("APPEND requires 5 arguments: table tenant_id freshness bind content")
+		}
+		table, tenantId, freshness, bind, contentStr := parts[1], parts[2], parts[3], parts[4], parts[5]
+		return resultReply(api.Append(table, tenantId, freshness, bind, []byte(contentStr)), "appended")
+
+	case "SETNX":
+		if len(parts) != 6 && len(parts) != 7 {
+			return errorReply("SETNX requires 5 or 6 arguments: table tenant_id freshness bind content [ttl]")
+		}
+		var ttl time.Duration
+		if len(parts) == 7 {
+			d, err := time.ParseDuration(parts[6])
+			if err != nil {
+				return errorReply("invalid ttl: " + parts[6])
 			}
-			baseDir := parts[1]
-			maxSize, err1 := strconv.Atoi(parts[2])
-			cap, err2 := strconv.ParseFloat(parts[3], 64)
-			if err1 != nil || err2 != nil {
-				fmt.Println("ERROR: invalid number format")
-				continue
+			ttl = d
+		}
+		stored, err := api.SetNX(parts[1], parts[2], parts[3], parts[4], []byte(parts[5]), ttl)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return okReply(strconv.FormatBool(stored))
+
+	case "GET", "PEEK":
+		if len(parts) != 5 {
+			return errorReply(command + " requires 4 arguments: table tenant_id freshness bind")
+		}
+		table, tenantId, freshness, bind := parts[1], parts[2], parts[3], parts[4]
+		get := api.Get
+		if command == "PEEK" {
+			// 最新アクセス時刻を更新しない
+			get = api.Peek
+		}
+		content, err := get(table, tenantId, freshness, bind)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		if content == nil {
+			return reply{status: "MISS", text: "cache not found"}
+		}
+		return reply{status: "OK", value: content}
+
+	case "TOUCH":
+		if len(parts) != 5 && len(parts) != 6 {
+			return errorReply("TOUCH requires 4 or 5 arguments: table tenant_id freshness bind [ttl]")
+		}
+		var ttl time.Duration
+		if len(parts) == 6 {
+			d, err := time.ParseDuration(parts[5])
+			if err != nil {
+				return errorReply("invalid ttl: " + parts[5])
 			}
-			err := api.Init(baseDir, maxSize, cap)
-			success = (err == nil)
-			result = "initialized"
+			ttl = d
+		}
+		err := api.Touch(parts[1], parts[2], parts[3], parts[4], ttl)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return okReply("touched")
 
-		case "SET":
-			if len(parts) != 6 {
-				fmt.Println("ERROR: SET requires 5 arguments: table tenant_id freshness bind content")
-				continue
+	case "EXISTS":
+		if len(parts) != 5 {
+			return errorReply("EXISTS requires 4 arguments: table tenant_id freshness bind")
+		}
+		table, tenantId, freshness, bind := parts[1], parts[2], parts[3], parts[4]
+		exists, err := api.Exists(table, tenantId, freshness, bind)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return okReply(strconv.FormatBool(exists))
+
+	case "DELETE":
+		if len(parts) != 2 {
+			return errorReply("DELETE requires 1 argument: table")
+		}
+		return resultReply(api.Delete(parts[1]), "deleted")
+
+	case "DELETE_ENTRY":
+		if len(parts) != 5 {
+			return errorReply("DELETE_ENTRY requires 4 arguments: table tenant_id freshness bind")
+		}
+		table, tenantId, freshness, bind := parts[1], parts[2], parts[3], parts[4]
+		return resultReply(api.DeleteEntry(table, tenantId, freshness, bind), "deleted")
+
+	case "LIST_TABLES", "LIST_TENANTS":
+		var names []string
+		var err error
+		if command == "LIST_TABLES" {
+			if len(parts) != 1 {
+				return errorReply("LIST_TABLES takes no arguments")
+			}
+			names, err = api.ListTables()
+		} else {
+			if len(parts) != 2 {
+				return errorReply("LIST_TENANTS requires 1 argument: table")
 			}
-			table, tenantId, freshness, bind, contentStr := parts[1], parts[2], parts[3], parts[4], parts[5]
-			content := []byte(contentStr)
-			err := api.Set(table, tenantId, freshness, bind, content)
-			success = (err == nil)
-			result = "set"
+			names, err = api.ListTenants(parts[1])
+		}
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		// 1行のJSONの配列で返す
+		data, err := json.Marshal(names)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return reply{status: "OK", value: data}
 
-		case "GET":
-			if len(parts) != 5 {
-				fmt.Println("ERROR: GET requires 4 arguments: table tenant_id freshness bind")
-				continue
+	case "SCAN":
+		if len(parts) < 5 || len(parts) > 7 {
+			return errorReply("SCAN requires 4 to 6 arguments: table tenant_id freshness cursor [count] [prefix]")
+		}
+		// カーソルは0で始め、0が返ったら終わり
+		cursor := parts[4]
+		if cursor == "0" {
+			cursor = ""
+		}
+		var count int
+		if len(parts) >= 6 {
+			n, err := strconv.Atoi(parts[5])
+			if err != nil {
+				return errorReply("invalid count: " + parts[5])
 			}
-			table, tenantId, freshness, bind := parts[1], parts[2], parts[3], parts[4]
-			content, err := api.Get(table, tenantId, freshness, bind)
+			count = n
+		}
+		var prefix string
+		if len(parts) == 7 {
+			prefix = parts[6]
+		}
+		binds, next, err := api.ScanPrefix(parts[1], parts[2], parts[3], prefix, cursor, count)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		if next == "" {
+			next = "0"
+		}
+		if binds == nil {
+			binds = []cache.BindInfo{}
+		}
+		// 1行のJSONで返す
+		data, err := json.Marshal(scanResult{Cursor: next, Binds: binds})
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return reply{status: "OK", value: data}
+
+	case "DELETE_PREFIX":
+		if len(parts) != 5 {
+			return errorReply("DELETE_PREFIX requires 4 arguments: table tenant_id freshness prefix")
+		}
+		deleted, err := api.DeletePrefix(parts[1], parts[2], parts[3], parts[4])
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return okReply(strconv.FormatInt(deleted, 10))
+
+	case "DELETE_WHERE":
+		if len(parts) < 5 {
+			return errorReply("DELETE_WHERE requires at least 4 arguments: table tenant_id freshness part [part...]")
+		}
+		deleted, err := api.DeleteWhere(parts[1], parts[2], parts[3], parts[4:])
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return okReply(strconv.FormatInt(deleted, 10))
+
+	case "DELETE_TENANT":
+		if len(parts) != 3 {
+			return errorReply("DELETE_TENANT requires 2 arguments: table tenant_id")
+		}
+		return resultReply(api.DeleteTenant(parts[1], parts[2]), "deleted")
+
+	case "COMPACT":
+		// tenant_idを省略するとテーブルのすべてのテナントを対象にする
+		if len(parts) != 2 && len(parts) != 3 {
+			return errorReply("COMPACT requires 1 or 2 arguments: table [tenant_id]")
+		}
+		tenantID := ""
+		if len(parts) == 3 {
+			tenantID = parts[2]
+		}
+		reclaimed, err := api.Compact(parts[1], tenantID)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return okReply(strconv.FormatInt(reclaimed, 10))
+
+	case "BACKUP":
+		// 引数が1つならすべてのキャッシュファイルを、4つなら1つのキャッシュファイルをバックアップする
+		switch len(parts) {
+		case 2:
+			written, err := api.BackupAll(parts[1])
 			if err != nil {
-				fmt.Printf("ERROR: %s\n", err.Error())
-			} else if content != nil {
-				fmt.Printf("OK: %s\n", string(content))
-			} else {
-				fmt.Println("MISS: cache not found")
+				return reply{status: "ERROR", text: err.Error(), err: err}
 			}
-			continue
+			return okReply(strconv.Itoa(written))
+		case 5:
+			if err := api.Backup(parts[1], parts[2], parts[3], parts[4]); err != nil {
+				return reply{status: "ERROR", text: err.Error(), err: err}
+			}
+			return okReply("backed up")
+		}
+		return errorReply("BACKUP requires 1 argument: dest_dir, or 4 arguments: table tenant_id freshness dest_path")
 
-		case "DELETE":
+	case "EXPORT", "IMPORT":
+		var count int
+		var err error
+		if command == "EXPORT" {
+			if len(parts) != 4 {
+				return errorReply("EXPORT requires 3 arguments: table tenant_id path")
+			}
+			count, err = api.Export(parts[1], parts[2], parts[3])
+		} else {
 			if len(parts) != 2 {
-				fmt.Println("ERROR: DELETE requires 1 argument: table")
-				continue
+				return errorReply("IMPORT requires 1 argument: path")
 			}
-			table := parts[1]
-			err := api.Delete(table)
-			success = (err == nil)
-			result = "deleted"
+			count, err = api.Import(parts[1])
+		}
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return okReply(strconv.Itoa(count))
 
-		case "CLOSE":
-			err := api.Close()
-			success = (err == nil)
-			result = "closed"
-			if success {
-				fmt.Printf("OK: %s\n", result)
-			} else {
-				fmt.Printf("ERROR: failed to %s\n", result)
+	case "PRELOAD":
+		if len(parts) != 5 {
+			return errorReply("PRELOAD requires 4 arguments: table tenant_id freshness path")
+		}
+		file, err := os.Open(parts[4])
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		defer file.Close()
+		count, err := api.Preload(parts[1], parts[2], parts[3], file, nil)
+		if err != nil {
+			// 途中までのトランザクションは残るので、登録できた数も返す
+			err = fmt.Errorf("%w (%d entries stored)", err, count)
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return okReply(strconv.Itoa(count))
+
+	case "RESTORE":
+		if len(parts) != 2 {
+			return errorReply("RESTORE requires 1 argument: src_dir")
+		}
+		restored, err := api.Restore(parts[1])
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return okReply(strconv.Itoa(restored))
+
+	case "STATS":
+		// 1行のJSONで返す
+		stats, err := api.Stats()
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		data, err := json.Marshal(stats)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return reply{status: "OK", value: data}
+
+	case "TOP_KEYS":
+		if len(parts) != 3 && len(parts) != 4 {
+			return errorReply("TOP_KEYS requires 2 or 3 arguments: table tenant_id [n]")
+		}
+		n := 10
+		if len(parts) == 4 {
+			v, err := strconv.Atoi(parts[3])
+			if err != nil || v <= 0 {
+				return errorReply(fmt.Sprintf("invalid n: %s", parts[3]))
 			}
-			break
+			n = v
+		}
+		top, err := api.TopKeys(parts[1], parts[2], n)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		data, err := json.Marshal(top)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return reply{status: "OK", value: data}
 
-		default:
-			fmt.Printf("ERROR: unknown command: %s\n", command)
+	case "PREVIEW_EVICTION":
+		if len(parts) != 3 {
+			return errorReply("PREVIEW_EVICTION requires 2 arguments: table tenant_id")
+		}
+		previews, err := api.PreviewEviction(parts[1], parts[2])
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		data, err := json.Marshal(previews)
+		if err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}
+		}
+		return reply{status: "OK", value: data}
+
+	case "HELP":
+		return helpReply(parts)
+
+	case "MULTI", "EXEC", "ROLLBACK":
+		// 貯めたコマンドはセッションに持つので、対話モードのループで扱う
+		return errorReply(command + " is only supported in the interactive and piped protocol")
+
+	case "PING":
+		// キャッシュを初期化していなくても応答する (接続の確認用)
+		if len(parts) > 2 {
+			return errorReply("PING requires 0 or 1 argument: [message]")
+		}
+		if len(parts) == 2 {
+			return okReply(parts[1])
+		}
+		return okReply("PONG")
+
+	case "HELLO":
+		// 対話モード以外 (exec、JSON) は常にテキストのプロトコルで応答する
+		return helloReply(parts, false, false)
+
+	case "CLOSE":
+		return resultReply(api.Close(), "closed")
+
+	case "SHUTDOWN":
+		// 呼び出し側は応答を書いた後に終了する
+		return resultReply(api.Shutdown(), "shutdown")
+
+	default:
+		return errorReply(fmt.Sprintf("unknown command: %s", command))
+	}
+}
+
+// switchProto handles "PROTO 1" (text lines) and "PROTO 2" (length-prefixed frames).
+// The reply is already written in the newly selected format.
+func switchProto(parts []string, framed *bool) reply {
+	if len(parts) != 2 || (parts[1] != "1" && parts[1] != "2") {
+		return errorReply("PROTO requires 1 argument: 1 or 2")
+	}
+	*framed = parts[1] == "2"
+	return okReply("proto " + parts[1])
+}
+
+// readLine reads one line of text commands, to be split by splitCommands
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return line, nil
+}
+
+const (
+	maxFrameArgs = 1024
+	maxFrameBulk = 512 << 20
+)
+
+// readFrame reads one command in the PROTO 2 format: "*N\r\n" followed by N arguments,
+// each "$len\r\n<len bytes>\r\n". A line not starting with '*' is read as a text command.
+func readFrame(r *bufio.Reader) ([]string, error) {
+	line, err := readCRLF(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > maxFrameArgs {
+		return nil, fmt.Errorf("invalid argument count: %q", line)
+	}
+
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		header, err := readCRLF(r)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(header, "$") {
+			return nil, fmt.Errorf("invalid bulk header: %q", header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 || size > maxFrameBulk {
+			return nil, fmt.Errorf("invalid bulk length: %q", header)
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("bulk data of argument %d is not terminated by CRLF", i+1)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readCRLF reads a line and strips the trailing CRLF (or LF)
+func readCRLF(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && line != "" {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// writeText writes the reply as "STATUS: text"
+func writeText(w *bufio.Writer, rep reply) {
+	if rep.value != nil {
+		fmt.Fprintf(w, "%s: %s\n", rep.status, rep.value)
+		return
+	}
+	fmt.Fprintf(w, "%s: %s\n", rep.status, rep.text)
+}
+
+// writeFramed writes the reply in the PROTO 2 format: data as "$len\r\n<bytes>\r\n", a miss as
+// "$-1\r\n", success as "+OK text\r\n" and failures as "-ERROR text\r\n"
+func writeFramed(w *bufio.Writer, rep reply) {
+	switch {
+	case rep.value != nil:
+		fmt.Fprintf(w, "$%d\r\n", len(rep.value))
+		w.Write(rep.value)
+		w.WriteString("\r\n")
+	case rep.status == "MISS" || (rep.err != nil && cache.IsNotFound(rep.err)):
+		w.WriteString("$-1\r\n")
+	case rep.status == "ERROR":
+		text := strings.NewReplacer("\r", " ", "\n", " ").Replace(rep.text)
+		fmt.Fprintf(w, "-ERROR %s\r\n", text)
+	default:
+		fmt.Fprintf(w, "+OK %s\r\n", rep.text)
+	}
+}
+
+// jsonRequest is one line of the --json mode
+type jsonRequest struct {
+	ID         any      `json:"id,omitempty"` // そのままレスポンスに返す
+	Cmd        string   `json:"cmd"`
+	Table      string   `json:"table"`
+	TenantID   string   `json:"tenant_id"`
+	Freshness  string   `json:"freshness"`
+	Bind       string   `json:"bind"`
+	Content    *string  `json:"content"` // テキストのcontent。content_b64より優先する
+	ContentB64 string   `json:"content_b64"`
+	BaseDir    string   `json:"base_dir"`
+	MaxSize    int      `json:"max_size"`
+	Cap        float64  `json:"cap"`
+	TTL        string   `json:"ttl"`      // setnxとtouchの有効期限 (例: "10m")
+	Tags       []string `json:"tags"`     // setで付けるタグ
+	Priority   string   `json:"priority"` // setで付ける優先度 (low, normal, high, pin)
+	Tag        string   `json:"tag"`      // invalidate_tagで削除するタグ
+	Prefix     string   `json:"prefix"`   // delete_prefixとscan
+	Parts      []string `json:"parts"`    // delete_whereで一致させる先頭の部分
+	Cursor     string   `json:"cursor"`   // scanのカーソル (空または"0"で始める)
+	Count      int      `json:"count"`    // scanで返す最大の数 (0なら100)、top_keysで返す数 (0なら10)
+	Path       string   `json:"path"`     // backup、restore、export、importのファイルやディレクトリ
+}
+
+// scanResult is the reply of SCAN
+type scanResult struct {
+	Cursor string           `json:"cursor"` // 次のSCANに渡す。0なら終わり
+	Binds  []cache.BindInfo `json:"binds"`
+}
+
+type jsonResponse struct {
+	ID         any             `json:"id,omitempty"`
+	Status     string          `json:"status"` // ok, miss, error
+	Code       string          `json:"code"`   // success, not_found, disk_full, invalid_arg, not_init, too_large, general
+	Result     string          `json:"result,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	ContentB64 string          `json:"content_b64,omitempty"`
+	Stats      json.RawMessage `json:"stats,omitempty"`
+	Scan       json.RawMessage `json:"scan,omitempty"`
+	Names      json.RawMessage `json:"names,omitempty"`    // list_tablesとlist_tenants
+	Eviction   json.RawMessage `json:"eviction,omitempty"` // preview_eviction
+	TopKeys    json.RawMessage `json:"top_keys,omitempty"` // top_keys
+	Hello      json.RawMessage `json:"hello,omitempty"`    // hello
+}
+
+// runJSON reads one JSON request per line and writes one JSON response per line
+func runJSON() {
+	handleSignals()
+	reader := bufio.NewReader(os.Stdin)
+	writer := bufio.NewWriter(os.Stdout)
+	encoder := json.NewEncoder(writer)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err != io.EOF {
+				fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+				os.Exit(1)
+			}
+			break
+		}
+		if len(strings.TrimSpace(string(line))) == 0 {
 			continue
 		}
 
-		if command != "GET" {
-			if success {
-				fmt.Printf("OK: %s\n", result)
-			} else {
-				fmt.Printf("ERROR: failed to %s\n", result)
+		commandMu.Lock()
+		var req jsonRequest
+		var resp jsonResponse
+		if err := json.Unmarshal(line, &req); err != nil {
+			resp = jsonResponse{Status: "error", Code: "invalid_arg", Error: "invalid JSON: " + err.Error()}
+		} else if args, err := jsonArgs(req); err != nil {
+			resp = jsonResponse{ID: req.ID, Status: "error", Code: "invalid_arg", Error: err.Error()}
+		} else {
+			resp = jsonReply(req, execute(args))
+		}
+
+		encoder.Encode(resp)
+		writer.Flush()
+		commandMu.Unlock()
+
+		if strings.EqualFold(req.Cmd, "shutdown") {
+			return
+		}
+	}
+}
+
+// jsonArgs converts the request to the arguments of the text protocol
+func jsonArgs(req jsonRequest) ([]string, error) {
+	content := []byte(nil)
+	if req.Content != nil {
+		content = []byte(*req.Content)
+	} else if req.ContentB64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(req.ContentB64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid content_b64: %w", err)
+		}
+		content = decoded
+	}
+
+	cmd := strings.ToLower(req.Cmd)
+	var args []string
+	var required [][2]string // 引数名と値
+	switch cmd {
+	case "init":
+		args = []string{"INIT", req.BaseDir, strconv.Itoa(req.MaxSize), strconv.FormatFloat(req.Cap, 'g', -1, 64)}
+		required = [][2]string{{"base_dir", req.BaseDir}}
+	case "set", "append":
+		args = []string{strings.ToUpper(cmd), req.Table, req.TenantID, req.Freshness, req.Bind, string(content)}
+		if cmd == "set" && len(req.Tags) > 0 && req.Priority != "" {
+			return nil, fmt.Errorf("tags and priority cannot be set together")
+		}
+		if cmd == "set" && len(req.Tags) > 0 {
+			args = []string{"SET_TAGGED", req.Table, req.TenantID, req.Freshness, req.Bind, string(content), strings.Join(req.Tags, ",")}
+		}
+		if cmd == "set" && req.Priority != "" {
+			args = []string{"SET_PRIORITY", req.Table, req.TenantID, req.Freshness, req.Bind, string(content), req.Priority}
+		}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}, {"freshness", req.Freshness}, {"bind", req.Bind}}
+	case "invalidate_tag":
+		args = []string{"INVALIDATE_TAG", req.Table, req.TenantID, req.Tag}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}, {"tag", req.Tag}}
+	case "setnx":
+		args = []string{"SETNX", req.Table, req.TenantID, req.Freshness, req.Bind, string(content)}
+		if req.TTL != "" {
+			args = append(args, req.TTL)
+		}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}, {"freshness", req.Freshness}, {"bind", req.Bind}}
+	case "get", "peek", "exists", "delete_entry":
+		args = []string{strings.ToUpper(cmd), req.Table, req.TenantID, req.Freshness, req.Bind}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}, {"freshness", req.Freshness}, {"bind", req.Bind}}
+	case "touch":
+		args = []string{"TOUCH", req.Table, req.TenantID, req.Freshness, req.Bind}
+		if req.TTL != "" {
+			args = append(args, req.TTL)
+		}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}, {"freshness", req.Freshness}, {"bind", req.Bind}}
+	case "list_tenants":
+		args = []string{"LIST_TENANTS", req.Table}
+		required = [][2]string{{"table", req.Table}}
+	case "scan":
+		cursor := req.Cursor
+		if cursor == "" {
+			cursor = "0"
+		}
+		args = []string{"SCAN", req.Table, req.TenantID, req.Freshness, cursor, strconv.Itoa(req.Count), req.Prefix}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}, {"freshness", req.Freshness}}
+	case "delete_prefix":
+		args = []string{"DELETE_PREFIX", req.Table, req.TenantID, req.Freshness, req.Prefix}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}, {"freshness", req.Freshness}, {"prefix", req.Prefix}}
+	case "delete_where":
+		if len(req.Parts) == 0 {
+			return nil, fmt.Errorf("parts is required")
+		}
+		args = append([]string{"DELETE_WHERE", req.Table, req.TenantID, req.Freshness}, req.Parts...)
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}, {"freshness", req.Freshness}}
+	case "backup":
+		// tableを指定しなければすべてのキャッシュファイルをpathのディレクトリに書き出す
+		args = []string{"BACKUP", req.Path}
+		if req.Table != "" {
+			args = []string{"BACKUP", req.Table, req.TenantID, req.Freshness, req.Path}
+			required = [][2]string{{"tenant_id", req.TenantID}, {"freshness", req.Freshness}}
+		}
+		required = append(required, [2]string{"path", req.Path})
+	case "restore", "import":
+		args = []string{strings.ToUpper(cmd), req.Path}
+		required = [][2]string{{"path", req.Path}}
+	case "export":
+		args = []string{"EXPORT", req.Table, req.TenantID, req.Path}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}, {"path", req.Path}}
+	case "preload":
+		args = []string{"PRELOAD", req.Table, req.TenantID, req.Freshness, req.Path}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}, {"freshness", req.Freshness}, {"path", req.Path}}
+	case "top_keys":
+		args = []string{"TOP_KEYS", req.Table, req.TenantID}
+		if req.Count > 0 {
+			args = append(args, strconv.Itoa(req.Count))
+		}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}}
+	case "delete_tenant", "preview_eviction":
+		args = []string{strings.ToUpper(cmd), req.Table, req.TenantID}
+		required = [][2]string{{"table", req.Table}, {"tenant_id", req.TenantID}}
+	case "delete":
+		args = []string{"DELETE", req.Table}
+		required = [][2]string{{"table", req.Table}}
+	case "compact":
+		args = []string{"COMPACT", req.Table}
+		if req.TenantID != "" {
+			args = append(args, req.TenantID)
+		}
+		required = [][2]string{{"table", req.Table}}
+	case "":
+		return nil, fmt.Errorf("cmd is required")
+	default:
+		args = []string{strings.ToUpper(cmd)}
+	}
+
+	for _, field := range required {
+		if field[1] == "" {
+			return nil, fmt.Errorf("%s is required for %s", field[0], cmd)
+		}
+	}
+	return args, nil
+}
+
+// jsonReply converts the reply of execute to a JSON response
+func jsonReply(req jsonRequest, rep reply) jsonResponse {
+	resp := jsonResponse{ID: req.ID}
+	switch {
+	case rep.status == "MISS" || (rep.err != nil && cache.IsNotFound(rep.err)):
+		resp.Status, resp.Code = "miss", "not_found"
+	case rep.status == "ERROR":
+		resp.Status, resp.Code, resp.Error = "error", errorCode(rep.err), rep.text
+		if rep.err != nil {
+			resp.Error = rep.text + ": " + rep.err.Error()
+		}
+	default:
+		resp.Status, resp.Code, resp.Result = "ok", "success", rep.text
+	}
+
+	if rep.value != nil {
+		if strings.EqualFold(req.Cmd, "stats") {
+			resp.Stats = json.RawMessage(rep.value)
+		} else if strings.EqualFold(req.Cmd, "scan") {
+			resp.Scan = json.RawMessage(rep.value)
+		} else if strings.EqualFold(req.Cmd, "list_tables") || strings.EqualFold(req.Cmd, "list_tenants") {
+			resp.Names = json.RawMessage(rep.value)
+		} else if strings.EqualFold(req.Cmd, "preview_eviction") {
+			resp.Eviction = json.RawMessage(rep.value)
+		} else if strings.EqualFold(req.Cmd, "top_keys") {
+			resp.TopKeys = json.RawMessage(rep.value)
+		} else if strings.EqualFold(req.Cmd, "hello") {
+			resp.Hello = json.RawMessage(rep.value)
+		} else {
+			resp.ContentB64 = base64.StdEncoding.EncodeToString(rep.value)
+		}
+	}
+	return resp
+}
+
+// errorCode classifies err like the error codes of the C library. Errors without a cause are argument errors.
+func errorCode(err error) string {
+	if err == nil {
+		return "invalid_arg"
+	}
+	errStr := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(errStr, "disk full") || strings.Contains(errStr, "database or disk is full"):
+		return "disk_full"
+	case strings.Contains(errStr, "not init"):
+		return "not_init"
+	case strings.Contains(errStr, "too large"):
+		return "too_large"
+	default:
+		return "general"
+	}
+}
+
+// listener is implemented by the HTTP and gRPC servers
+type listener interface {
+	ListenAndServe() error
+	Shutdown(ctx context.Context) error
+}
+
+// runServe starts the HTTP (or gRPC) server and blocks until SIGINT/SIGTERM
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:8080", "listen address")
+	useGRPC := fs.Bool("grpc", false, "serve gRPC instead of HTTP")
+	baseDir := fs.String("base-dir", "./cache", "cache base directory")
+	maxSize := fs.Int("max-size", 100, "maximum cache file size (MB)")
+	cap := fs.Float64("cap", 0.8, "ratio of entries kept by LRU cleanup")
+	maxEntrySize := fs.Int64("max-entry-size", 0, "reject entries larger than this many bytes (0 means no limit)")
+	memcachedAddr := fs.String("memcached", "", "also serve the memcached text protocol on this address")
+	memcachedTable := fs.String("memcached-table", "memcached", "table used for memcached keys")
+	memcachedTenant := fs.String("memcached-tenant", "default", "tenant used for memcached keys")
+	memcachedFreshness := fs.String("memcached-freshness", "1", "freshness used for memcached keys")
+	changeFeed := fs.Int("change-feed", 0, "buffer this many mutations per /changes, Watch or replica client (0 disables the change feed)")
+	replicaOf := fs.String("replica-of", "", "follow the primary HTTP server at this URL and reject writes")
+	evictionPolicy := fs.String("eviction-policy", "lru", "entries removed first when a cache file is full: lru, sampled-lru, lfu or fifo")
+	tablePolicies := fs.String("table-eviction-policy", "", "per table eviction policies overriding --eviction-policy, e.g. sessions=lfu,logs=fifo")
+	hashBindsOver := fs.Int("hash-binds-over", 0, "store binds longer than this many bytes (at least 128) as hashed keys (0 disables)")
+	hashUnsafeNames := fs.Bool("hash-unsafe-names", false, "store tables, tenants and freshness values that are not safe path elements under hashed names instead of rejecting them")
+	memoryTables := fs.String("memory-tables", "", "comma separated tables kept in memory (tmpfs) and removed on exit, or * for every table")
+	tlsCert := fs.String("tls-cert", "", "serve TLS with this PEM certificate (requires --tls-key)")
+	tlsKey := fs.String("tls-key", "", "PEM private key of --tls-cert")
+	tlsClientCA := fs.String("tls-client-ca", "", "require client certificates signed by this PEM CA (mTLS)")
+	tlsCA := fs.String("tls-ca", "", "PEM CA that --replica-of uses to verify the primary instead of the system roots")
+	tenantRPS := fs.Float64("tenant-rps", 0, "limit each tenant to this many requests per second, answering 429 over it (0 means no limit)")
+	tenantBandwidth := fs.Float64("tenant-bandwidth", 0, "limit each tenant to this many content bytes read and written per second (0 means no limit)")
+	adminAddr := fs.String("admin-addr", "", "serve pprof (/debug/pprof/) and expvar (/debug/vars) on this address, e.g. 127.0.0.1:6060; also collects per-tenant counters")
+	authTokenFile := fs.String("auth-token-file", "", "require the token in this file from every client (Bearer token, or memcached text protocol auth)")
+	accessLog := fs.String("access-log", "", "append a record of every get, set and delete (time, op, table, tenant, bind, result) to this file")
+	accessLogFormat := fs.String("access-log-format", "ndjson", "format of --access-log: ndjson, or sqlite for an access_log table")
+	accessLogSample := fs.Float64("access-log-sample", 0, "record only this ratio of operations in --access-log (0 records every operation)")
+	fs.Parse(args)
+
+	security, err := server.LoadSecurity(*tlsCert, *tlsKey, *tlsClientCA, *tlsCA, *authTokenFile)
+	if err != nil {
+		return err
+	}
+	// テナントの制限はプロトコルをまたいで数えるので、すべてのサーバーで1つを共有する
+	limiter, err := server.NewRateLimiter(server.RateLimit{RequestsPerSecond: *tenantRPS, BytesPerSecond: *tenantBandwidth})
+	if err != nil {
+		return fmt.Errorf("invalid --tenant-rps or --tenant-bandwidth: %w", err)
+	}
+
+	config := cache.CacheConfig{BaseDir: *baseDir, MaxSize: *maxSize, Cap: *cap, MaxEntrySize: *maxEntrySize, ChangeFeedBuffer: *changeFeed,
+		HashBindsOver: *hashBindsOver, HashUnsafeNames: *hashUnsafeNames, Metrics: *adminAddr != "",
+		AccessLogPath: *accessLog, AccessLogFormat: *accessLogFormat, AccessLogSampleRate: *accessLogSample}
+	if *memoryTables != "" {
+		config.MemoryTables = strings.Split(*memoryTables, ",")
+	}
+	if config.EvictionPolicy, err = cache.EvictionPolicyByName(*evictionPolicy); err != nil {
+		return err
+	}
+	if config.TableEvictionPolicies, err = parseTablePolicies(*tablePolicies); err != nil {
+		return err
+	}
+	if err := api.InitWithConfig(config); err != nil {
+		return err
+	}
+	defer api.Close()
+
+	var srv listener = server.New(*addr)
+	if *useGRPC {
+		srv = server.NewGRPC(*addr)
+	}
+	servers := []listener{srv}
+	if *memcachedAddr != "" {
+		servers = append(servers, server.NewMemcached(*memcachedAddr, *memcachedTable, *memcachedTenant, *memcachedFreshness, Version))
+	}
+	if *replicaOf != "" {
+		// 書き込みはプライマリにだけ行わせる
+		for _, srv := range servers {
+			if s, ok := srv.(interface{ SetReadOnly(bool) }); ok {
+				s.SetReadOnly(true)
 			}
 		}
+		servers = append(servers, server.NewReplica(*replicaOf))
+	}
+	if *adminAddr != "" {
+		servers = append(servers, server.NewAdmin(*adminAddr))
+	}
+	for _, srv := range servers {
+		if s, ok := srv.(interface{ SetSecurity(*server.Security) }); ok {
+			s.SetSecurity(security)
+		}
+		if s, ok := srv.(interface{ SetRateLimit(*server.RateLimiter) }); ok {
+			s.SetRateLimit(limiter)
+		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
-		os.Exit(1)
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv listener) {
+			errCh <- srv.ListenAndServe()
+		}(srv)
+	}
+	withTLS := ""
+	if security.TLS != nil {
+		withTLS = " with TLS"
+	}
+	fmt.Fprintf(os.Stderr, "sqcache serving on %s%s\n", *addr, withTLS)
+	if *memcachedAddr != "" {
+		fmt.Fprintf(os.Stderr, "sqcache serving memcached protocol on %s\n", *memcachedAddr)
+	}
+	if *replicaOf != "" {
+		fmt.Fprintf(os.Stderr, "sqcache replicating from %s\n", *replicaOf)
+	}
+	if *adminAddr != "" {
+		fmt.Fprintf(os.Stderr, "sqcache serving pprof and expvar on %s\n", *adminAddr)
 	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-sigCh:
+	}
+
+	// 処理中のリクエストを待ってから終了する
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var firstErr error
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// parseTablePolicies parses "table=policy,table=policy" of --table-eviction-policy
+func parseTablePolicies(spec string) (map[string]cache.EvictionPolicy, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	policies := make(map[string]cache.EvictionPolicy)
+	for _, item := range strings.Split(spec, ",") {
+		table, name, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok || table == "" {
+			return nil, fmt.Errorf("invalid table eviction policy %q: expected table=policy", item)
+		}
+		policy, err := cache.EvictionPolicyByName(name)
+		if err != nil {
+			return nil, err
+		}
+		policies[table] = policy
+	}
+	return policies, nil
 }
 
 func printHelp() {
@@ -138,31 +1130,105 @@ func printHelp() {
 
 USAGE:
     sqcache [COMMAND]
+    sqcache --json          Read JSON commands from stdin (see JSON MODE)
 
 COMMANDS:
     help     Show this help message
     version  Show version information
+    serve    Start the HTTP server
+             [--addr 127.0.0.1:8080] [--base-dir ./cache] [--max-size 100] [--cap 0.8]
+             [--max-entry-size 0]  Reject larger entries (bytes, 413 over HTTP)
+             [--grpc]  Serve the gRPC API (src/sqcachepb/sqcache.proto) instead of HTTP
+             [--memcached 127.0.0.1:11211]  Also serve the memcached text protocol
+             [--memcached-table memcached] [--memcached-tenant default] [--memcached-freshness 1]
+             [--change-feed 0]  Stream mutations via GET /changes or Watch, buffering this many per client
+             [--replica-of http://primary:8080]  Follow a primary started with --change-feed; writes are rejected
+             [--tls-cert server.pem --tls-key server.key]  Serve HTTPS, gRPC over TLS and memcached over TLS
+             [--tls-client-ca ca.pem]  Require client certificates signed by the CA (mTLS)
+             [--tls-ca ca.pem]  CA used by --replica-of to verify an https:// primary
+             [--tenant-rps 0] [--tenant-bandwidth 0]  Limit requests and content bytes per second of each tenant
+                                                     (429 with Retry-After, RESOURCE_EXHAUSTED, or SERVER_ERROR)
+             [--auth-token-file token.txt]  Require "Authorization: Bearer <token>" (HTTP, gRPC metadata); memcached
+                                            clients authenticate first with a set whose data is "<user> <token>"
+             [--admin-addr 127.0.0.1:6060]  Serve /debug/pprof/ and /debug/vars (expvar, with per-tenant counters)
+             [--access-log access.ndjson] [--access-log-format ndjson|sqlite] [--access-log-sample 0]
+                                            Append a record of every get, set and delete for auditing
+    stats    Print entries, sizes and freshness of each cache file in a cache directory (read-only)
+             [--json] <basedir>
+    ls       List the tables, the tenants of a table or the freshness generations of a tenant (read-only)
+             <basedir> [table [tenant]]  The current freshness is marked with *
+    du       Print the disk usage of each tenant and table directory (read-only)
+             <basedir>
+    doctor   Check permissions, integrity, schema and stale freshness files of a cache directory
+             [--fix]  Repair what can be repaired; stop the processes using the directory first
+             [--retain 0] [--json] <basedir>  Exits with 1 while problems remain
+    compact  VACUUM and optimize the cache files of a cache directory and print the reclaimed bytes
+             <basedir> [table [tenant]]  Each tenant is locked while it is compacted; run it off-peak
+    bench    Run a get/set mix against a temporary cache and print throughput and latency percentiles
+             [--workers 4] [--value-size 1024] [--keys 10000] [--duration 10s] [--read-ratio 0.9] [--tenants 1]
+             [--base-dir DIR] [--max-size 100] [--cap 0.8] [--journal-mode WAL] [--synchronous NORMAL]
+             [--compression zstd] [--json]
+    exec     Run a file of interactive mode commands ('-' for stdin) and print a JSON summary
+             [--continue-on-error]  Keep going after a failure (by default the rest is skipped)
+             [--base-dir DIR] [--max-size 100] [--cap 0.8] <commands.txt>  Without --base-dir the file starts with INIT
+             Consecutive SETs to the same cache file are stored in one transaction; exits with 1 if any command failed
+
+HTTP SERVER:
+    GET    /cache/{table}/{tenant}/{freshness}/{bind}   Get content (404 on miss)
+    PUT    /cache/{table}/{tenant}/{freshness}/{bind}   Set content from the request body (?ttl=60s)
+    DELETE /cache/{table}/{tenant}/{freshness}/{bind}   Delete the entry
+    DELETE /cache/{table}/{tenant}                      Delete the tenant
+    DELETE /cache/{table}                               Delete the table
+    GET    /changes                                     Stream mutations as NDJSON (?table=&tenant=, needs --change-feed)
+    GET    /replication                                 Stream changes with content for replicas (?snapshot=1, needs --change-feed)
+    GET    /healthz                                     Liveness probe ("ok" while the process serves requests)
+    GET    /readyz                                      Readiness probe (503 unless a SQLite file can be created in base_dir)
 
 INTERACTIVE MODE:
     Run without arguments to enter interactive mode.
-    Send simple text commands:
+    Send text commands, one or more per line separated by ';':
+    - Arguments are separated by spaces. "..." and '...' quote an argument containing spaces;
+      "..." also accepts \" \\ \n \r \t and \xHH. Quotes count only at the start of an argument,
+      so {"a":1} is taken as is. A ';' ends the command only at the end of an argument ("a;b" is kept).
+    - On a terminal a prompt is shown, with line editing (arrow keys, Ctrl-A/E/K/U/W) and history
+      kept in ~/.sqcache_history (up/down, Ctrl-P/N). Ctrl-D exits.
 
     Available commands:
-    INIT base_dir max_size cap
-    SET table tenant_id freshness bind content
-    GET table tenant_id freshness bind
-    DELETE table
-    CLOSE
+` + indentLines(protocolCommands, "    ") + `
+    SIGINT/SIGTERM also close all cache files (checkpointing the WAL in WAL mode)
+    after the running command before exiting.
 
     Responses:
     OK: <result>     - Success
     ERROR: <reason>  - Failure
     MISS: <reason>   - Cache miss
 
+FRAMED PROTOCOL (PROTO 2):
+    Commands are sent as "*<argc>\r\n" followed by each argument as "$<len>\r\n<bytes>\r\n",
+    so content may contain spaces, newlines and arbitrary bytes.
+    Responses:
+    $<len>\r\n<bytes>\r\n  - Data (GET, STATS, SCAN, LIST_TABLES, LIST_TENANTS)
+    $-1\r\n               - Cache miss
+    +OK <result>\r\n      - Success
+    -ERROR <reason>\r\n   - Failure
+    Frames may be pipelined without waiting for responses; they run and are answered in order,
+    and consecutive SETs to the same cache file are stored in one transaction.
+
+JSON MODE (--json):
+    Each stdin line is a JSON object and each response is one JSON line.
+    Request:  {"id":1,"cmd":"set","table":"users","tenant_id":"tenant1","freshness":"fresh1",
+               "bind":"user123","content_b64":"ZGF0YQ=="}
+              cmd: init (base_dir, max_size, cap), set (tags), setnx (ttl), get, peek, exists, touch (ttl), delete_entry, list_tables, list_tenants, scan (cursor, count, prefix), delete_prefix (prefix), delete_where (parts), delete_tenant, delete, compact (tenant_id optional), invalidate_tag (tag), stats, ping, hello, close, shutdown
+              "content" may be given instead of "content_b64" for text.
+    Response: {"id":1,"status":"ok|miss|error","code":"success|not_found|disk_full|invalid_arg|not_init|too_large|general",
+               "result":"...","error":"...","content_b64":"...","stats":[...]}
+
 EXAMPLES:
     echo 'INIT ./cache 100 0.8' | sqcache
     echo 'SET users tenant1 fresh1 user123 data' | sqcache
     echo 'GET users tenant1 fresh1 user123' | sqcache
+    echo 'DELETE_ENTRY users tenant1 fresh1 user123' | sqcache
+    echo 'STATS' | sqcache
     echo 'DELETE users' | sqcache
     echo 'CLOSE' | sqcache
 `
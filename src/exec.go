@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"strings"
+	"time"
+)
+
+// execBatchSize bounds the SET commands stored in one transaction by sqcache exec
+const execBatchSize = 1000
+
+// execCommand is one command of the script with its line number
+type execCommand struct {
+	line int
+	args []string
+}
+
+// execError is a failed command, or a failed transaction of Count SET commands starting at Line
+type execError struct {
+	Line    int    `json:"line"`
+	Command string `json:"command"`
+	Count   int    `json:"count,omitempty"`
+	Error   string `json:"error"`
+}
+
+// execSummary is printed as JSON by sqcache exec
+type execSummary struct {
+	File         string      `json:"file"`
+	Commands     int         `json:"commands"`
+	Succeeded    int         `json:"succeeded"`
+	Failed       int         `json:"failed"`
+	Skipped      int         `json:"skipped"`      // 失敗で止めた後の実行していないコマンド
+	Transactions int         `json:"transactions"` // まとめて登録したSETのトランザクション
+	DurationMs   int64       `json:"duration_ms"`
+	Errors       []execError `json:"errors"`
+}
+
+// runExec runs a file of protocol commands and prints a JSON summary:
+// sqcache exec [--continue-on-error] [--base-dir DIR] commands.txt
+func runExec(args []string) error {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	continueOnError := fs.Bool("continue-on-error", false, "run the remaining commands after a failure")
+	baseDir := fs.String("base-dir", "", "initialize the cache in this directory before the script (otherwise the script must start with INIT)")
+	maxSize := fs.Int("max-size", 100, "max size per DB in MB, with --base-dir")
+	cap := fs.Float64("cap", 0.8, "ratio of entries kept by LRU cleanup, with --base-dir")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: sqcache exec [--continue-on-error] [--base-dir DIR] <commands.txt|->")
+	}
+
+	path := fs.Arg(0)
+	var input io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		input = f
+	}
+
+	summary := execSummary{File: path, Errors: []execError{}}
+	commands, parseErrors, err := readScript(input)
+	if err != nil {
+		return err
+	}
+	summary.Commands = len(commands) + len(parseErrors)
+	summary.Failed = len(parseErrors)
+	summary.Errors = append(summary.Errors, parseErrors...)
+
+	start := time.Now()
+	if *baseDir != "" {
+		if err := api.Init(*baseDir, *maxSize, *cap); err != nil {
+			return err
+		}
+	}
+	defer api.Close()
+
+	// 読めない行があれば、途中まで実行してしまわないよう何も実行しない
+	if len(parseErrors) > 0 && !*continueOnError {
+		summary.Skipped = len(commands)
+		commands = nil
+	}
+	runScript(commands, *continueOnError, &summary)
+	summary.DurationMs = time.Since(start).Milliseconds()
+
+	encoder := json.NewEncoder(os.Stdout)
+	if err := encoder.Encode(summary); err != nil {
+		return err
+	}
+	if summary.Failed > 0 {
+		return fmt.Errorf("%d of %d commands failed", summary.Failed, summary.Commands)
+	}
+	return nil
+}
+
+// readScript reads the commands of the script, skipping empty lines and comments starting with '#'
+func readScript(r io.Reader) ([]execCommand, []execError, error) {
+	reader := bufio.NewReader(r)
+	var commands []execCommand
+	var parseErrors []execError
+	for lineNo := 1; ; lineNo++ {
+		line, err := readLine(reader)
+		if err == io.EOF {
+			return commands, parseErrors, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		parsed, err := splitCommands(line)
+		if err != nil {
+			parseErrors = append(parseErrors, execError{Line: lineNo, Error: err.Error()})
+			continue
+		}
+		for _, args := range parsed {
+			commands = append(commands, execCommand{line: lineNo, args: args})
+		}
+	}
+}
+
+// runScript runs the commands in order. Consecutive SETs to the same cache file are stored
+// together with MSet, so each run of them is one transaction that succeeds or fails as a whole.
+func runScript(commands []execCommand, continueOnError bool, summary *execSummary) {
+	useBase64 := false
+	for i := 0; i < len(commands); {
+		cmd := commands[i]
+		name := strings.ToUpper(cmd.args[0])
+
+		var failure *execError
+		n := 1
+		switch {
+		case isBatchableSet(cmd.args):
+			n = setBatchLen(commands[i:])
+			failure = runSetBatch(commands[i:i+n], useBase64)
+			summary.Transactions++
+		case name == "ENCODING":
+			if rep := switchEncoding(cmd.args, &useBase64); rep.status == "ERROR" {
+				failure = &execError{Line: cmd.line, Command: name, Error: rep.text}
+			}
+		case name == "PROTO" || name == "SHUTDOWN":
+			failure = &execError{Line: cmd.line, Command: name, Error: name + " is not supported in exec"}
+		default:
+			var rep reply
+			if useBase64 {
+				rep = executeBase64(cmd.args)
+			} else {
+				rep = execute(cmd.args)
+			}
+			// ミスは失敗として扱わない
+			if rep.status == "ERROR" && (rep.err == nil || !cache.IsNotFound(rep.err)) {
+				text := rep.text
+				if rep.err != nil && rep.err.Error() != text {
+					text += ": " + rep.err.Error()
+				}
+				failure = &execError{Line: cmd.line, Command: name, Error: text}
+			}
+		}
+
+		if failure != nil {
+			if n > 1 {
+				failure.Count = n
+			}
+			summary.Failed += n
+			summary.Errors = append(summary.Errors, *failure)
+			if !continueOnError {
+				summary.Skipped += len(commands) - i - n
+				return
+			}
+		} else {
+			summary.Succeeded += n
+		}
+		i += n
+	}
+}
+
+// isBatchableSet reports whether the command is a plain SET, which MSet can store
+func isBatchableSet(args []string) bool {
+	return strings.ToUpper(args[0]) == "SET" && len(args) == 6
+}
+
+// setBatchLen returns the number of leading SETs of commands to the same cache file, up to execBatchSize
+func setBatchLen(commands []execCommand) int {
+	args := make([][]string, min(len(commands), execBatchSize))
+	for i := range args {
+		args[i] = commands[i].args
+	}
+	return sameFileSets(args)
+}
+
+func runSetBatch(batch []execCommand, useBase64 bool) *execError {
+	first := batch[0].args
+	entries := make([]cache.CacheEntry, 0, len(batch))
+	for _, cmd := range batch {
+		content := []byte(cmd.args[5])
+		if useBase64 {
+			decoded, err := base64.StdEncoding.DecodeString(cmd.args[5])
+			if err != nil {
+				return &execError{Line: cmd.line, Command: "SET", Error: fmt.Sprintf("invalid base64 content: %v", err)}
+			}
+			content = decoded
+		}
+		entries = append(entries, cache.CacheEntry{Key: cmd.args[4], Content: content})
+	}
+	if err := api.MSet(first[1], first[2], first[3], entries); err != nil {
+		return &execError{Line: batch[0].line, Command: "SET", Error: err.Error()}
+	}
+	return nil
+}
@@ -3,14 +3,45 @@ package main
 /*
 #include <stdlib.h>
 #include <string.h>
+
+// 最後のエラーはスレッドごとに持つ (Goの関数は呼び出したCのスレッドの上で動く)
+static __thread char *sqcache_last_error = NULL;
+
+static void sqcache_set_last_error(char *msg) {
+	free(sqcache_last_error);
+	sqcache_last_error = msg;
+}
+
+static const char *sqcache_last_error_message(void) {
+	return sqcache_last_error;
+}
 */
 import "C"
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
 	"strings"
+	"sync"
+	"time"
 	"unsafe"
 )
 
+// copyBuffers pools the buffers GetToFile copies through
+var copyBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 256*1024)
+		return &buf
+	},
+}
+
+// apiVersion is returned by ApiVersion
+const apiVersion = 1
+
 // Error codes for Python ctypes integration
 const (
 	SUCCESS           = 1
@@ -19,18 +50,66 @@ const (
 	ERROR_INVALID_ARG = -2
 	ERROR_NOT_FOUND   = -3
 	ERROR_NOT_INIT    = -4
+	ERROR_TOO_LARGE   = -5 // MaxEntrySizeを超えている
+	ERROR_BUFFER_SIZE = -6 // GetIntoのバッファが足りない
+
+	// SetNXで既にエントリがあり、登録しなかった場合
+	NOT_STORED = 2
+	// GetIfChangedで呼び出し側のversionから変わっていない場合
+	NOT_MODIFIED = 3
 )
 
+var (
+	errInvalidArgument = errors.New("invalid argument: NULL pointer or negative length")
+	errInvalidHandle   = errors.New("invalid cache handle: not created by CreateCache or already closed")
+)
+
+// setLastError records err as the last error of the calling thread, returned by GetLastError
+func setLastError(err error) {
+	C.sqcache_set_last_error(C.CString(err.Error()))
+}
+
+// recoverPanic is deferred by every exported function so that a panic is returned as ERROR_GENERAL
+// (the zero value of the int results, and *resultLen if given) instead of terminating the host
+// process. The panic message is returned by GetLastError.
+func recoverPanic(resultLen *C.int) {
+	if r := recover(); r != nil {
+		setLastError(fmt.Errorf("panic in sqcache library: %v", r))
+		if resultLen != nil {
+			*resultLen = ERROR_GENERAL
+		}
+	}
+}
+
+// ApiVersionはC APIのバージョンを返す。関数のシグネチャやエラーコードの意味を変えたときに上げる
+// (関数の追加では上げないので、新しい関数はシンボルの有無で確かめる)
+//
+//export ApiVersion
+func ApiVersion() C.int {
+	return apiVersion
+}
+
+// GetLastErrorは、呼び出したスレッドで最後に失敗した呼び出しのエラーメッセージを返す。まだ失敗していなければNULL。
+// 成功した呼び出しでは変わらない。文字列はライブラリが持つので、FreeMemで解放せず、同じスレッドの次の失敗まで使える
+//
+//export GetLastError
+func GetLastError() *C.char {
+	return (*C.char)(unsafe.Pointer(C.sqcache_last_error_message()))
+}
+
 // Cライブラリインターフェース用のエクスポート関数
 
 //export Init
 func Init(baseDir *C.char, maxSize C.int, cap C.double) C.int {
+	defer recoverPanic(nil)
 	if baseDir == nil {
+		setLastError(errInvalidArgument)
 		return ERROR_INVALID_ARG
 	}
 
 	err := api.Init(C.GoString(baseDir), int(maxSize), float64(cap))
 	if err != nil {
+		setLastError(err)
 		if isDiskFullError(err) {
 			return ERROR_DISK_FULL
 		}
@@ -41,7 +120,9 @@ func Init(baseDir *C.char, maxSize C.int, cap C.double) C.int {
 
 //export Get
 func Get(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, resultLen *C.int) *C.char {
+	defer recoverPanic(resultLen)
 	if table == nil || tenantId == nil || freshness == nil || bind == nil || resultLen == nil {
+		setLastError(errInvalidArgument)
 		if resultLen != nil {
 			*resultLen = ERROR_INVALID_ARG
 		}
@@ -50,6 +131,7 @@ func Get(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, resul
 
 	result, err := api.Get(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind))
 	if err != nil {
+		setLastError(err)
 		if strings.Contains(strings.ToLower(err.Error()), "not found") {
 			*resultLen = ERROR_NOT_FOUND
 		} else if isDiskFullError(err) {
@@ -63,23 +145,367 @@ func Get(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, resul
 	}
 
 	if result == nil || len(result) == 0 {
+		setLastError(cache.ErrEntryNotFound)
 		*resultLen = ERROR_NOT_FOUND
 		return nil
 	}
 
 	*resultLen = C.int(len(result))
-	return (*C.char)(C.CBytes(result))
+	return cBuffers.copyToC(result)
+}
+
+// GetIntoはコンテンツを呼び出し側が用意したbufに書き込み、resultLenにバイト数を入れる。
+// Getと違ってCのメモリを確保しないので、FreeMemは不要。bufLenが足りなければ ERROR_BUFFER_SIZE を返し、
+// resultLenに必要なバイト数を入れる
+//
+//export GetInto
+func GetInto(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, buf *C.char, bufLen C.int, resultLen *C.int) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil || resultLen == nil || (buf == nil && bufLen > 0) || bufLen < 0 {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	result, err := api.Get(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind))
+	if err != nil {
+		setLastError(err)
+		if strings.Contains(strings.ToLower(err.Error()), "not found") {
+			return ERROR_NOT_FOUND
+		}
+		if isDiskFullError(err) {
+			return ERROR_DISK_FULL
+		}
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+
+	*resultLen = C.int(len(result))
+	if len(result) > int(bufLen) {
+		setLastError(fmt.Errorf("buffer too small: %d bytes needed, %d given", len(result), int(bufLen)))
+		return ERROR_BUFFER_SIZE
+	}
+	if len(result) > 0 {
+		copy(unsafe.Slice((*byte)(unsafe.Pointer(buf)), len(result)), result)
+	}
+	return SUCCESS
+}
+
+// GetIfChangedは、エントリのversionがknownVersionと同じなら内容を返さずに NOT_MODIFIED を返す。
+// 変わっていれば SUCCESS を返し、contentに内容 (FreeMemで解放する)、contentLenにバイト数、newVersionに
+// 新しいversionを入れる。knownVersionが0なら常に内容を返すので、最初の呼び出しでversionを得られる
+//
+//export GetIfChanged
+func GetIfChanged(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, knownVersion C.longlong, newVersion *C.longlong, content **C.char, contentLen *C.int) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil || newVersion == nil || content == nil || contentLen == nil {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	*content = nil
+	*contentLen = 0
+
+	entry, err := api.GetIfChanged(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind), int64(knownVersion))
+	if err != nil {
+		setLastError(err)
+		errStr := strings.ToLower(err.Error())
+		if strings.Contains(errStr, "not modified") {
+			*newVersion = knownVersion
+			return NOT_MODIFIED
+		}
+		if strings.Contains(errStr, "not found") {
+			return ERROR_NOT_FOUND
+		}
+		if isDiskFullError(err) {
+			return ERROR_DISK_FULL
+		}
+		if strings.Contains(errStr, "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+
+	*newVersion = C.longlong(entry.Version)
+	*contentLen = C.int(len(entry.Content))
+	if len(entry.Content) > 0 {
+		*content = (*C.char)(C.CBytes(entry.Content))
+	}
+	return SUCCESS
 }
 
 //export Set
 func Set(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, content *C.char, contentLen C.int) C.int {
-	if table == nil || tenantId == nil || freshness == nil || bind == nil || content == nil {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil || content == nil || contentLen < 0 {
+		setLastError(errInvalidArgument)
 		return ERROR_INVALID_ARG
 	}
 
 	contentBytes := C.GoBytes(unsafe.Pointer(content), contentLen)
 	err := api.Set(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind), contentBytes)
 	if err != nil {
+		setLastError(err)
+		if isTooLargeError(err) {
+			return ERROR_TOO_LARGE
+		}
+		if isDiskFullError(err) {
+			return ERROR_DISK_FULL
+		}
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+	return SUCCESS
+}
+
+// SetWithTTLはttlSeconds秒後に期限切れになるエントリを登録する。0以下なら期限なし
+//
+//export SetWithTTL
+func SetWithTTL(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, content *C.char, contentLen C.int, ttlSeconds C.longlong) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil || content == nil || contentLen < 0 {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	contentBytes := C.GoBytes(unsafe.Pointer(content), contentLen)
+	ttl := time.Duration(ttlSeconds) * time.Second
+	err := api.SetWithTTL(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind), contentBytes, ttl)
+	if err != nil {
+		setLastError(err)
+		if isTooLargeError(err) {
+			return ERROR_TOO_LARGE
+		}
+		if isDiskFullError(err) {
+			return ERROR_DISK_FULL
+		}
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+	return SUCCESS
+}
+
+// SetNXは登録できれば SUCCESS、既にエントリがあれば NOT_STORED を返す
+//
+//export SetNX
+func SetNX(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, content *C.char, contentLen C.int) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil || content == nil || contentLen < 0 {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	contentBytes := C.GoBytes(unsafe.Pointer(content), contentLen)
+	stored, err := api.SetNX(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind), contentBytes, 0)
+	if err != nil {
+		setLastError(err)
+		if isTooLargeError(err) {
+			return ERROR_TOO_LARGE
+		}
+		if isDiskFullError(err) {
+			return ERROR_DISK_FULL
+		}
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+	if !stored {
+		return NOT_STORED
+	}
+	return SUCCESS
+}
+
+// cStringsはCの文字列の配列をGoの文字列にする。NULLの要素があればfalseを返す
+func cStrings(arr **C.char, count C.int) ([]string, bool) {
+	if count == 0 {
+		return nil, true
+	}
+	strs := make([]string, count)
+	for i, s := range unsafe.Slice(arr, int(count)) {
+		if s == nil {
+			return nil, false
+		}
+		strs[i] = C.GoString(s)
+	}
+	return strs, true
+}
+
+// MGetはcount個のbindを1回の呼び出しで読む。i番目のコンテンツはblobのoffsets[i]からoffsets[i+1]までで、
+// 同じなら (空の範囲なら) キャッシュミス。offsetsには呼び出し側がcount+1個の領域を用意する。
+// blobはFreeMemで解放する (全てミスならNULL)
+//
+//export MGet
+func MGet(table *C.char, tenantId *C.char, freshness *C.char, binds **C.char, count C.int, offsets *C.longlong, blob **C.char) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || offsets == nil || blob == nil || count < 0 || (binds == nil && count > 0) {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	bindList, ok := cStrings(binds, count)
+	if !ok {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	*blob = nil
+
+	result, err := api.MGet(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), bindList)
+	if err != nil {
+		setLastError(err)
+		if isDiskFullError(err) {
+			return ERROR_DISK_FULL
+		}
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+
+	// ヒットしたコンテンツを要求の順に詰める
+	offs := unsafe.Slice(offsets, int(count)+1)
+	total := 0
+	for i, bind := range bindList {
+		offs[i] = C.longlong(total)
+		total += len(result[bind])
+	}
+	offs[count] = C.longlong(total)
+	if total == 0 {
+		return SUCCESS
+	}
+	packed := make([]byte, 0, total)
+	for _, bind := range bindList {
+		packed = append(packed, result[bind]...)
+	}
+	*blob = (*C.char)(C.CBytes(packed))
+	return SUCCESS
+}
+
+// MSetはcount個のエントリを1つのトランザクションで登録する。i番目のbindのコンテンツはblobの
+// offsets[i]からoffsets[i+1]まで (offsetsはcount+1個) で、MGetが返すものと同じ形
+//
+//export MSet
+func MSet(table *C.char, tenantId *C.char, freshness *C.char, binds **C.char, count C.int, offsets *C.longlong, blob *C.char) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || offsets == nil || count < 0 || (binds == nil && count > 0) {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	bindList, ok := cStrings(binds, count)
+	if !ok {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	offs := unsafe.Slice(offsets, int(count)+1)
+	if offs[0] != 0 || (blob == nil && offs[count] > 0) {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	for i := range bindList {
+		if offs[i+1] < offs[i] {
+			setLastError(fmt.Errorf("invalid argument: offsets[%d] is smaller than offsets[%d]", i+1, i))
+			return ERROR_INVALID_ARG
+		}
+	}
+	// HotCacheSizeのメモリに残ることがあるので、Cのメモリは参照せずにまとめてコピーする
+	var data []byte
+	if offs[count] > 0 {
+		data = C.GoBytes(unsafe.Pointer(blob), C.int(offs[count]))
+	}
+	entries := make([]cache.CacheEntry, len(bindList))
+	for i, bind := range bindList {
+		entries[i] = cache.CacheEntry{Key: bind, Content: data[offs[i]:offs[i+1]:offs[i+1]]}
+	}
+
+	err := api.MSet(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), entries)
+	if err != nil {
+		setLastError(err)
+		if isTooLargeError(err) {
+			return ERROR_TOO_LARGE
+		}
+		if isDiskFullError(err) {
+			return ERROR_DISK_FULL
+		}
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+	return SUCCESS
+}
+
+// GetToFileはコンテンツをpathのファイルに書き出す。大きな値をCのバッファに載せずに受け取れる
+//
+//export GetToFile
+func GetToFile(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, path *C.char) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil || path == nil {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	r, err := api.GetReader(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind))
+	if err != nil {
+		setLastError(err)
+		if strings.Contains(strings.ToLower(err.Error()), "not found") {
+			return ERROR_NOT_FOUND
+		}
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+	defer r.Close()
+
+	f, err := os.Create(C.GoString(path))
+	if err != nil {
+		setLastError(err)
+		return ERROR_INVALID_ARG
+	}
+	pooled := copyBuffers.Get().(*[]byte)
+	_, err = io.CopyBuffer(f, r, *pooled)
+	copyBuffers.Put(pooled)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		setLastError(err)
+		os.Remove(C.GoString(path))
+		if isDiskFullError(err) {
+			return ERROR_DISK_FULL
+		}
+		return ERROR_GENERAL
+	}
+	return SUCCESS
+}
+
+// SetFromFileはpathのファイルの内容を登録する
+//
+//export SetFromFile
+func SetFromFile(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, path *C.char) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil || path == nil {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	f, err := os.Open(C.GoString(path))
+	if err != nil {
+		setLastError(err)
+		return ERROR_INVALID_ARG
+	}
+	defer f.Close()
+
+	_, err = api.SetFromReader(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind), f, 0)
+	if err != nil {
+		setLastError(err)
+		if isTooLargeError(err) {
+			return ERROR_TOO_LARGE
+		}
 		if isDiskFullError(err) {
 			return ERROR_DISK_FULL
 		}
@@ -93,12 +519,80 @@ func Set(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, conte
 
 //export Delete
 func Delete(table *C.char) C.int {
+	defer recoverPanic(nil)
 	if table == nil {
+		setLastError(errInvalidArgument)
 		return ERROR_INVALID_ARG
 	}
 
 	err := api.Delete(C.GoString(table))
 	if err != nil {
+		setLastError(err)
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+	return SUCCESS
+}
+
+// Existsはエントリがあれば SUCCESS、なければ ERROR_NOT_FOUND を返す
+//
+//export Exists
+func Exists(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	exists, err := api.Exists(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind))
+	if err != nil {
+		setLastError(err)
+		if isDiskFullError(err) {
+			return ERROR_DISK_FULL
+		}
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+	if !exists {
+		return ERROR_NOT_FOUND
+	}
+	return SUCCESS
+}
+
+//export DeleteEntry
+func DeleteEntry(table *C.char, tenantId *C.char, freshness *C.char, bind *C.char) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	err := api.DeleteEntry(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind))
+	if err != nil {
+		setLastError(err)
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			return ERROR_NOT_INIT
+		}
+		return ERROR_GENERAL
+	}
+	return SUCCESS
+}
+
+//export DeleteTenant
+func DeleteTenant(table *C.char, tenantId *C.char) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	err := api.DeleteTenant(C.GoString(table), C.GoString(tenantId))
+	if err != nil {
+		setLastError(err)
 		if strings.Contains(strings.ToLower(err.Error()), "not init") {
 			return ERROR_NOT_INIT
 		}
@@ -107,10 +601,364 @@ func Delete(table *C.char) C.int {
 	return SUCCESS
 }
 
+// Statsは各キャッシュファイルの統計をJSON配列で返す。resultLenにはバイト数かエラーコードを入れる
+//
+//export Stats
+func Stats(resultLen *C.int) *C.char {
+	defer recoverPanic(resultLen)
+	if resultLen == nil {
+		setLastError(errInvalidArgument)
+		return nil
+	}
+
+	stats, err := api.Stats()
+	if err != nil {
+		setLastError(err)
+		if strings.Contains(strings.ToLower(err.Error()), "not init") {
+			*resultLen = ERROR_NOT_INIT
+		} else {
+			*resultLen = ERROR_GENERAL
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		setLastError(err)
+		*resultLen = ERROR_GENERAL
+		return nil
+	}
+
+	*resultLen = C.int(len(data))
+	return (*C.char)(C.CBytes(data))
+}
+
 //export Close
 func Close() C.int {
+	defer recoverPanic(nil)
 	err := api.Close()
 	if err != nil {
+		setLastError(err)
+		return ERROR_GENERAL
+	}
+	return SUCCESS
+}
+
+// ハンドルを使う関数は、CreateCacheで作ったキャッシュごとに独立して動く。Initなどのグローバルな
+// キャッシュとも別なので、1つのプロセスで複数のbase_dirのキャッシュを扱える。同じbase_dirを
+// 複数のハンドルで開かないこと。
+
+// cacheHandles holds the caches created by CreateCache
+var cacheHandles = struct {
+	sync.RWMutex
+	next     int64
+	managers map[int64]*cache.CacheManager
+}{managers: make(map[int64]*cache.CacheManager)}
+
+// handleConfig is the JSON configuration given to CreateCache
+type handleConfig struct {
+	BaseDir         string   `json:"base_dir"`
+	MaxSize         int      `json:"max_size"` // MB単位 (0なら100)
+	Cap             *float64 `json:"cap"`      // 省略時は0.8
+	MaxEntrySize    int64    `json:"max_entry_size"`
+	HotCacheSize    int64    `json:"hot_cache_size"`
+	Compression     string   `json:"compression"`
+	JournalMode     string   `json:"journal_mode"`
+	EvictionPolicy  string   `json:"eviction_policy"`
+	MemoryTables    []string `json:"memory_tables"`
+	HashBindsOver   int      `json:"hash_binds_over"`
+	HashUnsafeNames bool     `json:"hash_unsafe_names"`
+}
+
+// cacheConfig converts the JSON configuration to the cache configuration
+func (hc handleConfig) cacheConfig() (cache.CacheConfig, error) {
+	config := cache.CacheConfig{
+		BaseDir:         hc.BaseDir,
+		MaxSize:         hc.MaxSize,
+		Cap:             0.8,
+		MaxEntrySize:    hc.MaxEntrySize,
+		HotCacheSize:    hc.HotCacheSize,
+		Compression:     hc.Compression,
+		JournalMode:     hc.JournalMode,
+		MemoryTables:    hc.MemoryTables,
+		HashBindsOver:   hc.HashBindsOver,
+		HashUnsafeNames: hc.HashUnsafeNames,
+	}
+	if config.BaseDir == "" {
+		return config, errors.New("base_dir is required")
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = 100
+	}
+	if hc.Cap != nil {
+		config.Cap = *hc.Cap
+	}
+	if hc.EvictionPolicy != "" {
+		policy, err := cache.EvictionPolicyByName(hc.EvictionPolicy)
+		if err != nil {
+			return config, err
+		}
+		config.EvictionPolicy = policy
+	}
+	return config, nil
+}
+
+// CreateCacheはconfigJSONの設定でキャッシュを作り、正のハンドルを返す。失敗したらエラーコード (0以下) を返す。
+// configJSONの例: {"base_dir": "./cache", "max_size": 100, "cap": 0.8}
+//
+//export CreateCache
+func CreateCache(configJSON *C.char) C.longlong {
+	defer recoverPanic(nil)
+	if configJSON == nil {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	var hc handleConfig
+	if err := json.Unmarshal([]byte(C.GoString(configJSON)), &hc); err != nil {
+		setLastError(err)
+		return ERROR_INVALID_ARG
+	}
+	config, err := hc.cacheConfig()
+	if err != nil {
+		setLastError(err)
+		return ERROR_INVALID_ARG
+	}
+
+	cm := cache.NewCacheManager(config)
+	if err := cm.Init(config.BaseDir, config.MaxSize, config.Cap); err != nil {
+		setLastError(err)
+		if isDiskFullError(err) {
+			return ERROR_DISK_FULL
+		}
+		return ERROR_GENERAL
+	}
+
+	cacheHandles.Lock()
+	defer cacheHandles.Unlock()
+	cacheHandles.next++
+	cacheHandles.managers[cacheHandles.next] = cm
+	return C.longlong(cacheHandles.next)
+}
+
+// lookupHandle returns the cache of the handle, or nil if it was not created or is closed
+func lookupHandle(handle C.longlong) *cache.CacheManager {
+	cacheHandles.RLock()
+	defer cacheHandles.RUnlock()
+	return cacheHandles.managers[int64(handle)]
+}
+
+// handleErrorCode maps errors of a handle's cache to the error codes
+func handleErrorCode(err error) C.int {
+	switch {
+	case cache.IsNotFound(err):
+		return ERROR_NOT_FOUND
+	case isTooLargeError(err):
+		return ERROR_TOO_LARGE
+	case isDiskFullError(err):
+		return ERROR_DISK_FULL
+	case errors.Is(err, cache.ErrInvalidName):
+		return ERROR_INVALID_ARG
+	default:
+		return ERROR_GENERAL
+	}
+}
+
+// CacheGetはハンドルのキャッシュから読む。戻り値とresultLenはGetと同じ
+//
+//export CacheGet
+func CacheGet(handle C.longlong, table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, resultLen *C.int) *C.char {
+	defer recoverPanic(resultLen)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil || resultLen == nil {
+		setLastError(errInvalidArgument)
+		if resultLen != nil {
+			*resultLen = ERROR_INVALID_ARG
+		}
+		return nil
+	}
+	cm := lookupHandle(handle)
+	if cm == nil {
+		setLastError(errInvalidHandle)
+		*resultLen = ERROR_NOT_INIT
+		return nil
+	}
+
+	result, err := cm.Get(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind))
+	if err != nil {
+		setLastError(err)
+		*resultLen = handleErrorCode(err)
+		return nil
+	}
+	if len(result) == 0 {
+		setLastError(cache.ErrEntryNotFound)
+		*resultLen = ERROR_NOT_FOUND
+		return nil
+	}
+
+	*resultLen = C.int(len(result))
+	return (*C.char)(C.CBytes(result))
+}
+
+//export CacheSet
+func CacheSet(handle C.longlong, table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, content *C.char, contentLen C.int) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil || content == nil || contentLen < 0 {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	cm := lookupHandle(handle)
+	if cm == nil {
+		setLastError(errInvalidHandle)
+		return ERROR_NOT_INIT
+	}
+
+	contentBytes := C.GoBytes(unsafe.Pointer(content), contentLen)
+	if err := cm.Set(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind), contentBytes); err != nil {
+		setLastError(err)
+		return handleErrorCode(err)
+	}
+	return SUCCESS
+}
+
+//export CacheSetWithTTL
+func CacheSetWithTTL(handle C.longlong, table *C.char, tenantId *C.char, freshness *C.char, bind *C.char, content *C.char, contentLen C.int, ttlSeconds C.longlong) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil || content == nil || contentLen < 0 {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	cm := lookupHandle(handle)
+	if cm == nil {
+		setLastError(errInvalidHandle)
+		return ERROR_NOT_INIT
+	}
+
+	contentBytes := C.GoBytes(unsafe.Pointer(content), contentLen)
+	ttl := time.Duration(ttlSeconds) * time.Second
+	if err := cm.SetWithTTL(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind), contentBytes, ttl); err != nil {
+		setLastError(err)
+		return handleErrorCode(err)
+	}
+	return SUCCESS
+}
+
+// CacheExistsはハンドルのキャッシュにエントリがあれば SUCCESS、なければ ERROR_NOT_FOUND を返す
+//
+//export CacheExists
+func CacheExists(handle C.longlong, table *C.char, tenantId *C.char, freshness *C.char, bind *C.char) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	cm := lookupHandle(handle)
+	if cm == nil {
+		setLastError(errInvalidHandle)
+		return ERROR_NOT_INIT
+	}
+
+	exists, err := cm.Exists(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind))
+	if err != nil {
+		setLastError(err)
+		return handleErrorCode(err)
+	}
+	if !exists {
+		return ERROR_NOT_FOUND
+	}
+	return SUCCESS
+}
+
+// CacheDeleteはハンドルのキャッシュのテーブルを削除する
+//
+//export CacheDelete
+func CacheDelete(handle C.longlong, table *C.char) C.int {
+	defer recoverPanic(nil)
+	if table == nil {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	cm := lookupHandle(handle)
+	if cm == nil {
+		setLastError(errInvalidHandle)
+		return ERROR_NOT_INIT
+	}
+
+	if err := cm.Delete(C.GoString(table)); err != nil {
+		setLastError(err)
+		return handleErrorCode(err)
+	}
+	return SUCCESS
+}
+
+//export CacheDeleteEntry
+func CacheDeleteEntry(handle C.longlong, table *C.char, tenantId *C.char, freshness *C.char, bind *C.char) C.int {
+	defer recoverPanic(nil)
+	if table == nil || tenantId == nil || freshness == nil || bind == nil {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	cm := lookupHandle(handle)
+	if cm == nil {
+		setLastError(errInvalidHandle)
+		return ERROR_NOT_INIT
+	}
+
+	if err := cm.DeleteEntry(C.GoString(table), C.GoString(tenantId), C.GoString(freshness), C.GoString(bind)); err != nil {
+		setLastError(err)
+		return handleErrorCode(err)
+	}
+	return SUCCESS
+}
+
+// CacheStatsはハンドルのキャッシュの統計をStatsと同じJSON配列で返す
+//
+//export CacheStats
+func CacheStats(handle C.longlong, resultLen *C.int) *C.char {
+	defer recoverPanic(resultLen)
+	if resultLen == nil {
+		setLastError(errInvalidArgument)
+		return nil
+	}
+	cm := lookupHandle(handle)
+	if cm == nil {
+		setLastError(errInvalidHandle)
+		*resultLen = ERROR_NOT_INIT
+		return nil
+	}
+
+	stats, err := cm.Stats()
+	if err != nil {
+		setLastError(err)
+		*resultLen = handleErrorCode(err)
+		return nil
+	}
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		setLastError(err)
+		*resultLen = ERROR_GENERAL
+		return nil
+	}
+
+	*resultLen = C.int(len(data))
+	return (*C.char)(C.CBytes(data))
+}
+
+// CacheCloseはハンドルのキャッシュを閉じる。閉じたハンドルは使えなくなる
+//
+//export CacheClose
+func CacheClose(handle C.longlong) C.int {
+	defer recoverPanic(nil)
+	cacheHandles.Lock()
+	cm := cacheHandles.managers[int64(handle)]
+	delete(cacheHandles.managers, int64(handle))
+	cacheHandles.Unlock()
+	if cm == nil {
+		setLastError(errInvalidHandle)
+		return ERROR_NOT_INIT
+	}
+
+	if err := cm.Close(); err != nil {
+		setLastError(err)
 		return ERROR_GENERAL
 	}
 	return SUCCESS
@@ -118,11 +966,17 @@ func Close() C.int {
 
 //export FreeMem
 func FreeMem(ptr *C.char) {
-	if ptr != nil {
+	defer recoverPanic(nil)
+	if ptr != nil && !cBuffers.release(unsafe.Pointer(ptr)) {
 		C.free(unsafe.Pointer(ptr))
 	}
 }
 
+// isTooLargeError checks if the entry was rejected by MaxEntrySize
+func isTooLargeError(err error) bool {
+	return err != nil && strings.Contains(strings.ToLower(err.Error()), "too large")
+}
+
 // isDiskFullError checks if error is related to disk space issues
 func isDiskFullError(err error) bool {
 	if err == nil {
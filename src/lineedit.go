@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	replPrompt        = "sqcache> "
+	historyFileName   = ".sqcache_history"
+	maxHistoryEntries = 1000
+)
+
+// lineEditor reads lines from a terminal with cursor movement and history (Emacs-style keys and
+// the arrow keys). Only one line is read in raw mode at a time, and commands run in the normal mode.
+type lineEditor struct {
+	reader      *bufio.Reader
+	out         *os.File
+	fd          int
+	history     []string
+	historyPath string // 空なら履歴をファイルに残さない
+
+	mu  sync.Mutex
+	raw *terminalState // 行を読んでいる間だけnilでない
+
+	// 前回の表示。折り返した行を消して書き直すのに使う
+	rows      int
+	cursorRow int
+}
+
+// terminalEditor is the line editor of the interactive mode, restored by handleSignals
+var terminalEditor *lineEditor
+
+// newLineEditor returns an editor reading from reader if stdin and stdout are terminals, and nil otherwise
+func newLineEditor(reader *bufio.Reader) *lineEditor {
+	fd := int(os.Stdin.Fd())
+	if !isTerminal(fd) || !isTerminal(int(os.Stdout.Fd())) {
+		return nil
+	}
+	e := &lineEditor{reader: reader, out: os.Stdout, fd: fd}
+	if home, err := os.UserHomeDir(); err == nil {
+		e.historyPath = filepath.Join(home, historyFileName)
+		e.loadHistory()
+	}
+	return e
+}
+
+func (e *lineEditor) loadHistory() {
+	data, err := os.ReadFile(e.historyPath)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+	if len(e.history) > maxHistoryEntries {
+		e.history = e.history[len(e.history)-maxHistoryEntries:]
+	}
+}
+
+// addHistory remembers the line unless it repeats the previous one
+func (e *lineEditor) addHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if len(e.history) > maxHistoryEntries {
+		e.history = e.history[1:]
+	}
+	if e.historyPath == "" {
+		return
+	}
+	if f, err := os.OpenFile(e.historyPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600); err == nil {
+		fmt.Fprintln(f, line)
+		f.Close()
+	}
+}
+
+// restore puts the terminal back into the normal mode if a line is being read
+func (e *lineEditor) restore() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.raw != nil {
+		restoreTerminal(e.fd, e.raw)
+		e.raw = nil
+	}
+}
+
+// readLine shows the prompt and reads one line. Ctrl-C discards the line and Ctrl-D on an empty line returns io.EOF.
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	state, err := makeRaw(e.fd)
+	if err != nil {
+		// 端末を設定できなければ、そのまま1行読む
+		fmt.Fprint(e.out, prompt)
+		line, err := e.reader.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	e.mu.Lock()
+	e.raw = state
+	e.mu.Unlock()
+	defer e.restore()
+
+	var buf []rune
+	pos := 0
+	historyIndex := len(e.history)
+	var editing []rune // 履歴をたどる前に入力していた行
+	e.rows, e.cursorRow = 1, 1
+	e.refresh(prompt, buf, pos)
+
+	recall := func(index int) {
+		if index < 0 || index > len(e.history) || index == historyIndex {
+			return
+		}
+		if historyIndex == len(e.history) {
+			editing = buf
+		}
+		historyIndex = index
+		if index == len(e.history) {
+			buf = editing
+		} else {
+			buf = []rune(e.history[index])
+		}
+		pos = len(buf)
+	}
+
+	for {
+		r, _, err := e.reader.ReadRune()
+		if err != nil {
+			fmt.Fprint(e.out, "\r\n")
+			return "", err
+		}
+
+		switch r {
+		case '\r', '\n':
+			pos = len(buf)
+			e.refresh(prompt, buf, pos)
+			fmt.Fprint(e.out, "\r\n")
+			line := string(buf)
+			e.addHistory(line)
+			return line, nil
+		case 3: // Ctrl-C
+			pos = len(buf)
+			e.refresh(prompt, buf, pos)
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", nil
+		case 4: // Ctrl-D
+			if len(buf) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			if pos < len(buf) {
+				buf = append(buf[:pos], buf[pos+1:]...)
+			}
+		case 127, 8: // Backspace
+			if pos > 0 {
+				buf = append(buf[:pos-1], buf[pos:]...)
+				pos--
+			}
+		case 1: // Ctrl-A
+			pos = 0
+		case 5: // Ctrl-E
+			pos = len(buf)
+		case 2: // Ctrl-B
+			pos = max(pos-1, 0)
+		case 6: // Ctrl-F
+			pos = min(pos+1, len(buf))
+		case 11: // Ctrl-K
+			buf = buf[:pos]
+		case 21: // Ctrl-U
+			buf = append([]rune(nil), buf[pos:]...)
+			pos = 0
+		case 23: // Ctrl-W
+			start := pos
+			for start > 0 && buf[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && buf[start-1] != ' ' {
+				start--
+			}
+			buf = append(buf[:start], buf[pos:]...)
+			pos = start
+		case 12: // Ctrl-L
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+			e.rows, e.cursorRow = 1, 1
+		case 16: // Ctrl-P
+			recall(historyIndex - 1)
+		case 14: // Ctrl-N
+			recall(historyIndex + 1)
+		case 27: // ESC: 矢印キーなどのエスケープシーケンス
+			switch e.readEscape() {
+			case "A":
+				recall(historyIndex - 1)
+			case "B":
+				recall(historyIndex + 1)
+			case "C":
+				pos = min(pos+1, len(buf))
+			case "D":
+				pos = max(pos-1, 0)
+			case "H", "1~", "7~":
+				pos = 0
+			case "F", "4~", "8~":
+				pos = len(buf)
+			case "3~":
+				if pos < len(buf) {
+					buf = append(buf[:pos], buf[pos+1:]...)
+				}
+			}
+		default:
+			if r < ' ' {
+				continue
+			}
+			buf = append(buf[:pos], append([]rune{r}, buf[pos:]...)...)
+			pos++
+		}
+		e.refresh(prompt, buf, pos)
+	}
+}
+
+// readEscape reads the rest of an escape sequence such as "\x1b[A" and returns its tail, e.g. "A" or "3~"
+func (e *lineEditor) readEscape() string {
+	b, err := e.reader.ReadByte()
+	if err != nil || (b != '[' && b != 'O') {
+		return ""
+	}
+	var seq []byte
+	for {
+		c, err := e.reader.ReadByte()
+		if err != nil {
+			return ""
+		}
+		seq = append(seq, c)
+		if c < '0' || c > '9' {
+			return string(seq)
+		}
+	}
+}
+
+// refresh redraws the prompt and the line, which may wrap over several rows, and places the cursor at pos
+func (e *lineEditor) refresh(prompt string, buf []rune, pos int) {
+	cols := terminalWidth(e.fd)
+	promptWidth := runesWidth([]rune(prompt))
+	total := promptWidth + runesWidth(buf)
+	cursor := promptWidth + runesWidth(buf[:pos])
+
+	var out strings.Builder
+	// 前回の最後の行から上に向かって消す
+	if e.rows > e.cursorRow {
+		fmt.Fprintf(&out, "\x1b[%dB", e.rows-e.cursorRow)
+	}
+	for i := 1; i < e.rows; i++ {
+		out.WriteString("\r\x1b[K\x1b[1A")
+	}
+	out.WriteString("\r\x1b[K")
+	out.WriteString(prompt)
+	out.WriteString(string(buf))
+
+	rows := max((total+cols-1)/cols, 1)
+	// 行末がちょうど端末の幅で終わると、カーソルは次の行に移らないので移しておく
+	if pos == len(buf) && total > 0 && total%cols == 0 {
+		out.WriteString("\r\n")
+		rows++
+	}
+	cursorRow := cursor/cols + 1
+	if rows > cursorRow {
+		fmt.Fprintf(&out, "\x1b[%dA", rows-cursorRow)
+	}
+	out.WriteString("\r")
+	if col := cursor % cols; col > 0 {
+		fmt.Fprintf(&out, "\x1b[%dC", col)
+	}
+	e.out.WriteString(out.String())
+	e.rows, e.cursorRow = rows, cursorRow
+}
+
+// runesWidth returns the columns taken by runes, counting East Asian wide characters as two
+func runesWidth(runes []rune) int {
+	width := 0
+	for _, r := range runes {
+		switch {
+		case r >= 0x1100 && r <= 0x115F, r >= 0x2E80 && r <= 0xA4CF, r >= 0xAC00 && r <= 0xD7A3,
+			r >= 0xF900 && r <= 0xFAFF, r >= 0xFE30 && r <= 0xFE4F, r >= 0xFF00 && r <= 0xFF60,
+			r >= 0xFFE0 && r <= 0xFFE6, r >= 0x1F300 && r <= 0x1F64F, r >= 0x20000:
+			width += 2
+		default:
+			width++
+		}
+	}
+	return width
+}
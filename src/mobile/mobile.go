@@ -0,0 +1,86 @@
+// Package mobile exposes the cache to Android and iOS apps through gomobile bind.
+// The functions only use types gomobile can translate (string, []byte, bool, int64, float64, error),
+// and wrap the api package, so an app uses a single cache per process.
+//
+//	gomobile bind -target=android -o sqcache.aar ./src/mobile
+//	gomobile bind -target=ios -o Sqcache.xcframework ./src/mobile
+package mobile
+
+import (
+	"encoding/json"
+	"fmt"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"time"
+)
+
+// キャッシュミスはエラーにせずnilを返す。JavaやSwiftではエラーが例外になるので、
+// ミスのたびに例外を受け止めなくて済むようにする。
+
+// Init opens the cache under baseDir, the app's cache or files directory. maxSizeMB and capRatio
+// are the per file size limit and the fill ratio that triggers eviction, as in the shared library.
+func Init(baseDir string, maxSizeMB int64, capRatio float64) error {
+	return api.Init(baseDir, int(maxSizeMB), capRatio)
+}
+
+// Get returns the cached content, or nil when the entry is missing or expired
+func Get(table, tenantId string, freshness string, bind string) ([]byte, error) {
+	content, err := api.Get(table, tenantId, freshness, bind)
+	if cache.IsNotFound(err) {
+		return nil, nil
+	}
+	return content, err
+}
+
+// Set stores content without an expiry
+func Set(table, tenantId string, freshness string, bind string, content []byte) error {
+	return api.Set(table, tenantId, freshness, bind, content)
+}
+
+// SetWithTTL stores content that expires after ttlSeconds. Zero or less means no expiry.
+func SetWithTTL(table, tenantId string, freshness string, bind string, content []byte, ttlSeconds int64) error {
+	return api.SetWithTTL(table, tenantId, freshness, bind, content, time.Duration(ttlSeconds)*time.Second)
+}
+
+// Exists reports whether the entry is cached without reading it
+func Exists(table, tenantId string, freshness string, bind string) (bool, error) {
+	exists, err := api.Exists(table, tenantId, freshness, bind)
+	if cache.IsNotFound(err) {
+		return false, nil
+	}
+	return exists, err
+}
+
+// DeleteEntry removes a single entry
+func DeleteEntry(table, tenantId string, freshness string, bind string) error {
+	return api.DeleteEntry(table, tenantId, freshness, bind)
+}
+
+// DeleteTenant removes every cache file of the tenant
+func DeleteTenant(table, tenantId string) error {
+	return api.DeleteTenant(table, tenantId)
+}
+
+// Delete removes every cache file of the table
+func Delete(table string) error {
+	return api.Delete(table)
+}
+
+// Stats returns the statistics of every cache file as a JSON array, like the shared library's Stats
+func Stats() (string, error) {
+	stats, err := api.Stats()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode stats: %w", err)
+	}
+	return string(data), nil
+}
+
+// Close closes the cache. It succeeds when the cache was never opened, so apps can call it from
+// their shutdown path unconditionally.
+func Close() error {
+	return api.Shutdown()
+}
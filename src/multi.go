@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"strconv"
+	"strings"
+)
+
+// MULTIからEXECまでのSETとDELETE_ENTRYはすぐには実行せずに貯め、EXECで1つのトランザクションとして適用する。
+// 1つのキャッシュファイルの中でしか原子的にできないので、MULTIで指定したテーブル・テナント・フレッシュネスだけを
+// 受け付ける。貯められなかったコマンドがあれば、一部だけ適用されないようにEXECでは何も適用しない。
+
+// multiTx is the open MULTI block of a session
+type multiTx struct {
+	table     string
+	tenantId  string
+	freshness string
+	ops       []cache.BatchOp
+	failed    bool
+}
+
+// multiCommand handles MULTI, EXEC and ROLLBACK, and queues the commands sent between MULTI and
+// EXEC. It returns false for the other commands outside a MULTI block, which run as usual.
+func multiCommand(parts []string, tx **multiTx, useBase64 bool) (reply, bool) {
+	command := strings.ToUpper(parts[0])
+	switch command {
+	case "MULTI":
+		if *tx != nil {
+			return errorReply("MULTI calls can not be nested"), true
+		}
+		if len(parts) != 4 {
+			return errorReply("MULTI requires 3 arguments: table tenant_id freshness"), true
+		}
+		*tx = &multiTx{table: parts[1], tenantId: parts[2], freshness: parts[3]}
+		return okReply("multi"), true
+
+	case "EXEC":
+		if *tx == nil {
+			return errorReply("EXEC without MULTI"), true
+		}
+		t := *tx
+		*tx = nil
+		if t.failed {
+			return errorReply("transaction discarded because of previous errors"), true
+		}
+		if err := api.ApplyBatch(t.table, t.tenantId, t.freshness, t.ops); err != nil {
+			return reply{status: "ERROR", text: err.Error(), err: err}, true
+		}
+		return okReply(strconv.Itoa(len(t.ops))), true
+
+	case "ROLLBACK":
+		if *tx == nil {
+			return errorReply("ROLLBACK without MULTI"), true
+		}
+		*tx = nil
+		return okReply("rolled back"), true
+	}
+	if *tx == nil {
+		return reply{}, false
+	}
+
+	rep := (*tx).queue(command, parts, useBase64)
+	if rep.status == "ERROR" {
+		(*tx).failed = true
+	}
+	return rep, true
+}
+
+// queue adds a SET or DELETE_ENTRY to the block
+func (t *multiTx) queue(command string, parts []string, useBase64 bool) reply {
+	switch {
+	case command == "SET" && len(parts) == 6:
+	case command == "DELETE_ENTRY" && len(parts) == 5:
+	default:
+		return errorReply(fmt.Sprintf("%s can not be used in MULTI: only SET and DELETE_ENTRY with all arguments are queued", command))
+	}
+	if parts[1] != t.table || parts[2] != t.tenantId || parts[3] != t.freshness {
+		return errorReply(fmt.Sprintf("MULTI is for %s %s %s: every command must use the same cache file", t.table, t.tenantId, t.freshness))
+	}
+
+	if command == "DELETE_ENTRY" {
+		t.ops = append(t.ops, cache.BatchOp{Bind: parts[4], Delete: true})
+		return okReply("queued")
+	}
+	content := []byte(parts[5])
+	if useBase64 {
+		decoded, err := base64.StdEncoding.DecodeString(parts[5])
+		if err != nil {
+			return errorReply(fmt.Sprintf("invalid base64 content: %v", err))
+		}
+		content = decoded
+	}
+	t.ops = append(t.ops, cache.BatchOp{Bind: parts[4], Content: content})
+	return okReply("queued")
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"strings"
+)
+
+// クライアントは応答を待たずにフレームを続けて送ってよい (パイプライン)。受信済みのフレームはまとめて読み、
+// 送られた順に実行して同じ順に応答する。同じキャッシュファイルへの連続したSETは、sqcache execと同じく
+// 1つのトランザクション (MSet) で書き込む。応答は受信済みのコマンドをすべて処理してから書き出す。
+
+// readPipelined reads a frame and the frames already received after it, up to execBatchSize.
+// An error after the first frame is returned with the frames read before it, to be handled after they run.
+func readPipelined(r *bufio.Reader) ([][]string, error) {
+	var commands [][]string
+	for len(commands) < execBatchSize {
+		args, err := readFrame(r)
+		if err != nil {
+			return commands, err
+		}
+		commands = append(commands, args)
+		// PROTO 1の後はテキストの行なので、フレームとして先読みしない
+		if len(args) > 0 && (strings.EqualFold(args[0], "PROTO") || strings.EqualFold(args[0], "SHUTDOWN")) {
+			break
+		}
+		if r.Buffered() == 0 {
+			break
+		}
+	}
+	return commands, nil
+}
+
+// sameFileSets returns the number of leading SETs of commands to the same cache file, up to execBatchSize
+func sameFileSets(commands [][]string) int {
+	first := commands[0]
+	if len(first) == 0 || !isBatchableSet(first) {
+		return 1
+	}
+	n := 1
+	for n < len(commands) && n < execBatchSize {
+		args := commands[n]
+		if len(args) == 0 || !isBatchableSet(args) || args[1] != first[1] || args[2] != first[2] || args[3] != first[3] {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// runCoalescedSets stores the SETs of sameFileSets in one transaction and returns a reply for each.
+// When the transaction fails, the SETs run one by one so that each gets its own reply.
+func runCoalescedSets(commands [][]string, useBase64 bool) []reply {
+	first := commands[0]
+	entries := make([]cache.CacheEntry, 0, len(commands))
+	for _, args := range commands {
+		content := []byte(args[5])
+		if useBase64 {
+			decoded, err := base64.StdEncoding.DecodeString(args[5])
+			if err != nil {
+				entries = nil
+				break
+			}
+			content = decoded
+		}
+		entries = append(entries, cache.CacheEntry{Key: args[4], Content: content})
+	}
+
+	replies := make([]reply, 0, len(commands))
+	if entries != nil && api.MSet(first[1], first[2], first[3], entries) == nil {
+		for range commands {
+			replies = append(replies, okReply("set"))
+		}
+		return replies
+	}
+	for _, args := range commands {
+		if useBase64 {
+			replies = append(replies, executeBase64(args))
+		} else {
+			replies = append(replies, execute(args))
+		}
+	}
+	return replies
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sqlite-cache/src/api"
+	"strconv"
+	"strings"
+)
+
+// protocolCommands lists the commands of the text protocol, printed by HELP and the help message
+const protocolCommands = `INIT base_dir max_size cap
+SET table tenant_id freshness bind content
+SET_TAGGED table tenant_id freshness bind content tag[,tag...]  (SET with tags)
+SET_PRIORITY table tenant_id freshness bind content low|normal|high|pin  (SET with an eviction priority;
+                                   lower priorities are evicted first and pinned entries never)
+INVALIDATE_TAG table tenant_id tag  (delete the entries carrying tag; OK: <count>)
+APPEND table tenant_id freshness bind content  (add to the end of the content, creating it if absent)
+SETNX table tenant_id freshness bind content [ttl]  (store only if absent; OK: true if stored)
+GET table tenant_id freshness bind
+PEEK table tenant_id freshness bind    (GET without updating last access time)
+EXISTS table tenant_id freshness bind  (OK: true / OK: false)
+TOUCH table tenant_id freshness bind [ttl]  (update last access time, e.g. ttl=10m)
+DELETE table
+DELETE_ENTRY table tenant_id freshness bind
+LIST_TABLES                        (table names as a JSON array)
+LIST_TENANTS table                 (tenant IDs of the table as a JSON array)
+SCAN table tenant_id freshness cursor [count] [prefix]  (list binds in bind order as JSON;
+                                   start with cursor 0 and repeat with the returned cursor until it is 0)
+DELETE_PREFIX table tenant_id freshness prefix  (delete the entries whose bind starts with prefix; OK: <count>)
+DELETE_WHERE table tenant_id freshness part [part...]  (delete the SetMulti entries whose key starts with
+                                   the parts; OK: <count>)
+DELETE_TENANT table tenant_id
+COMPACT table [tenant_id]          (VACUUM the tenant's or every tenant's cache files; OK: <reclaimed bytes>)
+BACKUP dest_dir | BACKUP table tenant_id freshness dest_path  (copy all or one cache file; OK: <files>)
+RESTORE src_dir                    (install a BACKUP dest_dir into base_dir; OK: <files>)
+EXPORT table tenant_id path        (write the tenant's entries to a .tar.zst archive; OK: <entries>)
+IMPORT path                        (store the entries of an EXPORT archive; OK: <entries>)
+PRELOAD table tenant_id freshness path  (bulk-load {"bind","content"|"content_base64"} JSON lines or an
+                                   EXPORT archive into the cache file in large transactions; OK: <entries>)
+STATS                              (per cache file stats as JSON)
+TOP_KEYS table tenant_id [n]       (the n (default 10) most and least read binds with sizes and hits, as JSON)
+PREVIEW_EVICTION table tenant_id   (binds and bytes eviction would remove at the current size, as JSON)
+MULTI table tenant_id freshness    (queue the following SET and DELETE_ENTRY commands of that cache file)
+EXEC                               (apply the queued commands in one transaction; OK: <count>)
+ROLLBACK                           (discard the queued commands)
+PROTO 1|2                          (switch to the text or binary-safe framed protocol)
+ENCODING text|base64               (with base64, content arguments are decoded and GET/PEEK results encoded)
+HELP [command]                     (list the commands, or the usage of one)
+PING [message]                     (OK: PONG, or the message; works before INIT)
+HELLO                              (server name, version, protocol, encoding and INIT state as JSON)
+CLOSE
+SHUTDOWN                           (close all cache files and exit)`
+
+// indentLines prefixes every line of text with indent
+func indentLines(text, indent string) string {
+	return indent + strings.ReplaceAll(text, "\n", "\n"+indent)
+}
+
+// helpReply returns the usage of the command, or of every command without one
+func helpReply(parts []string) reply {
+	if len(parts) == 1 {
+		return reply{status: "OK", value: []byte(protocolCommands)}
+	}
+	if len(parts) != 2 {
+		return errorReply("HELP requires 0 or 1 argument: [command]")
+	}
+
+	// 字下げした行は前の行の続き
+	command := strings.ToUpper(parts[1])
+	var usage []string
+	matched := false
+	for _, line := range strings.Split(protocolCommands, "\n") {
+		if !strings.HasPrefix(line, " ") {
+			name, _, _ := strings.Cut(line, " ")
+			matched = name == command
+		}
+		if matched {
+			usage = append(usage, line)
+		}
+	}
+	if len(usage) == 0 {
+		return errorReply(fmt.Sprintf("unknown command: %s", command))
+	}
+	return reply{status: "OK", value: []byte(strings.Join(usage, "\n"))}
+}
+
+// helloInfo is the reply of HELLO, for clients to check what they are connected to
+type helloInfo struct {
+	Server      string `json:"server"`
+	Version     string `json:"version"`
+	Proto       int    `json:"proto"`    // PROTOで切り替えた形式 (1: テキスト、2: フレーム)
+	Encoding    string `json:"encoding"` // text|base64
+	Initialized bool   `json:"initialized"`
+}
+
+// helloReply describes the server and the protocol state of the session
+func helloReply(parts []string, framed, useBase64 bool) reply {
+	if len(parts) != 1 {
+		return errorReply("HELLO takes no arguments")
+	}
+	info := helloInfo{Server: "sqcache", Version: Version, Proto: 1, Encoding: "text", Initialized: api.Ping() == nil}
+	if framed {
+		info.Proto = 2
+	}
+	if useBase64 {
+		info.Encoding = "base64"
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return reply{status: "ERROR", text: err.Error(), err: err}
+	}
+	return reply{status: "OK", value: data}
+}
+
+// contentArg is the index of the content argument of the commands that take one
+var contentArg = map[string]int{"SET": 5, "SET_TAGGED": 5, "SET_PRIORITY": 5, "APPEND": 5, "SETNX": 5}
+
+// switchEncoding handles "ENCODING text|base64"
+func switchEncoding(parts []string, useBase64 *bool) reply {
+	if len(parts) != 2 {
+		return errorReply("ENCODING requires 1 argument: text or base64")
+	}
+	switch strings.ToLower(parts[1]) {
+	case "text":
+		*useBase64 = false
+	case "base64":
+		*useBase64 = true
+	default:
+		return errorReply("ENCODING requires 1 argument: text or base64")
+	}
+	return okReply("encoding " + strings.ToLower(parts[1]))
+}
+
+// executeBase64 is execute with the content argument decoded from base64 and GET/PEEK results encoded
+func executeBase64(parts []string) reply {
+	command := strings.ToUpper(parts[0])
+	if i, ok := contentArg[command]; ok && i < len(parts) {
+		content, err := base64.StdEncoding.DecodeString(parts[i])
+		if err != nil {
+			return errorReply(fmt.Sprintf("invalid base64 content: %v", err))
+		}
+		parts = append([]string(nil), parts...)
+		parts[i] = string(content)
+	}
+
+	rep := execute(parts)
+	if (command == "GET" || command == "PEEK") && rep.value != nil {
+		rep.value = []byte(base64.StdEncoding.EncodeToString(rep.value))
+	}
+	return rep
+}
+
+// splitCommands splits a text line into commands separated by ';' and each command into arguments.
+// An argument starting with '"' is read up to the closing quote with the escapes \" \\ \n \r \t and \xHH,
+// and one starting with a single quote up to the closing quote with only \' escaped, so that content may contain
+// spaces. Other arguments end at whitespace and are taken literally, so JSON such as {"a":1} needs no quoting.
+// A ';' ends the command when it ends an unquoted argument or follows a closing quote; "a;b" is one argument.
+func splitCommands(line string) ([][]string, error) {
+	var commands [][]string
+	var args []string
+	endCommand := func() {
+		if len(args) > 0 {
+			commands = append(commands, args)
+		}
+		args = nil
+	}
+
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i >= len(line) {
+			break
+		}
+
+		switch line[i] {
+		case '"', '\'':
+			arg, next, err := readQuoted(line, i)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+			i = next
+			if i < len(line) && line[i] == ';' {
+				endCommand()
+				i++
+			} else if i < len(line) && !isSpace(line[i]) {
+				return nil, fmt.Errorf("closing quote must be followed by a space or ';' at position %d", i+1)
+			}
+		default:
+			start := i
+			for i < len(line) && !isSpace(line[i]) {
+				i++
+			}
+			arg := line[start:i]
+			if strings.HasSuffix(arg, ";") {
+				if arg = arg[:len(arg)-1]; arg != "" {
+					args = append(args, arg)
+				}
+				endCommand()
+			} else {
+				args = append(args, arg)
+			}
+		}
+	}
+	endCommand()
+	return commands, nil
+}
+
+// readQuoted reads the quoted argument starting at line[start] and returns it with the index after the closing quote
+func readQuoted(line string, start int) (string, int, error) {
+	quote := line[start]
+	var b strings.Builder
+	for i := start + 1; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && i+1 < len(line) && quote == '\'':
+			// シングルクォートでは\'だけをエスケープとして扱う
+			if line[i+1] == '\'' {
+				b.WriteByte('\'')
+				i++
+			} else {
+				b.WriteByte(c)
+			}
+		case c == '\\' && i+1 < len(line):
+			i++
+			switch line[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'x':
+				if i+2 >= len(line) {
+					return "", 0, fmt.Errorf("invalid \\x escape at position %d", i)
+				}
+				v, err := strconv.ParseUint(line[i+1:i+3], 16, 8)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid \\x escape at position %d", i)
+				}
+				b.WriteByte(byte(v))
+				i += 2
+			default:
+				b.WriteByte(line[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unbalanced quotes")
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
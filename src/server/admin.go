@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"sqlite-cache/src/api"
+	"sync"
+	"time"
+)
+
+// 管理用のエンドポイントはキャッシュのAPIとは別のアドレスで待ち受けるので、localhostやクラスタ内だけに
+// 公開できる。プロファイルやコマンドラインを返すので、TLSとトークンはAPIのリスナーと同じものを要求する。
+// net/http/pprofはimportするとhttp.DefaultServeMuxにも登録するが、DefaultServeMuxはどこでも使わない。
+
+// publishOnce guards expvar.Publish, which panics when a name is published twice
+var publishOnce sync.Once
+
+// Admin serves net/http/pprof under /debug/pprof/ and expvar under /debug/vars
+type Admin struct {
+	httpServer *http.Server
+}
+
+func NewAdmin(addr string) *Admin {
+	publishOnce.Do(func() {
+		expvar.Publish("sqcache", expvar.Func(cacheVars))
+	})
+	a := &Admin{}
+	a.httpServer = &http.Server{
+		Addr:              addr,
+		Handler:           a.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return a
+}
+
+// Handler returns the HTTP handler with the profiling and expvar routes registered
+func (a *Admin) Handler() http.Handler {
+	mux := http.NewServeMux()
+	// Indexは/debug/pprof/heapなどのプロファイル名をruntime/pprofから引く
+	mux.HandleFunc("GET /debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("GET /debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("GET /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("POST /debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("GET /debug/pprof/trace", pprof.Trace)
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	return mux
+}
+
+// cacheVars is the "sqcache" expvar: the per-tenant counters and the prepared statement counters
+func cacheVars() any {
+	vars := map[string]any{}
+	// 初期化前や終了後は何も返さない
+	if tenants, err := api.TenantMetrics(); err == nil {
+		vars["tenants"] = tenants
+	}
+	if statements, err := api.StatementStats(); err == nil {
+		vars["statements"] = statements
+	}
+	return vars
+}
+
+// SetSecurity serves TLS and requires the token on every endpoint, as on the API listener
+func (a *Admin) SetSecurity(security *Security) {
+	a.httpServer.TLSConfig = security.TLS
+	if security.Token != "" {
+		a.httpServer.Handler = security.requireToken(a.Handler())
+	}
+}
+
+// ListenAndServe blocks until the server is shut down
+func (a *Admin) ListenAndServe() error {
+	var err error
+	if a.httpServer.TLSConfig != nil {
+		err = a.httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = a.httpServer.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting new requests. A running CPU profile or trace is waited for until ctx expires.
+func (a *Admin) Shutdown(ctx context.Context) error {
+	return a.httpServer.Shutdown(ctx)
+}
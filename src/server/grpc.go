@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/sqcachepb"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCServer exposes the cache over gRPC. The cache must be initialized via the api package beforehand.
+type GRPCServer struct {
+	sqcachepb.UnimplementedCacheServer
+
+	addr       string
+	grpcServer *grpc.Server
+	done       chan struct{} // Shutdownで閉じ、Watchのストリームを終わらせる
+	readOnly   bool
+	limiter    *RateLimiter
+}
+
+func NewGRPC(addr string) *GRPCServer {
+	s := &GRPCServer{addr: addr, grpcServer: grpc.NewServer(), done: make(chan struct{})}
+	s.register()
+	return s
+}
+
+func (s *GRPCServer) register() {
+	sqcachepb.RegisterCacheServer(s.grpcServer, s)
+	healthpb.RegisterHealthServer(s.grpcServer, grpcHealth{})
+}
+
+// grpcHealth serves the standard gRPC health checking protocol (grpc.health.v1) for load balancers.
+// Check runs the readiness check of /readyz; Watch is not implemented.
+type grpcHealth struct {
+	healthpb.UnimplementedHealthServer
+}
+
+func (grpcHealth) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	// サービス名は空 (サーバー全体) とsqcache.Cacheだけを知っている
+	if req.Service != "" && req.Service != sqcachepb.Cache_ServiceDesc.ServiceName {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.Service)
+	}
+	if err := api.CheckHealth(); err != nil {
+		return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING}, nil
+	}
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+// SetRateLimit limits the requests and bytes per second of each tenant; RPCs over the limit fail
+// with RESOURCE_EXHAUSTED. limiter may be shared with the HTTP and memcached servers.
+// Call it before ListenAndServe.
+func (s *GRPCServer) SetRateLimit(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// SetSecurity serves gRPC over TLS and requires the token in the authorization metadata when they
+// are set. Call it before ListenAndServe.
+func (s *GRPCServer) SetSecurity(security *Security) {
+	var opts []grpc.ServerOption
+	if security.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(security.TLS)))
+	}
+	if security.Token != "" {
+		opts = append(opts, grpc.UnaryInterceptor(security.unaryInterceptor), grpc.StreamInterceptor(security.streamInterceptor))
+	}
+	// オプションはサーバーの作成時にしか渡せないので作り直す
+	s.grpcServer = grpc.NewServer(opts...)
+	s.register()
+}
+
+// SetReadOnly makes Set and Delete fail with FAILED_PRECONDITION, e.g. on a replica. Call it before ListenAndServe.
+func (s *GRPCServer) SetReadOnly(readOnly bool) {
+	s.readOnly = readOnly
+}
+
+// ListenAndServe blocks until the server is shut down
+func (s *GRPCServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	return s.grpcServer.Serve(listener)
+}
+
+// Shutdown stops accepting new RPCs and waits for in-flight ones, forcing a stop when ctx is done
+func (s *GRPCServer) Shutdown(ctx context.Context) error {
+	// GracefulStopは処理中のRPCを待つので、終わらないWatchを先に終わらせる
+	close(s.done)
+	done := make(chan struct{})
+	go func() {
+		s.grpcServer.GracefulStop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.grpcServer.Stop()
+		return ctx.Err()
+	}
+}
+
+func (s *GRPCServer) Get(ctx context.Context, req *sqcachepb.GetRequest) (*sqcachepb.GetResponse, error) {
+	if err := s.limiter.allow(req.TenantId); err != nil {
+		return nil, grpcError(err)
+	}
+	content, err := api.Get(req.Table, req.TenantId, req.Freshness, req.Bind)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	s.limiter.charge(req.TenantId, int64(len(content)))
+	return &sqcachepb.GetResponse{Content: content}, nil
+}
+
+func (s *GRPCServer) Set(ctx context.Context, req *sqcachepb.SetRequest) (*sqcachepb.SetResponse, error) {
+	if s.readOnly {
+		return nil, grpcError(errReadOnlyReplica)
+	}
+	if req.TtlSeconds < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl_seconds must not be negative")
+	}
+	if err := s.limiter.allow(req.TenantId); err != nil {
+		return nil, grpcError(err)
+	}
+	s.limiter.charge(req.TenantId, int64(len(req.Content)))
+	ttl := time.Duration(req.TtlSeconds) * time.Second
+	if err := api.SetWithTTL(req.Table, req.TenantId, req.Freshness, req.Bind, req.Content, ttl); err != nil {
+		return nil, grpcError(err)
+	}
+	return &sqcachepb.SetResponse{}, nil
+}
+
+func (s *GRPCServer) Delete(ctx context.Context, req *sqcachepb.DeleteRequest) (*sqcachepb.DeleteResponse, error) {
+	if s.readOnly {
+		return nil, grpcError(errReadOnlyReplica)
+	}
+	// テーブル全体の削除はテナントを持たないので制限しない
+	if req.TenantId != "" {
+		if err := s.limiter.allow(req.TenantId); err != nil {
+			return nil, grpcError(err)
+		}
+	}
+	var err error
+	switch {
+	case req.Bind != "":
+		err = api.DeleteEntry(req.Table, req.TenantId, req.Freshness, req.Bind)
+	case req.TenantId != "":
+		err = api.DeleteTenant(req.Table, req.TenantId)
+	default:
+		err = api.Delete(req.Table)
+	}
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &sqcachepb.DeleteResponse{}, nil
+}
+
+func (s *GRPCServer) MGet(ctx context.Context, req *sqcachepb.MGetRequest) (*sqcachepb.MGetResponse, error) {
+	if err := s.limiter.allow(req.TenantId); err != nil {
+		return nil, grpcError(err)
+	}
+	entries, err := api.MGet(req.Table, req.TenantId, req.Freshness, req.Binds)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	for _, content := range entries {
+		s.limiter.charge(req.TenantId, int64(len(content)))
+	}
+	return &sqcachepb.MGetResponse{Entries: entries}, nil
+}
+
+func (s *GRPCServer) Scan(req *sqcachepb.ScanRequest, stream sqcachepb.Cache_ScanServer) error {
+	if err := s.limiter.allow(req.TenantId); err != nil {
+		return grpcError(err)
+	}
+	err := api.Iterate(req.Table, req.TenantId, req.Freshness, func(bind string, content []byte) error {
+		s.limiter.charge(req.TenantId, int64(len(content)))
+		return stream.Send(&sqcachepb.Entry{Bind: bind, Content: content})
+	})
+	if err != nil {
+		// Sendの失敗はクライアントの切断なのでそのまま返す
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		return grpcError(err)
+	}
+	return nil
+}
+
+func (s *GRPCServer) Watch(req *sqcachepb.WatchRequest, stream sqcachepb.Cache_WatchServer) error {
+	mutations, err := api.Subscribe(stream.Context())
+	if err != nil {
+		return grpcError(err)
+	}
+	for {
+		select {
+		case <-s.done:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case m, ok := <-mutations:
+			if !ok {
+				// 取りこぼした変更があるかもしれないので、クライアントに上位のキャッシュを作り直させる
+				return status.Error(codes.Aborted, "change feed closed, mutations may have been lost")
+			}
+			if !matchMutation(m, req.Table, req.TenantId) {
+				continue
+			}
+			err := stream.Send(&sqcachepb.Mutation{
+				Op:           string(m.Op),
+				Table:        m.Table,
+				TenantId:     m.TenantID,
+				Freshness:    m.Freshness,
+				Bind:         m.Bind,
+				TimeUnixNano: m.Time.UnixNano(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcError maps cache errors to gRPC status codes
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var limited *errRateLimited
+	if errors.As(err, &limited) {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+	errStr := strings.ToLower(err.Error())
+	code := codes.Internal
+	switch {
+	case strings.Contains(errStr, "read-only replica"):
+		code = codes.FailedPrecondition
+	case strings.Contains(errStr, "not found"):
+		code = codes.NotFound
+	case strings.Contains(errStr, "disk full") || strings.Contains(errStr, "database or disk is full"):
+		code = codes.ResourceExhausted
+	case strings.Contains(errStr, "not init"):
+		code = codes.Unavailable
+	case strings.Contains(errStr, "too large") || strings.Contains(errStr, "invalid cache name"):
+		code = codes.InvalidArgument
+	case strings.Contains(errStr, "not enabled"):
+		code = codes.FailedPrecondition
+	}
+	return status.Error(code, err.Error())
+}
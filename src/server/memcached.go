@@ -0,0 +1,431 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// memcachedMaxKeyLength is the key length limit of the memcached protocol
+	memcachedMaxKeyLength = 250
+	// memcachedMaxValueSize bounds the data block of a set command
+	memcachedMaxValueSize = 64 << 20
+	// memcachedRelativeExpiry is the largest exptime treated as seconds from now (30 days)
+	memcachedRelativeExpiry = 60 * 60 * 24 * 30
+)
+
+// MemcachedServer speaks the memcached text protocol (get/set/delete/stats).
+// All keys are stored as binds of one (table, tenant, freshness), so the data is shared with
+// the other interfaces. Client flags are not persisted and are always returned as 0.
+type MemcachedServer struct {
+	addr      string
+	table     string
+	tenantID  string
+	freshness string
+	version   string
+	started   time.Time
+	readOnly  bool
+	security  *Security
+	limiter   *RateLimiter
+
+	cmdGet atomic.Uint64
+	cmdSet atomic.Uint64
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+func NewMemcached(addr, table, tenantID, freshness, version string) *MemcachedServer {
+	return &MemcachedServer{
+		addr:      addr,
+		table:     table,
+		tenantID:  tenantID,
+		freshness: freshness,
+		version:   version,
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// SetReadOnly makes set and delete fail with SERVER_ERROR, e.g. on a replica. Call it before ListenAndServe.
+func (s *MemcachedServer) SetReadOnly(readOnly bool) {
+	s.readOnly = readOnly
+}
+
+// SetRateLimit limits the requests and bytes per second of the memcached tenant; commands over the
+// limit fail with SERVER_ERROR. Give it the limiter of the other servers to count the tenant
+// across protocols. Call it before ListenAndServe.
+func (s *MemcachedServer) SetRateLimit(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// SetSecurity serves the protocol over TLS and requires the token when they are set. With a token,
+// a connection must first authenticate like memcached's text protocol authentication: a set of any
+// key whose data is "<username> <token>" (the username is not checked). Call it before ListenAndServe.
+func (s *MemcachedServer) SetSecurity(security *Security) {
+	s.security = security
+}
+
+// ListenAndServe blocks until the server is shut down
+func (s *MemcachedServer) ListenAndServe() error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if s.security != nil && s.security.TLS != nil {
+		listener = tls.NewListener(listener, s.security.TLS)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.started = time.Now()
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections and closes the open ones after their current command
+func (s *MemcachedServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	// 読み込み待ちの接続はすぐに閉じ、処理中のコマンドは書き込みまで終わらせる
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (s *MemcachedServer) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	authenticated := s.security == nil || s.security.Token == ""
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		parts := strings.Fields(line)
+		if len(parts) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+			w.Flush()
+			continue
+		}
+
+		var quit bool
+		if !authenticated {
+			switch parts[0] {
+			case "set":
+				authenticated, quit = s.handleAuth(r, w, parts[1:])
+			case "quit":
+				quit = true
+			default:
+				fmt.Fprint(w, "CLIENT_ERROR unauthenticated\r\n")
+			}
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+			continue
+		}
+		switch parts[0] {
+		case "get", "gets":
+			s.handleGet(w, parts[1:])
+		case "set":
+			quit = s.handleSet(r, w, parts[1:])
+		case "delete":
+			s.handleDelete(w, parts[1:])
+		case "stats":
+			s.handleStats(w)
+		case "version":
+			fmt.Fprintf(w, "VERSION %s\r\n", s.version)
+		case "mn":
+			// メタプロトコルのno-op。クライアントがパイプラインの区切りや死活確認に使う
+			fmt.Fprint(w, "MN\r\n")
+		case "quit":
+			quit = true
+		default:
+			fmt.Fprint(w, "ERROR\r\n")
+		}
+
+		if err := w.Flush(); err != nil || quit {
+			return
+		}
+	}
+}
+
+func (s *MemcachedServer) handleGet(w *bufio.Writer, keys []string) {
+	if len(keys) == 0 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+	for _, key := range keys {
+		if !validMemcachedKey(key) {
+			fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+	}
+
+	s.cmdGet.Add(uint64(len(keys)))
+	if err := s.limiter.allow(s.tenantID); err != nil {
+		fmt.Fprintf(w, "SERVER_ERROR %s\r\n", oneLine(err))
+		return
+	}
+	entries, err := api.MGet(s.table, s.tenantID, s.freshness, keys)
+	if err != nil {
+		fmt.Fprintf(w, "SERVER_ERROR %s\r\n", oneLine(err))
+		return
+	}
+	for _, key := range keys {
+		content, ok := entries[key]
+		if !ok {
+			continue
+		}
+		s.limiter.charge(s.tenantID, int64(len(content)))
+		fmt.Fprintf(w, "VALUE %s 0 %d\r\n", key, len(content))
+		w.Write(content)
+		fmt.Fprint(w, "\r\n")
+	}
+	fmt.Fprint(w, "END\r\n")
+}
+
+// handleSet reads the data block and stores it. It reports whether the connection must be
+// closed because the data block could not be consumed.
+func (s *MemcachedServer) handleSet(r *bufio.Reader, w *bufio.Writer, args []string) bool {
+	// set <key> <flags> <exptime> <bytes> [noreply]
+	if len(args) != 4 && len(args) != 5 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return false
+	}
+	key := args[0]
+	_, errFlags := strconv.ParseUint(args[1], 10, 32)
+	exptime, errExp := strconv.ParseInt(args[2], 10, 64)
+	size, errSize := strconv.Atoi(args[3])
+	noreply := len(args) == 5 && args[4] == "noreply"
+	if errFlags != nil || errExp != nil || errSize != nil || size < 0 {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+	if size > memcachedMaxValueSize {
+		fmt.Fprint(w, "SERVER_ERROR object too large for cache\r\n")
+		return true
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return true
+	}
+	if string(data[size:]) != "\r\n" {
+		fmt.Fprint(w, "CLIENT_ERROR bad data chunk\r\n")
+		return true
+	}
+	if !validMemcachedKey(key) {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return false
+	}
+
+	s.cmdSet.Add(1)
+	var err error
+	if s.readOnly {
+		err = errReadOnlyReplica
+	} else if err = s.limiter.allow(s.tenantID); err == nil {
+		if ttl, expired := memcachedTTL(exptime); expired {
+			// 負の値や過去の時刻は即座に期限切れとして扱う
+			err = api.DeleteEntry(s.table, s.tenantID, s.freshness, key)
+		} else {
+			s.limiter.charge(s.tenantID, int64(size))
+			err = api.SetWithTTL(s.table, s.tenantID, s.freshness, key, data[:size], ttl)
+		}
+	}
+
+	if noreply {
+		return false
+	}
+	if err != nil {
+		if errors.Is(err, cache.ErrEntryTooLarge) {
+			fmt.Fprint(w, "SERVER_ERROR object too large for cache\r\n")
+			return false
+		}
+		fmt.Fprintf(w, "SERVER_ERROR %s\r\n", oneLine(err))
+		return false
+	}
+	fmt.Fprint(w, "STORED\r\n")
+	return false
+}
+
+// handleAuth reads the data block of a set sent before authentication and checks the token in it.
+// It reports whether the connection is authenticated and whether it must be closed.
+func (s *MemcachedServer) handleAuth(r *bufio.Reader, w *bufio.Writer, args []string) (authenticated, quit bool) {
+	// set <key> <flags> <exptime> <bytes> (認証ではnoreplyを使わない)
+	if len(args) != 4 {
+		fmt.Fprint(w, "CLIENT_ERROR unauthenticated\r\n")
+		return false, false
+	}
+	size, err := strconv.Atoi(args[3])
+	// ユーザー名とトークンだけなので、大きなデータは読まずに切断する
+	if err != nil || size < 0 || size > 4096 {
+		fmt.Fprint(w, "CLIENT_ERROR authentication failure\r\n")
+		return false, true
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return false, true
+	}
+	_, token, _ := strings.Cut(strings.TrimSpace(string(data[:size])), " ")
+	if !s.security.validToken(token) {
+		fmt.Fprint(w, "CLIENT_ERROR authentication failure\r\n")
+		return false, false
+	}
+	fmt.Fprint(w, "STORED\r\n")
+	return true, false
+}
+
+func (s *MemcachedServer) handleDelete(w *bufio.Writer, args []string) {
+	// delete <key> [noreply]
+	if len(args) != 1 && len(args) != 2 {
+		fmt.Fprint(w, "ERROR\r\n")
+		return
+	}
+	key := args[0]
+	noreply := len(args) == 2 && args[1] == "noreply"
+	if !validMemcachedKey(key) {
+		fmt.Fprint(w, "CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+
+	// DeleteEntryは存在しないエントリでも成功するので、NOT_FOUNDは返さない
+	err := errReadOnlyReplica
+	if !s.readOnly {
+		if err = s.limiter.allow(s.tenantID); err == nil {
+			err = api.DeleteEntry(s.table, s.tenantID, s.freshness, key)
+		}
+	}
+	if noreply {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(w, "SERVER_ERROR %s\r\n", oneLine(err))
+		return
+	}
+	fmt.Fprint(w, "DELETED\r\n")
+}
+
+func (s *MemcachedServer) handleStats(w *bufio.Writer) {
+	// 全テナントを数えないよう、対象のDBファイルだけを調べる (まだなければ0)
+	var items, bytes int64
+	var hits, misses uint64
+	if st, err := api.StatsFor(s.table, s.tenantID, s.freshness); err == nil {
+		items, bytes = st.Entries, st.Bytes
+		hits, misses = st.Hits, st.Misses
+	}
+
+	now := time.Now()
+	fmt.Fprintf(w, "STAT pid %d\r\n", os.Getpid())
+	fmt.Fprintf(w, "STAT uptime %d\r\n", int64(now.Sub(s.started).Seconds()))
+	fmt.Fprintf(w, "STAT time %d\r\n", now.Unix())
+	fmt.Fprintf(w, "STAT version %s\r\n", s.version)
+	fmt.Fprintf(w, "STAT curr_items %d\r\n", items)
+	fmt.Fprintf(w, "STAT bytes %d\r\n", bytes)
+	fmt.Fprintf(w, "STAT cmd_get %d\r\n", s.cmdGet.Load())
+	fmt.Fprintf(w, "STAT cmd_set %d\r\n", s.cmdSet.Load())
+	fmt.Fprintf(w, "STAT get_hits %d\r\n", hits)
+	fmt.Fprintf(w, "STAT get_misses %d\r\n", misses)
+	fmt.Fprint(w, "END\r\n")
+}
+
+// memcachedTTL converts exptime to a TTL. Values up to 30 days are relative seconds,
+// larger values are absolute UNIX times, and 0 means no expiry.
+func memcachedTTL(exptime int64) (ttl time.Duration, expired bool) {
+	switch {
+	case exptime == 0:
+		return 0, false
+	case exptime < 0:
+		return 0, true
+	case exptime <= memcachedRelativeExpiry:
+		return time.Duration(exptime) * time.Second, false
+	}
+	ttl = time.Until(time.Unix(exptime, 0))
+	return ttl, ttl <= 0
+}
+
+func validMemcachedKey(key string) bool {
+	if key == "" || len(key) > memcachedMaxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// oneLine keeps error messages from breaking the line-based protocol
+func oneLine(err error) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(err.Error())
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// テナントIDごとにリクエスト数と転送バイト数のトークンバケットを持つ。どちらも1秒分までためられる
+// (リクエストは少なくとも1つ。1未満のRequestsPerSecondでも1/RequestsPerSecond秒ごとに1つ通す)。
+// HTTP・gRPC・memcachedのサーバーで1つのRateLimiterを共有し、どのプロトコルで来ても同じバケットから引く。
+// 転送するバイト数は読み書きが終わるまでわからないので、終わってから引き、残りが負の間 (使いすぎた分を
+// 取り戻すまで) は次のリクエストを断る。テーブルが違っても同じテナントIDは同じバケットを使う。
+
+// maxIdleBuckets is the number of tenant buckets kept before the full (idle) ones are dropped
+const maxIdleBuckets = 10000
+
+// RateLimit limits the requests and the content bytes per second of each tenant
+type RateLimit struct {
+	RequestsPerSecond float64 // 0なら制限しない
+	BytesPerSecond    float64 // 読み書きしたcontentのバイト数。0なら制限しない
+}
+
+// errRateLimited is returned for requests of a tenant over its limit
+type errRateLimited struct {
+	tenant     string
+	retryAfter time.Duration
+}
+
+func (e *errRateLimited) Error() string {
+	return fmt.Sprintf("rate limit exceeded for tenant %q, retry after %s", e.tenant, e.retryAfter.Round(time.Millisecond))
+}
+
+// retryAfterSeconds is the Retry-After value, rounded up to whole seconds
+func (e *errRateLimited) retryAfterSeconds() int {
+	return int(math.Ceil(e.retryAfter.Seconds()))
+}
+
+type tenantBucket struct {
+	requests float64 // 残りのリクエスト数
+	bytes    float64 // 残りのバイト数 (使いすぎると負になる)
+	updated  time.Time
+}
+
+// RateLimiter holds the buckets of the tenants. A nil *RateLimiter allows everything.
+type RateLimiter struct {
+	limit   RateLimit
+	mu      sync.Mutex
+	buckets map[string]*tenantBucket
+}
+
+// NewRateLimiter returns the limiter to pass to SetRateLimit of every server, or nil when limit has
+// no limits
+func NewRateLimiter(limit RateLimit) (*RateLimiter, error) {
+	if !(limit.RequestsPerSecond >= 0) || math.IsInf(limit.RequestsPerSecond, 0) {
+		return nil, fmt.Errorf("requests per second must be a non-negative number, got %v", limit.RequestsPerSecond)
+	}
+	if !(limit.BytesPerSecond >= 0) || math.IsInf(limit.BytesPerSecond, 0) {
+		return nil, fmt.Errorf("bytes per second must be a non-negative number, got %v", limit.BytesPerSecond)
+	}
+	if limit.RequestsPerSecond == 0 && limit.BytesPerSecond == 0 {
+		return nil, nil
+	}
+	return &RateLimiter{limit: limit, buckets: make(map[string]*tenantBucket)}, nil
+}
+
+// requestBurst is the number of requests a bucket holds when full
+func (l *RateLimiter) requestBurst() float64 {
+	return max(1, l.limit.RequestsPerSecond)
+}
+
+// bucket returns the refilled bucket of the tenant. The caller must hold l.mu.
+func (l *RateLimiter) bucket(tenant string, now time.Time) *tenantBucket {
+	b, ok := l.buckets[tenant]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.dropIdle(now)
+		}
+		b = &tenantBucket{requests: l.requestBurst(), bytes: l.limit.BytesPerSecond, updated: now}
+		l.buckets[tenant] = b
+		return b
+	}
+	elapsed := now.Sub(b.updated).Seconds()
+	b.requests = min(b.requests+elapsed*l.limit.RequestsPerSecond, l.requestBurst())
+	b.bytes = min(b.bytes+elapsed*l.limit.BytesPerSecond, l.limit.BytesPerSecond)
+	b.updated = now
+	return b
+}
+
+// dropIdle removes the buckets that have refilled completely, which are the same as new ones
+func (l *RateLimiter) dropIdle(now time.Time) {
+	for tenant, b := range l.buckets {
+		elapsed := now.Sub(b.updated).Seconds()
+		if b.requests+elapsed*l.limit.RequestsPerSecond >= l.requestBurst() &&
+			b.bytes+elapsed*l.limit.BytesPerSecond >= l.limit.BytesPerSecond {
+			delete(l.buckets, tenant)
+		}
+	}
+}
+
+// allow takes one request of the tenant, or returns an *errRateLimited error when it is over the limit
+func (l *RateLimiter) allow(tenant string) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.bucket(tenant, time.Now())
+	var wait time.Duration
+	if l.limit.RequestsPerSecond > 0 && b.requests < 1 {
+		wait = time.Duration((1 - b.requests) / l.limit.RequestsPerSecond * float64(time.Second))
+	}
+	if l.limit.BytesPerSecond > 0 && b.bytes < 0 {
+		wait = max(wait, time.Duration(-b.bytes/l.limit.BytesPerSecond*float64(time.Second)))
+	}
+	if wait > 0 {
+		return &errRateLimited{tenant: tenant, retryAfter: wait}
+	}
+	if l.limit.RequestsPerSecond > 0 {
+		b.requests--
+	}
+	return nil
+}
+
+// charge records n content bytes read or written by the tenant
+func (l *RateLimiter) charge(tenant string, n int64) {
+	if l == nil || l.limit.BytesPerSecond <= 0 || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bucket(tenant, time.Now()).bytes -= float64(n)
+}
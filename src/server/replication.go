@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"strings"
+	"time"
+)
+
+// errReadOnlyReplica is returned for writes to a server that follows a primary
+var errReadOnlyReplica = errors.New("read-only replica, write to the primary")
+
+// replicaRetryDelay is the wait before reconnecting to the primary
+const replicaRetryDelay = time.Second
+
+// handleReplication streams the changes for a replica as newline-delimited ReplicationRecords.
+// With ?snapshot=1 the stream starts with every live entry.
+func (s *Server) handleReplication(w http.ResponseWriter, r *http.Request) {
+	snapshot := r.URL.Query().Get("snapshot") == "1"
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+	started := false
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := api.Replicate(ctx, snapshot, func(record cache.ReplicationRecord) error {
+		// エラーをステータスコードで返せるよう、最初のレコードまでヘッダーを送らない
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && !started {
+		writeError(w, err)
+	}
+}
+
+// Replica follows a primary server and applies its changes to the local cache, which must be
+// initialized via the api package beforehand. Servers of a replica should be made read-only.
+type Replica struct {
+	primary string
+	client  *http.Client
+	token   string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// NewReplica returns a Replica following the HTTP server at primaryURL, e.g. "http://10.0.0.1:8080"
+func NewReplica(primaryURL string) *Replica {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Replica{
+		primary: strings.TrimSuffix(primaryURL, "/"),
+		client:  &http.Client{},
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+}
+
+// SetSecurity sends the token to the primary and connects with the client TLS settings, which
+// verify an HTTPS primary and present the certificate to a primary requiring client certificates.
+// Call it before ListenAndServe.
+func (r *Replica) SetSecurity(security *Security) {
+	r.token = security.Token
+	if security.ClientTLS != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = security.ClientTLS
+		r.client = &http.Client{Transport: transport}
+	}
+}
+
+// ListenAndServe follows the primary until Shutdown. Each connection starts with a snapshot, so the
+// replica catches up again after it was disconnected or fell behind.
+func (r *Replica) ListenAndServe() error {
+	defer close(r.done)
+	for {
+		err := r.follow()
+		if r.ctx.Err() != nil {
+			return nil
+		}
+		slog.Warn("sqlite-cache: replication stream ended", "primary", r.primary, "error", err)
+		select {
+		case <-r.ctx.Done():
+			return nil
+		case <-time.After(replicaRetryDelay):
+		}
+	}
+}
+
+// Shutdown stops following the primary
+func (r *Replica) Shutdown(ctx context.Context) error {
+	r.cancel()
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r *Replica) follow() error {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.primary+"/replication?snapshot=1", nil)
+	if err != nil {
+		return err
+	}
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("primary returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var record cache.ReplicationRecord
+		if err := decoder.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("primary closed the stream")
+			}
+			return err
+		}
+		// 1件の失敗 (ディスクフルなど) で止めず、次の変更を適用する
+		if err := api.ApplyReplication(record); err != nil {
+			slog.Warn("sqlite-cache: failed to apply replicated change", "table", record.Table, "tenant", record.TenantID, "bind", record.Bind, "error", err)
+		}
+	}
+}
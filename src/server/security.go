@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// トークンはHTTPとgRPCでは"Authorization: Bearer <token>"で、memcachedでは接続の最初のsetの
+// データ ("<ユーザー名> <token>"、memcachedのテキストプロトコルの認証と同じ形) で受け取る。
+// クライアント証明書を要求する場合 (mTLS) は、TLSのハンドシェイクで検証されるので、トークンと併用してもよい。
+
+// Security holds the TLS and authentication settings of the servers and the replica client
+type Security struct {
+	TLS       *tls.Config // nilなら平文で待ち受ける
+	ClientTLS *tls.Config // レプリカがプライマリに接続するときの設定 (nilなら既定)
+	Token     string      // 空でなければ、すべてのリクエストにこのトークンを要求する
+}
+
+// LoadSecurity reads the settings from PEM and token files. certFile and keyFile enable TLS,
+// and clientCAFile additionally requires client certificates signed by that CA. caFile is the CA
+// a replica uses to verify its primary, instead of the system roots. Empty names are not used.
+func LoadSecurity(certFile, keyFile, clientCAFile, caFile, tokenFile string) (*Security, error) {
+	security := &Security{}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("TLS certificate and key must be given together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		security.TLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		// プライマリがクライアント証明書を要求する場合に、レプリカも同じ証明書で接続する
+		security.ClientTLS = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	if clientCAFile != "" {
+		if security.TLS == nil {
+			return nil, fmt.Errorf("client certificate CA requires a TLS certificate and key")
+		}
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		security.TLS.ClientCAs = pool
+		security.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		if security.ClientTLS == nil {
+			security.ClientTLS = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		security.ClientTLS.RootCAs = pool
+	}
+	if tokenFile != "" {
+		data, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read auth token: %w", err)
+		}
+		security.Token = strings.TrimSpace(string(data))
+		if security.Token == "" || strings.ContainsAny(security.Token, " \t\r\n") {
+			return nil, fmt.Errorf("auth token file %s must contain one token without spaces", tokenFile)
+		}
+	}
+	return security, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// validToken compares in constant time so that the token cannot be guessed from response times
+func (sec *Security) validToken(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(sec.Token)) == 1
+}
+
+// bearerToken returns the token of an "Authorization: Bearer <token>" value
+func bearerToken(authorization string) string {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// requireToken rejects HTTP requests without the token with 401. The health probes, which return
+// no cache data, are served without it.
+func (sec *Security) requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !sec.validToken(bearerToken(r.Header.Get("Authorization"))) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="sqcache"`)
+			http.Error(w, "missing or invalid auth token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkGRPCToken returns UNAUTHENTICATED unless the authorization metadata carries the token
+func (sec *Security) checkGRPCToken(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if sec.validToken(bearerToken(v)) {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or invalid auth token")
+}
+
+func (sec *Security) unaryInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	// ヘルスチェックはロードバランサーから呼ばれ、キャッシュのデータを返さないのでトークンを求めない
+	if strings.HasPrefix(info.FullMethod, "/grpc.health.v1.Health/") {
+		return handler(ctx, req)
+	}
+	if err := sec.checkGRPCToken(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (sec *Security) streamInterceptor(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if strings.HasPrefix(info.FullMethod, "/grpc.health.v1.Health/") {
+		return handler(srv, ss)
+	}
+	if err := sec.checkGRPCToken(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server exposes the cache over HTTP. The cache must be initialized via the api package beforehand.
+type Server struct {
+	httpServer *http.Server
+	done       chan struct{} // Shutdownで閉じ、/changesのストリームを終わらせる
+	readOnly   bool
+	limiter    *RateLimiter
+}
+
+func New(addr string) *Server {
+	s := &Server{done: make(chan struct{})}
+	s.httpServer = &http.Server{
+		Addr:              addr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	// Shutdownは処理中のリクエストを待つので、終わらないストリームを先に閉じる
+	s.httpServer.RegisterOnShutdown(func() { close(s.done) })
+	return s
+}
+
+// Handler returns the HTTP handler with all routes registered
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /cache/{table}/{tenant}/{freshness}/{bind...}", s.handleGet)
+	mux.HandleFunc("PUT /cache/{table}/{tenant}/{freshness}/{bind...}", s.handlePut)
+	mux.HandleFunc("DELETE /cache/{table}/{tenant}/{freshness}/{bind...}", s.handleDeleteEntry)
+	mux.HandleFunc("DELETE /cache/{table}/{tenant}", s.handleDeleteTenant)
+	mux.HandleFunc("DELETE /cache/{table}", s.handleDeleteTable)
+	mux.HandleFunc("GET /changes", s.handleChanges)
+	mux.HandleFunc("GET /replication", s.handleReplication)
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+	return mux
+}
+
+// SetReadOnly makes PUT and DELETE fail with 403, e.g. on a replica. Call it before ListenAndServe.
+func (s *Server) SetReadOnly(readOnly bool) {
+	s.readOnly = readOnly
+}
+
+// SetRateLimit limits the requests and bytes per second of each tenant; requests over the limit
+// fail with 429 and Retry-After. Pass the same limiter to every server so that
+// a tenant's limit covers all of them. Call it before ListenAndServe.
+func (s *Server) SetRateLimit(limiter *RateLimiter) {
+	s.limiter = limiter
+}
+
+// SetSecurity serves HTTPS and requires the token when they are set. Call it before ListenAndServe.
+func (s *Server) SetSecurity(security *Security) {
+	s.httpServer.TLSConfig = security.TLS
+	if security.Token != "" {
+		s.httpServer.Handler = security.requireToken(s.Handler())
+	}
+}
+
+// ListenAndServe blocks until the server is shut down
+func (s *Server) ListenAndServe() error {
+	var err error
+	if s.httpServer.TLSConfig != nil {
+		// 証明書はTLSConfigに読み込み済み
+		err = s.httpServer.ListenAndServeTLS("", "")
+	} else {
+		err = s.httpServer.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting new requests and waits for in-flight ones to finish
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	tenant := r.PathValue("tenant")
+	if err := s.limiter.allow(tenant); err != nil {
+		writeError(w, err)
+		return
+	}
+	content, err := api.GetReader(r.PathValue("table"), tenant, r.PathValue("freshness"), r.PathValue("bind"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer content.Close()
+
+	// 大きな値もメモリに載せずにそのまま返す
+	w.Header().Set("Content-Type", "application/octet-stream")
+	n, _ := io.Copy(w, content)
+	s.limiter.charge(tenant, n)
+}
+
+func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly {
+		writeError(w, errReadOnlyReplica)
+		return
+	}
+	var ttl time.Duration
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, "invalid ttl: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	tenant := r.PathValue("tenant")
+	if err := s.limiter.allow(tenant); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	n, err := api.SetFromReader(r.PathValue("table"), tenant, r.PathValue("freshness"), r.PathValue("bind"), r.Body, ttl)
+	s.limiter.charge(tenant, n)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleDeleteEntry(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly {
+		writeError(w, errReadOnlyReplica)
+		return
+	}
+	if err := s.limiter.allow(r.PathValue("tenant")); err != nil {
+		writeError(w, err)
+		return
+	}
+	err := api.DeleteEntry(r.PathValue("table"), r.PathValue("tenant"), r.PathValue("freshness"), r.PathValue("bind"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleDeleteTenant(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly {
+		writeError(w, errReadOnlyReplica)
+		return
+	}
+	if err := s.limiter.allow(r.PathValue("tenant")); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := api.DeleteTenant(r.PathValue("table"), r.PathValue("tenant")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleDeleteTable(w http.ResponseWriter, r *http.Request) {
+	if s.readOnly {
+		writeError(w, errReadOnlyReplica)
+		return
+	}
+	if err := api.Delete(r.PathValue("table")); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleHealthz is the liveness probe: the process serves requests and the cache is initialized.
+// It does not touch the disk, so a slow disk makes the server unready instead of restarting it.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := api.Ping(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// handleReadyz is the readiness probe: the base directory is writable and a probe DB can be created
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := api.CheckHealth(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// handleChanges streams the cache mutations as newline-delimited JSON until the client disconnects.
+// The table and tenant query parameters limit the stream to one table or tenant. The stream also
+// ends when the server drops a client that fell behind, which must then reconnect and resync.
+func (s *Server) handleChanges(w http.ResponseWriter, r *http.Request) {
+	mutations, err := api.Subscribe(r.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	table, tenant := r.URL.Query().Get("table"), r.URL.Query().Get("tenant")
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	if flusher != nil {
+		flusher.Flush()
+	}
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-s.done:
+			return
+		case m, ok := <-mutations:
+			if !ok {
+				return
+			}
+			if !matchMutation(m, table, tenant) {
+				continue
+			}
+			if err := encoder.Encode(m); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// matchMutation reports whether m may affect the table and tenant. Empty filters match everything.
+func matchMutation(m cache.Mutation, table, tenant string) bool {
+	if table != "" && m.Table != table {
+		return false
+	}
+	// テーブル全体の削除はすべてのテナントに関係する
+	return tenant == "" || m.TenantID == "" || m.TenantID == tenant
+}
+
+// writeError maps cache errors to HTTP status codes
+func writeError(w http.ResponseWriter, err error) {
+	var limited *errRateLimited
+	if errors.As(err, &limited) {
+		w.Header().Set("Retry-After", strconv.Itoa(limited.retryAfterSeconds()))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	errStr := strings.ToLower(err.Error())
+	status := http.StatusInternalServerError
+	switch {
+	case strings.Contains(errStr, "read-only replica"):
+		status = http.StatusForbidden
+	case strings.Contains(errStr, "not found"):
+		status = http.StatusNotFound
+	case strings.Contains(errStr, "disk full") || strings.Contains(errStr, "database or disk is full"):
+		status = http.StatusInsufficientStorage
+	case strings.Contains(errStr, "not init"):
+		status = http.StatusServiceUnavailable
+	case strings.Contains(errStr, "too large"):
+		status = http.StatusRequestEntityTooLarge
+	case strings.Contains(errStr, "invalid cache name"):
+		status = http.StatusBadRequest
+	case strings.Contains(errStr, "not enabled"):
+		status = http.StatusNotImplemented
+	}
+	http.Error(w, err.Error(), status)
+}
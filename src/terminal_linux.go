@@ -0,0 +1,61 @@
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// terminalState is the terminal mode restored after a line was read in raw mode
+type terminalState struct {
+	termios syscall.Termios
+}
+
+func getTermios(fd int, termios *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCGETS, uintptr(unsafe.Pointer(termios))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func setTermios(fd int, termios *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TCSETS, uintptr(unsafe.Pointer(termios))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTerminal reports whether fd is a terminal
+func isTerminal(fd int) bool {
+	var termios syscall.Termios
+	return getTermios(fd, &termios) == nil
+}
+
+// makeRaw disables echo, line buffering and signal keys so that the line editor reads each key
+func makeRaw(fd int) (*terminalState, error) {
+	var state terminalState
+	if err := getTermios(fd, &state.termios); err != nil {
+		return nil, err
+	}
+	raw := state.termios
+	raw.Iflag &^= syscall.BRKINT | syscall.ICRNL | syscall.INPCK | syscall.ISTRIP | syscall.IXON
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := setTermios(fd, &raw); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func restoreTerminal(fd int, state *terminalState) error {
+	return setTermios(fd, &state.termios)
+}
+
+// terminalWidth returns the columns of the terminal, or 80 if unknown
+func terminalWidth(fd int) int {
+	var size struct{ rows, cols, xpixel, ypixel uint16 }
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&size))); errno != 0 || size.cols == 0 {
+		return 80
+	}
+	return int(size.cols)
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// 行編集はLinuxの端末だけで行い、それ以外では1行ずつそのまま読む
+
+type terminalState struct{}
+
+func isTerminal(fd int) bool {
+	return false
+}
+
+func makeRaw(fd int) (*terminalState, error) {
+	return nil, errors.New("line editing is not supported on this platform")
+}
+
+func restoreTerminal(fd int, state *terminalState) error {
+	return nil
+}
+
+func terminalWidth(fd int) int {
+	return 80
+}
@@ -0,0 +1,284 @@
+//go:build wasip1
+
+// Command wasm builds the cache as a WASI reactor module for Node.js, Electron and other WASI hosts,
+// with the pure Go SQLite driver (no native shared library). It needs Go 1.24 or later:
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o sqcache.wasm ./src/wasm
+//
+// Strings and contents are passed as a pointer into the module's memory and a byte length. The host
+// gets memory for them with Alloc and releases it with FreeMem, as in examples/wasm/sqcache.mjs.
+// The functions return the error codes of the shared library.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sqlite-cache/src/api"
+	"sqlite-cache/src/cache"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// WASMではGoのスケジューラはエクスポートした関数の呼び出し中にしか動かないので、スイーパーなどの
+// バックグラウンドの処理も呼び出しの合間には進まない。ファイルロックがないので、同じBaseDirを
+// 複数のモジュールやプロセスから開かないこと。
+
+// apiVersion is returned by ApiVersion
+const apiVersion = 1
+
+const (
+	SUCCESS           = 1
+	ERROR_GENERAL     = 0
+	ERROR_DISK_FULL   = -1
+	ERROR_INVALID_ARG = -2
+	ERROR_NOT_FOUND   = -3
+	ERROR_NOT_INIT    = -4
+	ERROR_TOO_LARGE   = -5
+)
+
+var errInvalidArgument = errors.New("invalid argument: NULL pointer or negative length")
+
+// allocations keeps the buffers given to the host alive until FreeMem
+var allocations = make(map[unsafe.Pointer][]byte)
+
+// lastError is the message returned by GetLastError
+var lastError []byte
+
+func setLastError(err error) {
+	lastError = []byte(err.Error())
+}
+
+// recoverPanic is deferred by every exported function so that a panic is returned as ERROR_GENERAL
+// instead of trapping the module
+func recoverPanic(code *int32) {
+	if r := recover(); r != nil {
+		setLastError(fmt.Errorf("panic in sqcache module: %v", r))
+		if code != nil {
+			*code = ERROR_GENERAL
+		}
+	}
+}
+
+// errorCode returns the error code of err and records it for GetLastError
+func errorCode(err error) int32 {
+	setLastError(err)
+	msg := strings.ToLower(err.Error())
+	switch {
+	case cache.IsNotFound(err):
+		return ERROR_NOT_FOUND
+	case errors.Is(err, cache.ErrEntryTooLarge):
+		return ERROR_TOO_LARGE
+	case strings.Contains(msg, "disk full") || strings.Contains(msg, "database or disk is full"):
+		return ERROR_DISK_FULL
+	case strings.Contains(msg, "not init"):
+		return ERROR_NOT_INIT
+	}
+	return ERROR_GENERAL
+}
+
+// goString copies n bytes at p. ok is false for a NULL pointer with a positive length or a negative length.
+func goString(p unsafe.Pointer, n int32) (string, bool) {
+	if n < 0 || (p == nil && n > 0) {
+		return "", false
+	}
+	if n == 0 {
+		return "", true
+	}
+	return string(unsafe.Slice((*byte)(p), n)), true
+}
+
+// goBytes is goString for contents
+func goBytes(p unsafe.Pointer, n int32) ([]byte, bool) {
+	s, ok := goString(p, n)
+	return []byte(s), ok
+}
+
+// keys converts the table, tenant, freshness and bind arguments
+func keys(table unsafe.Pointer, tableLen int32, tenantId unsafe.Pointer, tenantIdLen int32, freshness unsafe.Pointer, freshnessLen int32, bind unsafe.Pointer, bindLen int32) ([4]string, bool) {
+	var k [4]string
+	var ok [4]bool
+	k[0], ok[0] = goString(table, tableLen)
+	k[1], ok[1] = goString(tenantId, tenantIdLen)
+	k[2], ok[2] = goString(freshness, freshnessLen)
+	k[3], ok[3] = goString(bind, bindLen)
+	return k, ok[0] && ok[1] && ok[2] && ok[3]
+}
+
+//go:wasmexport ApiVersion
+func ApiVersion() int32 {
+	return apiVersion
+}
+
+// Allocはホストが文字列やcontentを書き込むためのsizeバイトのメモリを返す。FreeMemで解放する
+//
+//go:wasmexport Alloc
+func Alloc(size int32) unsafe.Pointer {
+	if size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	p := unsafe.Pointer(unsafe.SliceData(buf))
+	allocations[p] = buf
+	return p
+}
+
+//go:wasmexport FreeMem
+func FreeMem(p unsafe.Pointer) {
+	delete(allocations, p)
+}
+
+// keep returns b as memory the host reads and releases with FreeMem
+func keep(b []byte) unsafe.Pointer {
+	if len(b) == 0 {
+		return nil
+	}
+	p := unsafe.Pointer(unsafe.SliceData(b))
+	allocations[p] = b
+	return p
+}
+
+// GetLastErrorは最後に失敗した呼び出しのエラーメッセージ (UTF-8) を返し、resultLenにバイト数を入れる。
+// メモリはモジュールが持つので、FreeMemで解放せず、次の失敗まで使える
+//
+//go:wasmexport GetLastError
+func GetLastError(resultLen *int32) unsafe.Pointer {
+	if resultLen == nil {
+		return nil
+	}
+	*resultLen = int32(len(lastError))
+	if len(lastError) == 0 {
+		return nil
+	}
+	return unsafe.Pointer(unsafe.SliceData(lastError))
+}
+
+//go:wasmexport Init
+func Init(baseDir unsafe.Pointer, baseDirLen int32, maxSize int32, cap float64) (code int32) {
+	defer recoverPanic(&code)
+	dir, ok := goString(baseDir, baseDirLen)
+	if !ok || dir == "" {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	if err := api.Init(dir, int(maxSize), cap); err != nil {
+		return errorCode(err)
+	}
+	return SUCCESS
+}
+
+// Getはcontentを返し、resultLenにバイト数を入れる (失敗したらERROR_GENERAL (0) などのエラーコード)。
+// contentはFreeMemで解放する
+//
+//go:wasmexport Get
+func Get(table unsafe.Pointer, tableLen int32, tenantId unsafe.Pointer, tenantIdLen int32, freshness unsafe.Pointer, freshnessLen int32, bind unsafe.Pointer, bindLen int32, resultLen *int32) unsafe.Pointer {
+	defer recoverPanic(resultLen)
+	k, ok := keys(table, tableLen, tenantId, tenantIdLen, freshness, freshnessLen, bind, bindLen)
+	if !ok || resultLen == nil {
+		setLastError(errInvalidArgument)
+		if resultLen != nil {
+			*resultLen = ERROR_INVALID_ARG
+		}
+		return nil
+	}
+
+	result, err := api.Get(k[0], k[1], k[2], k[3])
+	if err != nil {
+		*resultLen = errorCode(err)
+		return nil
+	}
+	// 共有ライブラリと同じく、0はERROR_GENERALなので空のcontentはミスとして返す
+	if len(result) == 0 {
+		setLastError(cache.ErrEntryNotFound)
+		*resultLen = ERROR_NOT_FOUND
+		return nil
+	}
+	*resultLen = int32(len(result))
+	return keep(result)
+}
+
+//go:wasmexport Set
+func Set(table unsafe.Pointer, tableLen int32, tenantId unsafe.Pointer, tenantIdLen int32, freshness unsafe.Pointer, freshnessLen int32, bind unsafe.Pointer, bindLen int32, content unsafe.Pointer, contentLen int32) int32 {
+	return SetWithTTL(table, tableLen, tenantId, tenantIdLen, freshness, freshnessLen, bind, bindLen, content, contentLen, 0)
+}
+
+// SetWithTTLはttlSeconds秒で期限切れになるエントリを登録する。0以下なら期限なし
+//
+//go:wasmexport SetWithTTL
+func SetWithTTL(table unsafe.Pointer, tableLen int32, tenantId unsafe.Pointer, tenantIdLen int32, freshness unsafe.Pointer, freshnessLen int32, bind unsafe.Pointer, bindLen int32, content unsafe.Pointer, contentLen int32, ttlSeconds int64) (code int32) {
+	defer recoverPanic(&code)
+	k, ok := keys(table, tableLen, tenantId, tenantIdLen, freshness, freshnessLen, bind, bindLen)
+	data, dataOK := goBytes(content, contentLen)
+	if !ok || !dataOK {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	if err := api.SetWithTTL(k[0], k[1], k[2], k[3], data, time.Duration(ttlSeconds)*time.Second); err != nil {
+		return errorCode(err)
+	}
+	return SUCCESS
+}
+
+// ExistsはエントリがあればSUCCESS、なければERROR_NOT_FOUNDを返す
+//
+//go:wasmexport Exists
+func Exists(table unsafe.Pointer, tableLen int32, tenantId unsafe.Pointer, tenantIdLen int32, freshness unsafe.Pointer, freshnessLen int32, bind unsafe.Pointer, bindLen int32) (code int32) {
+	defer recoverPanic(&code)
+	k, ok := keys(table, tableLen, tenantId, tenantIdLen, freshness, freshnessLen, bind, bindLen)
+	if !ok {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+
+	exists, err := api.Exists(k[0], k[1], k[2], k[3])
+	if err != nil {
+		return errorCode(err)
+	}
+	if !exists {
+		return ERROR_NOT_FOUND
+	}
+	return SUCCESS
+}
+
+// Deleteはテーブルのすべてのテナントのキャッシュを削除する
+//
+//go:wasmexport Delete
+func Delete(table unsafe.Pointer, tableLen int32) (code int32) {
+	defer recoverPanic(&code)
+	name, ok := goString(table, tableLen)
+	if !ok {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	if err := api.Delete(name); err != nil {
+		return errorCode(err)
+	}
+	return SUCCESS
+}
+
+//go:wasmexport DeleteEntry
+func DeleteEntry(table unsafe.Pointer, tableLen int32, tenantId unsafe.Pointer, tenantIdLen int32, freshness unsafe.Pointer, freshnessLen int32, bind unsafe.Pointer, bindLen int32) (code int32) {
+	defer recoverPanic(&code)
+	k, ok := keys(table, tableLen, tenantId, tenantIdLen, freshness, freshnessLen, bind, bindLen)
+	if !ok {
+		setLastError(errInvalidArgument)
+		return ERROR_INVALID_ARG
+	}
+	if err := api.DeleteEntry(k[0], k[1], k[2], k[3]); err != nil {
+		return errorCode(err)
+	}
+	return SUCCESS
+}
+
+//go:wasmexport Close
+func Close() (code int32) {
+	defer recoverPanic(&code)
+	if err := api.Close(); err != nil {
+		return errorCode(err)
+	}
+	return SUCCESS
+}
+
+// reactorとしてビルドするので、mainは呼ばれない
+func main() {}